@@ -0,0 +1,172 @@
+-- Schema for the PostgreSQL repositories, selected with AUTH_SERVICE_REPO_TYPE=POSTGRESQL.
+--
+-- Tables referencing login have no cascading deletes, the repositories remove a user's rows themselves before the
+-- login is deleted.
+
+CREATE TABLE IF NOT EXISTS login (
+    id              text PRIMARY KEY,
+    email           text        NOT NULL,
+    username        text        NOT NULL,
+    salted_hash     text        NOT NULL,
+    email_verified  boolean     NOT NULL DEFAULT false,
+    roles           text[]      NOT NULL DEFAULT '{}',
+    status          text        NOT NULL DEFAULT 'active',
+    suspended_until timestamptz,
+    purge_at        timestamptz,
+    created_at      timestamptz NOT NULL DEFAULT now(),
+    updated_at      timestamptz NOT NULL DEFAULT now()
+);
+
+-- Email addresses, and usernames ignoring case, belong to a single user. The repositories map violations of these
+-- indexes to errEmailTaken and errUsernameTaken, so renaming them requires changing loginEmailIndex and
+-- loginUsernameIndex too.
+CREATE UNIQUE INDEX IF NOT EXISTS login_email_key ON login (email);
+CREATE UNIQUE INDEX IF NOT EXISTS login_lower_username_key ON login (lower(username));
+CREATE INDEX IF NOT EXISTS login_purge_at_idx ON login (purge_at) WHERE status = 'deleted';
+
+CREATE TABLE IF NOT EXISTS user_profile (
+    user_id text PRIMARY KEY REFERENCES login (id),
+    gender  text    NOT NULL,
+    age     integer NOT NULL,
+    topics  text[]  NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE IF NOT EXISTS refresh_token (
+    token_hash text PRIMARY KEY,
+    family_id  text        NOT NULL,
+    user_id    text        NOT NULL REFERENCES login (id),
+    expires_at timestamptz NOT NULL,
+    used_at    timestamptz,
+    revoked_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS refresh_token_family_id_idx ON refresh_token (family_id);
+CREATE INDEX IF NOT EXISTS refresh_token_user_id_idx ON refresh_token (user_id);
+
+CREATE TABLE IF NOT EXISTS totp (
+    user_id      text PRIMARY KEY REFERENCES login (id),
+    secret       text   NOT NULL,
+    confirmed_at timestamptz,
+    last_counter bigint NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS recovery_code (
+    id        text PRIMARY KEY,
+    user_id   text NOT NULL REFERENCES login (id),
+    code_hash text NOT NULL,
+    used_at   timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS recovery_code_user_id_idx ON recovery_code (user_id);
+
+CREATE TABLE IF NOT EXISTS action_token (
+    token_hash text PRIMARY KEY,
+    user_id    text        NOT NULL REFERENCES login (id),
+    purpose    text        NOT NULL,
+    data       text        NOT NULL DEFAULT '',
+    expires_at timestamptz NOT NULL,
+    used_at    timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS action_token_user_id_idx ON action_token (user_id, purpose);
+
+CREATE TABLE IF NOT EXISTS username_history (
+    user_id        text        NOT NULL REFERENCES login (id),
+    username       text        NOT NULL,
+    changed_at     timestamptz NOT NULL,
+    reserved_until timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS username_history_user_id_idx ON username_history (user_id);
+CREATE INDEX IF NOT EXISTS username_history_lower_username_idx ON username_history (lower(username));
+
+CREATE TABLE IF NOT EXISTS webauthn_credential (
+    id           text PRIMARY KEY,
+    user_id      text        NOT NULL REFERENCES login (id),
+    name         text        NOT NULL,
+    public_key   bytea       NOT NULL,
+    sign_count   bigint      NOT NULL DEFAULT 0,
+    created_at   timestamptz NOT NULL DEFAULT now(),
+    last_used_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS webauthn_credential_user_id_idx ON webauthn_credential (user_id);
+
+-- Keyed by throttle key rather than user, so failures are counted for unknown email addresses too.
+CREATE TABLE IF NOT EXISTS login_failure (
+    key            text PRIMARY KEY,
+    count          integer     NOT NULL,
+    last_failed_at timestamptz NOT NULL
+);
+
+-- Challenge tokens that can only be used once, kept until they expire.
+CREATE TABLE IF NOT EXISTS used_challenge (
+    id         text PRIMARY KEY,
+    expires_at timestamptz NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS account_status_change (
+    user_id         text        NOT NULL REFERENCES login (id),
+    status          text        NOT NULL,
+    suspended_until timestamptz,
+    purge_at        timestamptz,
+    reason          text        NOT NULL DEFAULT '',
+    changed_by      text        NOT NULL DEFAULT '',
+    changed_at      timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS account_status_change_user_id_idx ON account_status_change (user_id);
+
+CREATE TABLE IF NOT EXISTS session (
+    id         text PRIMARY KEY,
+    user_id    text        NOT NULL REFERENCES login (id),
+    client_id  text        NOT NULL DEFAULT '',
+    scope      text        NOT NULL DEFAULT '',
+    created_at timestamptz NOT NULL DEFAULT now(),
+    revoked_at timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS session_user_id_idx ON session (user_id);
+
+CREATE TABLE IF NOT EXISTS oauth_client (
+    id            text PRIMARY KEY,
+    name          text        NOT NULL,
+    secret_hash   text        NOT NULL DEFAULT '',
+    redirect_uris text[]      NOT NULL DEFAULT '{}',
+    scopes        text[]      NOT NULL DEFAULT '{}',
+    created_at    timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS oauth_code (
+    code_hash      text PRIMARY KEY,
+    client_id      text        NOT NULL REFERENCES oauth_client (id),
+    user_id        text        NOT NULL REFERENCES login (id),
+    redirect_uri   text        NOT NULL,
+    scope          text        NOT NULL DEFAULT '',
+    code_challenge text        NOT NULL,
+    nonce          text        NOT NULL DEFAULT '',
+    auth_time      timestamptz NOT NULL,
+    expires_at     timestamptz NOT NULL,
+    used_at        timestamptz
+);
+
+CREATE INDEX IF NOT EXISTS oauth_code_user_id_idx ON oauth_code (user_id);
+
+CREATE TABLE IF NOT EXISTS rate_limit (
+    key        text PRIMARY KEY,
+    tokens     double precision NOT NULL,
+    allowed    boolean          NOT NULL,
+    updated_at timestamptz      NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS data_export (
+    id           text PRIMARY KEY,
+    user_id      text        NOT NULL REFERENCES login (id),
+    format       text        NOT NULL,
+    state        text        NOT NULL,
+    requested_at timestamptz NOT NULL,
+    completed_at timestamptz,
+    expires_at   timestamptz NOT NULL,
+    archive      bytea,
+    UNIQUE (user_id, format)
+);
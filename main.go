@@ -11,6 +11,7 @@ import (
 	"github.com/stone1549/yapyapyap/auth/service"
 	"log"
 	"net/http"
+	"time"
 )
 
 func main() {
@@ -29,7 +30,13 @@ func main() {
 		})
 	}
 
-	repo, err := service.NewUserRepository(config)
+	db, err := service.NewDb(config)
+
+	if err != nil {
+		panic(fmt.Sprintf("Unable to open database: %s", err.Error()))
+	}
+
+	repo, err := service.NewUserRepository(config, db)
 
 	if err != nil {
 		panic(fmt.Sprintf("Unable to configure repository: %s", err.Error()))
@@ -42,18 +49,128 @@ func main() {
 		})
 	}
 
+	sessionRepo, err := service.NewSessionRepository(config, db)
+
+	if err != nil {
+		panic(fmt.Sprintf("Unable to configure session repository: %s", err.Error()))
+	}
+
+	sessionRepoMiddleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "sessionRepo", sessionRepo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+
+	exportRepo, err := service.NewExportRepository(config, db)
+
+	if err != nil {
+		panic(fmt.Sprintf("Unable to configure export repository: %s", err.Error()))
+	}
+
+	exportRepoMiddleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "exportRepo", exportRepo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+
+	oauthRepo, err := service.NewOAuthRepository(config, db)
+
+	if err != nil {
+		panic(fmt.Sprintf("Unable to configure OAuth repository: %s", err.Error()))
+	}
+
+	oauthRepoMiddleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "oauthRepo", oauthRepo)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+
+	mailer, err := service.NewMailer(config)
+
+	if err != nil {
+		panic(fmt.Sprintf("Unable to configure mailer: %s", err.Error()))
+	}
+
+	mailerMiddleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "mailer", mailer)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+
+	rateLimitStore, err := service.NewRateLimitStore(config, db)
+
+	if err != nil {
+		panic(fmt.Sprintf("Unable to configure rate limit store: %s", err.Error()))
+	}
+
+	rateLimitStoreMiddleware := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "rateLimitStore", rateLimitStore)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+
 	tokenFactory, err := service.NewTokenFactory(config)
 
 	if err != nil {
 		panic(fmt.Sprintf("Unable to configure token factory: %s", err.Error()))
 	}
 
+	if config.GetTokenKeyRotationInterval() > 0 {
+		go func() {
+			for range time.Tick(config.GetTokenKeyRotationInterval()) {
+				kid, err := tokenFactory.RotateKeys()
+
+				if err != nil {
+					log.Printf("Unable to rotate signing key: %s", err.Error())
+				} else {
+					log.Printf("Rotated signing key, now signing with %s", kid)
+				}
+			}
+		}()
+	}
+
+	if config.GetAccountPurgeInterval() > 0 {
+		go func() {
+			for range time.Tick(config.GetAccountPurgeInterval()) {
+				purged, err := service.PurgeDeletedUsers(time.Now(), repo, sessionRepo, oauthRepo, exportRepo,
+					rateLimitStore)
+
+				if err != nil {
+					log.Printf("Unable to purge deleted accounts: %s", err.Error())
+				}
+
+				if len(purged) > 0 {
+					log.Printf("Purged %d deleted accounts", len(purged))
+				}
+			}
+		}()
+	}
+
 	tokenMiddleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			ctx := context.WithValue(r.Context(), "tokenFactory", tokenFactory)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
+	// Rate limits are per route, guarding the endpoints open to abuse without being signed in.
+	loginLimit := service.RateLimitMiddleware("login", service.RateLimit{Requests: 30, Period: time.Minute},
+		service.RateLimitByIp)
+	signUpLimit := service.RateLimitMiddleware("signup", service.RateLimit{Requests: 10, Period: time.Hour},
+		service.RateLimitByIp)
+	emailLimit := service.RateLimitMiddleware("email", service.RateLimit{Requests: 10, Period: time.Hour},
+		service.RateLimitByIp)
+	tokenLimit := service.RateLimitMiddleware("token", service.RateLimit{Requests: 60, Period: time.Minute},
+		service.RateLimitByIp)
+	lookupLimit := service.RateLimitMiddleware("lookup", service.RateLimit{Requests: 120, Period: time.Minute},
+		service.RateLimitByUser)
+	exportLimit := service.RateLimitMiddleware("export", service.RateLimit{Requests: 30, Period: time.Hour},
+		service.RateLimitByUser)
+
 	r := chi.NewRouter()
 
 	// Basic CORS
@@ -75,6 +192,11 @@ func main() {
 	r.Use(render.SetContentType(render.ContentTypeJSON))
 	r.Use(configMiddleware)
 	r.Use(repoMiddleWare)
+	r.Use(sessionRepoMiddleware)
+	r.Use(oauthRepoMiddleware)
+	r.Use(exportRepoMiddleware)
+	r.Use(mailerMiddleware)
+	r.Use(rateLimitStoreMiddleware)
 	r.Use(tokenMiddleware)
 
 	// Set a timeout value on the request context (ctx), that will signal
@@ -82,15 +204,106 @@ func main() {
 	// processing should be stopped.
 	r.Use(middleware.Timeout(config.GetTimeout()))
 
+	r.Get("/.well-known/jwks.json", service.GetJwks)
+	r.Get("/.well-known/openid-configuration", service.GetOpenIdConfiguration)
+	r.With(service.DelegatedJwtAuthMiddleware).With(service.UserInfoMiddleware).Get("/userinfo", service.UserInfo)
+	r.With(service.DelegatedJwtAuthMiddleware).With(service.UserInfoMiddleware).Post("/userinfo", service.UserInfo)
+
 	r.Route("/session", func(r chi.Router) {
-		r.With(service.NewSessionMiddleware).Put("/", service.NewSession)
-		r.With(service.JwtAuthMiddleware).With(service.RefreshSessionMiddleware).Get("/", service.RefreshSession)
+		r.With(loginLimit).With(service.NewSessionMiddleware).Put("/", service.NewSession)
+		r.With(loginLimit).With(service.VerifyMfaMiddleware).Post("/mfa", service.NewSession)
+		r.With(tokenLimit).With(service.RefreshSessionMiddleware).Post("/refresh", service.RefreshSession)
+		r.With(service.JwtAuthMiddleware).With(service.EndSessionMiddleware).Delete("/", service.EndSession)
+		r.With(service.JwtAuthMiddleware).With(service.EndAllSessionsMiddleware).Delete("/all", service.EndSession)
+	})
+
+	r.Route("/password", func(r chi.Router) {
+		r.With(emailLimit).With(service.ForgotPasswordMiddleware).Post("/forgot", service.ForgotPassword)
+		r.With(loginLimit).With(service.ResetPasswordMiddleware).Post("/reset", service.ResetPassword)
+	})
+
+	r.Route("/webauthn", func(r chi.Router) {
+		r.With(service.JwtAuthMiddleware).With(service.BeginWebAuthnRegistrationMiddleware).Post("/register/begin",
+			service.BeginWebAuthnRegistration)
+		r.With(service.JwtAuthMiddleware).With(service.FinishWebAuthnRegistrationMiddleware).Post("/register/finish",
+			service.FinishWebAuthnRegistration)
+		r.With(service.JwtAuthMiddleware).With(service.ListWebAuthnCredentialsMiddleware).Get("/credentials",
+			service.WebAuthnCredentials)
+		r.With(service.JwtAuthMiddleware).With(service.RemoveWebAuthnCredentialMiddleware).
+			Delete("/credentials/{credentialId}", service.WebAuthnCredentials)
+		r.With(loginLimit).With(service.BeginWebAuthnLoginMiddleware).Post("/login/begin", service.BeginWebAuthnLogin)
+		r.With(loginLimit).With(service.FinishWebAuthnLoginMiddleware).Post("/login/finish", service.NewSession)
+	})
+
+	r.Route("/oauth", func(r chi.Router) {
+		r.With(service.AuthorizeMiddleware).Get("/authorize", service.Authorize)
+		r.With(loginLimit).With(service.AuthorizeMiddleware).Post("/authorize", service.Authorize)
+		r.With(tokenLimit).With(service.OAuthTokenMiddleware).Post("/token", service.OAuthToken)
 	})
 
 	r.Route("/user", func(r chi.Router) {
-		r.With(service.NewUserMiddleware).Put("/", service.NewUser)
-		r.With(service.GetUserMiddleware).Get("/{id}", service.GetUser)
-		r.With(service.UpdateProfileMiddleware).Patch("/{id}", service.UpdateProfile)
+		r.With(signUpLimit).With(service.NewUserMiddleware).Put("/", service.NewUser)
+		r.With(service.VerifyEmailMiddleware).Get("/verify", service.VerifyEmail)
+		r.With(emailLimit).With(service.ResendVerificationMiddleware).Post("/verify", service.ResendVerification)
+		r.With(tokenLimit).With(service.RestoreAccountMiddleware).Post("/restore", service.UserStatus)
+		r.With(service.JwtAuthMiddleware).With(service.ConfirmEmailChangeMiddleware).Post("/email/confirm",
+			service.NewSession)
+		r.With(service.JwtAuthMiddleware).With(service.EnrollTotpMiddleware).Post("/mfa/totp", service.EnrollTotp)
+		r.With(service.JwtAuthMiddleware).With(service.ConfirmTotpMiddleware).Post("/mfa/totp/confirm",
+			service.TotpStatus)
+		r.With(service.JwtAuthMiddleware).With(service.RemoveTotpMiddleware).Delete("/mfa/totp", service.TotpStatus)
+		r.With(service.JwtAuthMiddleware).With(service.RegenerateRecoveryCodesMiddleware).Post("/mfa/recovery-codes",
+			service.RecoveryCodes)
+		r.With(service.JwtAuthMiddleware).With(lookupLimit).With(service.GetUserMiddleware).Get("/{id}", service.GetUser)
+		r.With(service.JwtAuthMiddleware).With(service.ChangePasswordMiddleware).Put("/{id}/password",
+			service.ChangePassword)
+		r.With(service.JwtAuthMiddleware).With(service.ChangeEmailMiddleware).Post("/{id}/email", service.ChangeEmail)
+		r.With(service.JwtAuthMiddleware).With(service.ChangeUsernameMiddleware).Patch("/{id}/username",
+			service.NewSession)
+		r.With(service.JwtAuthMiddleware).With(lookupLimit).With(service.LookupUsernameMiddleware).Get(
+			"/username/{username}", service.LookupUsername)
+		r.With(service.JwtAuthMiddleware).With(service.UpdateProfileMiddleware).Patch("/{id}", service.UpdateProfile)
+		r.With(service.JwtAuthMiddleware).With(service.DeleteAccountMiddleware).Delete("/{id}", service.UserStatus)
+		r.With(service.JwtAuthMiddleware).With(service.RequireSelfOrPermission(service.ExportUsersPermission)).
+			With(exportLimit).With(service.ExportUserMiddleware).Get("/{id}/export", service.ExportUser)
+		r.With(service.JwtAuthMiddleware).With(service.RequirePermission(service.ManageRolesPermission)).
+			With(service.SetRolesMiddleware).Put("/{id}/roles", service.SetRoles)
+	})
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Group(func(r chi.Router) {
+			r.Use(service.AdminKeyMiddleware)
+			r.With(service.RotateKeysMiddleware).Post("/keys/rotate", service.RotateKeys)
+			r.With(service.NewClientMiddleware).Post("/oauth/clients", service.NewClient)
+			// Grants the first admin, who can grant roles to everyone else with PUT /user/{id}/roles.
+			r.With(service.SetRolesMiddleware).Put("/users/{id}/roles", service.SetRoles)
+		})
+
+		// User management is done by signed in users, so each action is recorded against whoever made it.
+		r.Group(func(r chi.Router) {
+			r.Use(service.JwtAuthMiddleware)
+			r.With(service.RequirePermission(service.ReadUsersPermission)).With(service.ListUsersMiddleware).
+				Get("/users", service.ListUsers)
+			r.With(service.RequirePermission(service.WriteUsersPermission)).With(service.UnlockUserMiddleware).
+				Post("/users/{id}/unlock", service.UnlockUser)
+			r.With(service.RequirePermission(service.WriteUsersPermission)).With(service.DisableUserMiddleware).
+				Post("/users/{id}/disable", service.UserStatus)
+			r.With(service.RequirePermission(service.WriteUsersPermission)).With(service.EnableUserMiddleware).
+				Post("/users/{id}/enable", service.UserStatus)
+			r.With(service.RequirePermission(service.WriteUsersPermission)).With(service.SetAccountStatusMiddleware).
+				Put("/users/{id}/status", service.UserStatus)
+			r.With(service.RequirePermission(service.ReadUsersPermission)).
+				With(service.AccountStatusHistoryMiddleware).Get("/users/{id}/status", service.UserStatus)
+			r.With(service.RequirePermission(service.WriteUsersPermission)).
+				With(service.ForcePasswordResetMiddleware).Post("/users/{id}/password-reset",
+				service.ForcePasswordReset)
+			r.With(service.RequirePermission(service.DeleteUsersPermission)).With(service.DeleteUserMiddleware).
+				Delete("/users/{id}", service.DeleteUser)
+			r.With(service.RequirePermission(service.DeleteUsersPermission)).With(service.RestoreUserMiddleware).
+				Post("/users/{id}/restore", service.UserStatus)
+			r.With(service.RequirePermission(service.ExportUsersPermission)).With(service.ExportUserMiddleware).
+				Get("/users/{id}/export", service.ExportUser)
+		})
 	})
 
 	err = http.ListenAndServe(":3333", r)
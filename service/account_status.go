@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"time"
+)
+
+// maxStatusReasonLength is the longest reason that can be recorded for a change of account status.
+const maxStatusReasonLength = 500
+
+type setAccountStatusRequest struct {
+	State          AccountState `json:"state"`
+	SuspendedUntil *time.Time   `json:"suspendedUntil"`
+	Reason         string       `json:"reason"`
+}
+
+type accountStatusResponse struct {
+	Status  AccountStatus         `json:"status"`
+	History []AccountStatusChange `json:"history,omitempty"`
+}
+
+func (asr accountStatusResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// checkAccountStatus ensures the user's account is active, returning an error coded with the reason it isn't.
+func checkAccountStatus(user User) error {
+	now := time.Now()
+
+	switch user.Status.Effective(now) {
+	case AccountActive:
+		return nil
+	case AccountSuspended:
+		var retryAfter time.Duration
+
+		if user.Status.SuspendedUntil != nil {
+			retryAfter = user.Status.SuspendedUntil.Sub(now)
+		}
+
+		return NewAccountStatusErr("account suspended", "account_suspended", retryAfter)
+	case AccountDeleted:
+		return NewAccountStatusErr("account deleted", "account_deleted", 0)
+	default:
+		return NewAccountStatusErr("account disabled", "account_disabled", 0)
+	}
+}
+
+// statusTarget retrieves the user in the path for a change to their account by the signed in user, returning both.
+// Deleted accounts are only made active again through the restore flow, and the accounts of admins can only be changed
+// by other admins. Errors are ErrorResponse values suitable for rendering.
+func statusTarget(r *http.Request) (User, User, error) {
+	caller, ok := r.Context().Value("user").(User)
+
+	if !ok {
+		return User{}, User{}, NewInternalServerErr("internal error")
+	}
+
+	userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+	if !ok {
+		return User{}, User{}, NewInternalServerErr("internal error")
+	}
+
+	target, err := userRepo.GetUser(chi.URLParam(r, "id"))
+
+	if errors.Is(err, errUserNotFound) || (err == nil && target.Id == "") {
+		return User{}, User{}, NewNotFoundErr("user not found")
+	} else if err != nil {
+		return User{}, User{}, NewInternalServerErr("repo error")
+	}
+
+	if target.HasRole(AdminRole) && !caller.HasRole(AdminRole) {
+		return User{}, User{}, NewForbiddenErr("forbidden")
+	}
+
+	if target.Status.State == AccountDeleted {
+		return User{}, User{}, NewConflictErr("account deleted")
+	}
+
+	return target, caller, nil
+}
+
+// changeAccountStatus changes the status of a user's account on behalf of changedBy, ending the user's sessions unless
+// the account is left active. Errors are ErrorResponse values suitable for rendering.
+func changeAccountStatus(r *http.Request, userId string, status AccountStatus, reason string, changedBy string) error {
+	userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+	if !ok {
+		return NewInternalServerErr("internal error")
+	}
+
+	sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+	if !ok {
+		return NewInternalServerErr("internal error")
+	}
+
+	err := userRepo.SetAccountStatus(userId, status, reason, changedBy)
+
+	if errors.Is(err, errUserNotFound) {
+		return NewNotFoundErr("user not found")
+	} else if err != nil {
+		return NewInternalServerErr("repo error")
+	}
+
+	if status.State != AccountActive {
+		// Refresh tokens are checked against their session when exchanged, so revoking the sessions is sufficient.
+		err = sessionRepo.RevokeUserSessions(userId)
+
+		if err != nil {
+			return NewInternalServerErr("repo error")
+		}
+	}
+
+	return nil
+}
+
+// SetAccountStatusMiddleware middleware to make a user's account active, suspend it until a future time or disable it,
+// recording who made the change and why. Accounts are deleted and restored through their own endpoints.
+func SetAccountStatusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req setAccountStatusRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		status := AccountStatus{State: req.State}
+
+		switch req.State {
+		case AccountActive, AccountDisabled:
+		case AccountSuspended:
+			if req.SuspendedUntil == nil || !req.SuspendedUntil.After(time.Now()) {
+				RenderResponse(w, r, NewBadRequestErr("suspendedUntil must be in the future"))
+				return
+			}
+
+			status.SuspendedUntil = req.SuspendedUntil
+		default:
+			RenderResponse(w, r, NewBadRequestErr("state must be active, suspended or disabled"))
+			return
+		}
+
+		if len(req.Reason) > maxStatusReasonLength {
+			RenderResponse(w, r, NewBadRequestErr("reason is too long"))
+			return
+		}
+
+		target, caller, err := statusTarget(r)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		err = changeAccountStatus(r, target.Id, status, req.Reason, caller.Id)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "accountStatus", accountStatusResponse{Status: status})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// setAccountStateMiddleware returns middleware to put the account of the user in the path into the given state.
+func setAccountStateMiddleware(state AccountState) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			target, caller, err := statusTarget(r)
+
+			if err != nil {
+				RenderError(w, r, err)
+				return
+			}
+
+			status := AccountStatus{State: state}
+			err = changeAccountStatus(r, target.Id, status, "", caller.Id)
+
+			if err != nil {
+				RenderError(w, r, err)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "accountStatus", accountStatusResponse{Status: status})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// AccountStatusHistoryMiddleware middleware to retrieve the status of a user's account along with every change made
+// to it.
+func AccountStatusHistoryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		user, err := userRepo.GetUser(chi.URLParam(r, "id"))
+
+		if errors.Is(err, errUserNotFound) || (err == nil && user.Id == "") {
+			RenderResponse(w, r, NewNotFoundErr("user not found"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		history, err := userRepo.GetAccountStatusHistory(user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "accountStatus", accountStatusResponse{user.Status, history})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// UserStatus renders the status of a user's account.
+func UserStatus(w http.ResponseWriter, r *http.Request) {
+	res, ok := r.Context().Value("accountStatus").(accountStatusResponse)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, res)
+}
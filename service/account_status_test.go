@@ -0,0 +1,184 @@
+package service_test
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newAccountStatusTestServer constructs a session test server with the account status routes, restricted by
+// permission as they are in main.go, returning it along with the id of the logged in user.
+func newAccountStatusTestServer(t *testing.T) (*testServer, string) {
+	ts := newSessionTestServer(t)
+	ts.router.Route("/admin", func(r chi.Router) {
+		r.Use(service.JwtAuthMiddleware)
+		r.With(service.RequirePermission(service.WriteUsersPermission)).With(service.SetAccountStatusMiddleware).
+			Put("/users/{id}/status", service.UserStatus)
+		r.With(service.RequirePermission(service.ReadUsersPermission)).
+			With(service.AccountStatusHistoryMiddleware).Get("/users/{id}/status", service.UserStatus)
+	})
+
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+
+	return ts, user.Id
+}
+
+type accountStatusResponse struct {
+	Status  service.AccountStatus         `json:"status"`
+	History []service.AccountStatusChange `json:"history"`
+}
+
+// errorCode returns the machine readable code of an error response body.
+func errorCode(t *testing.T, body []byte) string {
+	var res service.ErrorResponse
+	ok(t, json.Unmarshal(body, &res))
+	return res.Code
+}
+
+// TestAccountStatus_Login ensures logins to suspended, disabled and deleted accounts are refused with the reason, but
+// only once the password is known to be right, and that suspensions end by themselves.
+func TestAccountStatus_Login(t *testing.T) {
+	ts, id := newAccountStatusTestServer(t)
+	until := time.Now().Add(time.Hour)
+
+	ok(t, ts.repo.SetAccountStatus(id, service.AccountStatus{State: service.AccountSuspended, SuspendedUntil: &until},
+		"spam", "moderator"))
+
+	res := attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "wrong")
+	equals(t, http.StatusUnauthorized, res.Code)
+
+	res = attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "password")
+	equals(t, http.StatusForbidden, res.Code)
+	equals(t, "account_suspended", errorCode(t, res.Body.Bytes()))
+	assert(t, res.Header().Get("Retry-After") != "", "expected a Retry-After header")
+
+	for state, code := range map[service.AccountState]string{
+		service.AccountDisabled: "account_disabled",
+		service.AccountDeleted:  "account_deleted",
+	} {
+		ok(t, ts.repo.SetAccountStatus(id, service.AccountStatus{State: state}, "", "admin"))
+
+		res = attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "password")
+		equals(t, http.StatusForbidden, res.Code)
+		equals(t, code, errorCode(t, res.Body.Bytes()))
+	}
+
+	ended := time.Now().Add(-time.Minute)
+	ok(t, ts.repo.SetAccountStatus(id, service.AccountStatus{State: service.AccountSuspended, SuspendedUntil: &ended},
+		"", "admin"))
+	login(t, ts)
+}
+
+// TestAccountStatus_Tokens ensures access and refresh tokens issued before an account stopped being active are
+// refused, even if their session wasn't revoked.
+func TestAccountStatus_Tokens(t *testing.T) {
+	ts, id := newAccountStatusTestServer(t)
+	tokens := login(t, ts)
+
+	ok(t, ts.repo.SetAccountStatus(id, service.AccountStatus{State: service.AccountDisabled}, "", "admin"))
+
+	var res service.ErrorResponse
+	equals(t, http.StatusForbidden, ts.do(t, http.MethodDelete, "/session/", tokens.Token, nil, &res))
+	equals(t, "account_disabled", res.Code)
+
+	res = service.ErrorResponse{}
+	status := ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, &res)
+	equals(t, http.StatusForbidden, status)
+	equals(t, "account_disabled", res.Code)
+
+	// Refusing the refresh token ends its family
+	ok(t, ts.repo.SetAccountStatus(id, service.AccountStatus{State: service.AccountActive}, "", "admin"))
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, nil)
+	equals(t, http.StatusUnauthorized, status)
+	equals(t, http.StatusOK, ts.do(t, http.MethodDelete, "/session/", tokens.Token, nil, nil))
+}
+
+// TestSetAccountStatus ensures status changes are validated, end the user's sessions and are recorded with who made
+// them.
+func TestSetAccountStatus(t *testing.T) {
+	ts, id := newAccountStatusTestServer(t)
+	tokens := login(t, ts)
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	past := time.Now().Add(-time.Hour)
+
+	adminId, admin := loginAdmin(t, ts)
+
+	for _, body := range []map[string]interface{}{
+		{"state": "deleted"},
+		{"state": "unknown"},
+		{"state": "suspended"},
+		{"state": "suspended", "suspendedUntil": past},
+	} {
+		equals(t, http.StatusBadRequest, ts.do(t, http.MethodPut, "/admin/users/"+id+"/status", admin, body, nil))
+	}
+
+	status := ts.do(t, http.MethodPut, "/admin/users/missing/status", admin,
+		map[string]string{"state": "disabled"}, nil)
+	equals(t, http.StatusNotFound, status)
+
+	var res accountStatusResponse
+	status = ts.do(t, http.MethodPut, "/admin/users/"+id+"/status", admin,
+		map[string]interface{}{"state": "suspended", "suspendedUntil": until, "reason": "spam"}, &res)
+	equals(t, http.StatusOK, status)
+	equals(t, service.AccountSuspended, res.Status.State)
+	equals(t, until, *res.Status.SuspendedUntil)
+
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodDelete, "/session/", tokens.Token, nil, nil))
+
+	// Moderators can lift the suspension, and are recorded as doing so
+	moderatorId, err := ts.repo.NewUser("moderator@justinstone.net", "moderator", "password", service.FEMALE, 30,
+		[]string{})
+	ok(t, err)
+	ok(t, ts.repo.SetRoles(moderatorId, []string{service.ModeratorRole}))
+
+	var moderator sessionTokens
+	status = ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "moderator@justinstone.net", "password": "password"}, &moderator)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodPut, "/admin/users/"+id+"/status", moderator.Token,
+		map[string]string{"state": "active", "reason": "appealed"}, nil)
+	equals(t, http.StatusOK, status)
+	login(t, ts)
+
+	res = accountStatusResponse{}
+	equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/admin/users/"+id+"/status", moderator.Token, nil, &res))
+	equals(t, service.AccountActive, res.Status.State)
+	equals(t, 2, len(res.History))
+	equals(t, "spam", res.History[0].Reason)
+	equals(t, adminId, res.History[0].ChangedBy)
+	equals(t, service.AccountActive, res.History[1].Status.State)
+	equals(t, moderatorId, res.History[1].ChangedBy)
+	assert(t, !res.History[1].ChangedAt.Before(res.History[0].ChangedAt), "expected history oldest first")
+
+	// Users without permission can't change statuses
+	tokens = login(t, ts)
+	status = ts.do(t, http.MethodPut, "/admin/users/"+moderatorId+"/status", tokens.Token,
+		map[string]string{"state": "disabled"}, nil)
+	equals(t, http.StatusForbidden, status)
+
+	// Moderators can't change the status of admins, and deleted accounts can only be restored
+	ok(t, ts.repo.SetRoles(id, []string{service.AdminRole}))
+	status = ts.do(t, http.MethodPut, "/admin/users/"+id+"/status", moderator.Token,
+		map[string]string{"state": "disabled"}, nil)
+	equals(t, http.StatusForbidden, status)
+
+	purgeAt := time.Now().Add(time.Hour)
+	ok(t, ts.repo.SetAccountStatus(moderatorId, service.AccountStatus{State: service.AccountDeleted,
+		PurgeAt: &purgeAt}, "", moderatorId))
+	status = ts.do(t, http.MethodPut, "/admin/users/"+moderatorId+"/status", admin,
+		map[string]string{"state": "active"}, nil)
+	equals(t, http.StatusConflict, status)
+
+	res = accountStatusResponse{}
+	equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/admin/users/"+moderatorId+"/status", admin, nil,
+		&res))
+	equals(t, service.AccountDeleted, res.Status.State)
+	assert(t, res.Status.PurgeAt != nil, "expected purge time kept")
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const adminKeyHeader = "X-Admin-Key"
+
+// AdminKeyMiddleware middleware to restrict administrative endpoints to callers presenting the configured admin key
+func AdminKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		adminKey := config.GetAdminKey()
+
+		if adminKey == "" {
+			RenderResponse(w, r, NewForbiddenErr("admin endpoints disabled"))
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(adminKeyHeader)), []byte(adminKey)) != 1 {
+			RenderResponse(w, r, NewForbiddenErr("forbidden"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,340 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultUserPageSize is how many users are listed when no limit is given.
+	defaultUserPageSize = 50
+	// maxUserPageSize is the most users listed at once.
+	maxUserPageSize = 200
+)
+
+type listUsersResponse struct {
+	Users []UserRecord `json:"users"`
+	// NextOffset is the offset of the next page, nil on the last page
+	NextOffset *int `json:"nextOffset"`
+}
+
+func (lur listUsersResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+type adminUserResponse struct {
+	status int
+}
+
+func (aur adminUserResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(aur.status)
+
+	return nil
+}
+
+// parseCreatedFilter parses a created date filter, either a date or an RFC 3339 time.
+func parseCreatedFilter(name string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+
+	if err != nil {
+		t, err = time.Parse("2006-01-02", value)
+	}
+
+	if err != nil {
+		return time.Time{}, NewBadRequestErr(fmt.Sprintf("%s must be a date or RFC 3339 time", name))
+	}
+
+	return t, nil
+}
+
+// parseUserPage parses the offset and limit of a page of users.
+func parseUserPage(r *http.Request) (int, int, error) {
+	offset := 0
+	limit := defaultUserPageSize
+	var err error
+
+	if value := r.URL.Query().Get("offset"); value != "" {
+		offset, err = strconv.Atoi(value)
+
+		if err != nil || offset < 0 {
+			return 0, 0, NewBadRequestErr("offset must be a non negative integer")
+		}
+	}
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+
+		if err != nil || limit <= 0 || limit > maxUserPageSize {
+			return 0, 0, NewBadRequestErr(fmt.Sprintf("limit must be between 1 and %d", maxUserPageSize))
+		}
+	}
+
+	return offset, limit, nil
+}
+
+// ListUsersMiddleware middleware to retrieve a page of users, oldest first, optionally filtered by the emailPrefix,
+// username, createdAfter, createdBefore and topic query parameters.
+func ListUsersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := UserFilter{
+			EmailPrefix: query.Get("emailPrefix"),
+			Username:    query.Get("username"),
+			Topic:       query.Get("topic"),
+		}
+
+		var err error
+		filter.CreatedAfter, err = parseCreatedFilter("createdAfter", query.Get("createdAfter"))
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		filter.CreatedBefore, err = parseCreatedFilter("createdBefore", query.Get("createdBefore"))
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		offset, limit, err := parseUserPage(r)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		// One more user than needed is retrieved to tell whether there is another page.
+		users, err := userRepo.ListUsers(filter, offset, limit+1)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		res := listUsersResponse{Users: users}
+
+		if len(users) > limit {
+			nextOffset := offset + limit
+			res = listUsersResponse{users[:limit], &nextOffset}
+		}
+
+		ctx := context.WithValue(r.Context(), "users", res)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ListUsers renders a page of users.
+func ListUsers(w http.ResponseWriter, r *http.Request) {
+	res, ok := r.Context().Value("users").(listUsersResponse)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, res)
+}
+
+// DisableUserMiddleware middleware to disable a user's account, ending their sessions and preventing them from signing
+// in until it is enabled again.
+func DisableUserMiddleware(next http.Handler) http.Handler {
+	return setAccountStateMiddleware(AccountDisabled)(next)
+}
+
+// EnableUserMiddleware middleware to make a disabled or suspended user's account active again.
+func EnableUserMiddleware(next http.Handler) http.Handler {
+	return setAccountStateMiddleware(AccountActive)(next)
+}
+
+// ForcePasswordResetMiddleware middleware to make a user choose a new password. Their password is replaced with a
+// random one nobody knows, their sessions are ended, and they are emailed a password reset link.
+func ForcePasswordResetMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		mailer, ok := r.Context().Value("mailer").(Mailer)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		user, _, err := statusTarget(r)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		password, _, err := newOpaqueToken()
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		err = userRepo.UpdatePassword(user.Id, password)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = userRepo.RemoveWebAuthnCredentials(user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = sessionRepo.RevokeUserSessions(user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		token, err := issueActionToken(userRepo, user.Id, passwordResetPurpose, "", passwordResetTtl)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = mailer.Send(Message{
+			To:      user.Email,
+			Subject: "Choose a new password",
+			Body: fmt.Sprintf("The password for %s has been reset by an administrator. Follow the link below within "+
+				"the next hour to choose a new one.\n\n%s", user.Username,
+				actionLink(config, "/password/reset", token)),
+		})
+
+		// The password is already reset, so the user can still recover with a forgotten password email.
+		if err != nil {
+			log.Printf("Unable to send forced password reset email: %s", err.Error())
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ForcePasswordReset renders the response to forcing a password reset.
+func ForcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	RenderResponse(w, r, adminUserResponse{http.StatusAccepted})
+}
+
+// DeleteUserMiddleware middleware to permanently delete a user along with everything stored for them, ending their
+// sessions.
+func DeleteUserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		oauthRepo, ok := r.Context().Value("oauthRepo").(OAuthRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		exportRepo, ok := r.Context().Value("exportRepo").(ExportRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		rateLimitStore, ok := r.Context().Value("rateLimitStore").(RateLimitStore)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		userId := chi.URLParam(r, "id")
+		user, err := userRepo.GetUser(userId)
+
+		if errors.Is(err, errUserNotFound) || (err == nil && user.Id == "") {
+			RenderResponse(w, r, NewNotFoundErr("user not found"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = purgeUserData(userId, sessionRepo, oauthRepo, exportRepo, rateLimitStore)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = userRepo.DeleteUser(userId)
+
+		if errors.Is(err, errUserNotFound) {
+			RenderResponse(w, r, NewNotFoundErr("user not found"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// DeleteUser renders the response to deleting a user.
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	RenderResponse(w, r, adminUserResponse{http.StatusNoContent})
+}
@@ -0,0 +1,229 @@
+package service_test
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newAdminUsersTestServer constructs a password reset test server with the user management routes, restricted by
+// permission as they are in main.go. Returns it along with the id of the logged in user, and the id and access token of
+// an admin.
+func newAdminUsersTestServer(t *testing.T) (*testServer, string, string, string) {
+	ts := newPasswordResetTestServer(t)
+	ts.router.Route("/admin", func(r chi.Router) {
+		r.Use(service.JwtAuthMiddleware)
+		r.With(service.RequirePermission(service.ReadUsersPermission)).With(service.ListUsersMiddleware).
+			Get("/users", service.ListUsers)
+		r.With(service.RequirePermission(service.WriteUsersPermission)).With(service.DisableUserMiddleware).
+			Post("/users/{id}/disable", service.UserStatus)
+		r.With(service.RequirePermission(service.WriteUsersPermission)).With(service.EnableUserMiddleware).
+			Post("/users/{id}/enable", service.UserStatus)
+		r.With(service.RequirePermission(service.WriteUsersPermission)).
+			With(service.ForcePasswordResetMiddleware).Post("/users/{id}/password-reset", service.ForcePasswordReset)
+		r.With(service.RequirePermission(service.DeleteUsersPermission)).With(service.DeleteUserMiddleware).
+			Delete("/users/{id}", service.DeleteUser)
+	})
+
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+
+	adminId, admin := loginAdmin(t, ts)
+
+	return ts, user.Id, adminId, admin
+}
+
+type listUsersResponse struct {
+	Users      []service.UserRecord `json:"users"`
+	NextOffset *int                 `json:"nextOffset"`
+}
+
+// TestListUsers_Paginates ensures users are listed oldest first a page at a time.
+func TestListUsers_Paginates(t *testing.T) {
+	ts, id, adminId, admin := newAdminUsersTestServer(t)
+	otherId, err := ts.repo.NewUser("other@justinstone.net", "other", "password", service.FEMALE, 25, []string{})
+	ok(t, err)
+	_, err = ts.repo.NewUser("third@justinstone.net", "third", "password", service.MALE, 40, []string{})
+	ok(t, err)
+
+	var res listUsersResponse
+	equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/admin/users?limit=3", admin, nil, &res))
+	equals(t, 3, len(res.Users))
+	equals(t, id, res.Users[0].Id)
+	equals(t, "user@justinstone.net", res.Users[0].Email)
+	equals(t, adminId, res.Users[1].Id)
+	equals(t, otherId, res.Users[2].Id)
+	assert(t, res.NextOffset != nil && *res.NextOffset == 3, "expected another page")
+
+	res = listUsersResponse{}
+	equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/admin/users?limit=3&offset=3", admin, nil, &res))
+	equals(t, 1, len(res.Users))
+	equals(t, "third", res.Users[0].Username)
+	assert(t, res.NextOffset == nil, "expected the last page")
+
+	equals(t, http.StatusBadRequest, ts.do(t, http.MethodGet, "/admin/users?limit=0", admin, nil, nil))
+	equals(t, http.StatusBadRequest, ts.do(t, http.MethodGet, "/admin/users?offset=-1", admin, nil, nil))
+	equals(t, http.StatusBadRequest, ts.do(t, http.MethodGet, "/admin/users?createdAfter=yesterday", admin, nil, nil))
+}
+
+// TestListUsers_Filters ensures users can be found by email prefix, username, created date and topic.
+func TestListUsers_Filters(t *testing.T) {
+	ts, id, adminId, admin := newAdminUsersTestServer(t)
+	otherId, err := ts.repo.NewUser("Other@example.com", "other", "password", service.FEMALE, 25,
+		[]string{"go", "chess"})
+	ok(t, err)
+
+	find := func(query string) []string {
+		var res listUsersResponse
+		equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/admin/users?"+query, admin, nil, &res))
+
+		ids := make([]string, 0, len(res.Users))
+		for _, user := range res.Users {
+			ids = append(ids, user.Id)
+		}
+
+		return ids
+	}
+
+	equals(t, []string{id, adminId, otherId}, find(""))
+	equals(t, []string{otherId}, find("emailPrefix=other@"))
+	equals(t, []string{}, find("emailPrefix=%25"))
+	equals(t, []string{id}, find("username=USER"))
+	equals(t, []string{otherId}, find("topic=chess"))
+	equals(t, []string{}, find("topic=ches"))
+
+	tomorrow := time.Now().Add(24 * time.Hour).Format("2006-01-02")
+	equals(t, []string{id, adminId, otherId}, find("createdBefore="+tomorrow))
+	equals(t, []string{}, find("createdAfter="+tomorrow))
+}
+
+// TestDisableUser ensures disabled users are signed out and can't sign in until they are enabled again.
+func TestDisableUser(t *testing.T) {
+	ts, id, adminId, admin := newAdminUsersTestServer(t)
+	tokens := login(t, ts)
+
+	equals(t, http.StatusOK, ts.do(t, http.MethodPost, "/admin/users/"+id+"/disable", admin, nil, nil))
+	equals(t, http.StatusNotFound, ts.do(t, http.MethodPost, "/admin/users/missing/disable", admin, nil, nil))
+
+	status := ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, nil)
+	equals(t, http.StatusUnauthorized, status)
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodDelete, "/session/", tokens.Token, nil, nil))
+
+	status = ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "user@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusForbidden, status)
+
+	equals(t, http.StatusOK, ts.do(t, http.MethodPost, "/admin/users/"+id+"/enable", admin, nil, nil))
+	login(t, ts)
+
+	// Both changes are recorded against the admin who made them.
+	history, err := ts.repo.GetAccountStatusHistory(id)
+	ok(t, err)
+	equals(t, 2, len(history))
+	equals(t, adminId, history[0].ChangedBy)
+	equals(t, adminId, history[1].ChangedBy)
+}
+
+// TestForcePasswordReset ensures a forced reset signs the user out, stops their password and passkeys working and
+// emails them a link to choose a new one.
+func TestForcePasswordReset(t *testing.T) {
+	ts, id, _, admin := newAdminUsersTestServer(t)
+	tokens := login(t, ts)
+	ok(t, ts.repo.AddWebAuthnCredential(service.WebAuthnCredential{Id: "passkey", UserId: id, PublicKey: []byte{1}}))
+
+	equals(t, http.StatusAccepted, ts.do(t, http.MethodPost, "/admin/users/"+id+"/password-reset", admin, nil, nil))
+
+	credentials, err := ts.repo.GetWebAuthnCredentials(id)
+	ok(t, err)
+	equals(t, 0, len(credentials))
+	equals(t, http.StatusNotFound, ts.do(t, http.MethodPost, "/admin/users/missing/password-reset", admin, nil, nil))
+
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodDelete, "/session/", tokens.Token, nil, nil))
+
+	status := ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "user@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	message := ts.mailer.last(t)
+	equals(t, "user@justinstone.net", message.To)
+
+	status = ts.do(t, http.MethodPost, "/password/reset", "",
+		map[string]string{"token": linkToken(t, message, "/password/reset"), "password": "new password"}, nil)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "user@justinstone.net", "password": "new password"}, nil)
+	equals(t, http.StatusOK, status)
+}
+
+// TestDeleteUser ensures deleted users are signed out and removed entirely.
+func TestDeleteUser(t *testing.T) {
+	ts, id, _, admin := newAdminUsersTestServer(t)
+	tokens := login(t, ts)
+
+	equals(t, http.StatusNoContent, ts.do(t, http.MethodDelete, "/admin/users/"+id, admin, nil, nil))
+	equals(t, http.StatusNotFound, ts.do(t, http.MethodDelete, "/admin/users/"+id, admin, nil, nil))
+
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodDelete, "/session/", tokens.Token, nil, nil))
+
+	status := ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "user@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	// The email address and username are free for a new account
+	_, err := ts.repo.NewUser("user@justinstone.net", "user", "password", service.MALE, 30, []string{})
+	ok(t, err)
+}
+
+// TestAdminUsers_RequiresPermission ensures user management needs a signed in user granted the permission for the
+// action, rather than any shared key.
+func TestAdminUsers_RequiresPermission(t *testing.T) {
+	ts, id, adminId, _ := newAdminUsersTestServer(t)
+
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodGet, "/admin/users", "", nil, nil))
+
+	tokens := login(t, ts)
+	equals(t, http.StatusForbidden, ts.do(t, http.MethodGet, "/admin/users", tokens.Token, nil, nil))
+	equals(t, http.StatusForbidden, ts.do(t, http.MethodDelete, "/admin/users/"+adminId, tokens.Token, nil, nil))
+
+	ok(t, ts.repo.SetRoles(id, []string{service.ModeratorRole}))
+	tokens = login(t, ts)
+	equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/admin/users", tokens.Token, nil, nil))
+	equals(t, http.StatusForbidden, ts.do(t, http.MethodDelete, "/admin/users/"+adminId, tokens.Token, nil, nil))
+}
+
+// TestAdminUsers_Targets ensures moderators can't change the accounts of admins, and deleted accounts are only made
+// active again by restoring them.
+func TestAdminUsers_Targets(t *testing.T) {
+	ts, id, adminId, admin := newAdminUsersTestServer(t)
+
+	ok(t, ts.repo.SetRoles(id, []string{service.ModeratorRole}))
+	moderator := login(t, ts)
+
+	for _, action := range []string{"disable", "enable", "password-reset"} {
+		status := ts.do(t, http.MethodPost, "/admin/users/"+adminId+"/"+action, moderator.Token, nil, nil)
+		equals(t, http.StatusForbidden, status)
+	}
+
+	user, err := ts.repo.GetUser(adminId)
+	ok(t, err)
+	equals(t, service.AccountActive, user.Status.Effective(time.Now()))
+
+	otherId, err := ts.repo.NewUser("other@justinstone.net", "other", "password", service.MALE, 25, []string{})
+	ok(t, err)
+	purgeAt := time.Now().Add(time.Hour)
+	ok(t, ts.repo.SetAccountStatus(otherId, service.AccountStatus{State: service.AccountDeleted, PurgeAt: &purgeAt},
+		"", otherId))
+
+	for _, action := range []string{"disable", "enable", "password-reset"} {
+		equals(t, http.StatusConflict, ts.do(t, http.MethodPost, "/admin/users/"+otherId+"/"+action, admin, nil, nil))
+	}
+
+	user, err = ts.repo.GetUser(otherId)
+	ok(t, err)
+	equals(t, service.AccountDeleted, user.Status.State)
+	assert(t, user.Status.PurgeAt != nil, "expected purge time kept")
+}
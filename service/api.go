@@ -1,6 +1,7 @@
 package service
 
 import (
+	"errors"
 	"github.com/go-chi/render"
 	"log"
 	"net/http"
@@ -12,3 +13,16 @@ func RenderResponse(writer http.ResponseWriter, request *http.Request, renderer
 		log.Println(err)
 	}
 }
+
+// RenderError renders err if it is an ErrorResponse, or a generic internal server error otherwise.
+func RenderError(writer http.ResponseWriter, request *http.Request, err error) {
+	var errorResponse ErrorResponse
+
+	if errors.As(err, &errorResponse) {
+		RenderResponse(writer, request, errorResponse)
+		return
+	}
+
+	log.Println(err)
+	RenderResponse(writer, request, NewInternalServerErr("internal error"))
+}
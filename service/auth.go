@@ -3,72 +3,109 @@ package service
 import (
 	"context"
 	"errors"
-	"github.com/golang-jwt/jwt"
+	"github.com/stone1549/yapyapyap/auth/verifier"
 	"net/http"
 	"strings"
 )
 
-func JwtAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
-		authHeader := strings.Split(request.Header.Get("Authorization"), "Bearer ")
-		if len(authHeader) != 2 {
-			RenderResponse(writer, request, NewUnauthorizedErr("unauthorized"))
-			return
-		}
+// authenticateBearer validates the bearer token of the request, returning the user and session it was issued for.
+// Tokens a user delegated to an OAuth client are only accepted when delegated is true, as their scope doesn't extend to
+// the first party endpoints. Errors are ErrorResponse values suitable for rendering.
+func authenticateBearer(request *http.Request, delegated bool) (User, string, error) {
+	authHeader := strings.Split(request.Header.Get("Authorization"), "Bearer ")
+	if len(authHeader) != 2 {
+		return User{}, "", NewUnauthorizedErr("unauthorized")
+	}
 
-		config, ok := request.Context().Value("config").(Configuration)
+	tokenFactory, ok := request.Context().Value("tokenFactory").(TokenFactory)
 
-		if !ok {
-			RenderResponse(writer, request, NewInternalServerErr("config not found"))
-			return
-		}
+	if !ok {
+		return User{}, "", NewInternalServerErr("token factory not found")
+	}
+
+	token, err := tokenFactory.ParseToken(authHeader[1])
+
+	if err != nil {
+		return User{}, "", NewUnauthorizedErr(err.Error())
+	}
+
+	// Claim validation is shared with the verifier package so downstream services accept exactly the same tokens.
+	parseClaims := verifier.ParseClaims
+
+	if delegated {
+		parseClaims = verifier.ParseDelegatedClaims
+	}
+
+	claims, err := parseClaims(token)
+
+	if err != nil || claims.IsClient() {
+		return User{}, "", NewUnauthorizedErr("unauthorized")
+	}
+
+	sessionRepo, ok := request.Context().Value("sessionRepo").(SessionRepository)
+
+	if !ok {
+		return User{}, "", NewInternalServerErr("session repo not found")
+	}
+
+	revoked, err := sessionRepo.IsRevoked(claims.SessionId)
 
-		jwtToken := authHeader[1]
-		token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
-			if config.GetTokenSecretKey() != "" {
-				return []byte(config.GetTokenSecretKey()), nil
-			}
+	if err != nil {
+		return User{}, "", NewInternalServerErr("repo error")
+	} else if revoked {
+		return User{}, "", NewUnauthorizedErr("session revoked")
+	}
 
-			if config.GetTokenPrivateKey() != nil {
-				return config.GetTokenPrivateKey(), nil
-			}
+	userRepo, ok := request.Context().Value("repo").(UserRepository)
 
-			return "", errors.New("unknown signing method")
+	if !ok {
+		return User{}, "", NewInternalServerErr("repo not found")
+	}
 
-		})
+	// Sessions are revoked when an account stops being active, but suspensions must also apply to tokens issued
+	// before they began and after they end, so the status is always read from the repo.
+	stored, err := userRepo.GetUser(claims.Subject)
+
+	if errors.Is(err, errUserNotFound) || (err == nil && stored.Id == "") {
+		return User{}, "", NewUnauthorizedErr("unauthorized")
+	} else if err != nil {
+		return User{}, "", NewInternalServerErr("repo error")
+	}
+
+	err = checkAccountStatus(stored)
+
+	if err != nil {
+		return User{}, "", err
+	}
+
+	return User{Id: claims.Subject, Username: claims.Username, Email: claims.Email, EmailVerified: claims.EmailVerified,
+		Roles: claims.Roles, Status: stored.Status}, claims.SessionId, nil
+}
+
+// JwtAuthMiddleware middleware to authenticate the user from a bearer token issued by a first party login. Tokens
+// issued to OAuth clients are refused.
+func JwtAuthMiddleware(next http.Handler) http.Handler {
+	return bearerAuthMiddleware(next, false)
+}
+
+// DelegatedJwtAuthMiddleware middleware to authenticate the user from a bearer token, also accepting tokens the user
+// delegated to an OAuth client. Handlers behind it must check the scope of the session themselves.
+func DelegatedJwtAuthMiddleware(next http.Handler) http.Handler {
+	return bearerAuthMiddleware(next, true)
+}
+
+func bearerAuthMiddleware(next http.Handler, delegated bool) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		user, sessionId, err := authenticateBearer(request, delegated)
 
 		if err != nil {
-			RenderResponse(writer, request, NewUnauthorizedErr(err.Error()))
+			RenderError(writer, request, err)
 			return
 		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			if _, ok := claims["sub"]; !ok {
-				RenderResponse(writer, request, NewUnauthorizedErr("unauthorized"))
-				return
-			}
-
-			if _, ok := claims["username"]; !ok {
-				RenderResponse(writer, request, NewUnauthorizedErr("unauthorized"))
-				return
-			}
-
-			if _, ok := claims["email"]; !ok {
-				RenderResponse(writer, request, NewUnauthorizedErr("unauthorized"))
-				return
-			}
-
-			ctx := context.WithValue(request.Context(), "user", User{
-				Id:       claims["sub"].(string),
-				Username: claims["username"].(string),
-				Email:    claims["email"].(string),
-			})
-
-			// Access context values in handlers like this
-			// props, _ := r.Context().Value("props").(jwt.MapClaims)
-			next.ServeHTTP(writer, request.WithContext(ctx))
-		} else {
-			RenderResponse(writer, request, NewUnauthorizedErr("unauthorized"))
-		}
+		ctx := context.WithValue(request.Context(), "user", user)
+		ctx = context.WithValue(ctx, "sessionId", sessionId)
+
+		next.ServeHTTP(writer, request.WithContext(ctx))
 	})
 }
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// emailChangeTtl is how long a link confirming a new email address remains valid.
+	emailChangeTtl = 24 * time.Hour
+)
+
+type changeEmailRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type confirmEmailChangeRequest struct {
+	Token string `json:"token"`
+}
+
+type changeEmailResponse struct {
+}
+
+func (cer changeEmailResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusAccepted)
+
+	return nil
+}
+
+// ChangeEmailMiddleware middleware to start changing the authenticated user's email address, sending a confirmation
+// link to the new address and a notification to the current one. The address isn't changed until confirmed.
+func ChangeEmailMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenUser, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		if chi.URLParam(r, "id") != tokenUser.Id {
+			RenderResponse(w, r, NewForbiddenErr("forbidden"))
+			return
+		}
+
+		var req changeEmailRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		if !validEmail(req.Email) {
+			RenderResponse(w, r, NewBadRequestErr("email is invalid"))
+			return
+		}
+
+		if req.Password == "" {
+			RenderResponse(w, r, NewBadRequestErr("password is required"))
+			return
+		}
+
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		mailer, ok := r.Context().Value("mailer").(Mailer)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		// The email in the token may predate an earlier change.
+		user, err := userRepo.GetUser(tokenUser.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		if req.Email == user.Email {
+			RenderResponse(w, r, NewBadRequestErr("email is unchanged"))
+			return
+		}
+
+		err = confirmPassword(r, user.Id, req.Password)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		_, err = userRepo.GetUserByEmail(req.Email)
+
+		if err == nil {
+			RenderResponse(w, r, NewConflictErr("email already in use"))
+			return
+		} else if !errors.Is(err, errUserNotFound) {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		token, err := issueActionToken(userRepo, user.Id, emailChangePurpose, req.Email, emailChangeTtl)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = mailer.Send(Message{
+			To:      req.Email,
+			Subject: "Confirm your new email address",
+			Body: fmt.Sprintf("%s asked to use this email address for their account. If it was you, follow the link "+
+				"below within the next day to confirm the change.\n\n%s\n\nIf it wasn't, you can ignore this email.",
+				user.Username, actionLink(config, "/user/email/confirm", token)),
+		})
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("unable to send email"))
+			log.Println(err)
+			return
+		}
+
+		err = mailer.Send(Message{
+			To:      user.Email,
+			Subject: "Your email address is being changed",
+			Body: fmt.Sprintf("Someone asked to change the email address for %s to %s. It will change once the new "+
+				"address is confirmed. If this wasn't you, reset your password to secure your account.",
+				user.Username, req.Email),
+		})
+
+		if err != nil {
+			log.Printf("Unable to send email change notification: %s", err.Error())
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ChangeEmail renders the response to a request to change email address.
+func ChangeEmail(w http.ResponseWriter, r *http.Request) {
+	RenderResponse(w, r, changeEmailResponse{})
+}
+
+// ConfirmEmailChangeMiddleware middleware to swap the authenticated user's email address for the one confirmed by a
+// token from an email change link. Every session holds tokens with the old address, so they are all revoked and a new
+// session is started in place of the current one.
+func ConfirmEmailChangeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenUser, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		var req confirmEmailChangeRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		if req.Token == "" {
+			RenderResponse(w, r, NewBadRequestErr("token is required"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		actionToken, err := userRepo.ConsumeActionToken(hashOpaqueToken(req.Token), emailChangePurpose)
+
+		if errors.Is(err, errActionTokenInvalid) || (err == nil && actionToken.UserId != tokenUser.Id) {
+			RenderResponse(w, r, NewBadRequestErr("invalid or expired token"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = userRepo.ChangeEmail(tokenUser.Id, actionToken.Data)
+
+		if errors.Is(err, errEmailTaken) {
+			RenderResponse(w, r, NewConflictErr("email already in use"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		// Refresh tokens are checked against their session when exchanged, so revoking the sessions is sufficient.
+		err = sessionRepo.RevokeUserSessions(tokenUser.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		user, err := userRepo.GetUser(tokenUser.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		token, refreshToken, err := startSession(r.Context(), user, "", "")
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "token", token)
+		ctx = context.WithValue(ctx, "refreshToken", refreshToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
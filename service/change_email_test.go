@@ -0,0 +1,115 @@
+package service_test
+
+import (
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"testing"
+)
+
+func newChangeEmailTestServer(t *testing.T) (*testServer, string) {
+	ts := newSessionTestServer(t)
+	ts.router.With(service.JwtAuthMiddleware).With(service.ConfirmEmailChangeMiddleware).Post("/user/email/confirm",
+		service.NewSession)
+	ts.router.With(service.JwtAuthMiddleware).With(service.ChangeEmailMiddleware).Post("/user/{id}/email",
+		service.ChangeEmail)
+
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+
+	return ts, user.Id
+}
+
+// TestChangeEmail ensures the new address must be confirmed before it replaces the old one, after which only newly
+// issued tokens work.
+func TestChangeEmail(t *testing.T) {
+	ts, id := newChangeEmailTestServer(t)
+	tokens := login(t, ts)
+
+	status := ts.do(t, http.MethodPost, "/user/"+id+"/email", tokens.Token,
+		map[string]string{"email": "new@justinstone.net", "password": "wrong"}, nil)
+	equals(t, http.StatusForbidden, status)
+
+	status = ts.do(t, http.MethodPost, "/user/"+id+"/email", tokens.Token,
+		map[string]string{"email": "new@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusAccepted, status)
+	equals(t, 2, len(ts.mailer.messages))
+	equals(t, "new@justinstone.net", ts.mailer.messages[0].To)
+	equals(t, "user@justinstone.net", ts.mailer.messages[1].To)
+
+	user, err := ts.repo.GetUser(id)
+	ok(t, err)
+	equals(t, "user@justinstone.net", user.Email)
+
+	var newTokens sessionTokens
+	status = ts.do(t, http.MethodPost, "/user/email/confirm", tokens.Token,
+		map[string]string{"token": linkToken(t, ts.mailer.messages[0], "/user/email/confirm")}, &newTokens)
+	equals(t, http.StatusOK, status)
+	assert(t, newTokens.Token != "", "expected token")
+
+	user, err = ts.repo.GetUser(id)
+	ok(t, err)
+	equals(t, "new@justinstone.net", user.Email)
+	equals(t, true, user.EmailVerified)
+
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, nil)
+	equals(t, http.StatusUnauthorized, status)
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": newTokens.RefreshToken}, nil)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "new@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusOK, status)
+}
+
+// TestChangeEmail_Taken ensures users can't take an address belonging to another user, even if it is registered after
+// the change was requested.
+func TestChangeEmail_Taken(t *testing.T) {
+	ts, id := newChangeEmailTestServer(t)
+	tokens := login(t, ts)
+
+	_, err := ts.repo.NewUser("other@justinstone.net", "other", "password", service.FEMALE, 30, []string{})
+	ok(t, err)
+
+	status := ts.do(t, http.MethodPost, "/user/"+id+"/email", tokens.Token,
+		map[string]string{"email": "other@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusConflict, status)
+
+	status = ts.do(t, http.MethodPost, "/user/"+id+"/email", tokens.Token,
+		map[string]string{"email": "new@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusAccepted, status)
+
+	_, err = ts.repo.NewUser("new@justinstone.net", "new", "password", service.FEMALE, 30, []string{})
+	ok(t, err)
+
+	status = ts.do(t, http.MethodPost, "/user/email/confirm", tokens.Token,
+		map[string]string{"token": linkToken(t, ts.mailer.messages[0], "/user/email/confirm")}, nil)
+	equals(t, http.StatusConflict, status)
+}
+
+// TestChangeEmail_OtherUser ensures a change can't be requested or confirmed for another user.
+func TestChangeEmail_OtherUser(t *testing.T) {
+	ts, id := newChangeEmailTestServer(t)
+	tokens := login(t, ts)
+
+	otherId, err := ts.repo.NewUser("other@justinstone.net", "other", "password", service.FEMALE, 30, []string{})
+	ok(t, err)
+
+	status := ts.do(t, http.MethodPost, "/user/"+otherId+"/email", tokens.Token,
+		map[string]string{"email": "new@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusForbidden, status)
+
+	status = ts.do(t, http.MethodPost, "/user/"+id+"/email", tokens.Token,
+		map[string]string{"email": "new@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusAccepted, status)
+
+	var other sessionTokens
+	status = ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "other@justinstone.net", "password": "password"}, &other)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodPost, "/user/email/confirm", other.Token,
+		map[string]string{"token": linkToken(t, ts.mailer.messages[0], "/user/email/confirm")}, nil)
+	equals(t, http.StatusBadRequest, status)
+}
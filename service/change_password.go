@@ -0,0 +1,157 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+type changePasswordRequest struct {
+	CurrentPassword     string `json:"currentPassword"`
+	Password            string `json:"password"`
+	LogoutOtherSessions bool   `json:"logoutOtherSessions"`
+}
+
+type changePasswordResponse struct {
+}
+
+func (cpr changePasswordResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// ChangePasswordMiddleware middleware to replace the authenticated user's password, optionally revoking every other
+// session they have.
+func ChangePasswordMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		sessionId, ok := r.Context().Value("sessionId").(string)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		if chi.URLParam(r, "id") != user.Id {
+			RenderResponse(w, r, NewForbiddenErr("forbidden"))
+			return
+		}
+
+		var req changePasswordRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		if req.CurrentPassword == "" {
+			RenderResponse(w, r, NewBadRequestErr("currentPassword is required"))
+			return
+		}
+
+		if req.Password == "" {
+			RenderResponse(w, r, NewBadRequestErr("password is required"))
+			return
+		}
+
+		if req.Password == req.CurrentPassword {
+			RenderResponse(w, r, NewBadRequestErr("password must differ from currentPassword"))
+			return
+		}
+
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		err = checkPasswordPolicy(config, req.Password, user.Email, user.Username)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		// Checked ahead of the change so that guesses count towards the login throttle.
+		err = confirmPassword(r, user.Id, req.CurrentPassword)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		err = userRepo.ChangePassword(user.Id, req.CurrentPassword, req.Password)
+
+		if errors.Is(err, errPasswordMismatch) {
+			RenderResponse(w, r, NewForbiddenErr("current password is incorrect"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		if req.LogoutOtherSessions {
+			err = revokeOtherSessions(sessionRepo, user.Id, sessionId)
+
+			if err != nil {
+				RenderResponse(w, r, NewInternalServerErr("repo error"))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// revokeOtherSessions revokes every active session belonging to a user except the one given.
+func revokeOtherSessions(sessionRepo SessionRepository, userId string, sessionId string) error {
+	sessions, err := sessionRepo.GetUserSessions(userId)
+
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.Id == sessionId || session.RevokedAt != nil {
+			continue
+		}
+
+		// Refresh tokens are checked against their session when exchanged, so revoking the session is sufficient.
+		err = sessionRepo.RevokeSession(session.Id)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ChangePassword renders the response to a successful password change.
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+	RenderResponse(w, r, changePasswordResponse{})
+}
@@ -0,0 +1,76 @@
+package service_test
+
+import (
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"testing"
+)
+
+func newChangePasswordTestServer(t *testing.T) (*testServer, string) {
+	ts := newSessionTestServer(t)
+	ts.router.With(service.JwtAuthMiddleware).With(service.ChangePasswordMiddleware).Put("/user/{id}/password",
+		service.ChangePassword)
+
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+
+	return ts, user.Id
+}
+
+// TestChangePassword ensures the current password is required and other sessions can be logged out.
+func TestChangePassword(t *testing.T) {
+	ts, id := newChangePasswordTestServer(t)
+	tokens := login(t, ts)
+	other := login(t, ts)
+
+	status := ts.do(t, http.MethodPut, "/user/"+id+"/password", tokens.Token,
+		map[string]interface{}{"currentPassword": "wrong", "password": "new password"}, nil)
+	equals(t, http.StatusForbidden, status)
+
+	status = ts.do(t, http.MethodPut, "/user/"+id+"/password", tokens.Token,
+		map[string]interface{}{"currentPassword": "password", "password": "new password", "logoutOtherSessions": true},
+		nil)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": other.RefreshToken}, nil)
+	equals(t, http.StatusUnauthorized, status)
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, nil)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "user@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusUnauthorized, status)
+	status = ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "user@justinstone.net", "password": "new password"}, nil)
+	equals(t, http.StatusOK, status)
+}
+
+// TestChangePassword_KeepsSessions ensures other sessions survive unless logging them out is requested.
+func TestChangePassword_KeepsSessions(t *testing.T) {
+	ts, id := newChangePasswordTestServer(t)
+	tokens := login(t, ts)
+	other := login(t, ts)
+
+	status := ts.do(t, http.MethodPut, "/user/"+id+"/password", tokens.Token,
+		map[string]interface{}{"currentPassword": "password", "password": "new password"}, nil)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": other.RefreshToken}, nil)
+	equals(t, http.StatusOK, status)
+}
+
+// TestChangePassword_OtherUser ensures users can't change another user's password.
+func TestChangePassword_OtherUser(t *testing.T) {
+	ts, _ := newChangePasswordTestServer(t)
+	tokens := login(t, ts)
+
+	otherId, err := ts.repo.NewUser("other@justinstone.net", "other", "password", service.FEMALE, 30, []string{})
+	ok(t, err)
+
+	status := ts.do(t, http.MethodPut, "/user/"+otherId+"/password", tokens.Token,
+		map[string]interface{}{"currentPassword": "password", "password": "new password"}, nil)
+	equals(t, http.StatusForbidden, status)
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type changeUsernameRequest struct {
+	Username string `json:"username"`
+}
+
+type usernameLookupResponse struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	// Previous reports whether the username looked up is one the user has since given up
+	Previous bool `json:"previous"`
+}
+
+func (ulr usernameLookupResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// ChangeUsernameMiddleware middleware to change the authenticated user's username. The old username stays reserved
+// for them for a while and the session is restarted, as tokens carry the username.
+func ChangeUsernameMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenUser, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		sessionId, ok := r.Context().Value("sessionId").(string)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		if chi.URLParam(r, "id") != tokenUser.Id {
+			RenderResponse(w, r, NewForbiddenErr("forbidden"))
+			return
+		}
+
+		var req changeUsernameRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		if strings.TrimSpace(req.Username) == "" {
+			RenderResponse(w, r, NewBadRequestErr("username is required"))
+			return
+		}
+
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		user, err := userRepo.GetUser(tokenUser.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		if req.Username == user.Username {
+			RenderResponse(w, r, NewBadRequestErr("username is unchanged"))
+			return
+		}
+
+		history, err := userRepo.GetUsernameHistory(user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		if len(history) > 0 {
+			allowedAt := history[len(history)-1].ChangedAt.Add(config.GetUsernameChangeCooldown())
+
+			if time.Now().Before(allowedAt) {
+				RenderResponse(w, r, NewForbiddenErr(fmt.Sprintf("username can't be changed again until %s",
+					allowedAt.UTC().Format(time.RFC3339))))
+				return
+			}
+		}
+
+		err = userRepo.ChangeUsername(user.Id, req.Username, time.Now().Add(config.GetUsernameReservation()))
+
+		if errors.Is(err, errUsernameTaken) {
+			RenderResponse(w, r, NewConflictErr("username taken"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = sessionRepo.RevokeSession(sessionId)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		user.Username = req.Username
+		token, refreshToken, err := startSession(r.Context(), user, "", "")
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "token", token)
+		ctx = context.WithValue(ctx, "refreshToken", refreshToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// LookupUsernameMiddleware middleware to find the user holding a username, or who most recently gave it up
+func LookupUsernameMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := chi.URLParam(r, "username")
+
+		if username == "" {
+			RenderResponse(w, r, NewBadRequestErr("username is required in path"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		user, err := userRepo.GetUserByUsername(username)
+		previous := false
+
+		if errors.Is(err, errUserNotFound) {
+			var userId string
+			userId, err = userRepo.GetPreviousUsernameOwner(username)
+
+			if errors.Is(err, errUserNotFound) {
+				RenderResponse(w, r, NewNotFoundErr("username not found"))
+				return
+			} else if err == nil {
+				user, err = userRepo.GetUser(userId)
+				previous = true
+			}
+		}
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "usernameLookup",
+			usernameLookupResponse{Id: user.Id, Username: user.Username, Previous: previous})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// LookupUsername renders the response to a username lookup.
+func LookupUsername(w http.ResponseWriter, r *http.Request) {
+	lookup, ok := r.Context().Value("usernameLookup").(usernameLookupResponse)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, lookup)
+}
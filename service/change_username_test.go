@@ -0,0 +1,125 @@
+package service_test
+
+import (
+	"github.com/stone1549/yapyapyap/auth/service"
+	"github.com/stone1549/yapyapyap/auth/verifier"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// noUsernameCooldownConfiguration is a configuration that lets users change username as often as they like.
+type noUsernameCooldownConfiguration struct {
+	service.Configuration
+}
+
+func (c noUsernameCooldownConfiguration) GetUsernameChangeCooldown() time.Duration {
+	return 0
+}
+
+type usernameLookup struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+	Previous bool   `json:"previous"`
+}
+
+func newChangeUsernameTestServer(t *testing.T) (*testServer, string) {
+	ts := newSessionTestServer(t)
+	ts.router.With(service.JwtAuthMiddleware).With(service.ChangeUsernameMiddleware).Patch("/user/{id}/username",
+		service.NewSession)
+	ts.router.With(service.JwtAuthMiddleware).With(service.LookupUsernameMiddleware).Get("/user/username/{username}",
+		service.LookupUsername)
+
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+
+	return ts, user.Id
+}
+
+// TestChangeUsername ensures a username can be changed to one nobody else holds, reserving the old one, and that the
+// old username can still be looked up.
+func TestChangeUsername(t *testing.T) {
+	ts, id := newChangeUsernameTestServer(t)
+	tokens := login(t, ts)
+
+	_, err := ts.repo.NewUser("other@justinstone.net", "Other", "password", service.FEMALE, 30, []string{})
+	ok(t, err)
+
+	status := ts.do(t, http.MethodPatch, "/user/"+id+"/username", tokens.Token,
+		map[string]string{"username": "OTHER"}, nil)
+	equals(t, http.StatusConflict, status)
+
+	var newTokens sessionTokens
+	status = ts.do(t, http.MethodPatch, "/user/"+id+"/username", tokens.Token,
+		map[string]string{"username": "Renamed"}, &newTokens)
+	equals(t, http.StatusOK, status)
+
+	token, err := ts.tokenFactory.ParseToken(newTokens.Token)
+	ok(t, err)
+	claims, err := verifier.ParseClaims(token)
+	ok(t, err)
+	equals(t, "Renamed", claims.Username)
+
+	// The session is restarted so the old tokens, carrying the old username, stop working.
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	var lookup usernameLookup
+	status = ts.do(t, http.MethodGet, "/user/username/renamed", newTokens.Token, nil, &lookup)
+	equals(t, http.StatusOK, status)
+	equals(t, usernameLookup{id, "Renamed", false}, lookup)
+
+	status = ts.do(t, http.MethodGet, "/user/username/USER", newTokens.Token, nil, &lookup)
+	equals(t, http.StatusOK, status)
+	equals(t, usernameLookup{id, "Renamed", true}, lookup)
+
+	status = ts.do(t, http.MethodGet, "/user/username/nobody", newTokens.Token, nil, nil)
+	equals(t, http.StatusNotFound, status)
+
+	// The old username is reserved for its previous owner.
+	otherUser, err := ts.repo.GetUserByEmail("other@justinstone.net")
+	ok(t, err)
+	ok(t, ts.repo.ChangeUsername(otherUser.Id, "other2", time.Now()))
+	notOk(t, ts.repo.ChangeUsername(otherUser.Id, "user", time.Now()))
+	_, err = ts.repo.NewUser("new@justinstone.net", "User", "password", service.FEMALE, 30, []string{})
+	notOk(t, err)
+}
+
+// TestChangeUsername_Cooldown ensures users must wait between changes of username, but can reclaim their old one.
+func TestChangeUsername_Cooldown(t *testing.T) {
+	ts, id := newChangeUsernameTestServer(t)
+	tokens := login(t, ts)
+
+	status := ts.do(t, http.MethodPatch, "/user/"+id+"/username", tokens.Token,
+		map[string]string{"username": "renamed"}, &tokens)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodPatch, "/user/"+id+"/username", tokens.Token,
+		map[string]string{"username": "again"}, nil)
+	equals(t, http.StatusForbidden, status)
+
+	ts.config = noUsernameCooldownConfiguration{ts.config}
+	status = ts.do(t, http.MethodPatch, "/user/"+id+"/username", tokens.Token,
+		map[string]string{"username": "user"}, nil)
+	equals(t, http.StatusOK, status)
+
+	history, err := ts.repo.GetUsernameHistory(id)
+	ok(t, err)
+	equals(t, 2, len(history))
+	equals(t, "user", history[0].Username)
+	equals(t, "renamed", history[1].Username)
+}
+
+// TestChangeUsername_OtherUser ensures users can't change another user's username.
+func TestChangeUsername_OtherUser(t *testing.T) {
+	ts, _ := newChangeUsernameTestServer(t)
+	tokens := login(t, ts)
+
+	otherId, err := ts.repo.NewUser("other@justinstone.net", "other", "password", service.FEMALE, 30, []string{})
+	ok(t, err)
+
+	status := ts.do(t, http.MethodPatch, "/user/"+otherId+"/username", tokens.Token,
+		map[string]string{"username": "renamed"}, nil)
+	equals(t, http.StatusForbidden, status)
+}
@@ -1,10 +1,11 @@
 package service
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"errors"
 	"fmt"
-	"github.com/golang-jwt/jwt"
+	"golang.org/x/crypto/bcrypt"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -21,6 +22,66 @@ const (
 	tokenSecretKeyKey string = "AUTH_SERVICE_TOKEN_SECRET"
 	tokenPrivateKey   string = "AUTH_SERVICE_TOKEN_PRIV"
 	tokenPublicKey    string = "AUTH_SERVICE_TOKEN_PUB"
+	refreshTtlKey     string = "AUTH_SERVICE_REFRESH_TOKEN_TTL"
+
+	tokenKeyDirKey       string = "AUTH_SERVICE_TOKEN_KEY_DIR"
+	tokenKeysKey         string = "AUTH_SERVICE_TOKEN_KEYS"
+	tokenKeyRotationKey  string = "AUTH_SERVICE_TOKEN_KEY_ROTATION"
+	tokenKeyRetentionKey string = "AUTH_SERVICE_TOKEN_KEY_RETENTION"
+	tokenKeyAlgKey       string = "AUTH_SERVICE_TOKEN_KEY_ALG"
+	adminKeyKey          string = "AUTH_SERVICE_ADMIN_KEY"
+	issuerKey            string = "AUTH_SERVICE_ISSUER"
+	webAuthnRpIdKey      string = "AUTH_SERVICE_WEBAUTHN_RP_ID"
+	webAuthnOriginsKey   string = "AUTH_SERVICE_WEBAUTHN_ORIGINS"
+	mailerKey            string = "AUTH_SERVICE_MAILER"
+	mailerDirKey         string = "AUTH_SERVICE_MAILER_DIR"
+	appUrlKey            string = "AUTH_SERVICE_APP_URL"
+	requireVerifiedKey   string = "AUTH_SERVICE_REQUIRE_VERIFIED_EMAIL"
+	usernameCooldownKey  string = "AUTH_SERVICE_USERNAME_COOLDOWN"
+	usernameReserveKey   string = "AUTH_SERVICE_USERNAME_RESERVATION"
+	passwordMinKey       string = "AUTH_SERVICE_PASSWORD_MIN_LENGTH"
+	passwordMaxKey       string = "AUTH_SERVICE_PASSWORD_MAX_LENGTH"
+	passwordClassesKey   string = "AUTH_SERVICE_PASSWORD_CHARACTER_CLASSES"
+	passwordIdentityKey  string = "AUTH_SERVICE_PASSWORD_DISALLOW_IDENTITY"
+	passwordBreachedKey  string = "AUTH_SERVICE_PASSWORD_BREACHED_LIST"
+	passwordHashKey      string = "AUTH_SERVICE_PASSWORD_HASH"
+	bcryptCostKey        string = "AUTH_SERVICE_BCRYPT_COST"
+	argon2MemoryKey      string = "AUTH_SERVICE_ARGON2_MEMORY"
+	argon2IterationsKey  string = "AUTH_SERVICE_ARGON2_ITERATIONS"
+	argon2ParallelismKey string = "AUTH_SERVICE_ARGON2_PARALLELISM"
+	loginFreeKey         string = "AUTH_SERVICE_LOGIN_FREE_ATTEMPTS"
+	loginBackoffKey      string = "AUTH_SERVICE_LOGIN_BACKOFF"
+	loginLockoutAtKey    string = "AUTH_SERVICE_LOGIN_LOCKOUT_ATTEMPTS"
+	loginLockoutKey      string = "AUTH_SERVICE_LOGIN_LOCKOUT"
+	loginIpAttemptsKey   string = "AUTH_SERVICE_LOGIN_IP_ATTEMPTS"
+	loginWindowKey       string = "AUTH_SERVICE_LOGIN_WINDOW"
+	deletionGraceKey     string = "AUTH_SERVICE_ACCOUNT_DELETION_GRACE"
+	purgeIntervalKey     string = "AUTH_SERVICE_ACCOUNT_PURGE_INTERVAL"
+)
+
+const (
+	// serviceName identifies the service to users in authenticator apps and passkey prompts.
+	serviceName = "yapyapyap"
+
+	defaultRefreshTtlSeconds = 30 * 24 * 60 * 60
+	defaultKeyRetention      = 2
+	defaultUsernameCooldown  = 30 * 24 * 60 * 60
+	defaultUsernameReserve   = 90 * 24 * 60 * 60
+	defaultDeletionGrace     = 30 * 24 * 60 * 60
+	defaultPurgeInterval     = 60 * 60
+	defaultPasswordMin       = 8
+	// defaultPasswordMax is the most bcrypt can hash.
+	defaultPasswordMax = 72
+	// The default Argon2id parameters are those recommended by RFC 9106 when memory is constrained.
+	defaultArgon2Memory      = 64 * 1024
+	defaultArgon2Iterations  = 3
+	defaultArgon2Parallelism = 4
+	defaultLoginFree         = 5
+	defaultLoginBackoff      = 1
+	defaultLoginLockoutAt    = 10
+	defaultLoginLockout      = 15 * 60
+	defaultLoginIpAttempts   = 100
+	defaultLoginWindow       = 15 * 60
 )
 
 // LifeCycle represents a particular application life cycle.
@@ -69,6 +130,48 @@ func (prt UserRepositoryType) String() string {
 	}
 }
 
+// MailerType represents a type of Mailer
+type MailerType int
+
+const (
+	// LogMailerType represents a Mailer that writes messages to the log.
+	LogMailerType MailerType = 0
+	// FileMailerType represents a Mailer that writes each message to a file in a directory.
+	FileMailerType MailerType = iota
+)
+
+func (mt MailerType) String() string {
+	switch mt {
+	case LogMailerType:
+		return "LOG"
+	case FileMailerType:
+		return "FILE"
+	default:
+		return ""
+	}
+}
+
+// PasswordHashType represents an algorithm passwords are hashed with
+type PasswordHashType int
+
+const (
+	// BcryptHashType represents hashing passwords with bcrypt.
+	BcryptHashType PasswordHashType = 0
+	// Argon2idHashType represents hashing passwords with Argon2id.
+	Argon2idHashType PasswordHashType = iota
+)
+
+func (pht PasswordHashType) String() string {
+	switch pht {
+	case BcryptHashType:
+		return "BCRYPT"
+	case Argon2idHashType:
+		return "ARGON2ID"
+	default:
+		return ""
+	}
+}
+
 // Configuration provides methods for retrieving aspects of the applications configuration.
 type Configuration interface {
 	// GetLifeCycle retrieves the configured life cycle.
@@ -89,23 +192,103 @@ type Configuration interface {
 	// GetTokenSecretKey a shared secret key for signing tokens
 	GetTokenSecretKey() string
 
-	// GetTokenPrivateKey retrieves the the private key used to sign tokens.
-	GetTokenPrivateKey() *rsa.PrivateKey
+	// GetTokenSigningKeys retrieves the private keys used to sign and verify JWT tokens. The first key is used for
+	// signing, the rest are previous keys that are still accepted for verification.
+	GetTokenSigningKeys() []crypto.Signer
+
+	// GetTokenKeyDir retrieves the directory signing keys are loaded from and rotated keys are written to, if any.
+	GetTokenKeyDir() string
+
+	// GetTokenKeyRotationInterval retrieves how often a new signing key is generated, zero disables rotation.
+	GetTokenKeyRotationInterval() time.Duration
+
+	// GetTokenKeyRetention retrieves how many previous signing keys are still accepted for verification.
+	GetTokenKeyRetention() int
+
+	// GetTokenKeyAlgorithm retrieves the JWT algorithm generated signing keys are created for, empty to match the
+	// current key.
+	GetTokenKeyAlgorithm() string
+
+	// GetAdminKey retrieves the key required to call administrative endpoints, empty disables them.
+	GetAdminKey() string
+
+	// GetRefreshTokenTtl retrieves how long an issued refresh token remains valid.
+	GetRefreshTokenTtl() time.Duration
+
+	// GetIssuer retrieves the base url the service is reachable at, used to identify it as an OpenID provider. Empty
+	// disables OpenID Connect.
+	GetIssuer() string
+
+	// GetWebAuthnRpId retrieves the relying party id passkeys are scoped to, empty disables WebAuthn.
+	GetWebAuthnRpId() string
+
+	// GetWebAuthnOrigins retrieves the origins WebAuthn ceremonies are accepted from.
+	GetWebAuthnOrigins() []string
+
+	// GetMailerType retrieves the configured mailer type.
+	GetMailerType() MailerType
+
+	// GetMailerDir retrieves the directory a file mailer writes messages to.
+	GetMailerDir() string
+
+	// GetAppUrl retrieves the base url of the front end links sent to users point to.
+	GetAppUrl() string
+
+	// GetRequireVerifiedEmail retrieves whether users must verify their email address before they can log in.
+	GetRequireVerifiedEmail() bool
+
+	// GetUsernameChangeCooldown retrieves how long a user must wait between changes of username.
+	GetUsernameChangeCooldown() time.Duration
+
+	// GetUsernameReservation retrieves how long a username that was given up stays reserved for its previous owner.
+	GetUsernameReservation() time.Duration
+
+	// GetAccountDeletionGrace retrieves how long a deleted account can be restored before it is purged.
+	GetAccountDeletionGrace() time.Duration
+
+	// GetAccountPurgeInterval retrieves how often deleted accounts past their grace period are purged, zero disabling
+	// purging.
+	GetAccountPurgeInterval() time.Duration
+
+	// GetPasswordPolicy retrieves the rules new passwords must follow.
+	GetPasswordPolicy() PasswordPolicy
 
-	// GetTokenPublicKey retrieves public key used to validate JWT tokens.
-	GetTokenPublicKey() *rsa.PublicKey
+	// GetPasswordHasher retrieves the hasher passwords are hashed and verified with.
+	GetPasswordHasher() PasswordHasher
+
+	// GetLoginThrottle retrieves the limits on failed logins.
+	GetLoginThrottle() LoginThrottle
 }
 
 type configuration struct {
-	lifeCycle   LifeCycle
-	repoType    UserRepositoryType
-	timeout     time.Duration
-	port        int
-	pgUrl       string
-	initDataset string
-	secretKey   string
-	privateKey  *rsa.PrivateKey
-	publicKey   *rsa.PublicKey
+	lifeCycle    LifeCycle
+	repoType     UserRepositoryType
+	timeout      time.Duration
+	port         int
+	pgUrl        string
+	initDataset  string
+	secretKey    string
+	signingKeys  []crypto.Signer
+	keyDir       string
+	keyRotation  time.Duration
+	keyRetention int
+	keyAlg       string
+	adminKey     string
+	refreshTtl   time.Duration
+	issuer       string
+	rpId         string
+	rpOrigins    []string
+	mailerType   MailerType
+	mailerDir    string
+	appUrl       string
+	requireEmail bool
+	nameCooldown time.Duration
+	nameReserve  time.Duration
+	deleteGrace  time.Duration
+	purgeEvery   time.Duration
+	pwPolicy     PasswordPolicy
+	pwHasher     PasswordHasher
+	throttle     LoginThrottle
 }
 
 func (conf *configuration) GetLifeCycle() LifeCycle {
@@ -137,14 +320,95 @@ func (conf *configuration) GetTokenSecretKey() string {
 	return conf.secretKey
 }
 
-// GetTokenPrivateKey retrieves the private RSA key used to sign JWT tokens.
-func (conf *configuration) GetTokenPrivateKey() *rsa.PrivateKey {
-	return conf.privateKey
+// GetTokenSigningKeys retrieves the private keys used to sign and verify JWT tokens, current key first.
+func (conf *configuration) GetTokenSigningKeys() []crypto.Signer {
+	return conf.signingKeys
+}
+
+// GetTokenKeyDir retrieves the directory signing keys are loaded from and rotated keys are written to.
+func (conf *configuration) GetTokenKeyDir() string {
+	return conf.keyDir
+}
+
+// GetTokenKeyRotationInterval retrieves how often a new signing key is generated.
+func (conf *configuration) GetTokenKeyRotationInterval() time.Duration {
+	return conf.keyRotation
+}
+
+// GetTokenKeyRetention retrieves how many previous signing keys are still accepted for verification.
+func (conf *configuration) GetTokenKeyRetention() int {
+	return conf.keyRetention
+}
+
+// GetTokenKeyAlgorithm retrieves the JWT algorithm generated signing keys are created for.
+func (conf *configuration) GetTokenKeyAlgorithm() string {
+	return conf.keyAlg
+}
+
+// GetAdminKey retrieves the key required to call administrative endpoints.
+func (conf *configuration) GetAdminKey() string {
+	return conf.adminKey
+}
+
+// GetRefreshTokenTtl retrieves how long an issued refresh token remains valid.
+func (conf *configuration) GetRefreshTokenTtl() time.Duration {
+	return conf.refreshTtl
+}
+
+func (conf *configuration) GetIssuer() string {
+	return conf.issuer
+}
+
+func (conf *configuration) GetWebAuthnRpId() string {
+	return conf.rpId
+}
+
+func (conf *configuration) GetWebAuthnOrigins() []string {
+	return conf.rpOrigins
 }
 
-// GetTokenPublicKey retrieves public RSA key used to validate JWT tokens.
-func (conf *configuration) GetTokenPublicKey() *rsa.PublicKey {
-	return conf.publicKey
+func (conf *configuration) GetMailerType() MailerType {
+	return conf.mailerType
+}
+
+func (conf *configuration) GetMailerDir() string {
+	return conf.mailerDir
+}
+
+func (conf *configuration) GetAppUrl() string {
+	return conf.appUrl
+}
+
+func (conf *configuration) GetRequireVerifiedEmail() bool {
+	return conf.requireEmail
+}
+
+func (conf *configuration) GetUsernameChangeCooldown() time.Duration {
+	return conf.nameCooldown
+}
+
+func (conf *configuration) GetUsernameReservation() time.Duration {
+	return conf.nameReserve
+}
+
+func (conf *configuration) GetAccountDeletionGrace() time.Duration {
+	return conf.deleteGrace
+}
+
+func (conf *configuration) GetAccountPurgeInterval() time.Duration {
+	return conf.purgeEvery
+}
+
+func (conf *configuration) GetPasswordPolicy() PasswordPolicy {
+	return conf.pwPolicy
+}
+
+func (conf *configuration) GetPasswordHasher() PasswordHasher {
+	return conf.pwHasher
+}
+
+func (conf *configuration) GetLoginThrottle() LoginThrottle {
+	return conf.throttle
 }
 
 // GetConfiguration constructs a Configuration based on environment variables.
@@ -231,42 +495,413 @@ func GetConfiguration() (Configuration, error) {
 		return nil, err
 	}
 
-	secretKey := os.Getenv(tokenSecretKeyKey)
-	privateKeyPath := os.Getenv(tokenPrivateKey)
-	publicKeyPath := os.Getenv(tokenPublicKey)
+	refreshTtlStr := os.Getenv(refreshTtlKey)
 
-	if secretKey == "" && (privateKeyPath == "" || publicKeyPath == "") {
-		if config.lifeCycle == DevLifeCycle {
-			config.secretKey = "secret"
-		} else {
-			return nil, errors.New(fmt.Sprintf("must set either %s environment variable or both %s AND %s "+
-				"environment variables", tokenSecretKeyKey, tokenPublicKey, tokenPrivateKey))
-		}
-	} else if secretKey != "" {
-		config.secretKey = secretKey
+	if refreshTtlStr == "" {
+		refreshTtlStr = strconv.Itoa(defaultRefreshTtlSeconds)
+	}
+
+	refreshTtlInt, err := strconv.Atoi(refreshTtlStr)
+
+	if err != nil || refreshTtlInt <= 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid refresh token ttl, set %s environment variable to a number of "+
+			"seconds", refreshTtlKey))
+	}
+
+	config.refreshTtl = time.Duration(refreshTtlInt) * time.Second
+
+	err = setTokenKeyConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config.adminKey = os.Getenv(adminKeyKey)
+
+	config.issuer = strings.TrimSuffix(os.Getenv(issuerKey), "/")
+
+	if config.issuer == "" && config.lifeCycle == DevLifeCycle {
+		config.issuer = fmt.Sprintf("http://localhost:%d", config.port)
+	}
+
+	err = setWebAuthnConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = setMailerConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	requireVerifiedStr := os.Getenv(requireVerifiedKey)
+
+	if requireVerifiedStr == "" {
+		config.requireEmail = config.lifeCycle == ProdLifeCycle
 	} else {
-		signBytes, err := os.ReadFile(privateKeyPath)
+		config.requireEmail, err = strconv.ParseBool(requireVerifiedStr)
+
 		if err != nil {
-			return nil, err
+			return nil, errors.New(fmt.Sprintf("Invalid email verification requirement, set %s environment variable "+
+				"to true or false", requireVerifiedKey))
 		}
+	}
+
+	err = setUsernameConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = setAccountDeletionConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = setPasswordPolicyConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = setPasswordHasherConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = setLoginThrottleConfig(&config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// setPasswordPolicyConfig sets the rules new passwords must follow.
+func setPasswordPolicyConfig(config *configuration) error {
+	minStr := os.Getenv(passwordMinKey)
+
+	if minStr == "" {
+		minStr = strconv.Itoa(defaultPasswordMin)
+	}
+
+	minInt, err := strconv.Atoi(minStr)
+
+	if err != nil || minInt < 0 {
+		return errors.New(fmt.Sprintf("Invalid minimum password length, set %s environment variable to a number",
+			passwordMinKey))
+	}
+
+	maxStr := os.Getenv(passwordMaxKey)
+
+	if maxStr == "" {
+		maxStr = strconv.Itoa(defaultPasswordMax)
+	}
+
+	maxInt, err := strconv.Atoi(maxStr)
+
+	if err != nil || maxInt < 0 || (maxInt > 0 && maxInt < minInt) {
+		return errors.New(fmt.Sprintf("Invalid maximum password length, set %s environment variable to a number "+
+			"no less than the minimum", passwordMaxKey))
+	}
+
+	config.pwPolicy = PasswordPolicy{MinLength: minInt, MaxLength: maxInt, DisallowIdentity: true}
+
+	if classesStr := os.Getenv(passwordClassesKey); classesStr != "" {
+		for _, class := range strings.Split(classesStr, ",") {
+			class = strings.TrimSpace(class)
+
+			switch class {
+			case LowerClass, UpperClass, DigitClass, SymbolClass:
+				config.pwPolicy.CharacterClasses = append(config.pwPolicy.CharacterClasses, class)
+			default:
+				return errors.New(fmt.Sprintf("Invalid password character class, set %s environment variable to a "+
+					"comma separated list of lower, upper, digit or symbol", passwordClassesKey))
+			}
+		}
+	}
+
+	if identityStr := os.Getenv(passwordIdentityKey); identityStr != "" {
+		config.pwPolicy.DisallowIdentity, err = strconv.ParseBool(identityStr)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid password identity rule, set %s environment variable to true or "+
+				"false", passwordIdentityKey))
+		}
+	}
+
+	if breachedPath := os.Getenv(passwordBreachedKey); breachedPath != "" {
+		config.pwPolicy.Breached, err = LoadBreachedPasswordFile(breachedPath)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("Unable to load breached password list set in %s environment variable: %s",
+				passwordBreachedKey, err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// setPasswordHasherConfig sets the algorithm and parameters new password hashes are made with. Hashes made any other
+// way are still accepted and replaced when their owner next logs in.
+func setPasswordHasherConfig(config *configuration) error {
+	switch os.Getenv(passwordHashKey) {
+	case "", BcryptHashType.String():
+		costStr := os.Getenv(bcryptCostKey)
+
+		if costStr == "" {
+			costStr = strconv.Itoa(bcrypt.DefaultCost)
+		}
+
+		cost, err := strconv.Atoi(costStr)
+
+		if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			return errors.New(fmt.Sprintf("Invalid bcrypt cost, set %s environment variable to a number from %d to %d",
+				bcryptCostKey, bcrypt.MinCost, bcrypt.MaxCost))
+		}
+
+		config.pwHasher = MakeUpgradingHasher(MakeBcryptHasher(cost))
+	case Argon2idHashType.String():
+		memory, err := argon2ParamFromEnv(argon2MemoryKey, defaultArgon2Memory, 32)
 
-		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(signBytes)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		verifyBytes, err := os.ReadFile(publicKeyPath)
+		iterations, err := argon2ParamFromEnv(argon2IterationsKey, defaultArgon2Iterations, 32)
+
+		if err != nil {
+			return err
+		}
+
+		parallelism, err := argon2ParamFromEnv(argon2ParallelismKey, defaultArgon2Parallelism, 8)
+
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(verifyBytes)
+		params := Argon2idParams{Memory: uint32(memory), Iterations: uint32(iterations), Parallelism: uint8(parallelism)}
 
-		config.privateKey = privateKey
-		config.publicKey = publicKey
+		// Argon2id requires at least 8 KiB of memory per thread.
+		if params.Memory < 8*uint32(params.Parallelism) {
+			return errors.New(fmt.Sprintf("Invalid Argon2id memory, set %s environment variable to at least 8 KiB "+
+				"per thread", argon2MemoryKey))
+		}
+
+		config.pwHasher = MakeUpgradingHasher(MakeArgon2idHasher(params))
+	default:
+		return errors.New(fmt.Sprintf("Invalid password hash, set %s environment variable to one of BCRYPT or "+
+			"ARGON2ID", passwordHashKey))
 	}
 
-	return &config, nil
+	return nil
+}
+
+// argon2ParamFromEnv reads a positive Argon2id parameter of the given bit size from the environment.
+func argon2ParamFromEnv(key string, defaultValue uint64, bits int) (uint64, error) {
+	str := os.Getenv(key)
+
+	if str == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseUint(str, 10, bits)
+
+	if err != nil || value == 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid Argon2id parameter, set %s environment variable to a positive "+
+			"number of at most %d bits", key, bits))
+	}
+
+	return value, nil
+}
+
+// setLoginThrottleConfig sets the limits on failed logins.
+func setLoginThrottleConfig(config *configuration) error {
+	settings := []struct {
+		key          string
+		defaultValue int
+		value        *int
+	}{
+		{loginFreeKey, defaultLoginFree, &config.throttle.FreeAttempts},
+		{loginLockoutAtKey, defaultLoginLockoutAt, &config.throttle.LockoutAttempts},
+		{loginIpAttemptsKey, defaultLoginIpAttempts, &config.throttle.IpAttempts},
+	}
+
+	for _, setting := range settings {
+		value, err := nonNegativeIntFromEnv(setting.key, setting.defaultValue)
+
+		if err != nil {
+			return err
+		}
+
+		*setting.value = value
+	}
+
+	durations := []struct {
+		key          string
+		defaultValue int
+		value        *time.Duration
+	}{
+		{loginBackoffKey, defaultLoginBackoff, &config.throttle.Backoff},
+		{loginLockoutKey, defaultLoginLockout, &config.throttle.Lockout},
+		{loginWindowKey, defaultLoginWindow, &config.throttle.Window},
+	}
+
+	for _, setting := range durations {
+		seconds, err := nonNegativeIntFromEnv(setting.key, setting.defaultValue)
+
+		if err != nil {
+			return err
+		}
+
+		*setting.value = time.Duration(seconds) * time.Second
+	}
+
+	if config.throttle.LockoutAttempts > 0 && config.throttle.LockoutAttempts <= config.throttle.FreeAttempts {
+		return errors.New(fmt.Sprintf("Invalid login lockout, set %s environment variable to more than %s or 0",
+			loginLockoutAtKey, loginFreeKey))
+	}
+
+	return nil
+}
+
+// nonNegativeIntFromEnv reads a number that can't be negative from the environment.
+func nonNegativeIntFromEnv(key string, defaultValue int) (int, error) {
+	str := os.Getenv(key)
+
+	if str == "" {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.Atoi(str)
+
+	if err != nil || value < 0 {
+		return 0, errors.New(fmt.Sprintf("Invalid value, set %s environment variable to a number no less than 0",
+			key))
+	}
+
+	return value, nil
+}
+
+// setUsernameConfig sets the limits on changing username.
+func setUsernameConfig(config *configuration) error {
+	cooldownStr := os.Getenv(usernameCooldownKey)
+
+	if cooldownStr == "" {
+		cooldownStr = strconv.Itoa(defaultUsernameCooldown)
+	}
+
+	cooldownInt, err := strconv.Atoi(cooldownStr)
+
+	if err != nil || cooldownInt < 0 {
+		return errors.New(fmt.Sprintf("Invalid username change cooldown, set %s environment variable to a number "+
+			"of seconds", usernameCooldownKey))
+	}
+
+	config.nameCooldown = time.Duration(cooldownInt) * time.Second
+
+	reserveStr := os.Getenv(usernameReserveKey)
+
+	if reserveStr == "" {
+		reserveStr = strconv.Itoa(defaultUsernameReserve)
+	}
+
+	reserveInt, err := strconv.Atoi(reserveStr)
+
+	if err != nil || reserveInt < 0 {
+		return errors.New(fmt.Sprintf("Invalid username reservation, set %s environment variable to a number of "+
+			"seconds", usernameReserveKey))
+	}
+
+	config.nameReserve = time.Duration(reserveInt) * time.Second
+
+	return nil
+}
+
+// setAccountDeletionConfig sets how long deleted accounts can be restored and how often they are purged afterwards.
+func setAccountDeletionConfig(config *configuration) error {
+	grace, err := nonNegativeIntFromEnv(deletionGraceKey, defaultDeletionGrace)
+
+	if err != nil {
+		return err
+	}
+
+	interval, err := nonNegativeIntFromEnv(purgeIntervalKey, defaultPurgeInterval)
+
+	if err != nil {
+		return err
+	}
+
+	config.deleteGrace = time.Duration(grace) * time.Second
+	config.purgeEvery = time.Duration(interval) * time.Second
+
+	return nil
+}
+
+// setMailerConfig sets how messages to users are delivered and the front end links within them point to, which
+// defaults to the issuer.
+func setMailerConfig(config *configuration) error {
+	switch os.Getenv(mailerKey) {
+	case "", LogMailerType.String():
+		config.mailerType = LogMailerType
+	case FileMailerType.String():
+		config.mailerType = FileMailerType
+	default:
+		return errors.New(fmt.Sprintf("Invalid mailer, set %s environment variable to one of LOG or FILE", mailerKey))
+	}
+
+	config.mailerDir = os.Getenv(mailerDirKey)
+
+	if config.mailerType == FileMailerType && strings.TrimSpace(config.mailerDir) == "" {
+		return errors.New(fmt.Sprintf("No mailer directory configured, set %s environment variable", mailerDirKey))
+	}
+
+	config.appUrl = strings.TrimSuffix(os.Getenv(appUrlKey), "/")
+
+	if config.appUrl == "" {
+		config.appUrl = config.issuer
+	}
+
+	return nil
+}
+
+// setWebAuthnConfig sets the relying party WebAuthn ceremonies are performed for. Both the id and origins default to
+// the issuer.
+func setWebAuthnConfig(config *configuration) error {
+	config.rpId = os.Getenv(webAuthnRpIdKey)
+	originsStr := os.Getenv(webAuthnOriginsKey)
+
+	if originsStr != "" {
+		for _, origin := range strings.Split(originsStr, ",") {
+			config.rpOrigins = append(config.rpOrigins, strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		}
+	} else if config.issuer != "" {
+		issuer, err := url.Parse(config.issuer)
+
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid issuer, set %s environment variable to a url", issuerKey))
+		}
+
+		config.rpOrigins = []string{issuer.Scheme + "://" + issuer.Host}
+	}
+
+	if config.rpId == "" && len(config.rpOrigins) > 0 {
+		origin, err := url.Parse(config.rpOrigins[0])
+
+		if err != nil || origin.Hostname() == "" {
+			return errors.New(fmt.Sprintf("Unable to determine WebAuthn relying party, set %s environment variable",
+				webAuthnRpIdKey))
+		}
+
+		config.rpId = origin.Hostname()
+	}
+
+	return nil
 }
 
 func setPostgresqlConfig(config *configuration) error {
@@ -280,3 +915,73 @@ func setPostgresqlConfig(config *configuration) error {
 
 	return err
 }
+
+func setTokenKeyConfig(config *configuration) error {
+	secretKey := os.Getenv(tokenSecretKeyKey)
+	keyDir := os.Getenv(tokenKeyDirKey)
+	keyList := os.Getenv(tokenKeysKey)
+	privateKeyPath := os.Getenv(tokenPrivateKey)
+	publicKeyPath := os.Getenv(tokenPublicKey)
+
+	rotationStr := os.Getenv(tokenKeyRotationKey)
+
+	if rotationStr == "" {
+		rotationStr = "0"
+	}
+
+	rotationInt, err := strconv.Atoi(rotationStr)
+
+	if err != nil || rotationInt < 0 {
+		return errors.New(fmt.Sprintf("Invalid key rotation interval, set %s environment variable to a number of "+
+			"seconds", tokenKeyRotationKey))
+	}
+
+	config.keyRotation = time.Duration(rotationInt) * time.Second
+
+	retentionStr := os.Getenv(tokenKeyRetentionKey)
+
+	if retentionStr == "" {
+		retentionStr = strconv.Itoa(defaultKeyRetention)
+	}
+
+	config.keyRetention, err = strconv.Atoi(retentionStr)
+
+	if err != nil || config.keyRetention < 0 {
+		return errors.New(fmt.Sprintf("Invalid key retention, set %s environment variable to a number of keys",
+			tokenKeyRetentionKey))
+	}
+
+	config.keyAlg = os.Getenv(tokenKeyAlgKey)
+
+	switch config.keyAlg {
+	case "", "RS512", "ES256", "ES384", "ES512", "EdDSA":
+	default:
+		return errors.New(fmt.Sprintf("Invalid signing algorithm, set %s environment variable to one of RS512, "+
+			"ES256, ES384, ES512 or EdDSA", tokenKeyAlgKey))
+	}
+
+	switch {
+	case secretKey != "":
+		config.secretKey = secretKey
+	case keyDir != "":
+		config.keyDir = keyDir
+		config.signingKeys, err = loadSigningKeyDir(keyDir)
+	case keyList != "":
+		config.signingKeys, err = loadSigningKeyList(strings.Split(keyList, ","))
+	case privateKeyPath != "" && publicKeyPath != "":
+		var signingKey crypto.Signer
+		signingKey, err = loadSigningKeyPair(privateKeyPath, publicKeyPath)
+		config.signingKeys = []crypto.Signer{signingKey}
+	case config.lifeCycle == DevLifeCycle:
+		config.secretKey = "secret"
+	default:
+		err = errors.New(fmt.Sprintf("must set either %s, %s or %s environment variable or both %s AND %s "+
+			"environment variables", tokenSecretKeyKey, tokenKeyDirKey, tokenKeysKey, tokenPublicKey, tokenPrivateKey))
+	}
+
+	if err == nil && config.keyRotation > 0 && config.secretKey != "" {
+		err = errors.New(fmt.Sprintf("%s can't be used with a shared secret key", tokenKeyRotationKey))
+	}
+
+	return err
+}
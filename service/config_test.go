@@ -2,8 +2,11 @@ package service_test
 
 import (
 	"github.com/stone1549/yapyapyap/auth/service"
+	"golang.org/x/crypto/bcrypt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 const (
@@ -16,6 +19,34 @@ const (
 	tokenSecretKeyKey  string = "AUTH_SERVICE_TOKEN_SECRET"
 	tokenPrivateKeyKey string = "AUTH_SERVICE_TOKEN_PRIV"
 	tokenPublicKeyKey  string = "AUTH_SERVICE_TOKEN_PUB"
+	tokenKeyDirKey     string = "AUTH_SERVICE_TOKEN_KEY_DIR"
+	tokenKeysKey       string = "AUTH_SERVICE_TOKEN_KEYS"
+	tokenRotationKey   string = "AUTH_SERVICE_TOKEN_KEY_ROTATION"
+	tokenKeyAlgKey     string = "AUTH_SERVICE_TOKEN_KEY_ALG"
+	issuerKey          string = "AUTH_SERVICE_ISSUER"
+	webAuthnRpIdKey    string = "AUTH_SERVICE_WEBAUTHN_RP_ID"
+	webAuthnOriginsKey string = "AUTH_SERVICE_WEBAUTHN_ORIGINS"
+	requireVerifiedKey string = "AUTH_SERVICE_REQUIRE_VERIFIED_EMAIL"
+	usernameCooldown   string = "AUTH_SERVICE_USERNAME_COOLDOWN"
+	usernameReserve    string = "AUTH_SERVICE_USERNAME_RESERVATION"
+	passwordMin        string = "AUTH_SERVICE_PASSWORD_MIN_LENGTH"
+	passwordMax        string = "AUTH_SERVICE_PASSWORD_MAX_LENGTH"
+	passwordClasses    string = "AUTH_SERVICE_PASSWORD_CHARACTER_CLASSES"
+	passwordIdentity   string = "AUTH_SERVICE_PASSWORD_DISALLOW_IDENTITY"
+	passwordBreached   string = "AUTH_SERVICE_PASSWORD_BREACHED_LIST"
+	passwordHash       string = "AUTH_SERVICE_PASSWORD_HASH"
+	bcryptCost         string = "AUTH_SERVICE_BCRYPT_COST"
+	argon2Memory       string = "AUTH_SERVICE_ARGON2_MEMORY"
+	argon2Iterations   string = "AUTH_SERVICE_ARGON2_ITERATIONS"
+	argon2Parallelism  string = "AUTH_SERVICE_ARGON2_PARALLELISM"
+	loginFree          string = "AUTH_SERVICE_LOGIN_FREE_ATTEMPTS"
+	loginBackoff       string = "AUTH_SERVICE_LOGIN_BACKOFF"
+	loginLockoutAt     string = "AUTH_SERVICE_LOGIN_LOCKOUT_ATTEMPTS"
+	loginLockout       string = "AUTH_SERVICE_LOGIN_LOCKOUT"
+	loginIpAttempts    string = "AUTH_SERVICE_LOGIN_IP_ATTEMPTS"
+	loginWindow        string = "AUTH_SERVICE_LOGIN_WINDOW"
+	deletionGrace      string = "AUTH_SERVICE_ACCOUNT_DELETION_GRACE"
+	purgeInterval      string = "AUTH_SERVICE_ACCOUNT_PURGE_INTERVAL"
 )
 
 func clearEnv() {
@@ -28,6 +59,46 @@ func clearEnv() {
 	_ = os.Setenv(tokenSecretKeyKey, "")
 	_ = os.Setenv(tokenPrivateKeyKey, "../data/sample.key")
 	_ = os.Setenv(tokenPublicKeyKey, "../data/sample.pub")
+	_ = os.Setenv(issuerKey, "")
+	_ = os.Setenv(webAuthnRpIdKey, "")
+	_ = os.Setenv(webAuthnOriginsKey, "")
+	_ = os.Setenv(requireVerifiedKey, "")
+	_ = os.Setenv(usernameCooldown, "")
+	_ = os.Setenv(usernameReserve, "")
+	_ = os.Setenv(deletionGrace, "")
+	_ = os.Setenv(purgeInterval, "")
+	clearPasswordPolicyEnv()
+	clearLoginThrottleEnv()
+	clearKeyRingEnv()
+}
+
+func clearKeyRingEnv() {
+	_ = os.Setenv(tokenKeyDirKey, "")
+	_ = os.Setenv(tokenKeysKey, "")
+	_ = os.Setenv(tokenRotationKey, "")
+	_ = os.Setenv(tokenKeyAlgKey, "")
+}
+
+func clearPasswordPolicyEnv() {
+	_ = os.Setenv(passwordMin, "")
+	_ = os.Setenv(passwordMax, "")
+	_ = os.Setenv(passwordClasses, "")
+	_ = os.Setenv(passwordIdentity, "")
+	_ = os.Setenv(passwordBreached, "")
+	_ = os.Setenv(passwordHash, "")
+	_ = os.Setenv(bcryptCost, "")
+	_ = os.Setenv(argon2Memory, "")
+	_ = os.Setenv(argon2Iterations, "")
+	_ = os.Setenv(argon2Parallelism, "")
+}
+
+func clearLoginThrottleEnv() {
+	_ = os.Setenv(loginFree, "")
+	_ = os.Setenv(loginBackoff, "")
+	_ = os.Setenv(loginLockoutAt, "")
+	_ = os.Setenv(loginLockout, "")
+	_ = os.Setenv(loginIpAttempts, "")
+	_ = os.Setenv(loginWindow, "")
 }
 
 func setEnv(lifeCycle, repoType, timeoutSeconds, port, pgUrl, pgInitDataset, tokenSecretKey, tokenPrivateKey,
@@ -41,6 +112,17 @@ func setEnv(lifeCycle, repoType, timeoutSeconds, port, pgUrl, pgInitDataset, tok
 	_ = os.Setenv(tokenSecretKeyKey, tokenSecretKey)
 	_ = os.Setenv(tokenPrivateKeyKey, tokenPrivateKey)
 	_ = os.Setenv(tokenPublicKeyKey, tokenPublicKey)
+	_ = os.Setenv(issuerKey, "")
+	_ = os.Setenv(webAuthnRpIdKey, "")
+	_ = os.Setenv(webAuthnOriginsKey, "")
+	_ = os.Setenv(requireVerifiedKey, "")
+	_ = os.Setenv(usernameCooldown, "")
+	_ = os.Setenv(usernameReserve, "")
+	_ = os.Setenv(deletionGrace, "")
+	_ = os.Setenv(purgeInterval, "")
+	clearPasswordPolicyEnv()
+	clearLoginThrottleEnv()
+	clearKeyRingEnv()
 }
 
 // TestGetConfiguration_Defaults ensures that a default configuration is returned if no configuration is provided in
@@ -143,3 +225,295 @@ func TestGetConfiguration_ImFailRsaJustPublicKey(t *testing.T) {
 	_, err := service.GetConfiguration()
 	notOk(t, err)
 }
+
+// TestGetConfiguration_ImFailRsaMismatchedKeys ensures that an error is returned when the public JWT key doesn't match
+// the private key.
+func TestGetConfiguration_ImFailRsaMismatchedKeys(t *testing.T) {
+	setEnv("PROD", "IN_MEMORY", "60", "3333", "", "",
+		"", "../data/sample.key", "../data/small_set.json")
+	_, err := service.GetConfiguration()
+	notOk(t, err)
+}
+
+// TestGetConfiguration_KeyList ensures that signing keys can be configured as a list of paths.
+func TestGetConfiguration_KeyList(t *testing.T) {
+	setEnv("PROD", "IN_MEMORY", "60", "3333", "", "",
+		"", "", "")
+	_ = os.Setenv(tokenKeysKey, "../data/sample.key")
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	equals(t, 1, len(config.GetTokenSigningKeys()))
+}
+
+// TestGetConfiguration_KeyDir ensures that signing keys can be configured as a directory.
+func TestGetConfiguration_KeyDir(t *testing.T) {
+	setEnv("PROD", "IN_MEMORY", "60", "3333", "", "",
+		"", "", "")
+	_ = os.Setenv(tokenKeyDirKey, t.TempDir())
+	_ = os.Setenv(tokenRotationKey, "86400")
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	equals(t, 0, len(config.GetTokenSigningKeys()))
+}
+
+// TestGetConfiguration_FailRotationWithSecret ensures that an error is returned when rotation is configured for a
+// shared secret.
+func TestGetConfiguration_FailRotationWithSecret(t *testing.T) {
+	setEnv("PROD", "IN_MEMORY", "60", "3333", "", "",
+		"SECRET", "", "")
+	_ = os.Setenv(tokenRotationKey, "86400")
+	_, err := service.GetConfiguration()
+	notOk(t, err)
+}
+
+// TestGetConfiguration_FailKeyAlg ensures that an error is returned when an unsupported signing algorithm is configured.
+func TestGetConfiguration_FailKeyAlg(t *testing.T) {
+	setEnv("PROD", "IN_MEMORY", "60", "3333", "", "",
+		"", "", "")
+	_ = os.Setenv(tokenKeyDirKey, t.TempDir())
+	_ = os.Setenv(tokenKeyAlgKey, "HS256")
+	_, err := service.GetConfiguration()
+	notOk(t, err)
+}
+
+// TestGetConfiguration_Issuer ensures the issuer defaults to localhost in development and is normalized when set.
+func TestGetConfiguration_Issuer(t *testing.T) {
+	setEnv("DEV", "IN_MEMORY", "60", "4444", "", "",
+		"SECRET", "", "")
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	equals(t, "http://localhost:4444", config.GetIssuer())
+
+	setEnv("PROD", "IN_MEMORY", "60", "3333", "", "",
+		"SECRET", "", "")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, "", config.GetIssuer())
+
+	_ = os.Setenv(issuerKey, "https://auth.example.com/")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, "https://auth.example.com", config.GetIssuer())
+}
+
+// TestGetConfiguration_WebAuthn ensures the relying party defaults to the issuer and can be overridden.
+func TestGetConfiguration_WebAuthn(t *testing.T) {
+	setEnv("PROD", "IN_MEMORY", "60", "3333", "", "",
+		"SECRET", "", "")
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	equals(t, "", config.GetWebAuthnRpId())
+
+	_ = os.Setenv(issuerKey, "https://auth.example.com:8443/")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, "auth.example.com", config.GetWebAuthnRpId())
+	equals(t, []string{"https://auth.example.com:8443"}, config.GetWebAuthnOrigins())
+
+	_ = os.Setenv(webAuthnRpIdKey, "example.com")
+	_ = os.Setenv(webAuthnOriginsKey, "https://example.com, https://app.example.com/")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, "example.com", config.GetWebAuthnRpId())
+	equals(t, []string{"https://example.com", "https://app.example.com"}, config.GetWebAuthnOrigins())
+}
+
+// TestGetConfiguration_RequireVerifiedEmail ensures verified email addresses are only required by default in PROD.
+func TestGetConfiguration_RequireVerifiedEmail(t *testing.T) {
+	setEnv("DEV", "IN_MEMORY", "60", "3333", "", "",
+		"SECRET", "", "")
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	equals(t, false, config.GetRequireVerifiedEmail())
+
+	_ = os.Setenv(requireVerifiedKey, "true")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, true, config.GetRequireVerifiedEmail())
+
+	setEnv("PROD", "IN_MEMORY", "60", "3333", "", "",
+		"SECRET", "", "")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, true, config.GetRequireVerifiedEmail())
+
+	_ = os.Setenv(requireVerifiedKey, "false")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, false, config.GetRequireVerifiedEmail())
+
+	_ = os.Setenv(requireVerifiedKey, "maybe")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+}
+
+// TestGetConfiguration_Username ensures the username change limits have defaults and reject invalid values.
+func TestGetConfiguration_Username(t *testing.T) {
+	setEnv("DEV", "IN_MEMORY", "60", "3333", "", "",
+		"SECRET", "", "")
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	equals(t, 30*24*time.Hour, config.GetUsernameChangeCooldown())
+	equals(t, 90*24*time.Hour, config.GetUsernameReservation())
+
+	_ = os.Setenv(usernameCooldown, "60")
+	_ = os.Setenv(usernameReserve, "0")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, time.Minute, config.GetUsernameChangeCooldown())
+	equals(t, time.Duration(0), config.GetUsernameReservation())
+
+	_ = os.Setenv(usernameReserve, "-1")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+}
+
+// TestGetConfiguration_AccountDeletion ensures the account deletion grace period and purge interval have defaults and
+// reject invalid values.
+func TestGetConfiguration_AccountDeletion(t *testing.T) {
+	setEnv("DEV", "IN_MEMORY", "60", "3333", "", "",
+		"SECRET", "", "")
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	equals(t, 30*24*time.Hour, config.GetAccountDeletionGrace())
+	equals(t, time.Hour, config.GetAccountPurgeInterval())
+
+	_ = os.Setenv(deletionGrace, "86400")
+	_ = os.Setenv(purgeInterval, "0")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, 24*time.Hour, config.GetAccountDeletionGrace())
+	equals(t, time.Duration(0), config.GetAccountPurgeInterval())
+
+	_ = os.Setenv(deletionGrace, "soon")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+}
+
+// TestGetConfiguration_PasswordPolicy ensures the password policy has defaults and rejects invalid values.
+func TestGetConfiguration_PasswordPolicy(t *testing.T) {
+	setEnv("DEV", "IN_MEMORY", "60", "3333", "", "",
+		"SECRET", "", "")
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	equals(t, service.PasswordPolicy{MinLength: 8, MaxLength: 72, DisallowIdentity: true}, config.GetPasswordPolicy())
+
+	_ = os.Setenv(passwordMin, "12")
+	_ = os.Setenv(passwordMax, "0")
+	_ = os.Setenv(passwordClasses, "upper, digit")
+	_ = os.Setenv(passwordIdentity, "false")
+	_ = os.Setenv(passwordBreached, writeBreachedPasswordFile(t, "password"))
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	policy := config.GetPasswordPolicy()
+	equals(t, 12, policy.MinLength)
+	equals(t, 0, policy.MaxLength)
+	equals(t, []string{service.UpperClass, service.DigitClass}, policy.CharacterClasses)
+	equals(t, false, policy.DisallowIdentity)
+	assert(t, policy.Breached != nil, "expected breached password list to be loaded")
+
+	_ = os.Setenv(passwordMax, "10")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+
+	_ = os.Setenv(passwordMax, "")
+	_ = os.Setenv(passwordClasses, "emoji")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+
+	_ = os.Setenv(passwordClasses, "")
+	_ = os.Setenv(passwordBreached, "/does/not/exist")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+	clearPasswordPolicyEnv()
+}
+
+// TestGetConfiguration_PasswordHasher ensures passwords are hashed with the configured algorithm and parameters.
+func TestGetConfiguration_PasswordHasher(t *testing.T) {
+	setEnv("DEV", "IN_MEMORY", "60", "3333", "", "",
+		"SECRET", "", "")
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	defaultHash, err := service.MakeBcryptHasher(bcrypt.DefaultCost).Hash("password")
+	ok(t, err)
+	equals(t, false, config.GetPasswordHasher().NeedsRehash(defaultHash))
+
+	_ = os.Setenv(bcryptCost, "4")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, true, config.GetPasswordHasher().NeedsRehash(defaultHash))
+
+	_ = os.Setenv(bcryptCost, "99")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+
+	_ = os.Setenv(bcryptCost, "")
+	_ = os.Setenv(passwordHash, "ARGON2ID")
+	_ = os.Setenv(argon2Memory, "64")
+	_ = os.Setenv(argon2Iterations, "1")
+	_ = os.Setenv(argon2Parallelism, "1")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	encoded, err := config.GetPasswordHasher().Hash("password")
+	ok(t, err)
+	assert(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$"), "expected argon2id hash, got %s", encoded)
+	equals(t, true, config.GetPasswordHasher().NeedsRehash(defaultHash))
+
+	match, err := config.GetPasswordHasher().Verify(defaultHash, "password")
+	ok(t, err)
+	assert(t, match, "expected bcrypt hash to still verify")
+
+	_ = os.Setenv(argon2Parallelism, "256")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+
+	_ = os.Setenv(argon2Parallelism, "16")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+
+	_ = os.Setenv(passwordHash, "MD5")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+	clearPasswordPolicyEnv()
+}
+
+// TestGetConfiguration_LoginThrottle ensures the limits on failed logins have defaults and reject invalid values.
+func TestGetConfiguration_LoginThrottle(t *testing.T) {
+	setEnv("DEV", "IN_MEMORY", "60", "3333", "", "",
+		"SECRET", "", "")
+	config, err := service.GetConfiguration()
+	ok(t, err)
+	equals(t, service.LoginThrottle{
+		FreeAttempts:    5,
+		Backoff:         time.Second,
+		LockoutAttempts: 10,
+		Lockout:         15 * time.Minute,
+		IpAttempts:      100,
+		Window:          15 * time.Minute,
+	}, config.GetLoginThrottle())
+
+	_ = os.Setenv(loginFree, "3")
+	_ = os.Setenv(loginBackoff, "2")
+	_ = os.Setenv(loginLockoutAt, "0")
+	_ = os.Setenv(loginLockout, "60")
+	_ = os.Setenv(loginIpAttempts, "0")
+	_ = os.Setenv(loginWindow, "3600")
+	config, err = service.GetConfiguration()
+	ok(t, err)
+	equals(t, service.LoginThrottle{
+		FreeAttempts: 3,
+		Backoff:      2 * time.Second,
+		Lockout:      time.Minute,
+		Window:       time.Hour,
+	}, config.GetLoginThrottle())
+
+	_ = os.Setenv(loginLockoutAt, "3")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+
+	_ = os.Setenv(loginLockoutAt, "")
+	_ = os.Setenv(loginWindow, "-1")
+	_, err = service.GetConfiguration()
+	notOk(t, err)
+	clearLoginThrottleEnv()
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+)
+
+// confirmIdentityRequest is sent by a signed in user to prove they own the account before a sensitive action, since an
+// access token alone may have been stolen.
+type confirmIdentityRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// confirmIdentity checks the password given by a signed in user, along with their TOTP or recovery code if they have
+// enabled two-factor authentication. Errors are ErrorResponse values suitable for rendering.
+func confirmIdentity(r *http.Request, userId string, req confirmIdentityRequest) error {
+	err := confirmPassword(r, userId, req.Password)
+
+	if err != nil {
+		return err
+	}
+
+	userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+	if !ok {
+		return NewInternalServerErr("internal error")
+	}
+
+	return confirmSecondFactor(userRepo, userId, req.Code, req.RecoveryCode)
+}
+
+// confirmPassword checks the password a signed in user gave to confirm a sensitive action. Wrong passwords count as
+// failed logins, so an access token can't be used to guess the password any faster than logging in. Errors are
+// ErrorResponse values suitable for rendering.
+func confirmPassword(r *http.Request, userId string, password string) error {
+	if password == "" {
+		return NewBadRequestErr("password is required")
+	}
+
+	config, ok := r.Context().Value("config").(Configuration)
+
+	if !ok {
+		return NewInternalServerErr("internal error")
+	}
+
+	userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+	if !ok {
+		return NewInternalServerErr("internal error")
+	}
+
+	// The email in the token may predate an earlier change.
+	user, err := userRepo.GetUser(userId)
+
+	if errors.Is(err, errUserNotFound) {
+		return NewUnauthorizedErr("unauthorized")
+	} else if err != nil {
+		return NewInternalServerErr("repo error")
+	}
+
+	err = checkLoginThrottle(r, config, userRepo, user.Email)
+
+	if err != nil {
+		return err
+	}
+
+	authenticated, err := userRepo.Authenticate(user.Email, password)
+
+	if err != nil && !errors.Is(err, errAccountInactive) {
+		return NewInternalServerErr("repo error")
+	}
+
+	confirmed := authenticated.Id == user.Id
+	err = recordLoginResult(r, config, userRepo, user.Email, confirmed)
+
+	if err != nil {
+		return NewInternalServerErr("repo error")
+	} else if !confirmed {
+		return NewForbiddenErr("password is incorrect")
+	}
+
+	return checkAccountStatus(authenticated)
+}
+
+// confirmSecondFactor checks a TOTP or recovery code given by a signed in user to confirm a sensitive action, if they
+// have enabled two-factor authentication. Errors are ErrorResponse values suitable for rendering.
+func confirmSecondFactor(userRepo UserRepository, userId string, code string, recoveryCode string) error {
+	enrollment, err := userRepo.GetTotp(userId)
+
+	if errors.Is(err, errTotpNotFound) || (err == nil && !enrollment.Confirmed) {
+		return nil
+	} else if err != nil {
+		return NewInternalServerErr("repo error")
+	}
+
+	if code == "" && recoveryCode == "" {
+		return NewBadRequestErr("code or recoveryCode is required")
+	}
+
+	return checkSecondFactor(userRepo, userId, enrollment, code, recoveryCode)
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+	"time"
+)
+
+type restoreAccountRequest struct {
+	Token string `json:"token"`
+}
+
+// DeleteAccountMiddleware middleware to delete a user's account. The account can't be used from then on but can be
+// restored until the configured grace period ends, after which it is purged along with everything stored for it. Users
+// may only delete their own account unless they are allowed to delete other users. The owner is emailed a link to
+// restore the account. Users deleting their own account must confirm their password, along with their second factor if
+// they have enabled two-factor authentication.
+func DeleteAccountMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		userId := chi.URLParam(r, "id")
+
+		if userId != caller.Id && !caller.HasPermission(DeleteUsersPermission) {
+			RenderResponse(w, r, NewForbiddenErr("forbidden"))
+			return
+		}
+
+		if userId == caller.Id {
+			var req confirmIdentityRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+
+			if err != nil {
+				RenderResponse(w, r, NewBadRequestErr("request body invalid"))
+				return
+			}
+
+			err = confirmIdentity(r, caller.Id, req)
+
+			if err != nil {
+				RenderError(w, r, err)
+				return
+			}
+		}
+
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		mailer, ok := r.Context().Value("mailer").(Mailer)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		user, err := userRepo.GetUser(userId)
+
+		if errors.Is(err, errUserNotFound) || (err == nil && user.Id == "") {
+			RenderResponse(w, r, NewNotFoundErr("user not found"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		} else if user.Status.State == AccountDeleted {
+			RenderResponse(w, r, NewConflictErr("account already deleted"))
+			return
+		}
+
+		grace := config.GetAccountDeletionGrace()
+		purgeAt := time.Now().Add(grace)
+		status := AccountStatus{State: AccountDeleted, PurgeAt: &purgeAt}
+		err = changeAccountStatus(r, user.Id, status, "", caller.Id)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		// Without a grace period the account is purged the next time deleted accounts are, so there's nothing to restore.
+		if grace > 0 {
+			err = sendRestoreEmail(config, userRepo, mailer, user, grace)
+
+			// The account is already deleted, an admin can still restore it if the owner changes their mind.
+			if err != nil {
+				log.Printf("Unable to send account restore email: %s", err.Error())
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), "accountStatus", accountStatusResponse{Status: status})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// sendRestoreEmail emails the owner of a deleted account a link to restore it within the grace period.
+func sendRestoreEmail(config Configuration, userRepo UserRepository, mailer Mailer, user User,
+	grace time.Duration) error {
+	token, err := issueActionToken(userRepo, user.Id, accountRestorePurpose, "", grace)
+
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Your account has been deleted",
+		Body: fmt.Sprintf("The account %s has been deleted and everything stored for it will be removed on %s. If "+
+			"you change your mind, follow the link below before then to restore it.\n\n%s", user.Username,
+			time.Now().Add(grace).Format("January 2, 2006"), actionLink(config, "/user/restore", token)),
+	})
+}
+
+// restoreAccount makes a deleted account whose grace period hasn't ended active again on behalf of changedBy. Errors
+// are ErrorResponse values suitable for rendering.
+func restoreAccount(r *http.Request, user User, changedBy string) (AccountStatus, error) {
+	if user.Status.State != AccountDeleted || (user.Status.PurgeAt != nil && !time.Now().Before(*user.Status.PurgeAt)) {
+		return AccountStatus{}, NewConflictErr("account can't be restored")
+	}
+
+	status := AccountStatus{State: AccountActive}
+	err := changeAccountStatus(r, user.Id, status, "", changedBy)
+
+	if err != nil {
+		return AccountStatus{}, err
+	}
+
+	return status, nil
+}
+
+// RestoreAccountMiddleware middleware to restore a deleted account using the token from the link emailed to its owner
+// when it was deleted.
+func RestoreAccountMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req restoreAccountRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil || req.Token == "" {
+			RenderResponse(w, r, NewBadRequestErr("token is required"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		actionToken, err := userRepo.ConsumeActionToken(hashOpaqueToken(req.Token), accountRestorePurpose)
+
+		if errors.Is(err, errActionTokenInvalid) {
+			RenderResponse(w, r, NewBadRequestErr("invalid or expired token"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		user, err := userRepo.GetUser(actionToken.UserId)
+
+		if errors.Is(err, errUserNotFound) || (err == nil && user.Id == "") {
+			RenderResponse(w, r, NewBadRequestErr("invalid or expired token"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		// Following the link proves the requester owns the account, so they are recorded as restoring it.
+		status, err := restoreAccount(r, user, user.Id)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "accountStatus", accountStatusResponse{Status: status})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RestoreUserMiddleware middleware to restore the deleted account of the user in the path before it is purged.
+func RestoreUserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		user, err := userRepo.GetUser(chi.URLParam(r, "id"))
+
+		if errors.Is(err, errUserNotFound) || (err == nil && user.Id == "") {
+			RenderResponse(w, r, NewNotFoundErr("user not found"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		status, err := restoreAccount(r, user, caller.Id)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "accountStatus", accountStatusResponse{Status: status})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// purgeUserData removes everything the session, OAuth and export repositories and the rate limit store hold for a user.
+// It must be done before the user repo removes the user, as the rows of the other repositories reference the user.
+func purgeUserData(userId string, sessionRepo SessionRepository, oauthRepo OAuthRepository, exportRepo ExportRepository,
+	rateLimitStore RateLimitStore) error {
+	// Deleted sessions are reported as revoked, so any tokens the user still holds stop working too.
+	err := sessionRepo.DeleteUserSessions(userId)
+
+	if err != nil {
+		return err
+	}
+
+	err = oauthRepo.DeleteUserAuthorizationCodes(userId)
+
+	if err != nil {
+		return err
+	}
+
+	err = exportRepo.DeleteUserExports(userId)
+
+	if err != nil {
+		return err
+	}
+
+	return rateLimitStore.ForgetUser(userId)
+}
+
+// PurgeDeletedUsers permanently removes every deleted user whose purge time is no later than now, along with everything
+// stored for them in each of the repositories. Returns the ids of the users removed. A user restored while being purged
+// keeps their account, though not what the other repositories held for it, which is all rebuilt as the account is used.
+func PurgeDeletedUsers(now time.Time, userRepo UserRepository, sessionRepo SessionRepository,
+	oauthRepo OAuthRepository, exportRepo ExportRepository, rateLimitStore RateLimitStore) ([]string, error) {
+	userIds, err := userRepo.GetUsersToPurge(now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	purged := make([]string, 0, len(userIds))
+
+	for _, userId := range userIds {
+		err = purgeUserData(userId, sessionRepo, oauthRepo, exportRepo, rateLimitStore)
+
+		if err != nil {
+			return purged, err
+		}
+
+		removed, err := userRepo.PurgeUser(userId, now)
+
+		if err != nil {
+			return purged, err
+		} else if removed {
+			purged = append(purged, userId)
+		}
+	}
+
+	return purged, nil
+}
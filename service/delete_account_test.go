@@ -0,0 +1,194 @@
+package service_test
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// newDeleteAccountTestServer constructs a session test server with the account deletion and restore routes, restricted
+// by permission as they are in main.go, returning it along with the id of the logged in user and of another user.
+func newDeleteAccountTestServer(t *testing.T) (*testServer, string, string) {
+	ts := newSessionTestServer(t)
+	ts.router.Route("/user", func(r chi.Router) {
+		r.With(service.RestoreAccountMiddleware).Post("/restore", service.UserStatus)
+		r.With(service.JwtAuthMiddleware).With(service.GetUserMiddleware).Get("/{id}", service.GetUser)
+		r.With(service.JwtAuthMiddleware).With(service.DeleteAccountMiddleware).Delete("/{id}", service.UserStatus)
+	})
+	ts.router.Route("/admin", func(r chi.Router) {
+		r.With(service.JwtAuthMiddleware).With(service.RequirePermission(service.DeleteUsersPermission)).
+			With(service.RestoreUserMiddleware).Post("/users/{id}/restore", service.UserStatus)
+	})
+
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+
+	otherId, err := ts.repo.NewUser("other@justinstone.net", "other", "password", service.FEMALE, 25, []string{})
+	ok(t, err)
+
+	return ts, user.Id, otherId
+}
+
+// TestDeleteAccount_Self ensures users can delete their own account once they confirm their password, which ends their
+// sessions and refuses logins until they restore it with the emailed link.
+func TestDeleteAccount_Self(t *testing.T) {
+	ts, id, _ := newDeleteAccountTestServer(t)
+	tokens := login(t, ts)
+
+	equals(t, http.StatusBadRequest, ts.do(t, http.MethodDelete, "/user/"+id, tokens.Token, nil, nil))
+	equals(t, http.StatusBadRequest, ts.do(t, http.MethodDelete, "/user/"+id, tokens.Token,
+		map[string]string{}, nil))
+	equals(t, http.StatusForbidden, ts.do(t, http.MethodDelete, "/user/"+id, tokens.Token,
+		map[string]string{"password": "wrong"}, nil))
+
+	var res accountStatusResponse
+	equals(t, http.StatusOK, ts.do(t, http.MethodDelete, "/user/"+id, tokens.Token,
+		map[string]string{"password": "password"}, &res))
+	equals(t, service.AccountDeleted, res.Status.State)
+	assert(t, res.Status.PurgeAt != nil && res.Status.PurgeAt.After(time.Now().Add(29*24*time.Hour)),
+		"expected the account to be purged after the grace period")
+
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodGet, "/user/"+id, tokens.Token, nil, nil))
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, nil))
+
+	refused := attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "password")
+	equals(t, http.StatusForbidden, refused.Code)
+	equals(t, "account_deleted", errorCode(t, refused.Body.Bytes()))
+
+	token := linkToken(t, ts.mailer.last(t), "/user/restore")
+	equals(t, http.StatusBadRequest, ts.do(t, http.MethodPost, "/user/restore", "",
+		map[string]string{"token": "invalid"}, nil))
+
+	res = accountStatusResponse{}
+	equals(t, http.StatusOK, ts.do(t, http.MethodPost, "/user/restore", "", map[string]string{"token": token}, &res))
+	equals(t, service.AccountActive, res.Status.State)
+	equals(t, http.StatusBadRequest, ts.do(t, http.MethodPost, "/user/restore", "",
+		map[string]string{"token": token}, nil))
+
+	tokens = login(t, ts)
+	equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/user/"+id, tokens.Token, nil, nil))
+
+	history, err := ts.repo.GetAccountStatusHistory(id)
+	ok(t, err)
+	equals(t, 2, len(history))
+	equals(t, id, history[0].ChangedBy)
+	equals(t, id, history[1].ChangedBy)
+}
+
+// TestDeleteAccount_Other ensures only users allowed to delete other users can, after which the account is hidden
+// from everyone else, and that admins can restore it.
+func TestDeleteAccount_Other(t *testing.T) {
+	ts, id, otherId := newDeleteAccountTestServer(t)
+	tokens := login(t, ts)
+	adminId, admin := loginAdmin(t, ts)
+
+	equals(t, http.StatusForbidden, ts.do(t, http.MethodDelete, "/user/"+otherId, tokens.Token, nil, nil))
+	equals(t, http.StatusForbidden, ts.do(t, http.MethodPost, "/admin/users/"+otherId+"/restore", tokens.Token, nil,
+		nil))
+	equals(t, http.StatusNotFound, ts.do(t, http.MethodPost, "/admin/users/missing/restore", admin, nil, nil))
+
+	ok(t, ts.repo.SetRoles(id, []string{service.AdminRole}))
+	tokens = login(t, ts)
+
+	equals(t, http.StatusOK, ts.do(t, http.MethodDelete, "/user/"+otherId, tokens.Token, nil, nil))
+	equals(t, http.StatusConflict, ts.do(t, http.MethodDelete, "/user/"+otherId, tokens.Token, nil, nil))
+	equals(t, http.StatusNotFound, ts.do(t, http.MethodDelete, "/user/missing", tokens.Token, nil, nil))
+	equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/user/"+otherId, tokens.Token, nil, nil))
+
+	ok(t, ts.repo.SetRoles(id, []string{}))
+	tokens = login(t, ts)
+	equals(t, http.StatusNotFound, ts.do(t, http.MethodGet, "/user/"+otherId, tokens.Token, nil, nil))
+
+	equals(t, http.StatusOK, ts.do(t, http.MethodPost, "/admin/users/"+otherId+"/restore", admin, nil, nil))
+	equals(t, http.StatusConflict, ts.do(t, http.MethodPost, "/admin/users/"+otherId+"/restore", admin, nil, nil))
+	equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/user/"+otherId, tokens.Token, nil, nil))
+
+	history, err := ts.repo.GetAccountStatusHistory(otherId)
+	ok(t, err)
+	equals(t, 2, len(history))
+	equals(t, id, history[0].ChangedBy)
+	equals(t, adminId, history[1].ChangedBy)
+}
+
+// TestDeleteAccount_Purge ensures accounts can't be restored once their grace period has ended, and are then purged.
+func TestDeleteAccount_Purge(t *testing.T) {
+	ts, _, otherId := newDeleteAccountTestServer(t)
+	_, admin := loginAdmin(t, ts)
+	ended := time.Now().Add(-time.Minute)
+
+	ok(t, ts.repo.SetAccountStatus(otherId, service.AccountStatus{State: service.AccountDeleted, PurgeAt: &ended}, "",
+		otherId))
+	equals(t, http.StatusConflict, ts.do(t, http.MethodPost, "/admin/users/"+otherId+"/restore", admin, nil, nil))
+
+	purged, err := service.PurgeDeletedUsers(time.Now(), ts.repo, ts.sessionRepo, ts.oauthRepo, ts.exportRepo,
+		ts.rateLimits)
+	ok(t, err)
+	equals(t, []string{otherId}, purged)
+
+	equals(t, http.StatusNotFound, ts.do(t, http.MethodPost, "/admin/users/"+otherId+"/restore", admin, nil, nil))
+	_, err = ts.repo.GetUserByEmail("other@justinstone.net")
+	notOk(t, err)
+}
+
+// TestDeleteAccount_PurgeEverything ensures purging a user removes what every repository holds for them, leaving other
+// users' data alone.
+func TestDeleteAccount_PurgeEverything(t *testing.T) {
+	ts, id, otherId := newDeleteAccountTestServer(t)
+	limit := service.RateLimit{Requests: 1, Period: time.Hour}
+
+	var tokens sessionTokens
+	status := ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "other@justinstone.net", "password": "password"}, &tokens)
+	equals(t, http.StatusOK, status)
+	login(t, ts)
+
+	for _, userId := range []string{id, otherId} {
+		ok(t, ts.oauthRepo.AddAuthorizationCode(service.AuthorizationCode{CodeHash: "code-" + userId, ClientId: "client",
+			UserId: userId, ExpiresAt: time.Now().Add(time.Minute)}))
+
+		_, started, err := ts.exportRepo.StartExport(userId, service.ExportJson, time.Hour)
+		ok(t, err)
+		assert(t, started, "expected export to start")
+
+		wait, err := ts.rateLimits.Take("export:user:"+userId, limit)
+		ok(t, err)
+		equals(t, time.Duration(0), wait)
+	}
+
+	ended := time.Now().Add(-time.Minute)
+	ok(t, ts.repo.SetAccountStatus(otherId, service.AccountStatus{State: service.AccountDeleted, PurgeAt: &ended}, "",
+		otherId))
+
+	purged, err := service.PurgeDeletedUsers(time.Now(), ts.repo, ts.sessionRepo, ts.oauthRepo, ts.exportRepo,
+		ts.rateLimits)
+	ok(t, err)
+	equals(t, []string{otherId}, purged)
+
+	sessions, err := ts.sessionRepo.GetUserSessions(otherId)
+	ok(t, err)
+	equals(t, 0, len(sessions))
+	_, err = ts.oauthRepo.ConsumeAuthorizationCode("code-" + otherId)
+	notOk(t, err)
+	_, started, err := ts.exportRepo.StartExport(otherId, service.ExportJson, time.Hour)
+	ok(t, err)
+	assert(t, started, "expected the previous export to be gone")
+	wait, err := ts.rateLimits.Take("export:user:"+otherId, limit)
+	ok(t, err)
+	equals(t, time.Duration(0), wait)
+
+	// The other user's data is untouched
+	sessions, err = ts.sessionRepo.GetUserSessions(id)
+	ok(t, err)
+	equals(t, 1, len(sessions))
+	_, err = ts.oauthRepo.ConsumeAuthorizationCode("code-" + id)
+	ok(t, err)
+	_, started, err = ts.exportRepo.StartExport(id, service.ExportJson, time.Hour)
+	ok(t, err)
+	assert(t, !started, "expected the existing export to be kept")
+	wait, err = ts.rateLimits.Take("export:user:"+id, limit)
+	ok(t, err)
+	assert(t, wait > 0, "expected the rate limit to be kept")
+}
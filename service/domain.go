@@ -1,15 +1,69 @@
 package service
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 // User holds information on a user.
 type User struct {
 	Id       string `json:"id"`
 	Email    string `json:"email"`
 	Username string `json:"username"`
+	// EmailVerified reports whether the user has confirmed they own Email
+	EmailVerified bool `json:"emailVerified"`
+	// Roles are the names of the roles granted to the user, see HasPermission
+	Roles []string `json:"roles,omitempty"`
+	// Status reports whether the user may use their account
+	Status AccountStatus `json:"status"`
+	UserProfile
+}
+
+// AccountState is the state of a user's account.
+type AccountState string
+
+const (
+	// AccountActive accounts can be used normally. Accounts with no state are active.
+	AccountActive AccountState = "active"
+	// AccountSuspended accounts can't be used until their suspension ends.
+	AccountSuspended AccountState = "suspended"
+	// AccountDisabled accounts can't be used until an admin makes them active again.
+	AccountDisabled AccountState = "disabled"
+	// AccountDeleted accounts can't be used, their owner deleted them or had them deleted.
+	AccountDeleted AccountState = "deleted"
+)
+
+// AccountStatus holds the state of a user's account, when the suspension of suspended accounts ends and when deleted
+// accounts are purged.
+type AccountStatus struct {
+	State          AccountState `json:"state"`
+	SuspendedUntil *time.Time   `json:"suspendedUntil,omitempty"`
+	// PurgeAt is when a deleted account stops being restorable and everything stored for it is removed
+	PurgeAt *time.Time `json:"purgeAt,omitempty"`
+}
+
+// Effective returns the state of the account at the given time, suspensions that have ended and missing states being
+// active.
+func (as AccountStatus) Effective(now time.Time) AccountState {
+	if as.State == "" || (as.State == AccountSuspended && as.SuspendedUntil != nil && !now.Before(*as.SuspendedUntil)) {
+		return AccountActive
+	}
+
+	return as.State
+}
+
+// PublicUser is the view of a user shown to other users, leaving out their email address and roles.
+type PublicUser struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
 	UserProfile
 }
 
+// Public returns the view of the user shown to other users.
+func (u User) Public() PublicUser {
+	return PublicUser{u.Id, u.Username, u.UserProfile}
+}
+
 type Gender string
 
 const (
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"net/http"
+)
+
+type endSessionResponse struct {
+}
+
+func (esr endSessionResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// EndSessionMiddleware middleware to revoke the session the request was authenticated with
+func EndSessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionId, ok := r.Context().Value("sessionId").(string)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		err := sessionRepo.RevokeSession(sessionId)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = userRepo.RevokeRefreshTokenFamily(sessionId)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// EndAllSessionsMiddleware middleware to revoke every session belonging to the authenticated user
+func EndAllSessionsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		// Refresh tokens are checked against their session when exchanged, so revoking the sessions is sufficient.
+		err := sessionRepo.RevokeUserSessions(user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// EndSession renders the response to a logout request.
+func EndSession(w http.ResponseWriter, r *http.Request) {
+	RenderResponse(w, r, endSessionResponse{})
+}
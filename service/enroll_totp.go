@@ -0,0 +1,270 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type enrollTotpResponse struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+func (etr enrollTotpResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+type totpResponse struct {
+	Enabled       bool     `json:"enabled"`
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+func (tr totpResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// checkTotpCode validates a code against a user's TOTP secret, recording its time step so it can't be used again.
+// Errors are ErrorResponse values suitable for rendering.
+func checkTotpCode(userRepo UserRepository, userId string, enrollment TotpEnrollment, code string) error {
+	counter, valid := validateTotp(enrollment.Secret, code, time.Now())
+
+	if !valid {
+		return NewUnauthorizedErr("code invalid")
+	}
+
+	err := userRepo.UseTotpCounter(userId, counter)
+
+	if errors.Is(err, errTotpCodeReused) {
+		return NewUnauthorizedErr("code invalid")
+	} else if err != nil {
+		return NewInternalServerErr("repo error")
+	}
+
+	return nil
+}
+
+// decodeTotpCodeRequest reads the code from the request body.
+func decodeTotpCodeRequest(r *http.Request) (string, error) {
+	var req totpCodeRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		return "", NewBadRequestErr("request body invalid")
+	} else if req.Code == "" {
+		return "", NewBadRequestErr("code is required")
+	}
+
+	return req.Code, nil
+}
+
+// EnrollTotpMiddleware middleware to generate a new, unconfirmed TOTP secret for the authenticated user
+func EnrollTotpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewUnauthorizedErr("unauthorized"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("repo not found"))
+			return
+		}
+
+		enrollment, err := userRepo.GetTotp(user.Id)
+
+		if err == nil && enrollment.Confirmed {
+			RenderResponse(w, r, NewBadRequestErr("totp already enabled"))
+			return
+		} else if err != nil && !errors.Is(err, errTotpNotFound) {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		secret, err := newTotpSecret()
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		err = userRepo.SetTotpSecret(user.Id, secret)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		res := enrollTotpResponse{secret, totpProvisioningUri(user.Email, secret)}
+		ctx := context.WithValue(r.Context(), "totpEnrollment", res)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// EnrollTotp renders the new secret and the uri for adding it to an authenticator app.
+func EnrollTotp(w http.ResponseWriter, r *http.Request) {
+	res, ok := r.Context().Value("totpEnrollment").(enrollTotpResponse)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, res)
+}
+
+// ConfirmTotpMiddleware middleware to enable the authenticated user's pending TOTP secret once they prove their
+// authenticator produces valid codes for it
+func ConfirmTotpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, err := decodeTotpCodeRequest(r)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		user, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewUnauthorizedErr("unauthorized"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("repo not found"))
+			return
+		}
+
+		enrollment, err := userRepo.GetTotp(user.Id)
+
+		if errors.Is(err, errTotpNotFound) {
+			RenderResponse(w, r, NewBadRequestErr("totp not enrolled"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		} else if enrollment.Confirmed {
+			RenderResponse(w, r, NewBadRequestErr("totp already enabled"))
+			return
+		}
+
+		counter, valid := validateTotp(enrollment.Secret, code, time.Now())
+
+		if !valid {
+			RenderResponse(w, r, NewUnauthorizedErr("code invalid"))
+			return
+		}
+
+		err = userRepo.ConfirmTotp(user.Id, counter)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		codes, err := issueRecoveryCodes(userRepo, user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "totpEnabled", true)
+		ctx = context.WithValue(ctx, "recoveryCodes", codes)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RemoveTotpMiddleware middleware to disable TOTP for the authenticated user, requiring a valid code or recovery code
+// to do so
+func RemoveTotpMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeSecondFactorRequest(r)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		user, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewUnauthorizedErr("unauthorized"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("repo not found"))
+			return
+		}
+
+		enrollment, err := userRepo.GetTotp(user.Id)
+
+		if errors.Is(err, errTotpNotFound) || (err == nil && !enrollment.Confirmed) {
+			RenderResponse(w, r, NewBadRequestErr("totp not enabled"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = checkSecondFactor(userRepo, user.Id, enrollment, req.Code, req.RecoveryCode)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		err = userRepo.RemoveTotp(user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = userRepo.SetRecoveryCodes(user.Id, nil)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "totpEnabled", false)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// TotpStatus renders whether TOTP is now enabled for the user, along with any recovery codes issued.
+func TotpStatus(w http.ResponseWriter, r *http.Request) {
+	enabled, ok := r.Context().Value("totpEnabled").(bool)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	codes, _ := r.Context().Value("recoveryCodes").([]string)
+
+	RenderResponse(w, r, totpResponse{enabled, codes})
+}
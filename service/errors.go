@@ -2,20 +2,37 @@ package service
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type ErrorResponse struct {
 	Status  int    `json:"status"`
 	Message string `json:"message"`
+	// Code is a machine readable reason for the error, set when callers need to tell errors of the same status apart
+	Code       string              `json:"code,omitempty"`
+	Violations []PasswordViolation `json:"violations,omitempty"`
+	// RetryAfter is sent in the Retry-After header when set
+	RetryAfter time.Duration `json:"-"`
 }
 
 func (er ErrorResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	if er.RetryAfter > 0 {
+		setRetryAfter(w, er.RetryAfter)
+	}
+
 	w.WriteHeader(er.Status)
 
 	return nil
 }
 
+// setRetryAfter tells the caller how long to wait before trying again, rounded up to whole seconds.
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+}
+
 func (er ErrorResponse) Error() string {
 	return fmt.Sprintf("%d: %s", er.Status, er.Message)
 }
@@ -47,3 +64,46 @@ func NewUnauthorizedErr(message string) ErrorResponse {
 		Message: message,
 	}
 }
+
+func NewForbiddenErr(message string) ErrorResponse {
+	return ErrorResponse{
+		Status:  http.StatusForbidden,
+		Message: message,
+	}
+}
+
+func NewConflictErr(message string) ErrorResponse {
+	return ErrorResponse{
+		Status:  http.StatusConflict,
+		Message: message,
+	}
+}
+
+// NewPasswordPolicyErr returns an error listing the rules of the password policy a password breaks.
+func NewPasswordPolicyErr(violations []PasswordViolation) ErrorResponse {
+	return ErrorResponse{
+		Status:     http.StatusBadRequest,
+		Message:    "password does not meet policy",
+		Violations: violations,
+	}
+}
+
+// NewTooManyRequestsErr returns an error telling the caller to wait for retryAfter before trying again.
+func NewTooManyRequestsErr(message string, retryAfter time.Duration) ErrorResponse {
+	return ErrorResponse{
+		Status:     http.StatusTooManyRequests,
+		Message:    message,
+		RetryAfter: retryAfter,
+	}
+}
+
+// NewAccountStatusErr returns an error refusing a user whose account isn't active, code giving the reason. A suspended
+// account's retryAfter is when the suspension ends.
+func NewAccountStatusErr(message string, code string, retryAfter time.Duration) ErrorResponse {
+	return ErrorResponse{
+		Status:     http.StatusForbidden,
+		Message:    message,
+		Code:       code,
+		RetryAfter: retryAfter,
+	}
+}
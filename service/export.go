@@ -0,0 +1,318 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	// exportTtl is how long a generated export can be downloaded before it is discarded. It only needs to outlast the
+	// generation of large exports, and keeping it short means a later request soon reflects changes to the account.
+	exportTtl = 15 * time.Minute
+	// exportWait is how long a request waits for the export it started, so most accounts get their archive straight
+	// away and only large ones have to come back for it.
+	exportWait = 5 * time.Second
+	// exportRetryAfter is how long callers are asked to wait before requesting a pending export again.
+	exportRetryAfter = 10 * time.Second
+)
+
+// userDataExport is the archive of everything stored about a user.
+type userDataExport struct {
+	GeneratedAt time.Time `json:"generatedAt"`
+	// User holds the account and profile along with when the account was created and last updated
+	User UserRecord `json:"user"`
+	// Sessions holds every successful login, when it started, the OAuth client it was made through and when it ended
+	Sessions []Session `json:"sessions"`
+	// FailedLogins counts the failed logins to the account since the last successful one, individual failures aren't
+	// recorded
+	FailedLogins LoginFailures        `json:"failedLogins"`
+	Passkeys     []WebAuthnCredential `json:"passkeys"`
+	TwoFactor    twoFactorExport      `json:"twoFactor"`
+	Audit        auditExport          `json:"audit"`
+}
+
+type twoFactorExport struct {
+	TotpEnabled bool `json:"totpEnabled"`
+	// RecoveryCodesRemaining counts the unused recovery codes, the codes themselves are only stored hashed
+	RecoveryCodesRemaining int `json:"recoveryCodesRemaining"`
+}
+
+// auditExport holds the changes to a user's account that are recorded. Changes to passwords, email addresses and
+// second factors aren't, so only their current state is exported.
+type auditExport struct {
+	UsernameChanges []UsernameChange      `json:"usernameChanges"`
+	StatusChanges   []AccountStatusChange `json:"statusChanges"`
+}
+
+type dataExportResponse struct {
+	Export DataExport `json:"export"`
+}
+
+func (der dataExportResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	setRetryAfter(w, exportRetryAfter)
+	w.WriteHeader(http.StatusAccepted)
+
+	return nil
+}
+
+// collectUserData gathers everything stored about a user. Secrets, such as password hashes, TOTP secrets and recovery
+// codes, are left out.
+func collectUserData(userRepo UserRepository, sessionRepo SessionRepository, userId string) (userDataExport, error) {
+	data := userDataExport{GeneratedAt: time.Now()}
+	var err error
+
+	data.User, err = userRepo.GetUserRecord(userId)
+
+	if err != nil {
+		return userDataExport{}, err
+	}
+
+	data.Sessions, err = sessionRepo.GetUserSessions(userId)
+
+	if err != nil {
+		return userDataExport{}, err
+	}
+
+	sort.Slice(data.Sessions, func(i, j int) bool {
+		return data.Sessions[i].CreatedAt.Before(data.Sessions[j].CreatedAt)
+	})
+
+	data.FailedLogins, err = userRepo.GetLoginFailures(accountThrottleKey(data.User.Email))
+
+	if err != nil {
+		return userDataExport{}, err
+	}
+
+	data.Passkeys, err = userRepo.GetWebAuthnCredentials(userId)
+
+	if err != nil {
+		return userDataExport{}, err
+	}
+
+	enrollment, err := userRepo.GetTotp(userId)
+
+	if err != nil && !errors.Is(err, errTotpNotFound) {
+		return userDataExport{}, err
+	}
+
+	data.TwoFactor.TotpEnabled = err == nil && enrollment.Confirmed
+
+	codes, err := userRepo.GetRecoveryCodes(userId)
+
+	if err != nil {
+		return userDataExport{}, err
+	}
+
+	for _, code := range codes {
+		if code.UsedAt == nil {
+			data.TwoFactor.RecoveryCodesRemaining++
+		}
+	}
+
+	data.Audit.UsernameChanges, err = userRepo.GetUsernameHistory(userId)
+
+	if err != nil {
+		return userDataExport{}, err
+	}
+
+	data.Audit.StatusChanges, err = userRepo.GetAccountStatusHistory(userId)
+
+	if err != nil {
+		return userDataExport{}, err
+	}
+
+	return data, nil
+}
+
+// exportFileName is the name an export's archive is downloaded as.
+func exportFileName(export DataExport) string {
+	return fmt.Sprintf("%s-export-%s.%s", serviceName, export.UserId, export.Format)
+}
+
+// buildArchive encodes a user's data in the format of the export.
+func buildArchive(data userDataExport, export DataExport) ([]byte, error) {
+	document, err := json.MarshalIndent(data, "", "  ")
+
+	if err != nil || export.Format == ExportJson {
+		return document, err
+	}
+
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	file, err := writer.Create(fmt.Sprintf("%s-export-%s.json", serviceName, export.UserId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.Write(document)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return archive.Bytes(), nil
+}
+
+// generateExport gathers a user's data and stores the archive of a pending export. Nobody is waiting on the result,
+// so errors are logged and the export marked failed, letting the next request for it start again.
+func generateExport(userRepo UserRepository, sessionRepo SessionRepository, exportRepo ExportRepository,
+	export DataExport) {
+	data, err := collectUserData(userRepo, sessionRepo, export.UserId)
+
+	var archive []byte
+
+	if err == nil {
+		archive, err = buildArchive(data, export)
+	}
+
+	if err == nil {
+		err = exportRepo.CompleteExport(export.Id, archive)
+	}
+
+	if err != nil {
+		log.Printf("Unable to export user data: %s", err.Error())
+
+		err = exportRepo.FailExport(export.Id)
+
+		if err != nil && !errors.Is(err, errExportNotFound) {
+			log.Printf("Unable to record failed export: %s", err.Error())
+		}
+	}
+}
+
+// ExportUserMiddleware middleware to export everything stored about a user, as JSON or, with format=zip, a zip file
+// holding the JSON. Exports are generated in the background and kept for a few minutes, the request starting one waits
+// a short while for it to finish. If it takes longer, the caller repeats the request until the archive is ready.
+func ExportUserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var format ExportFormat
+
+		switch r.URL.Query().Get("format") {
+		case "", string(ExportJson):
+			format = ExportJson
+		case string(ExportZip):
+			format = ExportZip
+		default:
+			RenderResponse(w, r, NewBadRequestErr("format must be json or zip"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		exportRepo, ok := r.Context().Value("exportRepo").(ExportRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		user, err := userRepo.GetUser(chi.URLParam(r, "id"))
+
+		if errors.Is(err, errUserNotFound) || (err == nil && user.Id == "") {
+			RenderResponse(w, r, NewNotFoundErr("user not found"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		export, started, err := exportRepo.StartExport(user.Id, format, exportTtl)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		if started {
+			done := make(chan struct{})
+
+			go func() {
+				generateExport(userRepo, sessionRepo, exportRepo, export)
+				close(done)
+			}()
+
+			// The export carries on in the background if the request times out first.
+			select {
+			case <-done:
+			case <-time.After(exportWait):
+			case <-r.Context().Done():
+			}
+
+			export, err = exportRepo.GetExport(export.Id)
+
+			if err != nil {
+				RenderResponse(w, r, NewInternalServerErr("repo error"))
+				return
+			}
+		}
+
+		if export.State == ExportFailed {
+			RenderResponse(w, r, NewInternalServerErr("export failed"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "export", export)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ExportUser sends the archive of a ready export, or tells the caller to come back for one still being generated.
+func ExportUser(w http.ResponseWriter, r *http.Request) {
+	export, ok := r.Context().Value("export").(DataExport)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if export.State != ExportReady {
+		RenderResponse(w, r, dataExportResponse{export})
+		return
+	}
+
+	contentType := "application/json"
+
+	if export.Format == ExportZip {
+		contentType = "application/zip"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFileName(export)))
+	w.WriteHeader(http.StatusOK)
+
+	_, err := w.Write(export.Archive)
+
+	if err != nil {
+		log.Println(err)
+	}
+}
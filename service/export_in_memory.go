@@ -0,0 +1,136 @@
+package service
+
+import (
+	"github.com/twinj/uuid"
+	"sync"
+	"time"
+)
+
+type inMemoryExportRepository struct {
+	mutex   sync.RWMutex
+	exports map[string]*DataExport
+}
+
+// StartExport records a pending export of a user's data, unless they already have one in the format.
+func (imer *inMemoryExportRepository) StartExport(userId string, format ExportFormat, ttl time.Duration) (DataExport,
+	bool, error) {
+	if userId == "" {
+		return DataExport{}, false, newErrRepository("userId is required")
+	} else if format == "" {
+		return DataExport{}, false, newErrRepository("format is required")
+	}
+
+	imer.mutex.Lock()
+	defer imer.mutex.Unlock()
+
+	now := time.Now()
+
+	for id, export := range imer.exports {
+		if !usableExport(export, now) {
+			delete(imer.exports, id)
+		} else if export.UserId == userId && export.Format == format {
+			return *export, false, nil
+		}
+	}
+
+	export := &DataExport{
+		Id:          uuid.NewV4().String(),
+		UserId:      userId,
+		Format:      format,
+		State:       ExportPending,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(ttl),
+	}
+	imer.exports[export.Id] = export
+
+	return *export, true, nil
+}
+
+// usableExport reports whether an export can still be served or is still being generated at the given time.
+func usableExport(export *DataExport, now time.Time) bool {
+	return now.Before(export.ExpiresAt) && export.State != ExportFailed &&
+		(export.State != ExportPending || now.Before(export.RequestedAt.Add(exportGenerationTimeout)))
+}
+
+// GetExport retrieves the unexpired export with the given id.
+func (imer *inMemoryExportRepository) GetExport(exportId string) (DataExport, error) {
+	if exportId == "" {
+		return DataExport{}, newErrRepository("exportId is required")
+	}
+
+	imer.mutex.RLock()
+	defer imer.mutex.RUnlock()
+
+	export, ok := imer.exports[exportId]
+	if !ok || !time.Now().Before(export.ExpiresAt) {
+		return DataExport{}, errExportNotFound
+	}
+
+	return *export, nil
+}
+
+// CompleteExport stores the generated archive of a pending export.
+func (imer *inMemoryExportRepository) CompleteExport(exportId string, archive []byte) error {
+	if exportId == "" {
+		return newErrRepository("exportId is required")
+	}
+
+	imer.mutex.Lock()
+	defer imer.mutex.Unlock()
+
+	export, ok := imer.exports[exportId]
+	if !ok || export.State != ExportPending {
+		return errExportNotFound
+	}
+
+	now := time.Now()
+	export.State = ExportReady
+	export.CompletedAt = &now
+	export.Archive = archive
+
+	return nil
+}
+
+// FailExport records that a pending export couldn't be generated.
+func (imer *inMemoryExportRepository) FailExport(exportId string) error {
+	if exportId == "" {
+		return newErrRepository("exportId is required")
+	}
+
+	imer.mutex.Lock()
+	defer imer.mutex.Unlock()
+
+	export, ok := imer.exports[exportId]
+	if !ok || export.State != ExportPending {
+		return errExportNotFound
+	}
+
+	now := time.Now()
+	export.State = ExportFailed
+	export.CompletedAt = &now
+
+	return nil
+}
+
+// DeleteUserExports removes every export of the given user's data.
+func (imer *inMemoryExportRepository) DeleteUserExports(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imer.mutex.Lock()
+	defer imer.mutex.Unlock()
+
+	for id, export := range imer.exports {
+		if export.UserId == userId {
+			delete(imer.exports, id)
+		}
+	}
+
+	return nil
+}
+
+// MakeInMemoryExportRepository constructs an in memory backed ExportRepository.
+func MakeInMemoryExportRepository() ExportRepository {
+	return &inMemoryExportRepository{exports: make(map[string]*DataExport)}
+}
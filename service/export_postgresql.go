@@ -0,0 +1,143 @@
+package service
+
+import (
+	"database/sql"
+	"github.com/twinj/uuid"
+	"time"
+)
+
+const (
+	discardExports = "DELETE FROM data_export WHERE expires_at <= now() OR state='failed' OR (state='pending' AND requested_at <= now() - $1 * interval '1 second')"
+	insertExport   = "INSERT INTO data_export (id, user_id, format, state, requested_at, expires_at) VALUES ($1, $2, $3, 'pending', now(), now() + $4 * interval '1 second') ON CONFLICT (user_id, format) DO NOTHING RETURNING requested_at, expires_at"
+	getUserExport  = "SELECT id, user_id, format, state, requested_at, completed_at, expires_at, archive FROM data_export WHERE user_id=$1 AND format=$2"
+	getExport      = "SELECT id, user_id, format, state, requested_at, completed_at, expires_at, archive FROM data_export WHERE id=$1 AND expires_at > now()"
+	completeExport = "UPDATE data_export SET state='ready', completed_at=now(), archive=$2 WHERE id=$1 AND state='pending'"
+	failExport     = "UPDATE data_export SET state='failed', completed_at=now() WHERE id=$1 AND state='pending'"
+	deleteExports  = "DELETE FROM data_export WHERE user_id=$1"
+)
+
+type postgresqlExportRepository struct {
+	db *sql.DB
+}
+
+// StartExport records a pending export of a user's data, unless they already have one in the format.
+func (per *postgresqlExportRepository) StartExport(userId string, format ExportFormat, ttl time.Duration) (DataExport,
+	bool, error) {
+	if userId == "" {
+		return DataExport{}, false, newErrRepository("userId is required")
+	} else if format == "" {
+		return DataExport{}, false, newErrRepository("format is required")
+	}
+
+	_, err := per.db.Exec(discardExports, exportGenerationTimeout.Seconds())
+
+	if err != nil {
+		return DataExport{}, false, err
+	}
+
+	export := DataExport{Id: uuid.NewV4().String(), UserId: userId, Format: format, State: ExportPending}
+
+	err = per.db.QueryRow(insertExport, export.Id, userId, format, ttl.Seconds()).Scan(&export.RequestedAt,
+		&export.ExpiresAt)
+
+	if err == nil {
+		return export, true, nil
+	} else if err != sql.ErrNoRows {
+		return DataExport{}, false, err
+	}
+
+	// The user already has an export in the format.
+	export, err = scanExport(per.db.QueryRow(getUserExport, userId, format))
+
+	if err == sql.ErrNoRows {
+		return DataExport{}, false, errExportNotFound
+	}
+
+	return export, false, err
+}
+
+// GetExport retrieves the unexpired export with the given id.
+func (per *postgresqlExportRepository) GetExport(exportId string) (DataExport, error) {
+	if exportId == "" {
+		return DataExport{}, newErrRepository("exportId is required")
+	}
+
+	export, err := scanExport(per.db.QueryRow(getExport, exportId))
+
+	if err == sql.ErrNoRows {
+		return DataExport{}, errExportNotFound
+	}
+
+	return export, err
+}
+
+// CompleteExport stores the generated archive of a pending export.
+func (per *postgresqlExportRepository) CompleteExport(exportId string, archive []byte) error {
+	if exportId == "" {
+		return newErrRepository("exportId is required")
+	}
+
+	return per.finishExport(completeExport, exportId, archive)
+}
+
+// FailExport records that a pending export couldn't be generated.
+func (per *postgresqlExportRepository) FailExport(exportId string) error {
+	if exportId == "" {
+		return newErrRepository("exportId is required")
+	}
+
+	return per.finishExport(failExport, exportId)
+}
+
+// DeleteUserExports removes every export of the given user's data.
+func (per *postgresqlExportRepository) DeleteUserExports(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	_, err := per.db.Exec(deleteExports, userId)
+
+	return err
+}
+
+// finishExport moves a pending export out of the pending state with query, returning errExportNotFound if it is no
+// longer pending.
+func (per *postgresqlExportRepository) finishExport(query string, args ...interface{}) error {
+	result, err := per.db.Exec(query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errExportNotFound
+	}
+
+	return nil
+}
+
+func scanExport(row rowScanner) (DataExport, error) {
+	var export DataExport
+
+	err := row.Scan(
+		&export.Id,
+		&export.UserId,
+		&export.Format,
+		&export.State,
+		&export.RequestedAt,
+		&export.CompletedAt,
+		&export.ExpiresAt,
+		&export.Archive,
+	)
+
+	return export, err
+}
+
+// MakePostgresqlExportRepository constructs a PostgreSQL backed ExportRepository from the given db.
+func MakePostgresqlExportRepository(db *sql.DB) ExportRepository {
+	return &postgresqlExportRepository{db}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"database/sql"
+	"time"
+)
+
+// errExportNotFound is returned when no export exists with a given id.
+var errExportNotFound = newErrRepository("export not found")
+
+// exportGenerationTimeout is how long an export may stay pending before it is assumed to have failed, such as when the
+// instance generating it stopped.
+const exportGenerationTimeout = 10 * time.Minute
+
+// ExportFormat is the format of the archive an export produces.
+type ExportFormat string
+
+const (
+	// ExportJson archives are a single JSON document.
+	ExportJson ExportFormat = "json"
+	// ExportZip archives are a zip file holding the JSON document.
+	ExportZip ExportFormat = "zip"
+)
+
+// ExportState is the state of the generation of an export.
+type ExportState string
+
+const (
+	// ExportPending exports are still being generated.
+	ExportPending ExportState = "pending"
+	// ExportReady exports have been generated and their archive can be downloaded.
+	ExportReady ExportState = "ready"
+	// ExportFailed exports couldn't be generated, requesting the export again starts a new one.
+	ExportFailed ExportState = "failed"
+)
+
+// DataExport is an archive of everything stored about a user, generated on their request.
+type DataExport struct {
+	Id          string       `json:"id"`
+	UserId      string       `json:"userId"`
+	Format      ExportFormat `json:"format"`
+	State       ExportState  `json:"state"`
+	RequestedAt time.Time    `json:"requestedAt"`
+	CompletedAt *time.Time   `json:"completedAt,omitempty"`
+	// ExpiresAt is when the export is discarded, after which requesting it again generates a new one
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Archive holds the generated archive once the export is ready
+	Archive []byte `json:"-"`
+}
+
+// ExportRepository represents a data source holding users' data exports while they are generated and downloaded.
+type ExportRepository interface {
+	// StartExport records a pending export of a user's data in format, to be discarded after ttl. If the user already
+	// has an export in that format that hasn't expired or failed, it is returned instead. Reports whether a new export
+	// was recorded, in which case the caller must generate it.
+	StartExport(userId string, format ExportFormat, ttl time.Duration) (DataExport, bool, error)
+	// GetExport retrieves the unexpired export with the given id, returning errExportNotFound if there is none.
+	GetExport(exportId string) (DataExport, error)
+	// CompleteExport stores the generated archive of a pending export, making it ready.
+	CompleteExport(exportId string, archive []byte) error
+	// FailExport records that a pending export couldn't be generated.
+	FailExport(exportId string) error
+	// DeleteUserExports removes every export of the given user's data, for when the user is deleted. Exports still
+	// being generated fail to complete.
+	DeleteUserExports(userId string) error
+}
+
+// NewExportRepository constructs an ExportRepository from the given configuration. Instances sharing a PostgreSQL
+// database share their exports, so any of them can serve an export another generated.
+func NewExportRepository(config Configuration, db *sql.DB) (ExportRepository, error) {
+	var err error
+	var repo ExportRepository
+	switch config.GetRepoType() {
+	case InMemoryRepo:
+		repo = MakeInMemoryExportRepository()
+	case PostgreSqlRepo:
+		if db == nil {
+			return nil, newErrRepository("db is required")
+		}
+		repo = MakePostgresqlExportRepository(db)
+	default:
+		err = newErrRepository("repository type unimplemented")
+	}
+
+	return repo, err
+}
@@ -0,0 +1,231 @@
+package service_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newExportTestServer constructs a session test server with the data export routes for signed in users and admins,
+// returning it along with the id of the logged in user and of another user.
+func newExportTestServer(t *testing.T) (*testServer, string, string) {
+	ts := newSessionTestServer(t)
+	ts.router.Route("/user", func(r chi.Router) {
+		r.With(service.JwtAuthMiddleware).With(service.RequireSelfOrPermission(service.ExportUsersPermission)).
+			With(service.ExportUserMiddleware).Get("/{id}/export", service.ExportUser)
+	})
+	ts.router.Route("/admin", func(r chi.Router) {
+		r.With(service.ExportUserMiddleware).Get("/users/{id}/export", service.ExportUser)
+	})
+
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+
+	otherId, err := ts.repo.NewUser("other@justinstone.net", "other", "password", service.FEMALE, 25, []string{})
+	ok(t, err)
+
+	return ts, user.Id, otherId
+}
+
+// export requests an export, returning the response without decoding it.
+func export(ts *testServer, path string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res := httptest.NewRecorder()
+	ts.router.ServeHTTP(res, req)
+
+	return res
+}
+
+type userDataExport struct {
+	User struct {
+		service.User
+		CreatedAt time.Time `json:"createdAt"`
+	} `json:"user"`
+	Sessions     []service.Session     `json:"sessions"`
+	FailedLogins service.LoginFailures `json:"failedLogins"`
+	Audit        struct {
+		UsernameChanges []service.UsernameChange      `json:"usernameChanges"`
+		StatusChanges   []service.AccountStatusChange `json:"statusChanges"`
+	} `json:"audit"`
+}
+
+// TestExportUser_Self ensures users can download everything stored about them as JSON, without their password hash.
+func TestExportUser_Self(t *testing.T) {
+	ts, id, _ := newExportTestServer(t)
+	tokens := login(t, ts)
+	attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "wrong")
+	ok(t, ts.repo.ChangeUsername(id, "renamed", time.Now().Add(time.Hour)))
+
+	res := export(ts, "/user/"+id+"/export", tokens.Token)
+	equals(t, http.StatusOK, res.Code)
+	equals(t, "application/json", res.Header().Get("Content-Type"))
+	assert(t, strings.HasPrefix(res.Header().Get("Content-Disposition"), "attachment"), "expected an attachment")
+	assert(t, !strings.Contains(res.Body.String(), "$2a$"), "expected no password hash")
+
+	var data userDataExport
+	ok(t, json.Unmarshal(res.Body.Bytes(), &data))
+	equals(t, id, data.User.Id)
+	equals(t, "user@justinstone.net", data.User.Email)
+	equals(t, "renamed", data.User.Username)
+	equals(t, service.MALE, data.User.Gender)
+	assert(t, !data.User.CreatedAt.IsZero(), "expected the account creation time")
+	equals(t, 1, len(data.Sessions))
+	equals(t, 1, data.FailedLogins.Count)
+	equals(t, 1, len(data.Audit.UsernameChanges))
+	equals(t, "user", data.Audit.UsernameChanges[0].Username)
+}
+
+// TestExportUser_Zip ensures exports can be downloaded as a zip file holding the JSON, and that other formats are
+// refused.
+func TestExportUser_Zip(t *testing.T) {
+	ts, id, _ := newExportTestServer(t)
+	tokens := login(t, ts)
+
+	res := export(ts, "/user/"+id+"/export?format=zip", tokens.Token)
+	equals(t, http.StatusOK, res.Code)
+	equals(t, "application/zip", res.Header().Get("Content-Type"))
+
+	archive, err := zip.NewReader(bytes.NewReader(res.Body.Bytes()), int64(res.Body.Len()))
+	ok(t, err)
+	equals(t, 1, len(archive.File))
+
+	file, err := archive.File[0].Open()
+	ok(t, err)
+	document, err := io.ReadAll(file)
+	ok(t, err)
+
+	var data userDataExport
+	ok(t, json.Unmarshal(document, &data))
+	equals(t, id, data.User.Id)
+
+	equals(t, http.StatusBadRequest, export(ts, "/user/"+id+"/export?format=xml", tokens.Token).Code)
+}
+
+// TestExportUser_Access ensures users can only export their own data unless they are allowed to export other users'.
+func TestExportUser_Access(t *testing.T) {
+	ts, id, otherId := newExportTestServer(t)
+	tokens := login(t, ts)
+
+	equals(t, http.StatusUnauthorized, export(ts, "/user/"+id+"/export", "").Code)
+	equals(t, http.StatusForbidden, export(ts, "/user/"+otherId+"/export", tokens.Token).Code)
+
+	ok(t, ts.repo.SetRoles(id, []string{service.ModeratorRole}))
+	tokens = login(t, ts)
+	equals(t, http.StatusForbidden, export(ts, "/user/"+otherId+"/export", tokens.Token).Code)
+
+	ok(t, ts.repo.SetRoles(id, []string{service.AdminRole}))
+	tokens = login(t, ts)
+	equals(t, http.StatusOK, export(ts, "/user/"+otherId+"/export", tokens.Token).Code)
+	equals(t, http.StatusNotFound, export(ts, "/user/missing/export", tokens.Token).Code)
+
+	equals(t, http.StatusOK, export(ts, "/admin/users/"+otherId+"/export", "").Code)
+}
+
+// TestExportUser_Pending ensures callers are told to come back for an export still being generated, and get the
+// archive once it is ready.
+func TestExportUser_Pending(t *testing.T) {
+	ts, id, _ := newExportTestServer(t)
+	tokens := login(t, ts)
+
+	pending, started, err := ts.exportRepo.StartExport(id, service.ExportJson, time.Hour)
+	ok(t, err)
+	assert(t, started, "expected a new export")
+
+	var res struct {
+		Export service.DataExport `json:"export"`
+	}
+	equals(t, http.StatusAccepted, ts.do(t, http.MethodGet, "/user/"+id+"/export", tokens.Token, nil, &res))
+	equals(t, pending.Id, res.Export.Id)
+	equals(t, service.ExportPending, res.Export.State)
+	assert(t, export(ts, "/user/"+id+"/export", tokens.Token).Header().Get("Retry-After") != "",
+		"expected a Retry-After header")
+
+	ok(t, ts.exportRepo.CompleteExport(pending.Id, []byte(`{"ready":true}`)))
+
+	download := export(ts, "/user/"+id+"/export", tokens.Token)
+	equals(t, http.StatusOK, download.Code)
+	equals(t, `{"ready":true}`, download.Body.String())
+}
+
+// TestInMemoryExportRepository_StartExport ensures a user's unexpired export is reused until it fails or expires.
+func TestInMemoryExportRepository_StartExport(t *testing.T) {
+	repo := service.MakeInMemoryExportRepository()
+
+	first, started, err := repo.StartExport("1", service.ExportJson, time.Hour)
+	ok(t, err)
+	assert(t, started, "expected a new export")
+
+	again, started, err := repo.StartExport("1", service.ExportJson, time.Hour)
+	ok(t, err)
+	assert(t, !started, "expected the pending export")
+	equals(t, first.Id, again.Id)
+
+	_, started, err = repo.StartExport("1", service.ExportZip, time.Hour)
+	ok(t, err)
+	assert(t, started, "expected a new export in another format")
+
+	ok(t, repo.FailExport(first.Id))
+	notOk(t, repo.CompleteExport(first.Id, []byte("{}")))
+
+	retry, started, err := repo.StartExport("1", service.ExportJson, time.Hour)
+	ok(t, err)
+	assert(t, started, "expected a new export after a failure")
+	assert(t, retry.Id != first.Id, "expected a different export")
+
+	expiring, _, err := repo.StartExport("2", service.ExportJson, 0)
+	ok(t, err)
+	_, err = repo.GetExport(expiring.Id)
+	notOk(t, err)
+}
+
+// TestPostgresqlExportRepository_StartExport ensures a new export is only recorded when the user has none in the
+// format, returning the existing one otherwise.
+func TestPostgresqlExportRepository_StartExport(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	ok(t, err)
+	defer db.Close()
+
+	repo := service.MakePostgresqlExportRepository(db)
+	now := time.Now()
+
+	mock.ExpectExec("DELETE FROM data_export").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO data_export").WithArgs(sqlmock.AnyArg(), "1", service.ExportJson, float64(3600)).
+		WillReturnRows(sqlmock.NewRows([]string{"requested_at", "expires_at"}).AddRow(now, now.Add(time.Hour)))
+
+	created, started, err := repo.StartExport("1", service.ExportJson, time.Hour)
+	ok(t, err)
+	assert(t, started, "expected a new export")
+	equals(t, service.ExportPending, created.State)
+
+	mock.ExpectExec("DELETE FROM data_export").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("INSERT INTO data_export").WillReturnRows(sqlmock.NewRows([]string{"requested_at",
+		"expires_at"}))
+	mock.ExpectQuery("SELECT (.+) FROM data_export").WithArgs("1", service.ExportJson).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "format", "state", "requested_at", "completed_at",
+			"expires_at", "archive"}).AddRow(created.Id, "1", "json", "ready", now, now, now.Add(time.Hour), []byte("{}")))
+
+	existing, started, err := repo.StartExport("1", service.ExportJson, time.Hour)
+	ok(t, err)
+	assert(t, !started, "expected the existing export")
+	equals(t, service.ExportReady, existing.State)
+	equals(t, []byte("{}"), existing.Archive)
+
+	mock.ExpectExec("UPDATE data_export SET state='ready'").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	notOk(t, repo.CompleteExport(created.Id, []byte("{}")))
+	ok(t, mock.ExpectationsWereMet())
+}
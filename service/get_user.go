@@ -2,6 +2,7 @@ package service
 
 import (
 	"context"
+	"errors"
 	"github.com/go-chi/chi/v5"
 	"net/http"
 )
@@ -11,7 +12,8 @@ type getUserRequest struct {
 }
 
 type getUserResponse struct {
-	User `json:"user"`
+	// User is a User for the user themselves or those allowed to read other users, otherwise a PublicUser
+	User interface{} `json:"user"`
 }
 
 func (nsr getUserResponse) Render(w http.ResponseWriter, _ *http.Request) error {
@@ -20,9 +22,17 @@ func (nsr getUserResponse) Render(w http.ResponseWriter, _ *http.Request) error
 	return nil
 }
 
-// GetUserMiddleware middleware to retrieve a user from the repo
+// GetUserMiddleware middleware to retrieve a user from the repo. The full user is only returned to the user themselves
+// and to users allowed to read other users, everyone else gets the public view without the email address.
 func GetUserMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
 		var reqUser getUserRequest
 
 		reqUser.Id = chi.URLParam(r, "id")
@@ -41,25 +51,36 @@ func GetUserMiddleware(next http.Handler) http.Handler {
 
 		user, err := userRepo.GetUser(reqUser.Id)
 
-		if err != nil {
+		// Deleted accounts are hidden from everyone but those allowed to read other users until they are purged.
+		if errors.Is(err, errUserNotFound) || (err == nil && user.Id == "") ||
+			(err == nil && user.Status.State == AccountDeleted && !caller.HasPermission(ReadUsersPermission)) {
+			RenderResponse(w, r, NewNotFoundErr("user not found"))
+			return
+		} else if err != nil {
 			RenderResponse(w, r, NewInternalServerErr("internal error"))
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), "user", &user)
+		res := getUserResponse{user.Public()}
+
+		if user.Id == caller.Id || caller.HasPermission(ReadUsersPermission) {
+			res = getUserResponse{user}
+		}
+
+		// The authenticated user is kept under "user", so the one retrieved goes under its own key.
+		ctx := context.WithValue(r.Context(), "requestedUser", res)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
 // GetUser renders the response to the get user request.
 func GetUser(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	user, ok := ctx.Value("user").(*User)
+	res, ok := r.Context().Value("requestedUser").(getUserResponse)
 
 	if !ok {
 		RenderResponse(w, r, NewInternalServerErr("internal error"))
 		return
 	}
 
-	RenderResponse(w, r, getUserResponse{*user})
+	RenderResponse(w, r, res)
 }
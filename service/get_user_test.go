@@ -0,0 +1,120 @@
+package service_test
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"testing"
+)
+
+// newUserTestServer constructs a session test server with the user read and profile update routes, returning it along
+// with the id of the logged in user and of another user.
+func newUserTestServer(t *testing.T) (*testServer, string, string) {
+	ts := newSessionTestServer(t)
+	ts.router.Route("/user", func(r chi.Router) {
+		r.With(service.JwtAuthMiddleware).With(service.GetUserMiddleware).Get("/{id}", service.GetUser)
+		r.With(service.JwtAuthMiddleware).With(service.UpdateProfileMiddleware).Patch("/{id}", service.UpdateProfile)
+	})
+
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+
+	otherId, err := ts.repo.NewUser("other@justinstone.net", "other", "password", service.FEMALE, 25, []string{})
+	ok(t, err)
+
+	return ts, user.Id, otherId
+}
+
+type userResponse struct {
+	User map[string]interface{} `json:"user"`
+}
+
+// TestGetUser_RequiresToken ensures users can't be read without a valid token.
+func TestGetUser_RequiresToken(t *testing.T) {
+	ts, id, _ := newUserTestServer(t)
+
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodGet, "/user/"+id, "", nil, nil))
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodGet, "/user/"+id, "invalid", nil, nil))
+}
+
+// TestGetUser_Self ensures users can read their own email address.
+func TestGetUser_Self(t *testing.T) {
+	ts, id, _ := newUserTestServer(t)
+	tokens := login(t, ts)
+
+	var res userResponse
+	equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/user/"+id, tokens.Token, nil, &res))
+	equals(t, id, res.User["id"])
+	equals(t, "user@justinstone.net", res.User["email"])
+}
+
+// TestGetUser_Other ensures other users only get the public view, without the email address, unless they are allowed
+// to read users.
+func TestGetUser_Other(t *testing.T) {
+	ts, id, otherId := newUserTestServer(t)
+	tokens := login(t, ts)
+
+	var res userResponse
+	equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/user/"+otherId, tokens.Token, nil, &res))
+	equals(t, otherId, res.User["id"])
+	equals(t, "other", res.User["username"])
+	equals(t, "female", res.User["gender"])
+	_, hasEmail := res.User["email"]
+	assert(t, !hasEmail, "expected email to be hidden")
+
+	equals(t, http.StatusNotFound, ts.do(t, http.MethodGet, "/user/missing", tokens.Token, nil, nil))
+
+	ok(t, ts.repo.SetRoles(id, []string{service.AdminRole}))
+	tokens = login(t, ts)
+
+	res = userResponse{}
+	equals(t, http.StatusOK, ts.do(t, http.MethodGet, "/user/"+otherId, tokens.Token, nil, &res))
+	equals(t, "other@justinstone.net", res.User["email"])
+}
+
+// TestUpdateProfile_Self ensures users can edit their own profile, but not without a token or with an incomplete one.
+func TestUpdateProfile_Self(t *testing.T) {
+	ts, id, _ := newUserTestServer(t)
+	tokens := login(t, ts)
+	profile := service.UserProfile{Gender: service.NONBINARY, Age: 31, Topics: []string{"go"}}
+
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodPatch, "/user/"+id, "", profile, nil))
+	equals(t, http.StatusBadRequest, ts.do(t, http.MethodPatch, "/user/"+id, tokens.Token,
+		service.UserProfile{Gender: service.MALE}, nil))
+
+	equals(t, http.StatusOK, ts.do(t, http.MethodPatch, "/user/"+id, tokens.Token, profile, nil))
+
+	user, err := ts.repo.GetUser(id)
+	ok(t, err)
+	equals(t, profile, user.UserProfile)
+}
+
+// TestUpdateProfile_Other ensures only users allowed to edit profiles, which only admins are, can change someone else's
+// profile.
+func TestUpdateProfile_Other(t *testing.T) {
+	ts, id, otherId := newUserTestServer(t)
+	tokens := login(t, ts)
+	profile := service.UserProfile{Gender: service.OTHER, Age: 40, Topics: []string{"chess"}}
+
+	equals(t, http.StatusForbidden, ts.do(t, http.MethodPatch, "/user/"+otherId, tokens.Token, profile, nil))
+
+	other, err := ts.repo.GetUser(otherId)
+	ok(t, err)
+	equals(t, service.FEMALE, other.Gender)
+
+	// Moderators may read other users' accounts but not edit their profiles.
+	ok(t, ts.repo.SetRoles(id, []string{service.ModeratorRole}))
+	tokens = login(t, ts)
+
+	equals(t, http.StatusForbidden, ts.do(t, http.MethodPatch, "/user/"+otherId, tokens.Token, profile, nil))
+
+	ok(t, ts.repo.SetRoles(id, []string{service.AdminRole}))
+	tokens = login(t, ts)
+
+	equals(t, http.StatusOK, ts.do(t, http.MethodPatch, "/user/"+otherId, tokens.Token, profile, nil))
+	equals(t, http.StatusNotFound, ts.do(t, http.MethodPatch, "/user/missing", tokens.Token, profile, nil))
+
+	other, err = ts.repo.GetUser(otherId)
+	ok(t, err)
+	equals(t, profile, other.UserProfile)
+}
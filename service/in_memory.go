@@ -3,8 +3,11 @@ package service
 import (
 	"encoding/json"
 	"github.com/twinj/uuid"
-	"golang.org/x/crypto/bcrypt"
+	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,8 +18,34 @@ type storedUser struct {
 	CreatedAt  time.Time `json:"createdAt"`
 	UpdatedAt  time.Time `json:"updatedAt"`
 }
+
+type storedRefreshToken struct {
+	UserId    string
+	FamilyId  string
+	ExpiresAt time.Time
+	Used      bool
+	Revoked   bool
+}
+
+type storedActionToken struct {
+	ActionToken
+	Used bool
+}
+
 type inMemoryUserRepository struct {
-	usersByEmail map[string]*storedUser
+	mutex         sync.RWMutex
+	usersByEmail  map[string]*storedUser
+	refreshTokens map[string]*storedRefreshToken
+	totp          map[string]*TotpEnrollment
+	recoveryCodes map[string][]*RecoveryCode
+	credentials   map[string]*WebAuthnCredential
+	actionTokens  map[string]*storedActionToken
+	usernames     map[string][]UsernameChange
+	loginFailures map[string]*LoginFailures
+	statusChanges map[string][]AccountStatusChange
+	// usedChallenges holds when each used challenge token expires
+	usedChallenges map[string]time.Time
+	hasher         PasswordHasher
 }
 
 // NewUser adds a user to the repo.
@@ -38,12 +67,19 @@ func (imr *inMemoryUserRepository) NewUser(
 
 	id := uuid.NewV4().String()
 
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
 	_, ok := imr.usersByEmail[email]
 	if ok {
-		return "", newErrRepository("user already exists")
+		return "", errEmailTaken
+	}
+
+	if imr.usernameTaken(handle, "") {
+		return "", errUsernameTaken
 	}
 
-	saltedHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	saltedHash, err := imr.hasher.Hash(password)
 
 	if err != nil {
 		return "", newErrRepository("unable to generate password")
@@ -59,13 +95,14 @@ func (imr *inMemoryUserRepository) NewUser(
 			UserProfile: UserProfile{Gender: gender, Age: age, Topics: topics},
 		},
 		id,
-		string(saltedHash),
+		saltedHash,
 		createdAt, updatedAt}
 
 	return id, nil
 }
 
-// Authenticate compares the given email and password combination against the salted hash in the repo.
+// Authenticate compares the given email and password combination against the salted hash in the repo, replacing the
+// hash if it was made by an outdated algorithm or parameters.
 func (imr *inMemoryUserRepository) Authenticate(email string, password string) (User, error) {
 	if email == "" {
 		return User{}, newErrRepository("email is required")
@@ -73,16 +110,60 @@ func (imr *inMemoryUserRepository) Authenticate(email string, password string) (
 		return User{}, newErrRepository("password is required")
 	}
 
-	user, ok := imr.usersByEmail[email]
+	imr.mutex.RLock()
+	stored, ok := imr.usersByEmail[email]
+	var user User
+	var saltedHash string
+
+	if ok {
+		user = User{stored.Id, stored.Email, stored.Username, stored.EmailVerified, stored.Roles, stored.Status,
+			stored.UserProfile}
+		saltedHash = stored.SaltedHash
+	}
+
+	imr.mutex.RUnlock()
+
+	// Unknown emails are reported like a wrong password, matching the PostgreSQL repo.
 	if !ok {
-		return User{}, newErrRepository("user not found")
+		return User{}, nil
 	}
 
-	if bcrypt.CompareHashAndPassword([]byte(user.SaltedHash), []byte(password)) != nil {
+	// Hashing is slow, so the lock isn't held while the password is checked.
+	match, err := imr.hasher.Verify(saltedHash, password)
+
+	if err != nil {
+		return User{}, err
+	} else if !match {
 		return User{}, nil
 	}
 
-	return User{user.Id, user.Email, user.Username, user.UserProfile}, nil
+	if imr.hasher.NeedsRehash(saltedHash) {
+		imr.rehash(stored, saltedHash, password)
+	}
+
+	if user.Status.Effective(time.Now()) != AccountActive {
+		return user, errAccountInactive
+	}
+
+	return user, nil
+}
+
+// rehash replaces a user's outdated salted hash, unless their password changed since it was read. Failing only means
+// the hash is replaced on a later login, so errors are just logged.
+func (imr *inMemoryUserRepository) rehash(user *storedUser, saltedHash string, password string) {
+	newHash, err := imr.hasher.Hash(password)
+
+	if err != nil {
+		log.Printf("Unable to rehash password: %s", err.Error())
+		return
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	if user.SaltedHash == saltedHash {
+		user.SaltedHash = newHash
+	}
 }
 
 func (imr *inMemoryUserRepository) GetUser(id string) (User, error) {
@@ -90,17 +171,516 @@ func (imr *inMemoryUserRepository) GetUser(id string) (User, error) {
 		return User{}, newErrRepository("id is required")
 	}
 
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
 	for _, user := range imr.usersByEmail {
 		if user.Id == id {
-			return User{user.Id, user.Email, user.Username, user.UserProfile}, nil
+			return User{user.Id, user.Email, user.Username, user.EmailVerified, user.Roles, user.Status, user.UserProfile}, nil
+		}
+	}
+
+	return User{}, errUserNotFound
+}
+
+// GetUserByEmail retrieves the user with the given email address.
+func (imr *inMemoryUserRepository) GetUserByEmail(email string) (User, error) {
+	if email == "" {
+		return User{}, newErrRepository("email is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	user, ok := imr.usersByEmail[email]
+	if !ok {
+		return User{}, errUserNotFound
+	}
+
+	return User{user.Id, user.Email, user.Username, user.EmailVerified, user.Roles, user.Status, user.UserProfile}, nil
+}
+
+// findUser returns the stored user with the given id, the caller must hold the mutex.
+func (imr *inMemoryUserRepository) findUser(userId string) (*storedUser, bool) {
+	for _, user := range imr.usersByEmail {
+		if user.Id == userId {
+			return user, true
+		}
+	}
+
+	return nil, false
+}
+
+// UpdatePassword replaces a user's password.
+func (imr *inMemoryUserRepository) UpdatePassword(userId string, password string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if password == "" {
+		return newErrRepository("password is required")
+	}
+
+	saltedHash, err := imr.hasher.Hash(password)
+
+	if err != nil {
+		return newErrRepository("unable to generate password")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	user, ok := imr.findUser(userId)
+	if !ok {
+		return errUserNotFound
+	}
+
+	user.SaltedHash = saltedHash
+	user.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// VerifyEmail records that a user has confirmed they own their email address.
+func (imr *inMemoryUserRepository) VerifyEmail(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	user, ok := imr.findUser(userId)
+	if !ok {
+		return errUserNotFound
+	}
+
+	user.EmailVerified = true
+	user.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// SetRoles replaces the roles granted to a user.
+func (imr *inMemoryUserRepository) SetRoles(userId string, roles []string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	user, ok := imr.findUser(userId)
+	if !ok {
+		return errUserNotFound
+	}
+
+	user.Roles = append([]string(nil), roles...)
+	user.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// matches reports whether the stored user matches every field set in filter.
+func (filter UserFilter) matches(user *storedUser) bool {
+	if filter.EmailPrefix != "" && !strings.HasPrefix(strings.ToLower(user.Email), strings.ToLower(filter.EmailPrefix)) {
+		return false
+	} else if filter.Username != "" && !strings.EqualFold(user.Username, filter.Username) {
+		return false
+	} else if !filter.CreatedAfter.IsZero() && user.CreatedAt.Before(filter.CreatedAfter) {
+		return false
+	} else if !filter.CreatedBefore.IsZero() && !user.CreatedAt.Before(filter.CreatedBefore) {
+		return false
+	}
+
+	if filter.Topic == "" {
+		return true
+	}
+
+	for _, topic := range user.Topics {
+		if topic == filter.Topic {
+			return true
 		}
 	}
 
-	return User{}, newErrRepository("user not found")
+	return false
+}
+
+// GetUserRecord retrieves a user along with when their account was created and last updated.
+func (imr *inMemoryUserRepository) GetUserRecord(userId string) (UserRecord, error) {
+	if userId == "" {
+		return UserRecord{}, newErrRepository("userId is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	user, ok := imr.findUser(userId)
+	if !ok {
+		return UserRecord{}, errUserNotFound
+	}
+
+	return UserRecord{
+		User{user.Id, user.Email, user.Username, user.EmailVerified, user.Roles, user.Status, user.UserProfile},
+		user.CreatedAt,
+		user.UpdatedAt,
+	}, nil
+}
+
+// ListUsers retrieves up to limit users matching filter, oldest first, skipping the first offset.
+func (imr *inMemoryUserRepository) ListUsers(filter UserFilter, offset int, limit int) ([]UserRecord, error) {
+	if offset < 0 {
+		return nil, newErrRepository("offset must not be negative")
+	} else if limit <= 0 {
+		return nil, newErrRepository("limit must be positive")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	records := make([]UserRecord, 0)
+
+	for _, user := range imr.usersByEmail {
+		if filter.matches(user) {
+			records = append(records, UserRecord{
+				User{user.Id, user.Email, user.Username, user.EmailVerified, user.Roles, user.Status, user.UserProfile},
+				user.CreatedAt,
+				user.UpdatedAt,
+			})
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].CreatedAt.Equal(records[j].CreatedAt) {
+			return records[i].Id < records[j].Id
+		}
+
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+
+	if offset >= len(records) {
+		return []UserRecord{}, nil
+	} else if offset+limit < len(records) {
+		records = records[:offset+limit]
+	}
+
+	return records[offset:], nil
+}
+
+// SetAccountStatus changes the status of a user's account, recording who changed it, when and why.
+func (imr *inMemoryUserRepository) SetAccountStatus(userId string, status AccountStatus, reason string,
+	changedBy string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if status.State == "" {
+		return newErrRepository("state is required")
+	} else if changedBy == "" {
+		return newErrRepository("changedBy is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	user, ok := imr.findUser(userId)
+	if !ok {
+		return errUserNotFound
+	}
+
+	now := time.Now()
+	user.Status = status
+	user.UpdatedAt = now
+	imr.statusChanges[userId] = append(imr.statusChanges[userId], AccountStatusChange{status, reason, changedBy, now})
+
+	return nil
+}
+
+// GetAccountStatusHistory retrieves the changes made to the status of a user's account, oldest first.
+func (imr *inMemoryUserRepository) GetAccountStatusHistory(userId string) ([]AccountStatusChange, error) {
+	if userId == "" {
+		return nil, newErrRepository("userId is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	return append([]AccountStatusChange{}, imr.statusChanges[userId]...), nil
+}
+
+// DeleteUser permanently removes a user along with everything the repo stores for them.
+func (imr *inMemoryUserRepository) DeleteUser(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	user, ok := imr.findUser(userId)
+	if !ok {
+		return errUserNotFound
+	}
+
+	imr.deleteUser(user)
+
+	return nil
+}
+
+// GetUsersToPurge retrieves the ids of the deleted users whose purge time is no later than now, soonest due first.
+func (imr *inMemoryUserRepository) GetUsersToPurge(now time.Time) ([]string, error) {
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	due := make([]*storedUser, 0)
+
+	for _, user := range imr.usersByEmail {
+		if purgeDue(user.User, now) {
+			due = append(due, user)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Status.PurgeAt.Before(*due[j].Status.PurgeAt)
+	})
+
+	userIds := make([]string, 0, len(due))
+
+	for _, user := range due {
+		userIds = append(userIds, user.Id)
+	}
+
+	return userIds, nil
+}
+
+// PurgeUser permanently removes a deleted user if their purge time is still no later than now.
+func (imr *inMemoryUserRepository) PurgeUser(userId string, now time.Time) (bool, error) {
+	if userId == "" {
+		return false, newErrRepository("userId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	user, ok := imr.findUser(userId)
+	if !ok || !purgeDue(user.User, now) {
+		return false, nil
+	}
+
+	imr.deleteUser(user)
+
+	return true, nil
+}
+
+// purgeDue reports whether a user's account is deleted and its grace period ended by now.
+func purgeDue(user User, now time.Time) bool {
+	return user.Status.State == AccountDeleted && user.Status.PurgeAt != nil && !now.Before(*user.Status.PurgeAt)
+}
+
+func (imr *inMemoryUserRepository) deleteUser(user *storedUser) {
+	userId := user.Id
+
+	for tokenHash, token := range imr.refreshTokens {
+		if token.UserId == userId {
+			delete(imr.refreshTokens, tokenHash)
+		}
+	}
+
+	for credentialId, credential := range imr.credentials {
+		if credential.UserId == userId {
+			delete(imr.credentials, credentialId)
+		}
+	}
+
+	for tokenHash, token := range imr.actionTokens {
+		if token.UserId == userId {
+			delete(imr.actionTokens, tokenHash)
+		}
+	}
+
+	delete(imr.totp, userId)
+	delete(imr.recoveryCodes, userId)
+	delete(imr.usernames, userId)
+	delete(imr.statusChanges, userId)
+	delete(imr.loginFailures, accountThrottleKey(user.Email))
+	delete(imr.usersByEmail, user.Email)
+}
+
+// ChangeEmail replaces a user's email address with one they have confirmed they own.
+func (imr *inMemoryUserRepository) ChangeEmail(userId string, email string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if email == "" {
+		return newErrRepository("email is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	user, ok := imr.findUser(userId)
+	if !ok {
+		return errUserNotFound
+	}
+
+	if _, ok := imr.usersByEmail[email]; ok {
+		return errEmailTaken
+	}
+
+	delete(imr.usersByEmail, user.Email)
+	user.Email = email
+	user.EmailVerified = true
+	user.UpdatedAt = time.Now()
+	imr.usersByEmail[email] = user
+
+	return nil
+}
+
+// usernameTaken reports whether username is held or reserved by a user other than userId, the caller must hold the
+// mutex.
+func (imr *inMemoryUserRepository) usernameTaken(username string, userId string) bool {
+	for _, user := range imr.usersByEmail {
+		if user.Id != userId && strings.EqualFold(user.Username, username) {
+			return true
+		}
+	}
+
+	now := time.Now()
+
+	for ownerId, changes := range imr.usernames {
+		for _, change := range changes {
+			if ownerId != userId && strings.EqualFold(change.Username, username) && now.Before(change.ReservedUntil) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ChangeUsername replaces a user's username, reserving the old one for them until reservedUntil.
+func (imr *inMemoryUserRepository) ChangeUsername(userId string, username string, reservedUntil time.Time) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if username == "" {
+		return newErrRepository("username is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	user, ok := imr.findUser(userId)
+	if !ok {
+		return errUserNotFound
+	}
+
+	if imr.usernameTaken(username, userId) {
+		return errUsernameTaken
+	}
+
+	now := time.Now()
+	imr.usernames[userId] = append(imr.usernames[userId], UsernameChange{user.Username, now, reservedUntil})
+	user.Username = username
+	user.UpdatedAt = now
+
+	return nil
+}
+
+// GetUsernameHistory retrieves the usernames a user has given up, oldest first.
+func (imr *inMemoryUserRepository) GetUsernameHistory(userId string) ([]UsernameChange, error) {
+	if userId == "" {
+		return nil, newErrRepository("userId is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	return append([]UsernameChange{}, imr.usernames[userId]...), nil
+}
+
+// GetUserByUsername retrieves the user currently holding username, ignoring case.
+func (imr *inMemoryUserRepository) GetUserByUsername(username string) (User, error) {
+	if username == "" {
+		return User{}, newErrRepository("username is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	for _, user := range imr.usersByEmail {
+		if strings.EqualFold(user.Username, username) {
+			return User{user.Id, user.Email, user.Username, user.EmailVerified, user.Roles, user.Status, user.UserProfile}, nil
+		}
+	}
+
+	return User{}, errUserNotFound
+}
+
+// GetPreviousUsernameOwner retrieves the id of the user who most recently gave up username, ignoring case.
+func (imr *inMemoryUserRepository) GetPreviousUsernameOwner(username string) (string, error) {
+	if username == "" {
+		return "", newErrRepository("username is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	var ownerId string
+	var changedAt time.Time
+
+	for userId, changes := range imr.usernames {
+		for _, change := range changes {
+			if strings.EqualFold(change.Username, username) && change.ChangedAt.After(changedAt) {
+				ownerId = userId
+				changedAt = change.ChangedAt
+			}
+		}
+	}
+
+	if ownerId == "" {
+		return "", errUserNotFound
+	}
+
+	return ownerId, nil
+}
+
+// ChangePassword replaces a user's password after verifying their current one.
+func (imr *inMemoryUserRepository) ChangePassword(userId string, currentPassword string, password string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if currentPassword == "" {
+		return newErrRepository("currentPassword is required")
+	} else if password == "" {
+		return newErrRepository("password is required")
+	}
+
+	saltedHash, err := imr.hasher.Hash(password)
+
+	if err != nil {
+		return newErrRepository("unable to generate password")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	user, ok := imr.findUser(userId)
+	if !ok {
+		return errUserNotFound
+	}
+
+	match, err := imr.hasher.Verify(user.SaltedHash, currentPassword)
+
+	if err != nil {
+		return err
+	} else if !match {
+		return errPasswordMismatch
+	}
+
+	user.SaltedHash = saltedHash
+	user.UpdatedAt = time.Now()
+
+	return nil
 }
 
 func (imr *inMemoryUserRepository) UpdateProfile(userId string, profile UserProfile) error {
-	if profile.Gender == "" {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if profile.Gender == "" {
 		return newErrRepository("gender is required")
 	} else if profile.Age == 0 {
 		return newErrRepository("age is required")
@@ -108,12 +688,514 @@ func (imr *inMemoryUserRepository) UpdateProfile(userId string, profile UserProf
 		return newErrRepository("topics is required")
 	}
 
-	user, ok := imr.usersByEmail[userId]
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	user, ok := imr.findUser(userId)
 	if !ok {
-		return newErrRepository("user not found")
+		return errUserNotFound
 	}
 
 	user.UserProfile = profile
+	user.UpdatedAt = time.Now()
+
+	return nil
+}
+
+// AddRefreshToken stores the hash of a refresh token issued to a user as a member of the given token family.
+func (imr *inMemoryUserRepository) AddRefreshToken(
+	userId string,
+	familyId string,
+	tokenHash string,
+	expiresAt time.Time,
+) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if familyId == "" {
+		return newErrRepository("familyId is required")
+	} else if tokenHash == "" {
+		return newErrRepository("tokenHash is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	imr.refreshTokens[tokenHash] = &storedRefreshToken{
+		UserId:    userId,
+		FamilyId:  familyId,
+		ExpiresAt: expiresAt,
+	}
+
+	return nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same family, revoking the family on reuse.
+func (imr *inMemoryUserRepository) RotateRefreshToken(
+	tokenHash string,
+	newTokenHash string,
+	expiresAt time.Time,
+) (string, string, error) {
+	if tokenHash == "" {
+		return "", "", newErrRepository("tokenHash is required")
+	} else if newTokenHash == "" {
+		return "", "", newErrRepository("newTokenHash is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	token, ok := imr.refreshTokens[tokenHash]
+	if !ok || token.Revoked || time.Now().After(token.ExpiresAt) {
+		return "", "", errRefreshTokenInvalid
+	}
+
+	if token.Used {
+		imr.revokeRefreshTokenFamily(token.FamilyId)
+		return token.UserId, token.FamilyId, errRefreshTokenReused
+	}
+
+	token.Used = true
+	imr.refreshTokens[newTokenHash] = &storedRefreshToken{
+		UserId:    token.UserId,
+		FamilyId:  token.FamilyId,
+		ExpiresAt: expiresAt,
+	}
+
+	return token.UserId, token.FamilyId, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token belonging to the given family.
+func (imr *inMemoryUserRepository) RevokeRefreshTokenFamily(familyId string) error {
+	if familyId == "" {
+		return newErrRepository("familyId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	imr.revokeRefreshTokenFamily(familyId)
+
+	return nil
+}
+
+func (imr *inMemoryUserRepository) revokeRefreshTokenFamily(familyId string) {
+	for _, token := range imr.refreshTokens {
+		if token.FamilyId == familyId {
+			token.Revoked = true
+		}
+	}
+}
+
+// SetTotpSecret stores an unconfirmed TOTP secret for a user, replacing any previous enrollment.
+func (imr *inMemoryUserRepository) SetTotpSecret(userId string, secret string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if secret == "" {
+		return newErrRepository("secret is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	imr.totp[userId] = &TotpEnrollment{Secret: secret}
+
+	return nil
+}
+
+// GetTotp retrieves a user's TOTP enrollment.
+func (imr *inMemoryUserRepository) GetTotp(userId string) (TotpEnrollment, error) {
+	if userId == "" {
+		return TotpEnrollment{}, newErrRepository("userId is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	enrollment, ok := imr.totp[userId]
+	if !ok {
+		return TotpEnrollment{}, errTotpNotFound
+	}
+
+	return *enrollment, nil
+}
+
+// ConfirmTotp marks a user's TOTP secret as confirmed.
+func (imr *inMemoryUserRepository) ConfirmTotp(userId string, counter int64) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	enrollment, ok := imr.totp[userId]
+	if !ok {
+		return errTotpNotFound
+	}
+
+	enrollment.Confirmed = true
+	enrollment.LastCounter = counter
+
+	return nil
+}
+
+// UseTotpCounter records that a code for the given time step was accepted.
+func (imr *inMemoryUserRepository) UseTotpCounter(userId string, counter int64) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	enrollment, ok := imr.totp[userId]
+	if !ok {
+		return errTotpNotFound
+	} else if counter <= enrollment.LastCounter {
+		return errTotpCodeReused
+	}
+
+	enrollment.LastCounter = counter
+
+	return nil
+}
+
+// RemoveTotp removes a user's TOTP enrollment.
+func (imr *inMemoryUserRepository) RemoveTotp(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	delete(imr.totp, userId)
+
+	return nil
+}
+
+// SetRecoveryCodes replaces a user's recovery codes with the given hashes.
+func (imr *inMemoryUserRepository) SetRecoveryCodes(userId string, codeHashes []string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	codes := make([]*RecoveryCode, 0, len(codeHashes))
+
+	for _, codeHash := range codeHashes {
+		codes = append(codes, &RecoveryCode{Id: uuid.NewV4().String(), CodeHash: codeHash})
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	imr.recoveryCodes[userId] = codes
+
+	return nil
+}
+
+// GetRecoveryCodes retrieves a user's recovery codes, including used ones.
+func (imr *inMemoryUserRepository) GetRecoveryCodes(userId string) ([]RecoveryCode, error) {
+	if userId == "" {
+		return nil, newErrRepository("userId is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	codes := make([]RecoveryCode, 0, len(imr.recoveryCodes[userId]))
+
+	for _, code := range imr.recoveryCodes[userId] {
+		codes = append(codes, *code)
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode records that a user's recovery code was used.
+func (imr *inMemoryUserRepository) UseRecoveryCode(userId string, codeId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if codeId == "" {
+		return newErrRepository("codeId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	for _, code := range imr.recoveryCodes[userId] {
+		if code.Id != codeId {
+			continue
+		} else if code.UsedAt != nil {
+			return errRecoveryCodeUsed
+		}
+
+		usedAt := time.Now()
+		code.UsedAt = &usedAt
+
+		return nil
+	}
+
+	return errRecoveryCodeUsed
+}
+
+// AddWebAuthnCredential stores a WebAuthn credential for its user.
+func (imr *inMemoryUserRepository) AddWebAuthnCredential(credential WebAuthnCredential) error {
+	if credential.Id == "" {
+		return newErrRepository("id is required")
+	} else if credential.UserId == "" {
+		return newErrRepository("userId is required")
+	} else if len(credential.PublicKey) == 0 {
+		return newErrRepository("publicKey is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	_, ok := imr.credentials[credential.Id]
+	if ok {
+		return errCredentialExists
+	}
+
+	credential.CreatedAt = time.Now()
+	imr.credentials[credential.Id] = &credential
+
+	return nil
+}
+
+// GetWebAuthnCredential retrieves the WebAuthn credential with the given id.
+func (imr *inMemoryUserRepository) GetWebAuthnCredential(credentialId string) (WebAuthnCredential, error) {
+	if credentialId == "" {
+		return WebAuthnCredential{}, newErrRepository("credentialId is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	credential, ok := imr.credentials[credentialId]
+	if !ok {
+		return WebAuthnCredential{}, errCredentialNotFound
+	}
+
+	return *credential, nil
+}
+
+// GetWebAuthnCredentials retrieves every WebAuthn credential registered by a user.
+func (imr *inMemoryUserRepository) GetWebAuthnCredentials(userId string) ([]WebAuthnCredential, error) {
+	if userId == "" {
+		return nil, newErrRepository("userId is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	credentials := make([]WebAuthnCredential, 0)
+
+	for _, credential := range imr.credentials {
+		if credential.UserId == userId {
+			credentials = append(credentials, *credential)
+		}
+	}
+
+	return credentials, nil
+}
+
+// UseWebAuthnCredential records a login with a WebAuthn credential.
+func (imr *inMemoryUserRepository) UseWebAuthnCredential(credentialId string, signCount uint32) error {
+	if credentialId == "" {
+		return newErrRepository("credentialId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	credential, ok := imr.credentials[credentialId]
+	if !ok {
+		return errCredentialNotFound
+	}
+
+	usedAt := time.Now()
+	credential.SignCount = signCount
+	credential.LastUsedAt = &usedAt
+
+	return nil
+}
+
+// RemoveWebAuthnCredential removes one of a user's WebAuthn credentials.
+func (imr *inMemoryUserRepository) RemoveWebAuthnCredential(userId string, credentialId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if credentialId == "" {
+		return newErrRepository("credentialId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	credential, ok := imr.credentials[credentialId]
+	if !ok || credential.UserId != userId {
+		return errCredentialNotFound
+	}
+
+	delete(imr.credentials, credentialId)
+
+	return nil
+}
+
+// RemoveWebAuthnCredentials removes every WebAuthn credential registered by a user.
+func (imr *inMemoryUserRepository) RemoveWebAuthnCredentials(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	for credentialId, credential := range imr.credentials {
+		if credential.UserId == userId {
+			delete(imr.credentials, credentialId)
+		}
+	}
+
+	return nil
+}
+
+// AddActionToken stores an action token, invalidating any outstanding tokens the user has for the same purpose.
+func (imr *inMemoryUserRepository) AddActionToken(token ActionToken) error {
+	if token.TokenHash == "" {
+		return newErrRepository("tokenHash is required")
+	} else if token.UserId == "" {
+		return newErrRepository("userId is required")
+	} else if token.Purpose == "" {
+		return newErrRepository("purpose is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	for _, stored := range imr.actionTokens {
+		if stored.UserId == token.UserId && stored.Purpose == token.Purpose {
+			stored.Used = true
+		}
+	}
+
+	imr.actionTokens[token.TokenHash] = &storedActionToken{ActionToken: token}
+
+	return nil
+}
+
+// GetActionToken retrieves the unexpired, unused action token matching tokenHash and purpose without using it.
+func (imr *inMemoryUserRepository) GetActionToken(tokenHash string, purpose string) (ActionToken, error) {
+	if tokenHash == "" {
+		return ActionToken{}, newErrRepository("tokenHash is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	token, ok := imr.actionTokens[tokenHash]
+	if !ok || token.Used || token.Purpose != purpose || time.Now().After(token.ExpiresAt) {
+		return ActionToken{}, errActionTokenInvalid
+	}
+
+	return token.ActionToken, nil
+}
+
+// ConsumeActionToken retrieves the unexpired action token matching tokenHash and purpose, marking it used.
+func (imr *inMemoryUserRepository) ConsumeActionToken(tokenHash string, purpose string) (ActionToken, error) {
+	if tokenHash == "" {
+		return ActionToken{}, newErrRepository("tokenHash is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	token, ok := imr.actionTokens[tokenHash]
+	if !ok || token.Used || token.Purpose != purpose || time.Now().After(token.ExpiresAt) {
+		return ActionToken{}, errActionTokenInvalid
+	}
+
+	token.Used = true
+
+	return token.ActionToken, nil
+}
+
+// GetLoginFailures retrieves the failed logins counted against key.
+func (imr *inMemoryUserRepository) GetLoginFailures(key string) (LoginFailures, error) {
+	if key == "" {
+		return LoginFailures{}, newErrRepository("key is required")
+	}
+
+	imr.mutex.RLock()
+	defer imr.mutex.RUnlock()
+
+	failures, ok := imr.loginFailures[key]
+	if !ok {
+		return LoginFailures{}, nil
+	}
+
+	return *failures, nil
+}
+
+// RecordLoginFailure counts a failed login against key, starting again if the previous failure is older than window.
+func (imr *inMemoryUserRepository) RecordLoginFailure(key string, window time.Duration) (LoginFailures, error) {
+	if key == "" {
+		return LoginFailures{}, newErrRepository("key is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	now := time.Now()
+	failures, ok := imr.loginFailures[key]
+
+	if !ok || now.Sub(failures.LastFailedAt) > window {
+		failures = &LoginFailures{}
+		imr.loginFailures[key] = failures
+	}
+
+	failures.Count++
+	failures.LastFailedAt = now
+
+	return *failures, nil
+}
+
+// ClearLoginFailures forgets the failed logins counted against key.
+func (imr *inMemoryUserRepository) ClearLoginFailures(key string) error {
+	if key == "" {
+		return newErrRepository("key is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	delete(imr.loginFailures, key)
+
+	return nil
+}
+
+// UseChallenge records that the challenge token with the given id has been used.
+func (imr *inMemoryUserRepository) UseChallenge(challengeId string, expiresAt time.Time) error {
+	if challengeId == "" {
+		return newErrRepository("challengeId is required")
+	}
+
+	imr.mutex.Lock()
+	defer imr.mutex.Unlock()
+
+	now := time.Now()
+
+	for id, expiry := range imr.usedChallenges {
+		if !now.Before(expiry) {
+			delete(imr.usedChallenges, id)
+		}
+	}
+
+	if _, ok := imr.usedChallenges[challengeId]; ok {
+		return errChallengeUsed
+	}
+
+	imr.usedChallenges[challengeId] = expiresAt
 
 	return nil
 }
@@ -124,7 +1206,19 @@ func MakeInMemoryRepository(config Configuration) (UserRepository, error) {
 
 	usersByEmail, err := loadInitInMemoryDataset(config.GetInitDataSet())
 
-	return &inMemoryUserRepository{usersByEmail}, err
+	return &inMemoryUserRepository{
+		usersByEmail:   usersByEmail,
+		refreshTokens:  make(map[string]*storedRefreshToken),
+		totp:           make(map[string]*TotpEnrollment),
+		recoveryCodes:  make(map[string][]*RecoveryCode),
+		credentials:    make(map[string]*WebAuthnCredential),
+		actionTokens:   make(map[string]*storedActionToken),
+		usernames:      make(map[string][]UsernameChange),
+		loginFailures:  make(map[string]*LoginFailures),
+		statusChanges:  make(map[string][]AccountStatusChange),
+		usedChallenges: make(map[string]time.Time),
+		hasher:         config.GetPasswordHasher(),
+	}, err
 }
 
 func loadInitInMemoryDataset(dataset string) (map[string]*storedUser, error) {
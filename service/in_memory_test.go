@@ -0,0 +1,313 @@
+package service_test
+
+import (
+	"github.com/stone1549/yapyapyap/auth/service"
+	"testing"
+	"time"
+)
+
+func makeInMemoryRepo(t *testing.T) service.UserRepository {
+	repo, err := service.MakeInMemoryRepository(inMemoryEmpty)
+	ok(t, err)
+	return repo
+}
+
+// TestInMemoryUserRepository_RotateRefreshToken ensures a refresh token can be exchanged for a new one in the same
+// family exactly once.
+func TestInMemoryUserRepository_RotateRefreshToken(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	expiresAt := time.Now().Add(time.Hour)
+
+	ok(t, repo.AddRefreshToken("1", "family", "hash1", expiresAt))
+
+	userId, familyId, err := repo.RotateRefreshToken("hash1", "hash2", expiresAt)
+	ok(t, err)
+	equals(t, "1", userId)
+	equals(t, "family", familyId)
+
+	userId, familyId, err = repo.RotateRefreshToken("hash2", "hash3", expiresAt)
+	ok(t, err)
+	equals(t, "1", userId)
+	equals(t, "family", familyId)
+}
+
+// TestInMemoryUserRepository_RotateRefreshTokenReuse ensures replaying a used refresh token revokes its family.
+func TestInMemoryUserRepository_RotateRefreshTokenReuse(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	expiresAt := time.Now().Add(time.Hour)
+
+	ok(t, repo.AddRefreshToken("1", "family", "hash1", expiresAt))
+
+	_, _, err := repo.RotateRefreshToken("hash1", "hash2", expiresAt)
+	ok(t, err)
+
+	_, _, err = repo.RotateRefreshToken("hash1", "hash3", expiresAt)
+	notOk(t, err)
+
+	_, _, err = repo.RotateRefreshToken("hash2", "hash4", expiresAt)
+	notOk(t, err)
+}
+
+// TestInMemoryUserRepository_RotateRefreshTokenExpired ensures an expired refresh token can't be exchanged.
+func TestInMemoryUserRepository_RotateRefreshTokenExpired(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+
+	ok(t, repo.AddRefreshToken("1", "family", "hash1", time.Now().Add(-time.Minute)))
+
+	_, _, err := repo.RotateRefreshToken("hash1", "hash2", time.Now().Add(time.Hour))
+	notOk(t, err)
+}
+
+// TestInMemoryUserRepository_RevokeRefreshTokenFamily ensures a revoked family's tokens can't be exchanged.
+func TestInMemoryUserRepository_RevokeRefreshTokenFamily(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	expiresAt := time.Now().Add(time.Hour)
+
+	ok(t, repo.AddRefreshToken("1", "family", "hash1", expiresAt))
+	ok(t, repo.RevokeRefreshTokenFamily("family"))
+
+	_, _, err := repo.RotateRefreshToken("hash1", "hash2", expiresAt)
+	notOk(t, err)
+}
+
+// TestInMemoryUserRepository_Totp ensures a TOTP secret can be confirmed and each time step only used once.
+func TestInMemoryUserRepository_Totp(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+
+	_, err := repo.GetTotp("1")
+	notOk(t, err)
+
+	ok(t, repo.SetTotpSecret("1", "SECRET"))
+	enrollment, err := repo.GetTotp("1")
+	ok(t, err)
+	equals(t, service.TotpEnrollment{Secret: "SECRET"}, enrollment)
+
+	ok(t, repo.ConfirmTotp("1", 10))
+	notOk(t, repo.UseTotpCounter("1", 10))
+	ok(t, repo.UseTotpCounter("1", 11))
+	notOk(t, repo.UseTotpCounter("1", 11))
+
+	enrollment, err = repo.GetTotp("1")
+	ok(t, err)
+	equals(t, service.TotpEnrollment{Secret: "SECRET", Confirmed: true, LastCounter: 11}, enrollment)
+
+	ok(t, repo.RemoveTotp("1"))
+	_, err = repo.GetTotp("1")
+	notOk(t, err)
+}
+
+// TestInMemoryUserRepository_RecoveryCodes ensures recovery codes are replaced as a set and each is used only once.
+func TestInMemoryUserRepository_RecoveryCodes(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+
+	ok(t, repo.SetRecoveryCodes("1", []string{"hash1", "hash2"}))
+	codes, err := repo.GetRecoveryCodes("1")
+	ok(t, err)
+	equals(t, 2, len(codes))
+
+	ok(t, repo.UseRecoveryCode("1", codes[0].Id))
+	notOk(t, repo.UseRecoveryCode("1", codes[0].Id))
+	notOk(t, repo.UseRecoveryCode("2", codes[1].Id))
+
+	codes, err = repo.GetRecoveryCodes("1")
+	ok(t, err)
+	assert(t, codes[0].UsedAt != nil, "expected code to be recorded as used")
+	assert(t, codes[1].UsedAt == nil, "expected code to be unused")
+
+	ok(t, repo.SetRecoveryCodes("1", nil))
+	codes, err = repo.GetRecoveryCodes("1")
+	ok(t, err)
+	equals(t, 0, len(codes))
+}
+
+// TestInMemoryUserRepository_ActionTokens ensures action tokens are single use, expire and are replaced by newer
+// tokens for the same purpose.
+func TestInMemoryUserRepository_ActionTokens(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	expiresAt := time.Now().Add(time.Hour)
+
+	ok(t, repo.AddActionToken(service.ActionToken{TokenHash: "a", UserId: "1", Purpose: "reset", ExpiresAt: expiresAt}))
+	token, err := repo.ConsumeActionToken("a", "reset")
+	ok(t, err)
+	equals(t, "1", token.UserId)
+	_, err = repo.ConsumeActionToken("a", "reset")
+	notOk(t, err)
+
+	ok(t, repo.AddActionToken(service.ActionToken{TokenHash: "b", UserId: "1", Purpose: "reset", ExpiresAt: expiresAt}))
+	_, err = repo.ConsumeActionToken("b", "verify")
+	notOk(t, err)
+	ok(t, repo.AddActionToken(service.ActionToken{TokenHash: "c", UserId: "1", Purpose: "reset", ExpiresAt: expiresAt}))
+	_, err = repo.ConsumeActionToken("b", "reset")
+	notOk(t, err)
+
+	ok(t, repo.AddActionToken(service.ActionToken{TokenHash: "d", UserId: "2", Purpose: "reset",
+		ExpiresAt: time.Now().Add(-time.Second)}))
+	_, err = repo.ConsumeActionToken("d", "reset")
+	notOk(t, err)
+}
+
+// TestInMemoryUserRepository_ChangePassword ensures a password is only changed when the current one matches.
+func TestInMemoryUserRepository_ChangePassword(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	id, err := repo.NewUser("user@justinstone.net", "user", "password", service.MALE, 30, []string{})
+	ok(t, err)
+
+	notOk(t, repo.ChangePassword(id, "wrong", "new password"))
+	ok(t, repo.ChangePassword(id, "password", "new password"))
+
+	user, err := repo.Authenticate("user@justinstone.net", "new password")
+	ok(t, err)
+	equals(t, id, user.Id)
+}
+
+// TestInMemoryUserRepository_VerifyEmail ensures users start unverified until their email address is verified.
+func TestInMemoryUserRepository_VerifyEmail(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	id, err := repo.NewUser("user@justinstone.net", "user", "password", service.MALE, 30, []string{})
+	ok(t, err)
+
+	user, err := repo.GetUser(id)
+	ok(t, err)
+	equals(t, false, user.EmailVerified)
+
+	ok(t, repo.VerifyEmail(id))
+	user, err = repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+	equals(t, true, user.EmailVerified)
+
+	notOk(t, repo.VerifyEmail("missing"))
+}
+
+// TestInMemoryUserRepository_SetRoles ensures a user's roles are replaced and returned with the user.
+func TestInMemoryUserRepository_SetRoles(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	id, err := repo.NewUser("user@justinstone.net", "user", "password", service.MALE, 30, []string{})
+	ok(t, err)
+
+	ok(t, repo.SetRoles(id, []string{service.AdminRole}))
+	user, err := repo.GetUser(id)
+	ok(t, err)
+	equals(t, []string{service.AdminRole}, user.Roles)
+
+	ok(t, repo.SetRoles(id, []string{}))
+	user, err = repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+	equals(t, 0, len(user.Roles))
+
+	notOk(t, repo.SetRoles("missing", []string{service.AdminRole}))
+}
+
+// TestInMemoryUserRepository_PurgeUser ensures only deleted users past their purge time are found and removed.
+func TestInMemoryUserRepository_PurgeUser(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	dueId, err := repo.NewUser("due@justinstone.net", "due", "password", service.MALE, 30, []string{})
+	ok(t, err)
+	graceId, err := repo.NewUser("grace@justinstone.net", "grace", "password", service.MALE, 30, []string{})
+	ok(t, err)
+	activeId, err := repo.NewUser("active@justinstone.net", "active", "password", service.MALE, 30, []string{})
+	ok(t, err)
+
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+	ok(t, repo.SetAccountStatus(dueId, service.AccountStatus{State: service.AccountDeleted, PurgeAt: &past}, "",
+		dueId))
+	ok(t, repo.SetAccountStatus(graceId, service.AccountStatus{State: service.AccountDeleted, PurgeAt: &future}, "",
+		graceId))
+
+	userIds, err := repo.GetUsersToPurge(now)
+	ok(t, err)
+	equals(t, []string{dueId}, userIds)
+
+	for _, userId := range []string{graceId, activeId, "missing"} {
+		removed, err := repo.PurgeUser(userId, now)
+		ok(t, err)
+		assert(t, !removed, "expected user not due to be kept")
+	}
+
+	removed, err := repo.PurgeUser(dueId, now)
+	ok(t, err)
+	assert(t, removed, "expected due user to be removed")
+
+	_, err = repo.GetUserByEmail("due@justinstone.net")
+	notOk(t, err)
+	_, err = repo.GetUserByEmail("grace@justinstone.net")
+	ok(t, err)
+	_, err = repo.GetUserByEmail("active@justinstone.net")
+	ok(t, err)
+
+	userIds, err = repo.GetUsersToPurge(future)
+	ok(t, err)
+	equals(t, []string{graceId}, userIds)
+}
+
+// TestInMemoryUserRepository_ChangeEmail ensures a user's email address can only change to one that isn't taken.
+func TestInMemoryUserRepository_ChangeEmail(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+	id, err := repo.NewUser("user@justinstone.net", "user", "password", service.MALE, 30, []string{})
+	ok(t, err)
+	_, err = repo.NewUser("other@justinstone.net", "other", "password", service.MALE, 30, []string{})
+	ok(t, err)
+
+	notOk(t, repo.ChangeEmail(id, "other@justinstone.net"))
+	ok(t, repo.ChangeEmail(id, "new@justinstone.net"))
+
+	user, err := repo.Authenticate("new@justinstone.net", "password")
+	ok(t, err)
+	equals(t, id, user.Id)
+
+	_, err = repo.GetUserByEmail("user@justinstone.net")
+	notOk(t, err)
+}
+
+// TestInMemoryUserRepository_AuthenticateRehash ensures a hash made by an outdated algorithm is replaced on login, and
+// only once.
+func TestInMemoryUserRepository_AuthenticateRehash(t *testing.T) {
+	hasher := &countingHasher{PasswordHasher: service.MakeUpgradingHasher(service.MakeArgon2idHasher(testArgon2idParams))}
+	repo, err := service.MakeInMemoryRepository(hasherConfiguration{inMemorySmall, hasher})
+	ok(t, err)
+
+	user, err := repo.Authenticate("user@justinstone.net", "password")
+	ok(t, err)
+	equals(t, "1", user.Id)
+	equals(t, 1, hasher.hashes)
+
+	user, err = repo.Authenticate("user@justinstone.net", "password")
+	ok(t, err)
+	equals(t, "1", user.Id)
+	equals(t, 1, hasher.hashes)
+
+	user, err = repo.Authenticate("user@justinstone.net", "wrong")
+	ok(t, err)
+	equals(t, "", user.Id)
+}
+
+// TestInMemoryUserRepository_LoginFailures ensures failed logins are counted per key, start again once the previous
+// failure is older than the window and can be cleared.
+func TestInMemoryUserRepository_LoginFailures(t *testing.T) {
+	repo := makeInMemoryRepo(t)
+
+	failures, err := repo.GetLoginFailures("account:user@justinstone.net")
+	ok(t, err)
+	equals(t, 0, failures.Count)
+
+	_, err = repo.RecordLoginFailure("account:user@justinstone.net", time.Hour)
+	ok(t, err)
+	failures, err = repo.RecordLoginFailure("account:user@justinstone.net", time.Hour)
+	ok(t, err)
+	equals(t, 2, failures.Count)
+
+	failures, err = repo.GetLoginFailures("ip:192.0.2.1")
+	ok(t, err)
+	equals(t, 0, failures.Count)
+
+	time.Sleep(time.Millisecond)
+	failures, err = repo.RecordLoginFailure("account:user@justinstone.net", time.Nanosecond)
+	ok(t, err)
+	equals(t, 1, failures.Count)
+
+	ok(t, repo.ClearLoginFailures("account:user@justinstone.net"))
+	failures, err = repo.GetLoginFailures("account:user@justinstone.net")
+	ok(t, err)
+	equals(t, 0, failures.Count)
+}
@@ -0,0 +1,29 @@
+package service
+
+import (
+	"github.com/stone1549/yapyapyap/auth/verifier"
+	"net/http"
+)
+
+type jwksResponse struct {
+	verifier.JSONWebKeySet
+}
+
+func (jr jwksResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// GetJwks renders the public keys that can be used to verify tokens issued by the service.
+func GetJwks(w http.ResponseWriter, r *http.Request) {
+	tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, jwksResponse{tokenFactory.KeySet()})
+}
@@ -0,0 +1,54 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"github.com/stone1549/yapyapyap/auth/verifier"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestGetJwks_Rsa ensures tokens issued with an RSA key can be verified using the published key set alone.
+func TestGetJwks_Rsa(t *testing.T) {
+	tokenFactory, err := service.NewTokenFactory(inMemoryRsa)
+	ok(t, err)
+
+	router := chi.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "tokenFactory", tokenFactory)))
+		})
+	})
+	router.Get("/.well-known/jwks.json", service.GetJwks)
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/.well-known/jwks.json")
+	ok(t, err)
+	defer res.Body.Close()
+
+	var keySet verifier.JSONWebKeySet
+	ok(t, json.NewDecoder(res.Body).Decode(&keySet))
+	equals(t, 1, len(keySet.Keys))
+	equals(t, "RS512", keySet.Keys[0].Alg)
+
+	token, err := tokenFactory.NewToken(service.NewClaims("1", "user@justinstone.net", "user", "session", nil))
+	ok(t, err)
+
+	claims, err := verifier.NewVerifier(server.URL+"/.well-known/jwks.json", time.Minute).Verify(token)
+	ok(t, err)
+	equals(t, "1", claims.Subject)
+}
+
+// TestGetJwks_Secret ensures shared secrets are never published.
+func TestGetJwks_Secret(t *testing.T) {
+	tokenFactory, err := service.NewTokenFactory(inMemoryEmpty)
+	ok(t, err)
+
+	equals(t, 0, len(tokenFactory.KeySet().Keys))
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"crypto"
+	"errors"
+	"github.com/golang-jwt/jwt"
+	"github.com/stone1549/yapyapyap/auth/verifier"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSigningKeyBits = 2048
+	// minKeyReloadInterval limits how often an unknown key id can trigger a reload of the key directory.
+	minKeyReloadInterval = 10 * time.Second
+)
+
+type ringKey struct {
+	signer crypto.Signer
+	method jwt.SigningMethod
+	jwk    verifier.JSONWebKey
+}
+
+// keyRing holds the current signing key along with previous keys that are still accepted for verification, each
+// identified by the kid of its published JSON Web Key.
+type keyRing struct {
+	mutex      sync.RWMutex
+	keys       []*ringKey
+	alg        string
+	retention  int
+	dir        string
+	reloadedAt time.Time
+}
+
+func newRingKey(signer crypto.Signer) (*ringKey, error) {
+	method, err := signingMethodFor(signer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	jwk, err := verifier.NewJSONWebKey(signer.Public(), method.Alg())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ringKey{signer, method, jwk}, nil
+}
+
+func newRingKeys(signers []crypto.Signer) ([]*ringKey, error) {
+	keys := make([]*ringKey, 0, len(signers))
+
+	for _, signer := range signers {
+		key, err := newRingKey(signer)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// newKeyRing constructs a keyRing from the given keys, current key first. When dir is set and holds no keys yet an
+// initial key is generated for alg and written to it. Rotated keys are generated for alg, or match the type of the
+// current key when alg is empty.
+func newKeyRing(signers []crypto.Signer, alg string, retention int, dir string) (*keyRing, error) {
+	if len(signers) == 0 {
+		if dir == "" {
+			return nil, errors.New("no signing keys configured")
+		}
+
+		signer, err := generateSigningKey(alg, nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = writeSigningKey(dir, signer)
+
+		if err != nil {
+			return nil, err
+		}
+
+		signers = []crypto.Signer{signer}
+	}
+
+	keys, err := newRingKeys(signers)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyRing{keys: keys, alg: alg, retention: retention, dir: dir}, nil
+}
+
+// current retrieves the key new tokens are signed with.
+func (kr *keyRing) current() *ringKey {
+	kr.mutex.RLock()
+	defer kr.mutex.RUnlock()
+
+	return kr.keys[0]
+}
+
+// find retrieves the key with the given kid. Keys rotated by other instances sharing the key directory are picked up
+// by reloading the directory when an unknown kid is encountered.
+func (kr *keyRing) find(kid string) (*ringKey, bool) {
+	key, ok := kr.lookup(kid)
+
+	if ok || kr.dir == "" {
+		return key, ok
+	}
+
+	kr.mutex.RLock()
+	throttled := time.Since(kr.reloadedAt) < minKeyReloadInterval
+	kr.mutex.RUnlock()
+
+	if throttled || kr.reload() != nil {
+		return nil, false
+	}
+
+	return kr.lookup(kid)
+}
+
+func (kr *keyRing) lookup(kid string) (*ringKey, bool) {
+	kr.mutex.RLock()
+	defer kr.mutex.RUnlock()
+
+	for _, key := range kr.keys {
+		if key.jwk.Kid == kid {
+			return key, true
+		}
+	}
+
+	return nil, false
+}
+
+// reload replaces the keys in the ring with those in the key directory.
+func (kr *keyRing) reload() error {
+	signers, err := loadSigningKeyDir(kr.dir)
+
+	if err != nil {
+		return err
+	}
+
+	if len(signers) == 0 {
+		return errors.New("no signing keys found")
+	}
+
+	keys, err := newRingKeys(signers)
+
+	if err != nil {
+		return err
+	}
+
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+
+	kr.keys = keys
+	kr.reloadedAt = time.Now()
+
+	return nil
+}
+
+// rotate generates a new current key of the same type as the existing one, keeping up to retention previous keys for
+// verification. Returns the kid of the new key.
+func (kr *keyRing) rotate() (string, error) {
+	signer, err := generateSigningKey(kr.alg, kr.current().signer)
+
+	if err != nil {
+		return "", err
+	}
+
+	if kr.dir != "" {
+		err = writeSigningKey(kr.dir, signer)
+
+		if err != nil {
+			return "", err
+		}
+
+		err = pruneSigningKeyDir(kr.dir, kr.retention+1)
+
+		if err != nil {
+			return "", err
+		}
+
+		err = kr.reload()
+
+		if err != nil {
+			return "", err
+		}
+
+		return kr.current().jwk.Kid, nil
+	}
+
+	key, err := newRingKey(signer)
+
+	if err != nil {
+		return "", err
+	}
+
+	kr.mutex.Lock()
+	defer kr.mutex.Unlock()
+
+	kr.keys = append([]*ringKey{key}, kr.keys...)
+
+	if len(kr.keys) > kr.retention+1 {
+		kr.keys = kr.keys[:kr.retention+1]
+	}
+
+	return key.jwk.Kid, nil
+}
+
+// keySet returns the published form of every key in the ring.
+func (kr *keyRing) keySet() verifier.JSONWebKeySet {
+	kr.mutex.RLock()
+	defer kr.mutex.RUnlock()
+
+	keys := make([]verifier.JSONWebKey, 0, len(kr.keys))
+
+	for _, key := range kr.keys {
+		keys = append(keys, key.jwk)
+	}
+
+	return verifier.JSONWebKeySet{Keys: keys}
+}
@@ -0,0 +1,299 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const keyFileExt = ".pem"
+
+// loadSigningKeyDir loads every PEM encoded private key in the given directory. Keys are ordered by file name with
+// the last being the current signing key, the result is returned current key first.
+func loadSigningKeyDir(dir string) ([]crypto.Signer, error) {
+	names, err := signingKeyFiles(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]crypto.Signer, 0, len(names))
+
+	for i := len(names) - 1; i >= 0; i-- {
+		key, err := loadSigningKey(filepath.Join(dir, names[i]))
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// loadSigningKeyList loads the PEM encoded private keys at the given paths, the first being the current signing key.
+func loadSigningKeyList(paths []string) ([]crypto.Signer, error) {
+	keys := make([]crypto.Signer, 0, len(paths))
+
+	for _, path := range paths {
+		key, err := loadSigningKey(strings.TrimSpace(path))
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// loadSigningKeyPair loads a PEM encoded private key, ensuring it matches the PEM encoded public key.
+func loadSigningKeyPair(privateKeyPath, publicKeyPath string) (crypto.Signer, error) {
+	key, err := loadSigningKey(privateKeyPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	verifyBytes, err := os.ReadFile(publicKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, err := parsePublicKey(verifyBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	if !publicKey.Equal(key.Public()) {
+		return nil, errors.New("token public key does not match private key")
+	}
+
+	return key, nil
+}
+
+func loadSigningKey(path string) (crypto.Signer, error) {
+	keyBytes, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseSigningKey(keyBytes)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse signing key %s: %w", path, err)
+	}
+
+	return key, nil
+}
+
+// parseSigningKey parses a PEM encoded RSA, ECDSA or Ed25519 private key in PKCS #8, PKCS #1 or SEC 1 form.
+func parseSigningKey(keyBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyBytes)
+
+	if block == nil {
+		return nil, errors.New("key must be PEM encoded")
+	}
+
+	var key interface{}
+	var err error
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+
+	if !ok {
+		return nil, errors.New("unsupported signing key type")
+	}
+
+	_, err = signingMethodFor(signer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+type comparablePublicKey interface {
+	Equal(x crypto.PublicKey) bool
+}
+
+// parsePublicKey parses a PEM encoded public key in PKIX or PKCS #1 form.
+func parsePublicKey(keyBytes []byte) (comparablePublicKey, error) {
+	block, _ := pem.Decode(keyBytes)
+
+	if block == nil {
+		return nil, errors.New("key must be PEM encoded")
+	}
+
+	var key interface{}
+	var err error
+
+	if block.Type == "RSA PUBLIC KEY" {
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, ok := key.(comparablePublicKey)
+
+	if !ok {
+		return nil, errors.New("unsupported public key type")
+	}
+
+	return publicKey, nil
+}
+
+func encodeSigningKey(key crypto.Signer) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// generateSigningKey generates a new private key for the given JWT algorithm. When alg is empty the key has the same
+// type and size as like, or is a default sized RSA key if like is nil.
+func generateSigningKey(alg string, like crypto.Signer) (crypto.Signer, error) {
+	if alg == "" {
+		switch key := like.(type) {
+		case *rsa.PrivateKey:
+			return rsa.GenerateKey(rand.Reader, key.N.BitLen())
+		case *ecdsa.PrivateKey:
+			return ecdsa.GenerateKey(key.Curve, rand.Reader)
+		case ed25519.PrivateKey:
+			_, signer, err := ed25519.GenerateKey(rand.Reader)
+			return signer, err
+		case nil:
+			return rsa.GenerateKey(rand.Reader, defaultSigningKeyBits)
+		default:
+			return nil, errors.New("unsupported signing key type")
+		}
+	}
+
+	switch alg {
+	case jwt.SigningMethodRS512.Alg():
+		return rsa.GenerateKey(rand.Reader, defaultSigningKeyBits)
+	case jwt.SigningMethodES256.Alg():
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodES384.Alg():
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case jwt.SigningMethodES512.Alg():
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, signer, err := ed25519.GenerateKey(rand.Reader)
+		return signer, err
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm %s", alg)
+	}
+}
+
+// signingMethodFor determines the JWT signing method used with the given key.
+func signingMethodFor(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS512, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		default:
+			return nil, errors.New("unsupported elliptic curve")
+		}
+	case ed25519.PrivateKey:
+		return jwt.SigningMethodEdDSA, nil
+	default:
+		return nil, errors.New("unsupported signing key type")
+	}
+}
+
+// signingKeyFiles lists the names of the key files in dir, sorted oldest first.
+func signingKeyFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && filepath.Ext(entry.Name()) == keyFileExt {
+			names = append(names, entry.Name())
+		}
+	}
+
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// writeSigningKey writes a key to dir under a name that sorts after every key written before it.
+func writeSigningKey(dir string, key crypto.Signer) error {
+	keyBytes, err := encodeSigningKey(key)
+
+	if err != nil {
+		return err
+	}
+
+	name := time.Now().UTC().Format("20060102T150405.000000000Z") + keyFileExt
+
+	return os.WriteFile(filepath.Join(dir, name), keyBytes, 0600)
+}
+
+// pruneSigningKeyDir removes all but the newest keep key files from dir.
+func pruneSigningKeyDir(dir string, keep int) error {
+	names, err := signingKeyFiles(dir)
+
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(names)-keep; i++ {
+		err = os.Remove(filepath.Join(dir, names[i]))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
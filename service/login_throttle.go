@@ -0,0 +1,123 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LoginThrottle holds the limits on failed logins that slow down password guessing against an account or from an IP
+// address.
+type LoginThrottle struct {
+	// FreeAttempts is how many consecutive failed logins an account can have before further attempts are delayed
+	FreeAttempts int
+	// Backoff is the delay after the first failure beyond FreeAttempts, doubling with each failure after that
+	Backoff time.Duration
+	// LockoutAttempts is how many consecutive failed logins lock an account, zero disables lockout
+	LockoutAttempts int
+	// Lockout is how long a locked account stays locked
+	Lockout time.Duration
+	// IpAttempts is how many failed logins from an IP address block further attempts from it, zero disables the limit
+	IpAttempts int
+	// Window is how long failed logins are counted after the latest one, and how long a blocked IP address stays
+	// blocked
+	Window time.Duration
+}
+
+// accountRetryAt returns when an account with the given failed logins may next attempt to log in.
+func (lt LoginThrottle) accountRetryAt(failures LoginFailures) time.Time {
+	if lt.LockoutAttempts > 0 && failures.Count >= lt.LockoutAttempts {
+		return failures.LastFailedAt.Add(lt.Lockout)
+	} else if failures.Count <= lt.FreeAttempts {
+		return time.Time{}
+	}
+
+	// The delay never exceeds the window, after which the failures are forgotten anyway.
+	delay := float64(lt.Backoff) * math.Pow(2, float64(failures.Count-lt.FreeAttempts-1))
+
+	return failures.LastFailedAt.Add(time.Duration(math.Min(delay, float64(lt.Window))))
+}
+
+// ipRetryAt returns when an IP address with the given failed logins may next attempt to log in.
+func (lt LoginThrottle) ipRetryAt(failures LoginFailures) time.Time {
+	if lt.IpAttempts > 0 && failures.Count >= lt.IpAttempts {
+		return failures.LastFailedAt.Add(lt.Window)
+	}
+
+	return time.Time{}
+}
+
+func accountThrottleKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// clientIp returns the IP address a request came from.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// checkLoginThrottle checks whether logins to the account with the given email, or from the IP address the request
+// came from, are being throttled. Errors are ErrorResponse values suitable for rendering, a 429 telling the caller how
+// long to wait if so.
+func checkLoginThrottle(r *http.Request, config Configuration, userRepo UserRepository, email string) error {
+	throttle := config.GetLoginThrottle()
+
+	accountFailures, err := userRepo.GetLoginFailures(accountThrottleKey(email))
+
+	if err != nil {
+		return NewInternalServerErr("repo error")
+	}
+
+	ipFailures, err := userRepo.GetLoginFailures(ipThrottleKey(clientIp(r)))
+
+	if err != nil {
+		return NewInternalServerErr("repo error")
+	}
+
+	retryAt := throttle.accountRetryAt(accountFailures)
+
+	if ipRetryAt := throttle.ipRetryAt(ipFailures); ipRetryAt.After(retryAt) {
+		retryAt = ipRetryAt
+	}
+
+	if wait := time.Until(retryAt); wait > 0 {
+		return NewTooManyRequestsErr(fmt.Sprintf("too many failed logins, try again in %s",
+			wait.Round(time.Second)), wait)
+	}
+
+	return nil
+}
+
+// recordLoginResult counts a failed login against both the account and the IP address the request came from, or
+// forgets the failures of the account after a successful one. Failures from an IP address are only forgotten with
+// time, so logging in to one account doesn't allow guessing the passwords of others.
+func recordLoginResult(r *http.Request, config Configuration, userRepo UserRepository, email string,
+	success bool) error {
+	if success {
+		return userRepo.ClearLoginFailures(accountThrottleKey(email))
+	}
+
+	window := config.GetLoginThrottle().Window
+	_, err := userRepo.RecordLoginFailure(accountThrottleKey(email), window)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = userRepo.RecordLoginFailure(ipThrottleKey(clientIp(r)), window)
+
+	return err
+}
@@ -0,0 +1,199 @@
+package service_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// throttleConfiguration overrides the login throttle of a configuration.
+type throttleConfiguration struct {
+	service.Configuration
+	throttle service.LoginThrottle
+}
+
+func (tc throttleConfiguration) GetLoginThrottle() service.LoginThrottle {
+	return tc.throttle
+}
+
+func newThrottleTestServer(t *testing.T, throttle service.LoginThrottle) *testServer {
+	ts := newSessionTestServer(t)
+	ts.config = throttleConfiguration{ts.config, throttle}
+	ts.router.Route("/admin", func(r chi.Router) {
+		r.With(service.UnlockUserMiddleware).Post("/users/{id}/unlock", service.UnlockUser)
+	})
+
+	return ts
+}
+
+// attemptLogin tries to log in from the given IP address, returning the response.
+func attemptLogin(t *testing.T, ts *testServer, ip string, email string, password string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	ok(t, json.NewEncoder(&body).Encode(map[string]string{"email": email, "password": password}))
+
+	req := httptest.NewRequest(http.MethodPut, "/session/", &body)
+	req.RemoteAddr = ip + ":1234"
+	res := httptest.NewRecorder()
+	ts.router.ServeHTTP(res, req)
+
+	return res
+}
+
+// TestLoginThrottle_Backoff ensures failures beyond the free attempts delay further logins, with a Retry-After
+// growing exponentially, even with the right password.
+func TestLoginThrottle_Backoff(t *testing.T) {
+	ts := newThrottleTestServer(t, service.LoginThrottle{
+		FreeAttempts: 2,
+		Backoff:      time.Minute,
+		Window:       time.Hour,
+	})
+
+	for i := 0; i < 3; i++ {
+		res := attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "wrong")
+		equals(t, http.StatusUnauthorized, res.Code)
+	}
+
+	res := attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "password")
+	equals(t, http.StatusTooManyRequests, res.Code)
+	equals(t, "60", res.Header().Get("Retry-After"))
+
+	// The throttle applies to the account, whichever address the attempt comes from and however the email is cased.
+	res = attemptLogin(t, ts, "192.0.2.2", "USER@justinstone.net", "password")
+	equals(t, http.StatusTooManyRequests, res.Code)
+
+	ok(t, ts.repo.ClearLoginFailures("account:user@justinstone.net"))
+	_, err := ts.repo.RecordLoginFailure("account:user@justinstone.net", time.Hour)
+	ok(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = ts.repo.RecordLoginFailure("account:user@justinstone.net", time.Hour)
+		ok(t, err)
+	}
+
+	res = attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "password")
+	equals(t, http.StatusTooManyRequests, res.Code)
+	equals(t, "120", res.Header().Get("Retry-After"))
+}
+
+// TestLoginThrottle_Lockout ensures an account is locked after too many failures until an admin unlocks it, and that
+// a successful login forgets earlier failures.
+func TestLoginThrottle_Lockout(t *testing.T) {
+	ts := newThrottleTestServer(t, service.LoginThrottle{
+		FreeAttempts:    5,
+		LockoutAttempts: 3,
+		Lockout:         15 * time.Minute,
+		Window:          time.Hour,
+	})
+
+	for i := 0; i < 2; i++ {
+		res := attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "wrong")
+		equals(t, http.StatusUnauthorized, res.Code)
+	}
+
+	res := attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "password")
+	equals(t, http.StatusOK, res.Code)
+
+	for i := 0; i < 3; i++ {
+		res = attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "wrong")
+		equals(t, http.StatusUnauthorized, res.Code)
+	}
+
+	res = attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "password")
+	equals(t, http.StatusTooManyRequests, res.Code)
+	equals(t, "900", res.Header().Get("Retry-After"))
+
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+
+	status := ts.do(t, http.MethodPost, "/admin/users/"+user.Id+"/unlock", "", nil, nil)
+	equals(t, http.StatusOK, status)
+
+	res = attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "password")
+	equals(t, http.StatusOK, res.Code)
+
+	status = ts.do(t, http.MethodPost, "/admin/users/unknown/unlock", "", nil, nil)
+	equals(t, http.StatusNotFound, status)
+}
+
+// TestLoginThrottle_Ip ensures an IP address guessing passwords across accounts is blocked without affecting other
+// addresses.
+func TestLoginThrottle_Ip(t *testing.T) {
+	ts := newThrottleTestServer(t, service.LoginThrottle{
+		FreeAttempts: 5,
+		IpAttempts:   3,
+		Window:       time.Hour,
+	})
+
+	for _, email := range []string{"a@justinstone.net", "b@justinstone.net", "c@justinstone.net"} {
+		res := attemptLogin(t, ts, "192.0.2.1", email, "password")
+		equals(t, http.StatusUnauthorized, res.Code)
+	}
+
+	res := attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "password")
+	equals(t, http.StatusTooManyRequests, res.Code)
+	equals(t, "3600", res.Header().Get("Retry-After"))
+
+	res = attemptLogin(t, ts, "192.0.2.2", "user@justinstone.net", "password")
+	equals(t, http.StatusOK, res.Code)
+}
+
+// TestLoginThrottle_PostgresqlUnknownEmail ensures a login with an email nobody has fails like a wrong password when
+// backed by PostgreSQL, counting against the account and IP address.
+func TestLoginThrottle_PostgresqlUnknownEmail(t *testing.T) {
+	ts := newThrottleTestServer(t, service.LoginThrottle{FreeAttempts: 5, IpAttempts: 5, Window: time.Hour})
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+	ts.repo = repo
+
+	mock.ExpectQuery("SELECT count, last_failed_at FROM login_failure").WithArgs("account:missing@justinstone.net").
+		WillReturnRows(sqlmock.NewRows([]string{"count", "last_failed_at"}))
+	mock.ExpectQuery("SELECT count, last_failed_at FROM login_failure").WithArgs("ip:192.0.2.1").
+		WillReturnRows(sqlmock.NewRows([]string{"count", "last_failed_at"}))
+	mock.ExpectQuery("SELECT (.+) FROM login").WithArgs("missing@justinstone.net").
+		WillReturnRows(sqlmock.NewRows([]string{"salted_hash"}))
+	mock.ExpectQuery("INSERT INTO login_failure").WithArgs("account:missing@justinstone.net", float64(3600)).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "last_failed_at"}).AddRow(1, time.Now()))
+	mock.ExpectQuery("INSERT INTO login_failure").WithArgs("ip:192.0.2.1", float64(3600)).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "last_failed_at"}).AddRow(1, time.Now()))
+
+	res := attemptLogin(t, ts, "192.0.2.1", "missing@justinstone.net", "password")
+	equals(t, http.StatusUnauthorized, res.Code)
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestLoginThrottle_ConfirmPassword ensures wrong passwords given to change a signed in user's password or email
+// address count as failed logins, so a stolen access token can't guess the password any faster.
+func TestLoginThrottle_ConfirmPassword(t *testing.T) {
+	ts := newThrottleTestServer(t, service.LoginThrottle{FreeAttempts: 2, Backoff: time.Minute, Window: time.Hour})
+	ts.router.With(service.JwtAuthMiddleware).With(service.ChangePasswordMiddleware).Put("/user/{id}/password",
+		service.ChangePassword)
+	ts.router.With(service.JwtAuthMiddleware).With(service.ChangeEmailMiddleware).Post("/user/{id}/email",
+		service.ChangeEmail)
+	token := login(t, ts).Token
+
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+
+	status := ts.do(t, http.MethodPut, "/user/"+user.Id+"/password", token,
+		map[string]string{"currentPassword": "wrong", "password": "new password"}, nil)
+	equals(t, http.StatusForbidden, status)
+
+	for i := 0; i < 2; i++ {
+		status = ts.do(t, http.MethodPost, "/user/"+user.Id+"/email", token,
+			map[string]string{"email": "new@justinstone.net", "password": "wrong"}, nil)
+		equals(t, http.StatusForbidden, status)
+	}
+
+	status = ts.do(t, http.MethodPut, "/user/"+user.Id+"/password", token,
+		map[string]string{"currentPassword": "password", "password": "new password"}, nil)
+	equals(t, http.StatusTooManyRequests, status)
+
+	res := attemptLogin(t, ts, "192.0.2.1", "user@justinstone.net", "password")
+	equals(t, http.StatusTooManyRequests, res.Code)
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Message represents an email to be sent to a user.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer represents a means of delivering messages to users.
+type Mailer interface {
+	// Send delivers the given message.
+	Send(message Message) error
+}
+
+type logMailer struct {
+}
+
+// Send writes the message to the log.
+func (lm logMailer) Send(message Message) error {
+	log.Printf("Mail to %s: %s\n%s", message.To, message.Subject, message.Body)
+	return nil
+}
+
+// MakeLogMailer constructs a Mailer that writes messages to the log, intended for development.
+func MakeLogMailer() Mailer {
+	return logMailer{}
+}
+
+type fileMailer struct {
+	dir   string
+	count uint64
+}
+
+// Send writes the message to a new file in the mailer's directory.
+func (fm *fileMailer) Send(message Message) error {
+	if message.To == "" {
+		return errors.New("recipient is required")
+	}
+
+	name := fmt.Sprintf("%d-%d.eml", time.Now().UnixNano(), atomic.AddUint64(&fm.count, 1))
+	content := fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n", message.To, message.Subject,
+		strings.ReplaceAll(message.Body, "\n", "\r\n"))
+
+	return os.WriteFile(filepath.Join(fm.dir, name), []byte(content), 0600)
+}
+
+// MakeFileMailer constructs a Mailer that writes each message to a file in dir, creating it if necessary.
+func MakeFileMailer(dir string) (Mailer, error) {
+	err := os.MkdirAll(dir, 0700)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileMailer{dir: dir}, nil
+}
+
+// NewMailer constructs a Mailer from the given configuration.
+func NewMailer(config Configuration) (Mailer, error) {
+	switch config.GetMailerType() {
+	case LogMailerType:
+		return MakeLogMailer(), nil
+	case FileMailerType:
+		return MakeFileMailer(config.GetMailerDir())
+	default:
+		return nil, errors.New("mailer type unimplemented")
+	}
+}
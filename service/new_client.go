@@ -0,0 +1,106 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+type newClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectUris []string `json:"redirectUris"`
+	Scopes       []string `json:"scopes"`
+	Confidential bool     `json:"confidential"`
+}
+
+type newClientResponse struct {
+	ClientId     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+}
+
+func (ncr newClientResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// NewClientMiddleware middleware to register a new OAuth client from the request parameters
+func NewClientMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decoder := json.NewDecoder(r.Body)
+
+		var reqClient newClientRequest
+		err := decoder.Decode(&reqClient)
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		if reqClient.Name == "" {
+			RenderResponse(w, r, NewBadRequestErr("name is required"))
+			return
+		}
+
+		if len(reqClient.RedirectUris) == 0 && !reqClient.Confidential {
+			RenderResponse(w, r, NewBadRequestErr("redirectUris is required for public clients"))
+			return
+		}
+
+		for _, redirectUri := range reqClient.RedirectUris {
+			parsed, err := url.Parse(redirectUri)
+
+			if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+				RenderResponse(w, r, NewBadRequestErr("redirectUris must be absolute without a fragment"))
+				return
+			}
+		}
+
+		if reqClient.Scopes == nil {
+			reqClient.Scopes = make([]string, 0)
+		}
+
+		oauthRepo, ok := r.Context().Value("oauthRepo").(OAuthRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		var secret, secretHash string
+
+		if reqClient.Confidential {
+			secret, secretHash, err = newOpaqueToken()
+
+			if err != nil {
+				RenderResponse(w, r, NewInternalServerErr("internal error"))
+				return
+			}
+		}
+
+		id, err := oauthRepo.NewClient(reqClient.Name, secretHash, reqClient.RedirectUris, reqClient.Scopes)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			log.Println(err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "client", newClientResponse{id, secret})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// NewClient renders the response to the client registration request, the only time the secret is revealed.
+func NewClient(w http.ResponseWriter, r *http.Request) {
+	res, ok := r.Context().Value("client").(newClientResponse)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, res)
+}
@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 )
 
@@ -12,14 +13,17 @@ type newSessionRequest struct {
 }
 
 type newSessionResponse struct {
-	Token string `json:"token"`
+	Token          string `json:"token,omitempty"`
+	RefreshToken   string `json:"refreshToken,omitempty"`
+	MfaRequired    bool   `json:"mfaRequired,omitempty"`
+	ChallengeToken string `json:"challengeToken,omitempty"`
 }
 
 func (nsr newSessionResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
-// NewSessionMiddleware middleware to authenticate a user from the request parameters
+// NewSessionMiddleware middleware to authenticate a user from the request parameters, throttling repeated failures
 func NewSessionMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
@@ -48,8 +52,30 @@ func NewSessionMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		err = checkLoginThrottle(r, config, userRepo, reqUser.Email)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		// Inactive accounts are only reported once the password is known to be right.
 		user, err := userRepo.Authenticate(reqUser.Email, reqUser.Password)
 
+		if err != nil && !errors.Is(err, errAccountInactive) {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = recordLoginResult(r, config, userRepo, reqUser.Email, user.Id != "")
+
 		if err != nil {
 			RenderResponse(w, r, NewInternalServerErr("repo error"))
 			return
@@ -58,28 +84,57 @@ func NewSessionMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
+		err = checkAccountStatus(user)
 
-		if !ok {
-			RenderResponse(w, r, NewInternalServerErr("internal error"))
+		if err == nil {
+			err = checkEmailVerified(config, user)
+		}
+
+		if err != nil {
+			RenderError(w, r, err)
 			return
 		}
 
-		token, err := tokenFactory.NewToken(NewClaims(user.Id, user.Email, user.Username))
+		required, err := mfaRequired(userRepo, user.Id)
 
 		if err != nil {
-			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		} else if required {
+			challenge, err := newMfaChallenge(r.Context(), user.Id)
+
+			if err != nil {
+				RenderError(w, r, err)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), "challengeToken", challenge)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		token, refreshToken, err := startSession(r.Context(), user, "", "")
+
+		if err != nil {
+			RenderError(w, r, err)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), "token", token)
+		ctx = context.WithValue(ctx, "refreshToken", refreshToken)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// NewSession responds to authentication request with jwt token or appropriate error
+// NewSession responds to authentication request with jwt token, a challenge for a second factor or appropriate error
 func NewSession(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+
+	if challenge, ok := ctx.Value("challengeToken").(string); ok {
+		RenderResponse(w, r, newSessionResponse{MfaRequired: true, ChallengeToken: challenge})
+		return
+	}
+
 	token, ok := ctx.Value("token").(string)
 
 	if !ok {
@@ -87,5 +142,12 @@ func NewSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	RenderResponse(w, r, newSessionResponse{token})
+	refreshToken, ok := ctx.Value("refreshToken").(string)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, newSessionResponse{Token: token, RefreshToken: refreshToken})
 }
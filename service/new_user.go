@@ -3,8 +3,10 @@ package service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"net/mail"
 )
 
 type newUserRequest struct {
@@ -15,7 +17,9 @@ type newUserRequest struct {
 }
 
 type newUserResponse struct {
-	Token string `json:"token"`
+	Token                string `json:"token,omitempty"`
+	RefreshToken         string `json:"refreshToken,omitempty"`
+	VerificationRequired bool   `json:"verificationRequired,omitempty"`
 }
 
 func (nsr newUserResponse) Render(w http.ResponseWriter, _ *http.Request) error {
@@ -24,6 +28,12 @@ func (nsr newUserResponse) Render(w http.ResponseWriter, _ *http.Request) error
 	return nil
 }
 
+// validEmail reports whether email is a bare email address.
+func validEmail(email string) bool {
+	address, err := mail.ParseAddress(email)
+	return err == nil && address.Address == email
+}
+
 // NewUserMiddleware middleware to add a new user to the repo from the request parameters
 func NewUserMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -41,6 +51,11 @@ func NewUserMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		if !validEmail(reqUser.Email) {
+			RenderResponse(w, r, NewBadRequestErr("email is invalid"))
+			return
+		}
+
 		if reqUser.Username == "" {
 			RenderResponse(w, r, NewBadRequestErr("handle is required"))
 			return
@@ -51,6 +66,13 @@ func NewUserMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
 		userRepo, ok := r.Context().Value("repo").(UserRepository)
 
 		if !ok {
@@ -58,6 +80,20 @@ func NewUserMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		mailer, ok := r.Context().Value("mailer").(Mailer)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		err = checkPasswordPolicy(config, reqUser.Password, reqUser.Email, reqUser.Username)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
 		id, err := userRepo.NewUser(
 			reqUser.Email,
 			reqUser.Username,
@@ -67,27 +103,41 @@ func NewUserMiddleware(next http.Handler) http.Handler {
 			reqUser.UserProfile.Topics,
 		)
 
-		if err != nil {
+		if errors.Is(err, errEmailTaken) {
+			RenderResponse(w, r, NewConflictErr("email already in use"))
+			return
+		} else if errors.Is(err, errUsernameTaken) {
+			RenderResponse(w, r, NewConflictErr("handle taken"))
+			return
+		} else if err != nil {
 			RenderResponse(w, r, NewInternalServerErr("internal error"))
 			log.Println(err)
 			return
 		}
 
-		tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
+		user := User{Id: id, Email: reqUser.Email, Username: reqUser.Username, UserProfile: reqUser.UserProfile}
+		err = sendVerificationEmail(config, userRepo, mailer, user)
 
-		if !ok {
-			RenderResponse(w, r, NewInternalServerErr("internal error"))
+		// The user can ask for another link, so the account is kept.
+		if err != nil {
+			log.Printf("Unable to send verification email: %s", err.Error())
+		}
+
+		if checkEmailVerified(config, user) != nil {
+			ctx := context.WithValue(r.Context(), "verificationRequired", true)
+			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
 
-		token, err := tokenFactory.NewToken(NewClaims(id, reqUser.Email, reqUser.Username))
+		token, refreshToken, err := startSession(r.Context(), user, "", "")
 
 		if err != nil {
-			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			RenderError(w, r, err)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), "token", token)
+		ctx = context.WithValue(ctx, "refreshToken", refreshToken)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -95,6 +145,12 @@ func NewUserMiddleware(next http.Handler) http.Handler {
 // NewUser renders the response to the product update request.
 func NewUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+
+	if required, _ := ctx.Value("verificationRequired").(bool); required {
+		RenderResponse(w, r, newUserResponse{VerificationRequired: true})
+		return
+	}
+
 	token, ok := ctx.Value("token").(string)
 
 	if !ok {
@@ -102,5 +158,12 @@ func NewUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	RenderResponse(w, r, newUserResponse{token})
+	refreshToken, ok := ctx.Value("refreshToken").(string)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, newUserResponse{Token: token, RefreshToken: refreshToken})
 }
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	oauthInvalidRequest          = "invalid_request"
+	oauthInvalidClient           = "invalid_client"
+	oauthInvalidGrant            = "invalid_grant"
+	oauthInvalidScope            = "invalid_scope"
+	oauthUnauthorizedClient      = "unauthorized_client"
+	oauthUnsupportedGrantType    = "unsupported_grant_type"
+	oauthUnsupportedResponseType = "unsupported_response_type"
+	oauthAccessDenied            = "access_denied"
+	oauthServerError             = "server_error"
+)
+
+// oauthErrorResponse is an error in the form required by RFC 6749.
+type oauthErrorResponse struct {
+	Status      int    `json:"-"`
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (oer oauthErrorResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if oer.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Basic")
+	}
+
+	w.WriteHeader(oer.Status)
+
+	return nil
+}
+
+func (oer oauthErrorResponse) Error() string {
+	return fmt.Sprintf("%s: %s", oer.Code, oer.Description)
+}
+
+func newOAuthErr(code string, description string) oauthErrorResponse {
+	status := http.StatusBadRequest
+
+	if code == oauthInvalidClient {
+		status = http.StatusUnauthorized
+	} else if code == oauthServerError {
+		status = http.StatusInternalServerError
+	}
+
+	return oauthErrorResponse{status, code, description}
+}
+
+// toOAuthErr converts an ErrorResponse from the session helpers to its OAuth equivalent.
+func toOAuthErr(err error) oauthErrorResponse {
+	var oauthErr oauthErrorResponse
+	var errorResponse ErrorResponse
+
+	if errors.As(err, &oauthErr) {
+		return oauthErr
+	} else if errors.As(err, &errorResponse) && errorResponse.Status == http.StatusUnauthorized {
+		return newOAuthErr(oauthInvalidGrant, errorResponse.Message)
+	}
+
+	return newOAuthErr(oauthServerError, "")
+}
+
+// grantScope determines the scope granted to a client for the requested space separated scope. An empty request is
+// granted every scope the client is registered for.
+func grantScope(requested string, allowed []string) (string, bool) {
+	if strings.TrimSpace(requested) == "" {
+		return strings.Join(allowed, " "), true
+	}
+
+	scopes := strings.Fields(requested)
+
+	for _, scope := range scopes {
+		if !containsString(allowed, scope) {
+			return "", false
+		}
+	}
+
+	return strings.Join(scopes, " "), true
+}
+
+// verifyCodeChallenge checks a PKCE code verifier against the S256 challenge it should hash to.
+func verifyCodeChallenge(challenge string, verifier string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return verifier != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// authenticateClient identifies the client making a token request from HTTP basic credentials or form parameters,
+// verifying the secret of confidential clients.
+func authenticateClient(r *http.Request, oauthRepo OAuthRepository) (OAuthClient, error) {
+	clientId, secret, hasBasic := r.BasicAuth()
+
+	if !hasBasic {
+		clientId = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+
+	if clientId == "" {
+		return OAuthClient{}, newOAuthErr(oauthInvalidClient, "client authentication required")
+	}
+
+	client, err := oauthRepo.GetClient(clientId)
+
+	if errors.Is(err, errClientNotFound) {
+		return OAuthClient{}, newOAuthErr(oauthInvalidClient, "client authentication failed")
+	} else if err != nil {
+		return OAuthClient{}, newOAuthErr(oauthServerError, "")
+	}
+
+	if client.IsConfidential() {
+		match := subtle.ConstantTimeCompare([]byte(hashOpaqueToken(secret)), []byte(client.SecretHash)) == 1
+
+		if secret == "" || !match {
+			return OAuthClient{}, newOAuthErr(oauthInvalidClient, "client authentication failed")
+		}
+	} else if secret != "" {
+		return OAuthClient{}, newOAuthErr(oauthInvalidClient, "client authentication failed")
+	}
+
+	return client, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,385 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// authorizationCodeTtl is how long an authorization code can be exchanged for tokens after it is issued.
+const authorizationCodeTtl = 5 * time.Minute
+
+const (
+	// consentAllow is the consent decision granting the client the authorization it requested.
+	consentAllow = "allow"
+	// consentDeny is the consent decision refusing the client the authorization it requested.
+	consentDeny = "deny"
+)
+
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign in to {{.ClientName}}</title></head>
+<body>
+<h1>Sign in to {{.ClientName}}</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<form method="post" action="{{.Action}}">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<label>Email <input type="email" name="email" required></label>
+<label>Password <input type="password" name="password" required></label>
+{{if .CodeRequired}}<label>Authenticator or recovery code <input type="text" name="code" inputmode="numeric" autocomplete="one-time-code" required></label>
+{{end}}<p>{{.ClientName}} is asking to access your account{{if .Scope}} with the scope: {{.Scope}}{{end}}.</p>
+<button type="submit" name="consent" value="allow">Sign in and allow</button>
+<button type="submit" name="consent" value="deny" formnovalidate>Deny</button>
+</form>
+</body>
+</html>
+`))
+
+type loginPageParams struct {
+	ClientName   string
+	Error        string
+	Action       string
+	Params       map[string]string
+	Scope        string
+	CodeRequired bool
+}
+
+type authorizeRequest struct {
+	ResponseType        string
+	ClientId            string
+	RedirectUri         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+	// Consent is the user's decision on granting the authorization, consentAllow or consentDeny
+	Consent string
+}
+
+func parseAuthorizeRequest(form url.Values) authorizeRequest {
+	return authorizeRequest{
+		ResponseType:        form.Get("response_type"),
+		ClientId:            form.Get("client_id"),
+		RedirectUri:         form.Get("redirect_uri"),
+		Scope:               form.Get("scope"),
+		State:               form.Get("state"),
+		CodeChallenge:       form.Get("code_challenge"),
+		CodeChallengeMethod: form.Get("code_challenge_method"),
+		Nonce:               form.Get("nonce"),
+		Consent:             form.Get("consent"),
+	}
+}
+
+// params returns the request as the parameters it was made with, for carrying through the login form.
+func (ar authorizeRequest) params() map[string]string {
+	return map[string]string{
+		"response_type":         ar.ResponseType,
+		"client_id":             ar.ClientId,
+		"redirect_uri":          ar.RedirectUri,
+		"scope":                 ar.Scope,
+		"state":                 ar.State,
+		"code_challenge":        ar.CodeChallenge,
+		"code_challenge_method": ar.CodeChallengeMethod,
+		"nonce":                 ar.Nonce,
+	}
+}
+
+// redirectUrl builds the url the user agent is sent back to the client with.
+func (ar authorizeRequest) redirectUrl(params url.Values) string {
+	if ar.State != "" {
+		params.Set("state", ar.State)
+	}
+
+	redirect, _ := url.Parse(ar.RedirectUri)
+	query := redirect.Query()
+
+	for name, values := range params {
+		query[name] = values
+	}
+
+	redirect.RawQuery = query.Encode()
+
+	return redirect.String()
+}
+
+func (ar authorizeRequest) errorUrl(code string, description string) string {
+	return ar.redirectUrl(url.Values{"error": {code}, "error_description": {description}})
+}
+
+func renderLoginPage(w http.ResponseWriter, r *http.Request, status int, client OAuthClient, ar authorizeRequest,
+	message string, codeRequired bool) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	err := loginPage.Execute(w, loginPageParams{client.Name, message, r.URL.Path, ar.params(), ar.Scope, codeRequired})
+
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// authenticateAuthorizeRequest identifies the user granting an authorization and when they authenticated, either from
+// a first party bearer token or from credentials posted by the login form. Either way the user must have consented to
+// the authorization. Returns false if the login form was rendered instead.
+func authenticateAuthorizeRequest(w http.ResponseWriter, r *http.Request, client OAuthClient,
+	ar authorizeRequest) (User, time.Time, bool) {
+	userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return User{}, time.Time{}, false
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		// Tokens issued to OAuth clients can't be used to authorize another, or the same, client.
+		tokenUser, sessionId, err := authenticateBearer(r, false)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return User{}, time.Time{}, false
+		}
+
+		// The first party app presenting the token asks the user for their consent and passes on the decision.
+		if ar.Consent != consentAllow {
+			RenderResponse(w, r, NewBadRequestErr("consent required"))
+			return User{}, time.Time{}, false
+		}
+
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return User{}, time.Time{}, false
+		}
+
+		session, err := sessionRepo.GetSession(sessionId)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return User{}, time.Time{}, false
+		}
+
+		user, err := userRepo.GetUser(tokenUser.Id)
+
+		if errors.Is(err, errUserNotFound) {
+			RenderResponse(w, r, NewUnauthorizedErr("unauthorized"))
+			return User{}, time.Time{}, false
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return User{}, time.Time{}, false
+		}
+
+		// The user last authenticated when the session behind the token was started
+		return user, session.CreatedAt, true
+	}
+
+	email := r.PostForm.Get("email")
+	password := r.PostForm.Get("password")
+
+	if r.Method != http.MethodPost || email == "" || password == "" {
+		renderLoginPage(w, r, http.StatusOK, client, ar, "", false)
+		return User{}, time.Time{}, false
+	}
+
+	if ar.Consent != consentAllow {
+		renderLoginPage(w, r, http.StatusOK, client, ar, "Allow "+client.Name+" access to continue.", false)
+		return User{}, time.Time{}, false
+	}
+
+	config, ok := r.Context().Value("config").(Configuration)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return User{}, time.Time{}, false
+	}
+
+	var throttled ErrorResponse
+
+	if err := checkLoginThrottle(r, config, userRepo, email); errors.As(err, &throttled) &&
+		throttled.Status == http.StatusTooManyRequests {
+		setRetryAfter(w, throttled.RetryAfter)
+		renderLoginPage(w, r, http.StatusTooManyRequests, client, ar,
+			"Too many failed sign in attempts. Try again later.", false)
+		return User{}, time.Time{}, false
+	} else if err != nil {
+		RenderError(w, r, err)
+		return User{}, time.Time{}, false
+	}
+
+	user, err := userRepo.Authenticate(email, password)
+
+	if err == nil || errors.Is(err, errAccountInactive) {
+		err = recordLoginResult(r, config, userRepo, email, user.Id != "")
+	}
+
+	if err != nil {
+		RenderResponse(w, r, NewInternalServerErr("repo error"))
+		return User{}, time.Time{}, false
+	} else if user.Id == "" {
+		renderLoginPage(w, r, http.StatusUnauthorized, client, ar, "Incorrect email or password.", false)
+		return User{}, time.Time{}, false
+	}
+
+	if checkAccountStatus(user) != nil {
+		renderLoginPage(w, r, http.StatusForbidden, client, ar, "This account can't be used to sign in.", false)
+		return User{}, time.Time{}, false
+	}
+
+	if checkEmailVerified(config, user) != nil {
+		renderLoginPage(w, r, http.StatusForbidden, client, ar, "Verify your email address before signing in.", false)
+		return User{}, time.Time{}, false
+	}
+
+	required, err := mfaRequired(userRepo, user.Id)
+
+	if err != nil {
+		RenderResponse(w, r, NewInternalServerErr("repo error"))
+		return User{}, time.Time{}, false
+	} else if required {
+		code := r.PostForm.Get("code")
+
+		if code == "" {
+			renderLoginPage(w, r, http.StatusOK, client, ar, "Enter the code from your authenticator app or a recovery code.", true)
+			return User{}, time.Time{}, false
+		}
+
+		enrollment, err := userRepo.GetTotp(user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return User{}, time.Time{}, false
+		}
+
+		// The code field accepts recovery codes too, which are never six digits long
+		recoveryCode := ""
+
+		if len(code) != totpDigits {
+			recoveryCode = code
+		}
+
+		if checkSecondFactor(userRepo, user.Id, enrollment, code, recoveryCode) != nil {
+			renderLoginPage(w, r, http.StatusUnauthorized, client, ar, "Incorrect authenticator code.", true)
+			return User{}, time.Time{}, false
+		}
+	}
+
+	return user, time.Now(), true
+}
+
+// AuthorizeMiddleware middleware to grant an OAuth client an authorization code on behalf of a user
+func AuthorizeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("request invalid"))
+			return
+		}
+
+		ar := parseAuthorizeRequest(r.Form)
+
+		oauthRepo, ok := r.Context().Value("oauthRepo").(OAuthRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		client, err := oauthRepo.GetClient(ar.ClientId)
+
+		if errors.Is(err, errClientNotFound) || ar.ClientId == "" {
+			RenderResponse(w, r, NewBadRequestErr("client invalid"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		if ar.RedirectUri == "" && len(client.RedirectUris) == 1 {
+			ar.RedirectUri = client.RedirectUris[0]
+		}
+
+		// An unverified redirect uri must never be redirected to, errors are reported to the user agent instead.
+		if !containsString(client.RedirectUris, ar.RedirectUri) {
+			RenderResponse(w, r, NewBadRequestErr("redirect_uri invalid"))
+			return
+		}
+
+		if ar.ResponseType != "code" {
+			http.Redirect(w, r, ar.errorUrl(oauthUnsupportedResponseType, "only code is supported"), http.StatusFound)
+			return
+		}
+
+		if ar.CodeChallenge == "" || ar.CodeChallengeMethod != "S256" {
+			http.Redirect(w, r, ar.errorUrl(oauthInvalidRequest, "PKCE with S256 is required"), http.StatusFound)
+			return
+		}
+
+		scope, ok := grantScope(ar.Scope, client.Scopes)
+
+		if !ok {
+			http.Redirect(w, r, ar.errorUrl(oauthInvalidScope, "scope not allowed"), http.StatusFound)
+			return
+		}
+
+		// The login form asks for consent to exactly what is granted
+		ar.Scope = scope
+
+		if ar.Consent == consentDeny {
+			http.Redirect(w, r, ar.errorUrl(oauthAccessDenied, "the user denied the request"), http.StatusFound)
+			return
+		}
+
+		user, authTime, ok := authenticateAuthorizeRequest(w, r, client, ar)
+
+		if !ok {
+			return
+		}
+
+		code, codeHash, err := newOpaqueToken()
+
+		if err != nil {
+			http.Redirect(w, r, ar.errorUrl(oauthServerError, ""), http.StatusFound)
+			return
+		}
+
+		err = oauthRepo.AddAuthorizationCode(AuthorizationCode{
+			CodeHash:      codeHash,
+			ClientId:      client.Id,
+			UserId:        user.Id,
+			RedirectUri:   ar.RedirectUri,
+			Scope:         scope,
+			CodeChallenge: ar.CodeChallenge,
+			Nonce:         ar.Nonce,
+			AuthTime:      authTime,
+			ExpiresAt:     time.Now().Add(authorizationCodeTtl),
+		})
+
+		if err != nil {
+			http.Redirect(w, r, ar.errorUrl(oauthServerError, ""), http.StatusFound)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "redirect", ar.redirectUrl(url.Values{"code": {code}}))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Authorize redirects the user agent back to the client with the granted authorization code.
+func Authorize(w http.ResponseWriter, r *http.Request) {
+	redirect, ok := r.Context().Value("redirect").(string)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
@@ -0,0 +1,128 @@
+package service
+
+import (
+	"github.com/twinj/uuid"
+	"sync"
+	"time"
+)
+
+type storedAuthorizationCode struct {
+	AuthorizationCode
+	Used bool
+}
+
+type inMemoryOAuthRepository struct {
+	mutex   sync.RWMutex
+	clients map[string]*OAuthClient
+	codes   map[string]*storedAuthorizationCode
+}
+
+// NewClient registers a client, returning its generated id.
+func (imor *inMemoryOAuthRepository) NewClient(
+	name string,
+	secretHash string,
+	redirectUris []string,
+	scopes []string,
+) (string, error) {
+	if name == "" {
+		return "", newErrRepository("name is required")
+	} else if len(redirectUris) == 0 && secretHash == "" {
+		return "", newErrRepository("redirectUris is required for public clients")
+	}
+
+	id := uuid.NewV4().String()
+
+	imor.mutex.Lock()
+	defer imor.mutex.Unlock()
+
+	imor.clients[id] = &OAuthClient{
+		Id:           id,
+		Name:         name,
+		SecretHash:   secretHash,
+		RedirectUris: redirectUris,
+		Scopes:       scopes,
+		CreatedAt:    time.Now(),
+	}
+
+	return id, nil
+}
+
+// GetClient retrieves the client with the given id.
+func (imor *inMemoryOAuthRepository) GetClient(clientId string) (OAuthClient, error) {
+	if clientId == "" {
+		return OAuthClient{}, newErrRepository("clientId is required")
+	}
+
+	imor.mutex.RLock()
+	defer imor.mutex.RUnlock()
+
+	client, ok := imor.clients[clientId]
+	if !ok {
+		return OAuthClient{}, errClientNotFound
+	}
+
+	return *client, nil
+}
+
+// AddAuthorizationCode stores an authorization code pending exchange.
+func (imor *inMemoryOAuthRepository) AddAuthorizationCode(code AuthorizationCode) error {
+	if code.CodeHash == "" {
+		return newErrRepository("codeHash is required")
+	} else if code.ClientId == "" {
+		return newErrRepository("clientId is required")
+	} else if code.UserId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imor.mutex.Lock()
+	defer imor.mutex.Unlock()
+
+	imor.codes[code.CodeHash] = &storedAuthorizationCode{AuthorizationCode: code}
+
+	return nil
+}
+
+// ConsumeAuthorizationCode retrieves the authorization code matching codeHash, marking it used.
+func (imor *inMemoryOAuthRepository) ConsumeAuthorizationCode(codeHash string) (AuthorizationCode, error) {
+	if codeHash == "" {
+		return AuthorizationCode{}, newErrRepository("codeHash is required")
+	}
+
+	imor.mutex.Lock()
+	defer imor.mutex.Unlock()
+
+	code, ok := imor.codes[codeHash]
+	if !ok || code.Used || time.Now().After(code.ExpiresAt) {
+		return AuthorizationCode{}, errAuthorizationCodeInvalid
+	}
+
+	code.Used = true
+
+	return code.AuthorizationCode, nil
+}
+
+// DeleteUserAuthorizationCodes removes every authorization code granted by the given user.
+func (imor *inMemoryOAuthRepository) DeleteUserAuthorizationCodes(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imor.mutex.Lock()
+	defer imor.mutex.Unlock()
+
+	for codeHash, code := range imor.codes {
+		if code.UserId == userId {
+			delete(imor.codes, codeHash)
+		}
+	}
+
+	return nil
+}
+
+// MakeInMemoryOAuthRepository constructs an in memory backed OAuthRepository.
+func MakeInMemoryOAuthRepository() OAuthRepository {
+	return &inMemoryOAuthRepository{
+		clients: make(map[string]*OAuthClient),
+		codes:   make(map[string]*storedAuthorizationCode),
+	}
+}
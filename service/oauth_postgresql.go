@@ -0,0 +1,138 @@
+package service
+
+import (
+	"database/sql"
+	pg "github.com/lib/pq"
+	"github.com/twinj/uuid"
+)
+
+const (
+	insertOAuthClient       = "INSERT INTO oauth_client (id, name, secret_hash, redirect_uris, scopes) VALUES ($1, $2, $3, $4, $5)"
+	getOAuthClient          = "SELECT name, secret_hash, redirect_uris, scopes, created_at FROM oauth_client WHERE id=$1"
+	insertAuthorizationCode = "INSERT INTO oauth_code (code_hash, client_id, user_id, redirect_uri, scope, code_challenge, nonce, auth_time, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+	useAuthorizationCode    = "UPDATE oauth_code SET used_at=now() WHERE code_hash=$1 AND used_at IS NULL AND expires_at > now() RETURNING client_id, user_id, redirect_uri, scope, code_challenge, nonce, auth_time, expires_at"
+	deleteUserCodes         = "DELETE FROM oauth_code WHERE user_id=$1"
+)
+
+type postgresqlOAuthRepository struct {
+	db *sql.DB
+}
+
+// NewClient registers a client, returning its generated id.
+func (por *postgresqlOAuthRepository) NewClient(
+	name string,
+	secretHash string,
+	redirectUris []string,
+	scopes []string,
+) (string, error) {
+	if name == "" {
+		return "", newErrRepository("name is required")
+	} else if len(redirectUris) == 0 && secretHash == "" {
+		return "", newErrRepository("redirectUris is required for public clients")
+	}
+
+	id := uuid.NewV4().String()
+
+	_, err := por.db.Exec(insertOAuthClient, id, name, secretHash, pg.Array(redirectUris), pg.Array(scopes))
+
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// GetClient retrieves the client with the given id.
+func (por *postgresqlOAuthRepository) GetClient(clientId string) (OAuthClient, error) {
+	if clientId == "" {
+		return OAuthClient{}, newErrRepository("clientId is required")
+	}
+
+	client := OAuthClient{Id: clientId}
+
+	err := por.db.QueryRow(getOAuthClient, clientId).Scan(
+		&client.Name,
+		&client.SecretHash,
+		pg.Array(&client.RedirectUris),
+		pg.Array(&client.Scopes),
+		&client.CreatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return OAuthClient{}, errClientNotFound
+	} else if err != nil {
+		return OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+// AddAuthorizationCode stores an authorization code pending exchange.
+func (por *postgresqlOAuthRepository) AddAuthorizationCode(code AuthorizationCode) error {
+	if code.CodeHash == "" {
+		return newErrRepository("codeHash is required")
+	} else if code.ClientId == "" {
+		return newErrRepository("clientId is required")
+	} else if code.UserId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	_, err := por.db.Exec(
+		insertAuthorizationCode,
+		code.CodeHash,
+		code.ClientId,
+		code.UserId,
+		code.RedirectUri,
+		code.Scope,
+		code.CodeChallenge,
+		code.Nonce,
+		code.AuthTime,
+		code.ExpiresAt,
+	)
+
+	return err
+}
+
+// ConsumeAuthorizationCode retrieves the authorization code matching codeHash, marking it used.
+func (por *postgresqlOAuthRepository) ConsumeAuthorizationCode(codeHash string) (AuthorizationCode, error) {
+	if codeHash == "" {
+		return AuthorizationCode{}, newErrRepository("codeHash is required")
+	}
+
+	code := AuthorizationCode{CodeHash: codeHash}
+
+	err := por.db.QueryRow(useAuthorizationCode, codeHash).Scan(
+		&code.ClientId,
+		&code.UserId,
+		&code.RedirectUri,
+		&code.Scope,
+		&code.CodeChallenge,
+		&code.Nonce,
+		&code.AuthTime,
+		&code.ExpiresAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return AuthorizationCode{}, errAuthorizationCodeInvalid
+	} else if err != nil {
+		return AuthorizationCode{}, err
+	}
+
+	return code, nil
+}
+
+// DeleteUserAuthorizationCodes removes every authorization code granted by the given user.
+func (por *postgresqlOAuthRepository) DeleteUserAuthorizationCodes(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	_, err := por.db.Exec(deleteUserCodes, userId)
+
+	return err
+}
+
+// MakePostgresqlOAuthRepository constructs a PostgreSQL backed OAuthRepository from the given db.
+func MakePostgresqlOAuthRepository(db *sql.DB) OAuthRepository {
+	return &postgresqlOAuthRepository{db}
+}
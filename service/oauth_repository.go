@@ -0,0 +1,75 @@
+package service
+
+import (
+	"database/sql"
+	"time"
+)
+
+var (
+	// errClientNotFound is returned when no OAuth client is registered with a given id.
+	errClientNotFound = newErrRepository("client not found")
+	// errAuthorizationCodeInvalid is returned when an authorization code is unknown, expired or already used.
+	errAuthorizationCodeInvalid = newErrRepository("authorization code invalid")
+)
+
+// OAuthClient holds information on an application registered to obtain tokens through the OAuth endpoints.
+type OAuthClient struct {
+	Id           string    `json:"id"`
+	Name         string    `json:"name"`
+	SecretHash   string    `json:"-"`
+	RedirectUris []string  `json:"redirectUris"`
+	Scopes       []string  `json:"scopes"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// IsConfidential reports whether the client authenticates with a secret.
+func (oc OAuthClient) IsConfidential() bool {
+	return oc.SecretHash != ""
+}
+
+// AuthorizationCode holds the details of an authorization granted by a user to a client, pending exchange for tokens.
+type AuthorizationCode struct {
+	CodeHash      string
+	ClientId      string
+	UserId        string
+	RedirectUri   string
+	Scope         string
+	CodeChallenge string
+	Nonce         string
+	AuthTime      time.Time
+	ExpiresAt     time.Time
+}
+
+// OAuthRepository represents a data source through which OAuth clients and their authorizations can be managed.
+type OAuthRepository interface {
+	// NewClient registers a client, returning its generated id. Public clients have an empty secretHash.
+	NewClient(name string, secretHash string, redirectUris []string, scopes []string) (string, error)
+	// GetClient retrieves the client with the given id.
+	GetClient(clientId string) (OAuthClient, error)
+	// AddAuthorizationCode stores an authorization code pending exchange.
+	AddAuthorizationCode(code AuthorizationCode) error
+	// ConsumeAuthorizationCode retrieves the authorization code matching codeHash, ensuring it can't be used again.
+	ConsumeAuthorizationCode(codeHash string) (AuthorizationCode, error)
+	// DeleteUserAuthorizationCodes removes every authorization code granted by the given user, for when the user is
+	// deleted.
+	DeleteUserAuthorizationCodes(userId string) error
+}
+
+// NewOAuthRepository constructs an OAuthRepository from the given configuration, backed by db when it uses PostgreSQL.
+func NewOAuthRepository(config Configuration, db *sql.DB) (OAuthRepository, error) {
+	var err error
+	var repo OAuthRepository
+	switch config.GetRepoType() {
+	case InMemoryRepo:
+		repo = MakeInMemoryOAuthRepository()
+	case PostgreSqlRepo:
+		if db == nil {
+			return nil, newErrRepository("db is required")
+		}
+		repo = MakePostgresqlOAuthRepository(db)
+	default:
+		err = newErrRepository("repository type unimplemented")
+	}
+
+	return repo, err
+}
@@ -0,0 +1,357 @@
+package service_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testRedirectUri = "https://client.example.com/callback"
+
+type oauthTokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	IdToken      string `json:"id_token"`
+	Scope        string `json:"scope"`
+	Error        string `json:"error"`
+}
+
+func newOAuthTestServer(t *testing.T) *testServer {
+	ts := newTestServer(t, func(r chi.Router) {
+		r.Route("/oauth", func(r chi.Router) {
+			r.With(service.AuthorizeMiddleware).Get("/authorize", service.Authorize)
+			r.With(service.AuthorizeMiddleware).Post("/authorize", service.Authorize)
+			r.With(service.OAuthTokenMiddleware).Post("/token", service.OAuthToken)
+		})
+		r.With(service.NewClientMiddleware).Post("/admin/oauth/clients", service.NewClient)
+		r.With(service.JwtAuthMiddleware).With(service.EndSessionMiddleware).Delete("/session/", service.EndSession)
+		r.With(service.DelegatedJwtAuthMiddleware).With(service.UserInfoMiddleware).Get("/userinfo", service.UserInfo)
+		r.Get("/.well-known/openid-configuration", service.GetOpenIdConfiguration)
+	})
+
+	_, err := ts.repo.NewUser("user@justinstone.net", "user", "password", service.MALE, 30, []string{})
+	ok(t, err)
+
+	return ts
+}
+
+// newClient registers a client through the admin endpoint, returning its id and secret.
+func newClient(t *testing.T, ts *testServer, confidential bool) (string, string) {
+	var res struct {
+		ClientId     string `json:"clientId"`
+		ClientSecret string `json:"clientSecret"`
+	}
+
+	status := ts.do(t, http.MethodPost, "/admin/oauth/clients", "", map[string]interface{}{
+		"name":         "client",
+		"redirectUris": []string{testRedirectUri},
+		"scopes":       []string{"read", "write"},
+		"confidential": confidential,
+	}, &res)
+	equals(t, http.StatusOK, status)
+	assert(t, res.ClientId != "", "expected client id")
+	equals(t, confidential, res.ClientSecret != "")
+
+	return res.ClientId, res.ClientSecret
+}
+
+// postForm performs a form encoded request against the test server, returning the recorded response.
+func postForm(ts *testServer, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	ts.router.ServeHTTP(res, req)
+	return res
+}
+
+func requestToken(t *testing.T, ts *testServer, form url.Values) (int, oauthTokens) {
+	res := postForm(ts, "/oauth/token", form)
+
+	var tokens oauthTokens
+	ok(t, json.NewDecoder(res.Body).Decode(&tokens))
+	return res.Code, tokens
+}
+
+// authorize performs an authorization request with a PKCE challenge for verifier, returning the redirect location.
+func authorize(t *testing.T, ts *testServer, clientId string, verifier string, scope string) *url.URL {
+	sum := sha256.Sum256([]byte(verifier))
+	res := postForm(ts, "/oauth/authorize", url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientId},
+		"redirect_uri":          {testRedirectUri},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+		"email":                 {"user@justinstone.net"},
+		"password":              {"password"},
+		"consent":               {"allow"},
+	})
+	equals(t, http.StatusFound, res.Code)
+
+	location, err := url.Parse(res.Header().Get("Location"))
+	ok(t, err)
+	return location
+}
+
+// TestOAuth_AuthorizationCode ensures a public client can exchange a PKCE protected code for tokens exactly once.
+func TestOAuth_AuthorizationCode(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	clientId, _ := newClient(t, ts, false)
+
+	verifier := "a-sufficiently-long-code-verifier-for-the-test"
+	location := authorize(t, ts, clientId, verifier, "read")
+	equals(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	assert(t, code != "", "expected code in %s", location)
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientId},
+		"code":          {code},
+		"redirect_uri":  {testRedirectUri},
+		"code_verifier": {"wrong-verifier"},
+	}
+
+	status, tokens := requestToken(t, ts, form)
+	equals(t, http.StatusBadRequest, status)
+	equals(t, "invalid_grant", tokens.Error)
+
+	// A failed exchange still consumes the code.
+	form.Set("code_verifier", verifier)
+	status, tokens = requestToken(t, ts, form)
+	equals(t, http.StatusBadRequest, status)
+
+	code = authorize(t, ts, clientId, verifier, "read").Query().Get("code")
+	form.Set("code", code)
+	status, tokens = requestToken(t, ts, form)
+	equals(t, http.StatusOK, status)
+	equals(t, "Bearer", tokens.TokenType)
+	equals(t, "read", tokens.Scope)
+	assert(t, tokens.AccessToken != "", "expected access token")
+	assert(t, tokens.RefreshToken != "", "expected refresh token")
+
+	status, tokens = requestToken(t, ts, form)
+	equals(t, http.StatusBadRequest, status)
+}
+
+// TestOAuth_Authorize_UnknownRedirect ensures errors are never redirected to an unregistered redirect uri.
+func TestOAuth_Authorize_UnknownRedirect(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	clientId, _ := newClient(t, ts, false)
+
+	res := postForm(ts, "/oauth/authorize", url.Values{
+		"response_type": {"code"},
+		"client_id":     {clientId},
+		"redirect_uri":  {"https://evil.example.com/"},
+	})
+	equals(t, http.StatusBadRequest, res.Code)
+	equals(t, "", res.Header().Get("Location"))
+}
+
+// authorizeForm returns the parameters of an authorization request for clientId with a PKCE challenge.
+func authorizeForm(clientId string) url.Values {
+	sum := sha256.Sum256([]byte("a-sufficiently-long-code-verifier-for-the-test"))
+
+	return url.Values{
+		"response_type":         {"code"},
+		"client_id":             {clientId},
+		"redirect_uri":          {testRedirectUri},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}
+}
+
+// authorizeWithToken performs an authorization request authenticated with a bearer token.
+func authorizeWithToken(ts *testServer, form url.Values, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/oauth/authorize", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+token)
+	res := httptest.NewRecorder()
+	ts.router.ServeHTTP(res, req)
+	return res
+}
+
+// TestOAuth_Authorize_Consent ensures codes are only issued once the user allows the client access, and that denying
+// it is reported back to the client.
+func TestOAuth_Authorize_Consent(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	clientId, _ := newClient(t, ts, false)
+
+	form := authorizeForm(clientId)
+	form.Set("email", "user@justinstone.net")
+	form.Set("password", "password")
+	res := postForm(ts, "/oauth/authorize", form)
+	equals(t, http.StatusOK, res.Code)
+	equals(t, "", res.Header().Get("Location"))
+	assert(t, strings.Contains(res.Body.String(), "read write"), "expected the scope to be shown")
+
+	form = authorizeForm(clientId)
+	form.Set("consent", "deny")
+	res = postForm(ts, "/oauth/authorize", form)
+	equals(t, http.StatusFound, res.Code)
+
+	location, err := url.Parse(res.Header().Get("Location"))
+	ok(t, err)
+	equals(t, "access_denied", location.Query().Get("error"))
+	equals(t, "", location.Query().Get("code"))
+}
+
+// TestOAuth_Authorize_BearerToken ensures first party tokens can authorize a client once the user consents, and that
+// tokens issued to a client can authorize none.
+func TestOAuth_Authorize_BearerToken(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	clientId, _ := newClient(t, ts, false)
+	otherId, _ := newClient(t, ts, false)
+
+	user, err := ts.repo.Authenticate("user@justinstone.net", "password")
+	ok(t, err)
+	sessionId, err := ts.sessionRepo.NewSession(user.Id, "", "")
+	ok(t, err)
+	token, err := ts.tokenFactory.NewToken(service.NewClaims(user.Id, user.Email, user.Username, sessionId, user.Roles))
+	ok(t, err)
+
+	form := authorizeForm(clientId)
+	equals(t, http.StatusBadRequest, authorizeWithToken(ts, form, token).Code)
+
+	form.Set("consent", "allow")
+	res := authorizeWithToken(ts, form, token)
+	equals(t, http.StatusFound, res.Code)
+	assert(t, strings.Contains(res.Header().Get("Location"), "code="), "expected a code")
+
+	verifier := "a-sufficiently-long-code-verifier-for-the-test"
+	code := authorize(t, ts, clientId, verifier, "read").Query().Get("code")
+	status, tokens := requestToken(t, ts, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientId},
+		"code":          {code},
+		"redirect_uri":  {testRedirectUri},
+		"code_verifier": {verifier},
+	})
+	equals(t, http.StatusOK, status)
+
+	form = authorizeForm(otherId)
+	form.Set("consent", "allow")
+	equals(t, http.StatusUnauthorized, authorizeWithToken(ts, form, tokens.AccessToken).Code)
+}
+
+// TestOAuth_DelegatedToken ensures tokens issued to a client don't authenticate on the first party endpoints.
+func TestOAuth_DelegatedToken(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	clientId, _ := newClient(t, ts, false)
+
+	verifier := "a-sufficiently-long-code-verifier-for-the-test"
+	code := authorize(t, ts, clientId, verifier, "read").Query().Get("code")
+	status, tokens := requestToken(t, ts, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientId},
+		"code":          {code},
+		"redirect_uri":  {testRedirectUri},
+		"code_verifier": {verifier},
+	})
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodDelete, "/session/", tokens.AccessToken, nil, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	// The user info endpoint accepts them, refusing this one only for lacking the openid scope.
+	status = ts.do(t, http.MethodGet, "/userinfo", tokens.AccessToken, nil, nil)
+	equals(t, http.StatusForbidden, status)
+}
+
+// TestOAuth_RefreshToken ensures refresh tokens rotate and are bound to the client they were issued to.
+func TestOAuth_RefreshToken(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	clientId, _ := newClient(t, ts, false)
+	otherId, _ := newClient(t, ts, false)
+
+	verifier := "a-sufficiently-long-code-verifier-for-the-test"
+	code := authorize(t, ts, clientId, verifier, "").Query().Get("code")
+	status, tokens := requestToken(t, ts, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientId},
+		"code":          {code},
+		"redirect_uri":  {testRedirectUri},
+		"code_verifier": {verifier},
+	})
+	equals(t, http.StatusOK, status)
+	equals(t, "read write", tokens.Scope)
+
+	status, refreshed := requestToken(t, ts, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {clientId},
+		"refresh_token": {tokens.RefreshToken},
+	})
+	equals(t, http.StatusOK, status)
+	equals(t, "read write", refreshed.Scope)
+	assert(t, refreshed.RefreshToken != tokens.RefreshToken, "expected refresh token to rotate")
+
+	status, _ = requestToken(t, ts, url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {otherId},
+		"refresh_token": {refreshed.RefreshToken},
+	})
+	equals(t, http.StatusBadRequest, status)
+
+	// Presenting the token as another client revokes the session.
+	status = ts.do(t, http.MethodGet, "/userinfo", refreshed.AccessToken, nil, nil)
+	equals(t, http.StatusUnauthorized, status)
+}
+
+// TestOAuth_ClientCredentials ensures only authenticated confidential clients are issued client tokens.
+func TestOAuth_ClientCredentials(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	clientId, secret := newClient(t, ts, true)
+	publicId, _ := newClient(t, ts, false)
+
+	status, tokens := requestToken(t, ts, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientId},
+		"client_secret": {"wrong"},
+	})
+	equals(t, http.StatusUnauthorized, status)
+	equals(t, "invalid_client", tokens.Error)
+
+	status, tokens = requestToken(t, ts, url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {publicId},
+	})
+	equals(t, http.StatusBadRequest, status)
+	equals(t, "unauthorized_client", tokens.Error)
+
+	status, tokens = requestToken(t, ts, url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {clientId},
+		"client_secret": {secret},
+		"scope":         {"write"},
+	})
+	equals(t, http.StatusOK, status)
+	equals(t, "write", tokens.Scope)
+	equals(t, "", tokens.RefreshToken)
+
+	token, err := ts.tokenFactory.ParseToken(tokens.AccessToken)
+	ok(t, err)
+	assert(t, token.Valid, "expected valid token")
+
+	// Client tokens don't authenticate as a user.
+	status = ts.do(t, http.MethodDelete, "/session/", tokens.AccessToken, nil, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	status, tokens = requestToken(t, ts, url.Values{
+		"grant_type":    {"password"},
+		"client_id":     {clientId},
+		"client_secret": {secret},
+	})
+	equals(t, http.StatusBadRequest, status)
+	equals(t, "unsupported_grant_type", tokens.Error)
+}
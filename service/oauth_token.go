@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+func (otr oauthTokenResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+func newOAuthTokenResponse(token string, refreshToken string, scope string) oauthTokenResponse {
+	return oauthTokenResponse{
+		AccessToken:  token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTtl.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        scope,
+	}
+}
+
+func authorizationCodeGrant(r *http.Request, client OAuthClient, oauthRepo OAuthRepository) (oauthTokenResponse,
+	error) {
+	userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+	if !ok {
+		return oauthTokenResponse{}, newOAuthErr(oauthServerError, "")
+	}
+
+	code, err := oauthRepo.ConsumeAuthorizationCode(hashOpaqueToken(r.PostForm.Get("code")))
+
+	if errors.Is(err, errAuthorizationCodeInvalid) {
+		return oauthTokenResponse{}, newOAuthErr(oauthInvalidGrant, "code invalid")
+	} else if err != nil {
+		return oauthTokenResponse{}, newOAuthErr(oauthServerError, "")
+	}
+
+	if code.ClientId != client.Id || code.RedirectUri != r.PostForm.Get("redirect_uri") {
+		return oauthTokenResponse{}, newOAuthErr(oauthInvalidGrant, "code invalid")
+	}
+
+	if !verifyCodeChallenge(code.CodeChallenge, r.PostForm.Get("code_verifier")) {
+		return oauthTokenResponse{}, newOAuthErr(oauthInvalidGrant, "code_verifier invalid")
+	}
+
+	user, err := userRepo.GetUser(code.UserId)
+
+	// The user may have been purged since granting the code
+	if errors.Is(err, errUserNotFound) {
+		return oauthTokenResponse{}, newOAuthErr(oauthInvalidGrant, "code invalid")
+	} else if err != nil {
+		return oauthTokenResponse{}, newOAuthErr(oauthServerError, "")
+	}
+
+	idToken, err := newIdToken(r.Context(), user, code)
+
+	if err != nil {
+		return oauthTokenResponse{}, newOAuthErr(oauthServerError, "")
+	}
+
+	token, refreshToken, err := startSession(r.Context(), user, client.Id, code.Scope)
+
+	if err != nil {
+		return oauthTokenResponse{}, toOAuthErr(err)
+	}
+
+	res := newOAuthTokenResponse(token, refreshToken, code.Scope)
+	res.IdToken = idToken
+
+	return res, nil
+}
+
+func refreshTokenGrant(r *http.Request, client OAuthClient) (oauthTokenResponse, error) {
+	refreshToken := r.PostForm.Get("refresh_token")
+
+	if refreshToken == "" {
+		return oauthTokenResponse{}, newOAuthErr(oauthInvalidRequest, "refresh_token is required")
+	}
+
+	session, token, newRefreshToken, err := rotateSession(r.Context(), refreshToken)
+
+	if err != nil {
+		return oauthTokenResponse{}, toOAuthErr(err)
+	}
+
+	if session.ClientId != client.Id {
+		// The refresh token was issued to someone else, treat it as compromised.
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if ok {
+			_ = sessionRepo.RevokeSession(session.Id)
+		}
+
+		return oauthTokenResponse{}, newOAuthErr(oauthInvalidGrant, "refresh_token invalid")
+	}
+
+	return newOAuthTokenResponse(token, newRefreshToken, session.Scope), nil
+}
+
+func clientCredentialsGrant(r *http.Request, client OAuthClient) (oauthTokenResponse, error) {
+	if !client.IsConfidential() {
+		return oauthTokenResponse{}, newOAuthErr(oauthUnauthorizedClient, "client must be confidential")
+	}
+
+	tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
+
+	if !ok {
+		return oauthTokenResponse{}, newOAuthErr(oauthServerError, "")
+	}
+
+	scope, ok := grantScope(r.PostForm.Get("scope"), client.Scopes)
+
+	if !ok {
+		return oauthTokenResponse{}, newOAuthErr(oauthInvalidScope, "scope not allowed")
+	}
+
+	token, err := tokenFactory.NewToken(NewClientClaims(client.Id, scope))
+
+	if err != nil {
+		return oauthTokenResponse{}, newOAuthErr(oauthServerError, "")
+	}
+
+	return newOAuthTokenResponse(token, "", scope), nil
+}
+
+// OAuthTokenMiddleware middleware to issue tokens to an OAuth client for an authorization grant
+func OAuthTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+
+		if err != nil {
+			RenderResponse(w, r, newOAuthErr(oauthInvalidRequest, "request body invalid"))
+			return
+		}
+
+		oauthRepo, ok := r.Context().Value("oauthRepo").(OAuthRepository)
+
+		if !ok {
+			RenderResponse(w, r, newOAuthErr(oauthServerError, ""))
+			return
+		}
+
+		client, err := authenticateClient(r, oauthRepo)
+
+		if err != nil {
+			RenderResponse(w, r, toOAuthErr(err))
+			return
+		}
+
+		var res oauthTokenResponse
+
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			res, err = authorizationCodeGrant(r, client, oauthRepo)
+		case "refresh_token":
+			res, err = refreshTokenGrant(r, client)
+		case "client_credentials":
+			res, err = clientCredentialsGrant(r, client)
+		default:
+			err = newOAuthErr(oauthUnsupportedGrantType, "")
+		}
+
+		if err != nil {
+			RenderResponse(w, r, toOAuthErr(err))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "oauthToken", res)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// OAuthToken renders the tokens issued for an OAuth grant.
+func OAuthToken(w http.ResponseWriter, r *http.Request) {
+	res, ok := r.Context().Value("oauthToken").(oauthTokenResponse)
+
+	if !ok {
+		RenderResponse(w, r, newOAuthErr(oauthServerError, ""))
+		return
+	}
+
+	RenderResponse(w, r, res)
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	// openIdScope must be granted for a client to receive ID tokens and call the userinfo endpoint.
+	openIdScope  = "openid"
+	profileScope = "profile"
+	emailScope   = "email"
+)
+
+// userInfoClaims returns the standard OpenID Connect claims describing user that scope permits disclosing.
+func userInfoClaims(user User, scope string) map[string]interface{} {
+	scopes := strings.Fields(scope)
+	claims := map[string]interface{}{"sub": user.Id}
+
+	if containsString(scopes, profileScope) {
+		claims["preferred_username"] = user.Username
+		claims["nickname"] = user.Username
+
+		if user.Gender != "" {
+			claims["gender"] = user.Gender.String()
+		}
+	}
+
+	if containsString(scopes, emailScope) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+
+	return claims
+}
+
+// newIdToken issues an ID token for the user and client an authorization code was granted for, if its scope requests
+// one and OpenID Connect is enabled. Returns an empty string otherwise.
+func newIdToken(ctx context.Context, user User, code AuthorizationCode) (string, error) {
+	config, ok := ctx.Value("config").(Configuration)
+
+	if !ok {
+		return "", errors.New("config not found")
+	}
+
+	tokenFactory, ok := ctx.Value("tokenFactory").(TokenFactory)
+
+	if !ok {
+		return "", errors.New("token factory not found")
+	}
+
+	if config.GetIssuer() == "" || !containsString(strings.Fields(code.Scope), openIdScope) {
+		return "", nil
+	}
+
+	return tokenFactory.NewIdToken(NewIdClaims(config.GetIssuer(), user, code.ClientId, code.Nonce, code.AuthTime, code.Scope))
+}
+
+type openIdConfigurationResponse struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JwksUri                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IdTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+func (oicr openIdConfigurationResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// GetOpenIdConfiguration renders the OpenID Connect discovery document describing the service.
+func GetOpenIdConfiguration(w http.ResponseWriter, r *http.Request) {
+	config, ok := r.Context().Value("config").(Configuration)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	issuer := config.GetIssuer()
+
+	if issuer == "" {
+		RenderResponse(w, r, NewNotFoundErr("OpenID Connect is not enabled"))
+		return
+	}
+
+	algs := make([]string, 0)
+
+	for _, key := range tokenFactory.KeySet().Keys {
+		if !containsString(algs, key.Alg) {
+			algs = append(algs, key.Alg)
+		}
+	}
+
+	// Tokens signed with a shared secret can't be verified by clients, but are reported for completeness
+	if len(algs) == 0 {
+		algs = append(algs, "HS512")
+	}
+
+	RenderResponse(w, r, openIdConfigurationResponse{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth/authorize",
+		TokenEndpoint:                     issuer + "/oauth/token",
+		UserInfoEndpoint:                  issuer + "/userinfo",
+		JwksUri:                           issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   []string{openIdScope, profileScope, emailScope},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code", "refresh_token", "client_credentials"},
+		SubjectTypesSupported:             []string{"public"},
+		IdTokenSigningAlgValuesSupported:  algs,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported: []string{"iss", "sub", "aud", "exp", "iat", "auth_time", "nonce", "preferred_username",
+			"nickname", "gender", "email", "email_verified"},
+	})
+}
+
+type userInfoResponse map[string]interface{}
+
+func (uir userInfoResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// UserInfoMiddleware middleware to look up the claims about the authenticated user that the token's scope permits
+func UserInfoMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenUser, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewUnauthorizedErr("unauthorized"))
+			return
+		}
+
+		sessionId, _ := r.Context().Value("sessionId").(string)
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("repo not found"))
+			return
+		}
+
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		session, err := sessionRepo.GetSession(sessionId)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		scope := session.Scope
+
+		// Direct logins are first party and may see every claim
+		if session.ClientId == "" {
+			scope = strings.Join([]string{openIdScope, profileScope, emailScope}, " ")
+		} else if !containsString(strings.Fields(scope), openIdScope) {
+			RenderResponse(w, r, NewForbiddenErr("insufficient scope"))
+			return
+		}
+
+		user, err := userRepo.GetUser(tokenUser.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "userInfo", userInfoResponse(userInfoClaims(user, scope)))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// UserInfo renders the claims about the authenticated user.
+func UserInfo(w http.ResponseWriter, r *http.Request) {
+	res, ok := r.Context().Value("userInfo").(userInfoResponse)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, res)
+}
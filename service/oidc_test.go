@@ -0,0 +1,104 @@
+package service_test
+
+import (
+	"github.com/golang-jwt/jwt"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// TestGetOpenIdConfiguration ensures the discovery document points at the service's endpoints.
+func TestGetOpenIdConfiguration(t *testing.T) {
+	ts := newOAuthTestServer(t)
+
+	var discovery map[string]interface{}
+	status := ts.do(t, http.MethodGet, "/.well-known/openid-configuration", "", nil, &discovery)
+	equals(t, http.StatusOK, status)
+	equals(t, "http://localhost:3333", discovery["issuer"])
+	equals(t, "http://localhost:3333/oauth/token", discovery["token_endpoint"])
+	equals(t, "http://localhost:3333/userinfo", discovery["userinfo_endpoint"])
+	equals(t, "http://localhost:3333/.well-known/jwks.json", discovery["jwks_uri"])
+}
+
+// TestOpenIdConnect_IdToken ensures an ID token is issued for the openid scope, disclosing only the scoped claims.
+func TestOpenIdConnect_IdToken(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	clientId, err := ts.oauthRepo.NewClient("grafana", "", []string{testRedirectUri},
+		[]string{"openid", "profile", "email"})
+	ok(t, err)
+
+	verifier := "a-sufficiently-long-code-verifier-for-the-test"
+	code := authorize(t, ts, clientId, verifier, "openid profile").Query().Get("code")
+	status, tokens := requestToken(t, ts, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientId},
+		"code":          {code},
+		"redirect_uri":  {testRedirectUri},
+		"code_verifier": {verifier},
+	})
+	equals(t, http.StatusOK, status)
+	assert(t, tokens.IdToken != "", "expected ID token")
+
+	idToken, err := ts.tokenFactory.ParseToken(tokens.IdToken)
+	ok(t, err)
+	claims := idToken.Claims.(jwt.MapClaims)
+	equals(t, "http://localhost:3333", claims["iss"])
+	equals(t, clientId, claims["aud"])
+	equals(t, "n-0S6_WzA2Mj", claims["nonce"])
+	equals(t, "user", claims["preferred_username"])
+	assert(t, claims["auth_time"] != nil, "expected auth_time")
+	_, hasEmail := claims["email"]
+	assert(t, !hasEmail, "expected email to require the email scope")
+
+	// ID tokens can't be used as access tokens.
+	status = ts.do(t, http.MethodGet, "/userinfo", tokens.IdToken, nil, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	var userInfo map[string]interface{}
+	status = ts.do(t, http.MethodGet, "/userinfo", tokens.AccessToken, nil, &userInfo)
+	equals(t, http.StatusOK, status)
+	equals(t, claims["sub"], userInfo["sub"])
+	equals(t, "user", userInfo["preferred_username"])
+	equals(t, "male", userInfo["gender"])
+	_, hasEmail = userInfo["email"]
+	assert(t, !hasEmail, "expected email to require the email scope")
+}
+
+// TestOpenIdConnect_NoOpenIdScope ensures clients not granted the openid scope get neither ID tokens nor user info.
+func TestOpenIdConnect_NoOpenIdScope(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	clientId, _ := newClient(t, ts, false)
+
+	verifier := "a-sufficiently-long-code-verifier-for-the-test"
+	code := authorize(t, ts, clientId, verifier, "read").Query().Get("code")
+	status, tokens := requestToken(t, ts, url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientId},
+		"code":          {code},
+		"redirect_uri":  {testRedirectUri},
+		"code_verifier": {verifier},
+	})
+	equals(t, http.StatusOK, status)
+	equals(t, "", tokens.IdToken)
+
+	status = ts.do(t, http.MethodGet, "/userinfo", tokens.AccessToken, nil, nil)
+	equals(t, http.StatusForbidden, status)
+}
+
+// TestUserInfo_DirectLogin ensures first party sessions can read every claim.
+func TestUserInfo_DirectLogin(t *testing.T) {
+	ts := newOAuthTestServer(t)
+	user, err := ts.repo.Authenticate("user@justinstone.net", "password")
+	ok(t, err)
+	sessionId, err := ts.sessionRepo.NewSession(user.Id, "", "")
+	ok(t, err)
+	token, err := ts.tokenFactory.NewToken(service.NewClaims(user.Id, user.Email, user.Username, sessionId, user.Roles))
+	ok(t, err)
+
+	var userInfo map[string]interface{}
+	status := ts.do(t, http.MethodGet, "/userinfo", token, nil, &userInfo)
+	equals(t, http.StatusOK, status)
+	equals(t, "user@justinstone.net", userInfo["email"])
+	equals(t, "user", userInfo["preferred_username"])
+}
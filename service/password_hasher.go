@@ -0,0 +1,224 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	argon2idPrefix     = "$argon2id$"
+	argon2idSaltLength = 16
+	argon2idKeyLength  = 32
+)
+
+var errUnknownHashAlgorithm = errors.New("unknown password hash algorithm")
+
+// PasswordHasher hashes passwords into self describing, PHC style strings such as "$argon2id$v=19$m=...$salt$hash",
+// so hashes made by different algorithms or parameters can be told apart in the same column.
+type PasswordHasher interface {
+	// Hash returns the encoded, salted hash of password.
+	Hash(password string) (string, error)
+	// Verify reports whether password matches an encoded hash, failing with errUnknownHashAlgorithm if the hash wasn't
+	// made by an algorithm the hasher understands.
+	Verify(encoded string, password string) (bool, error)
+	// NeedsRehash reports whether an encoded hash was made by a different algorithm or with different parameters to
+	// those the hasher uses.
+	NeedsRehash(encoded string) bool
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+// MakeBcryptHasher constructs a PasswordHasher using bcrypt with the given cost.
+func MakeBcryptHasher(cost int) PasswordHasher {
+	return bcryptHasher{cost}
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+// Hash returns the bcrypt hash of password, whose modular crypt format is already self describing.
+func (bh bcryptHasher) Hash(password string) (string, error) {
+	saltedHash, err := bcrypt.GenerateFromPassword([]byte(password), bh.cost)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(saltedHash), nil
+}
+
+// Verify reports whether password matches a bcrypt hash of any cost.
+func (bh bcryptHasher) Verify(encoded string, password string) (bool, error) {
+	if !isBcryptHash(encoded) {
+		return false, errUnknownHashAlgorithm
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// NeedsRehash reports whether encoded isn't a bcrypt hash of the hasher's cost.
+func (bh bcryptHasher) NeedsRehash(encoded string) bool {
+	if !isBcryptHash(encoded) {
+		return true
+	}
+
+	cost, err := bcrypt.Cost([]byte(encoded))
+
+	return err != nil || cost != bh.cost
+}
+
+// Argon2idParams holds the cost parameters of Argon2id hashes.
+type Argon2idParams struct {
+	// Memory is the memory used in KiB
+	Memory uint32
+	// Iterations is the number of passes over the memory
+	Iterations uint32
+	// Parallelism is the number of threads used
+	Parallelism uint8
+}
+
+type argon2idHasher struct {
+	params Argon2idParams
+}
+
+// MakeArgon2idHasher constructs a PasswordHasher using Argon2id with the given parameters.
+func MakeArgon2idHasher(params Argon2idParams) PasswordHasher {
+	return argon2idHasher{params}
+}
+
+// Hash returns the Argon2id hash of password encoded as "$argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$
+// <salt>$<hash>", salt and hash in unpadded base64.
+func (ah argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, argon2idSaltLength)
+
+	_, err := rand.Read(salt)
+
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, ah.params.Iterations, ah.params.Memory, ah.params.Parallelism,
+		argon2idKeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, ah.params.Memory,
+		ah.params.Iterations, ah.params.Parallelism, base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// decodeArgon2idHash splits an encoded Argon2id hash into its parameters, salt and key.
+func decodeArgon2idHash(encoded string) (Argon2idParams, []byte, []byte, error) {
+	var params Argon2idParams
+	var version int
+
+	if !strings.HasPrefix(encoded, argon2idPrefix) {
+		return params, nil, nil, errUnknownHashAlgorithm
+	}
+
+	parts := strings.Split(encoded, "$")
+
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2id version: %s", parts[2])
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2id parameters: %s", parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+
+	if err != nil {
+		return params, nil, nil, errors.New("invalid argon2id salt")
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errors.New("invalid argon2id key")
+	}
+
+	return params, salt, key, nil
+}
+
+// Verify reports whether password matches an Argon2id hash made with any parameters.
+func (ah argon2idHasher) Verify(encoded string, password string) (bool, error) {
+	params, salt, key, err := decodeArgon2idHash(encoded)
+
+	if err != nil {
+		return false, err
+	}
+
+	candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism,
+		uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, candidate) == 1, nil
+}
+
+// NeedsRehash reports whether encoded isn't an Argon2id hash made with the hasher's parameters.
+func (ah argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2idHash(encoded)
+
+	return err != nil || params != ah.params || len(salt) != argon2idSaltLength || len(key) != argon2idKeyLength
+}
+
+type upgradingHasher struct {
+	preferred PasswordHasher
+	hashers   []PasswordHasher
+}
+
+// MakeUpgradingHasher constructs a PasswordHasher that hashes with preferred but verifies hashes made by any supported
+// algorithm, so users can still log in after the algorithm or its parameters change. Hashes not made by preferred need
+// rehashing.
+func MakeUpgradingHasher(preferred PasswordHasher) PasswordHasher {
+	// Verification reads the parameters from the hash, so the parameters of the fallbacks don't matter.
+	return upgradingHasher{preferred, []PasswordHasher{
+		preferred,
+		MakeBcryptHasher(bcrypt.DefaultCost),
+		MakeArgon2idHasher(Argon2idParams{}),
+	}}
+}
+
+func (uh upgradingHasher) Hash(password string) (string, error) {
+	return uh.preferred.Hash(password)
+}
+
+func (uh upgradingHasher) Verify(encoded string, password string) (bool, error) {
+	for _, hasher := range uh.hashers {
+		match, err := hasher.Verify(encoded, password)
+
+		if !errors.Is(err, errUnknownHashAlgorithm) {
+			return match, err
+		}
+	}
+
+	return false, errUnknownHashAlgorithm
+}
+
+func (uh upgradingHasher) NeedsRehash(encoded string) bool {
+	return uh.preferred.NeedsRehash(encoded)
+}
@@ -0,0 +1,107 @@
+package service_test
+
+import (
+	"github.com/stone1549/yapyapyap/auth/service"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+// testArgon2idParams are cheap Argon2id parameters that keep tests fast.
+var testArgon2idParams = service.Argon2idParams{Memory: 64, Iterations: 1, Parallelism: 1}
+
+// hasherConfiguration overrides the password hasher of a configuration.
+type hasherConfiguration struct {
+	service.Configuration
+	hasher service.PasswordHasher
+}
+
+func (hc hasherConfiguration) GetPasswordHasher() service.PasswordHasher {
+	return hc.hasher
+}
+
+// countingHasher counts the hashes made by the hasher it wraps.
+type countingHasher struct {
+	service.PasswordHasher
+	hashes int
+}
+
+func (ch *countingHasher) Hash(password string) (string, error) {
+	ch.hashes++
+
+	return ch.PasswordHasher.Hash(password)
+}
+
+// TestPasswordHasher_Bcrypt ensures bcrypt hashes verify and are only rehashed when their cost differs.
+func TestPasswordHasher_Bcrypt(t *testing.T) {
+	hasher := service.MakeBcryptHasher(bcrypt.MinCost)
+
+	encoded, err := hasher.Hash("password")
+	ok(t, err)
+	assert(t, strings.HasPrefix(encoded, "$2a$04$"), "expected bcrypt hash, got %s", encoded)
+
+	match, err := hasher.Verify(encoded, "password")
+	ok(t, err)
+	assert(t, match, "expected password to match")
+
+	match, err = hasher.Verify(encoded, "wrong")
+	ok(t, err)
+	assert(t, !match, "expected wrong password not to match")
+
+	equals(t, false, hasher.NeedsRehash(encoded))
+	equals(t, true, service.MakeBcryptHasher(bcrypt.MinCost+1).NeedsRehash(encoded))
+
+	_, err = hasher.Verify("$argon2id$v=19$m=64,t=1,p=1$c2FsdA$a2V5", "password")
+	notOk(t, err)
+}
+
+// TestPasswordHasher_Argon2id ensures Argon2id hashes are PHC encoded, verify and are only rehashed when their
+// parameters differ.
+func TestPasswordHasher_Argon2id(t *testing.T) {
+	hasher := service.MakeArgon2idHasher(testArgon2idParams)
+
+	encoded, err := hasher.Hash("password")
+	ok(t, err)
+	assert(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$"), "expected argon2id hash, got %s", encoded)
+
+	other, err := hasher.Hash("password")
+	ok(t, err)
+	assert(t, encoded != other, "expected hashes to be salted")
+
+	match, err := hasher.Verify(encoded, "password")
+	ok(t, err)
+	assert(t, match, "expected password to match")
+
+	match, err = hasher.Verify(encoded, "wrong")
+	ok(t, err)
+	assert(t, !match, "expected wrong password not to match")
+
+	equals(t, false, hasher.NeedsRehash(encoded))
+	equals(t, true, service.MakeArgon2idHasher(service.Argon2idParams{Memory: 128, Iterations: 1, Parallelism: 1}).
+		NeedsRehash(encoded))
+
+	_, err = hasher.Verify("$argon2id$v=19$m=64,t=1,p=1$not base64!$a2V5", "password")
+	notOk(t, err)
+}
+
+// TestPasswordHasher_Upgrading ensures an upgrading hasher verifies hashes of every algorithm but only keeps those
+// made by its preferred hasher.
+func TestPasswordHasher_Upgrading(t *testing.T) {
+	hasher := service.MakeUpgradingHasher(service.MakeArgon2idHasher(testArgon2idParams))
+
+	legacy, err := service.MakeBcryptHasher(bcrypt.MinCost).Hash("password")
+	ok(t, err)
+
+	match, err := hasher.Verify(legacy, "password")
+	ok(t, err)
+	assert(t, match, "expected bcrypt hash to verify")
+	equals(t, true, hasher.NeedsRehash(legacy))
+
+	encoded, err := hasher.Hash("password")
+	ok(t, err)
+	assert(t, strings.HasPrefix(encoded, "$argon2id$"), "expected argon2id hash, got %s", encoded)
+	equals(t, false, hasher.NeedsRehash(encoded))
+
+	_, err = hasher.Verify("plaintext", "plaintext")
+	notOk(t, err)
+}
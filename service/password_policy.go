@@ -0,0 +1,316 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// breachedPrefixLength is how many hex characters of a SHA-1 hash select the range of breached hashes it is
+	// compared against, matching the k-anonymity range queries of public breach corpuses.
+	breachedPrefixLength = 5
+)
+
+// Character classes a PasswordPolicy can require.
+const (
+	LowerClass  = "lower"
+	UpperClass  = "upper"
+	DigitClass  = "digit"
+	SymbolClass = "symbol"
+)
+
+// PasswordViolation describes a rule of the password policy that a password breaks.
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// BreachedPasswords represents a corpus of passwords known to have been exposed in data breaches.
+type BreachedPasswords interface {
+	// Range retrieves the uppercase hex suffixes of the SHA-1 hashes of breached passwords whose hash starts with
+	// the given five character prefix.
+	Range(prefix string) ([]string, error)
+}
+
+// PasswordPolicy holds the rules new passwords must follow.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters, zero for no minimum
+	MinLength int
+	// MaxLength is the maximum number of bytes, zero for no maximum
+	MaxLength int
+	// CharacterClasses are the classes of character a password must contain at least one of each of
+	CharacterClasses []string
+	// DisallowIdentity rejects passwords that match the user's email address or username
+	DisallowIdentity bool
+	// Breached rejects passwords that appear in a breach corpus, nil disables the check
+	Breached BreachedPasswords
+}
+
+// Check returns every rule of the policy that password breaks when set by the user with the given email and
+// username.
+func (pp PasswordPolicy) Check(password string, email string, username string) ([]PasswordViolation, error) {
+	violations := make([]PasswordViolation, 0)
+
+	if pp.MinLength > 0 && utf8.RuneCountInString(password) < pp.MinLength {
+		violations = append(violations, PasswordViolation{"min_length",
+			fmt.Sprintf("must be at least %d characters long", pp.MinLength)})
+	}
+
+	if pp.MaxLength > 0 && len(password) > pp.MaxLength {
+		violations = append(violations, PasswordViolation{"max_length",
+			fmt.Sprintf("must be at most %d bytes long", pp.MaxLength)})
+	}
+
+	for _, class := range pp.CharacterClasses {
+		if strings.IndexFunc(password, characterClassFunc(class)) < 0 {
+			violations = append(violations, PasswordViolation{class,
+				fmt.Sprintf("must contain a %s character", characterClassName(class))})
+		}
+	}
+
+	if pp.DisallowIdentity && matchesIdentity(password, email, username) {
+		violations = append(violations, PasswordViolation{"identity",
+			"must not be your email address or username"})
+	}
+
+	if pp.Breached != nil {
+		breached, err := isBreached(pp.Breached, password)
+
+		if err != nil {
+			return nil, err
+		} else if breached {
+			violations = append(violations, PasswordViolation{"breached",
+				"has appeared in a data breach and must not be used"})
+		}
+	}
+
+	return violations, nil
+}
+
+// checkPasswordPolicy checks password against the configured policy. Errors are ErrorResponse values suitable for
+// rendering, listing any violations.
+func checkPasswordPolicy(config Configuration, password string, email string, username string) error {
+	violations, err := config.GetPasswordPolicy().Check(password, email, username)
+
+	if err != nil {
+		return NewInternalServerErr("unable to check password")
+	} else if len(violations) > 0 {
+		return NewPasswordPolicyErr(violations)
+	}
+
+	return nil
+}
+
+func characterClassFunc(class string) func(rune) bool {
+	switch class {
+	case LowerClass:
+		return unicode.IsLower
+	case UpperClass:
+		return unicode.IsUpper
+	case DigitClass:
+		return unicode.IsDigit
+	default:
+		return func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+		}
+	}
+}
+
+func characterClassName(class string) string {
+	switch class {
+	case LowerClass:
+		return "lowercase"
+	case UpperClass:
+		return "uppercase"
+	case DigitClass:
+		return "numeric"
+	default:
+		return "symbol"
+	}
+}
+
+// matchesIdentity reports whether password is, ignoring case, the email address, its local part or the username.
+func matchesIdentity(password string, email string, username string) bool {
+	candidates := []string{email, username}
+
+	if at := strings.LastIndex(email, "@"); at > 0 {
+		candidates = append(candidates, email[:at])
+	}
+
+	for _, candidate := range candidates {
+		if candidate != "" && strings.EqualFold(password, candidate) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isBreached reports whether password is in the corpus, revealing only a prefix of its hash to it.
+func isBreached(breached BreachedPasswords, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	suffixes, err := breached.Range(hash[:breachedPrefixLength])
+
+	if err != nil {
+		return false, err
+	}
+
+	suffix := hash[breachedPrefixLength:]
+	index := sort.SearchStrings(suffixes, suffix)
+
+	return index < len(suffixes) && suffixes[index] == suffix, nil
+}
+
+// breachedPasswordFile is a breach corpus searched on disk, so that corpuses of hundreds of millions of hashes don't
+// have to be held in memory.
+type breachedPasswordFile struct {
+	file *os.File
+	size int64
+}
+
+// Range retrieves the sorted hash suffixes in the range selected by prefix, binary searching the file for the first
+// line in the range.
+func (bpf *breachedPasswordFile) Range(prefix string) ([]string, error) {
+	prefix = strings.ToUpper(prefix)
+
+	// Every line starting before low is before the range, and the first line starting at or after high is in or after
+	// it.
+	low, high := int64(0), bpf.size
+
+	for low < high {
+		mid := low + (high-low)/2
+		hash, next, err := bpf.lineAfter(mid)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if hash != "" && hash[:breachedPrefixLength] < prefix {
+			low = next
+		} else {
+			high = mid
+		}
+	}
+
+	suffixes := make([]string, 0)
+
+	for {
+		hash, next, err := bpf.lineAfter(low)
+
+		if err != nil {
+			return nil, err
+		} else if hash == "" || hash[:breachedPrefixLength] != prefix {
+			return suffixes, nil
+		}
+
+		suffixes = append(suffixes, hash[breachedPrefixLength:])
+		low = next
+	}
+}
+
+// lineAfter reads the hash on the first line starting at or after offset, returning it along with the offset of the
+// following line. The hash is empty at the end of the file.
+func (bpf *breachedPasswordFile) lineAfter(offset int64) (string, int64, error) {
+	if offset > 0 {
+		// Start from the previous byte, so a line starting at offset is found after the newline ending the one before.
+		offset--
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(bpf.file, offset, bpf.size-offset))
+
+	if offset > 0 {
+		skipped, err := reader.ReadString('\n')
+		offset += int64(len(skipped))
+
+		if errors.Is(err, io.EOF) {
+			return "", bpf.size, nil
+		} else if err != nil {
+			return "", 0, err
+		}
+	}
+
+	for {
+		line, err := reader.ReadString('\n')
+		next := offset + int64(len(line))
+
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", 0, err
+		}
+
+		hash, _, _ := strings.Cut(strings.TrimSpace(line), ":")
+
+		if hash != "" {
+			return strings.ToUpper(hash), next, nil
+		} else if err != nil {
+			return "", bpf.size, nil
+		}
+
+		offset = next
+	}
+}
+
+// LoadBreachedPasswordFile opens a breach corpus in a file of SHA-1 password hashes in hex, one per line and sorted by
+// hash, as published corpuses ordered by hash are. Anything after a colon on a line, such as the occurrence counts of
+// published corpuses, is ignored. The file is checked once when loaded and then searched in place, so it must not be
+// changed while in use.
+func LoadBreachedPasswordFile(path string) (BreachedPasswords, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkBreachedPasswordFile(file)
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &breachedPasswordFile{file, info.Size()}, nil
+}
+
+// checkBreachedPasswordFile ensures every line of a breach corpus holds a SHA-1 hash and that they are sorted, since a
+// binary search of a corrupt corpus would silently miss breached passwords.
+func checkBreachedPasswordFile(file *os.File) error {
+	scanner := bufio.NewScanner(file)
+	previous := ""
+
+	for scanner.Scan() {
+		hash, _, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+
+		if hash == "" {
+			continue
+		}
+
+		hash = strings.ToUpper(hash)
+
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha1.Size*2 {
+			return fmt.Errorf("invalid SHA-1 hash in breached password file: %s", hash)
+		} else if hash < previous {
+			return fmt.Errorf("breached password file isn't sorted by hash: %s follows %s", hash, previous)
+		}
+
+		previous = hash
+	}
+
+	return scanner.Err()
+}
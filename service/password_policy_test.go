@@ -0,0 +1,159 @@
+package service_test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeBreachedPasswordFile writes a breach corpus containing the given passwords, returning its path.
+func writeBreachedPasswordFile(t *testing.T, passwords ...string) string {
+	var lines []string
+
+	for _, password := range passwords {
+		sum := sha1.Sum([]byte(password))
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(sum[:]))+":42")
+	}
+
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	ok(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600))
+
+	return path
+}
+
+func violatedRules(violations []service.PasswordViolation) []string {
+	rules := make([]string, 0)
+
+	for _, violation := range violations {
+		rules = append(rules, violation.Rule)
+	}
+
+	return rules
+}
+
+// TestPasswordPolicy_Check ensures every broken rule is reported.
+func TestPasswordPolicy_Check(t *testing.T) {
+	breached, err := service.LoadBreachedPasswordFile(writeBreachedPasswordFile(t, "hunter22", "correct horse"))
+	ok(t, err)
+
+	policy := service.PasswordPolicy{
+		MinLength:        8,
+		MaxLength:        16,
+		CharacterClasses: []string{service.LowerClass, service.UpperClass, service.DigitClass, service.SymbolClass},
+		DisallowIdentity: true,
+		Breached:         breached,
+	}
+
+	violations, err := policy.Check("Str0ng-enough", "user@justinstone.net", "user")
+	ok(t, err)
+	equals(t, []string{}, violatedRules(violations))
+
+	violations, err = policy.Check("short", "user@justinstone.net", "user")
+	ok(t, err)
+	equals(t, []string{"min_length", "upper", "digit", "symbol"}, violatedRules(violations))
+
+	violations, err = policy.Check("Way-t00-long-for-this-policy", "user@justinstone.net", "user")
+	ok(t, err)
+	equals(t, []string{"max_length"}, violatedRules(violations))
+
+	violations, err = policy.Check("USER@justinstone.net", "user@justinstone.net", "user")
+	ok(t, err)
+	equals(t, []string{"max_length", "digit", "identity"}, violatedRules(violations))
+
+	policy.CharacterClasses = nil
+	violations, err = policy.Check("hunter22", "user@justinstone.net", "user")
+	ok(t, err)
+	equals(t, []string{"breached"}, violatedRules(violations))
+
+	violations, err = policy.Check("justinstone", "justinstone@example.com", "user")
+	ok(t, err)
+	equals(t, []string{"identity"}, violatedRules(violations))
+}
+
+// TestLoadBreachedPasswordFile_Invalid ensures a corrupt breach corpus is rejected rather than silently ignored.
+func TestLoadBreachedPasswordFile_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	ok(t, os.WriteFile(path, []byte("not a hash\n"), 0600))
+
+	_, err := service.LoadBreachedPasswordFile(path)
+	notOk(t, err)
+
+	_, err = service.LoadBreachedPasswordFile(filepath.Join(t.TempDir(), "missing.txt"))
+	notOk(t, err)
+
+	unsorted := strings.Repeat("F", 40) + "\n" + strings.Repeat("0", 40) + "\n"
+	ok(t, os.WriteFile(path, []byte(unsorted), 0600))
+	_, err = service.LoadBreachedPasswordFile(path)
+	notOk(t, err)
+}
+
+// TestLoadBreachedPasswordFile_Range ensures every hash in a range is found by searching the file, including those at
+// its start and end.
+func TestLoadBreachedPasswordFile_Range(t *testing.T) {
+	passwords := make([]string, 0)
+
+	for i := 0; i < 1000; i++ {
+		passwords = append(passwords, "password"+strconv.Itoa(i))
+	}
+
+	breached, err := service.LoadBreachedPasswordFile(writeBreachedPasswordFile(t, passwords...))
+	ok(t, err)
+
+	policy := service.PasswordPolicy{Breached: breached}
+
+	for _, password := range passwords {
+		violations, err := policy.Check(password, "user@justinstone.net", "user")
+		ok(t, err)
+		equals(t, []string{"breached"}, violatedRules(violations))
+	}
+
+	violations, err := policy.Check("not breached", "user@justinstone.net", "user")
+	ok(t, err)
+	equals(t, []string{}, violatedRules(violations))
+
+	suffixes, err := breached.Range("00000")
+	ok(t, err)
+	equals(t, 0, len(suffixes))
+	suffixes, err = breached.Range("fffff")
+	ok(t, err)
+	equals(t, 0, len(suffixes))
+}
+
+// TestPasswordPolicy_Enforced ensures signup and password resets reject passwords breaking the policy, listing the
+// rules broken, without using up the reset token.
+func TestPasswordPolicy_Enforced(t *testing.T) {
+	ts := newPasswordResetTestServer(t)
+	ts.router.With(service.NewUserMiddleware).Put("/user/", service.NewUser)
+
+	var errResponse service.ErrorResponse
+	status := ts.do(t, http.MethodPut, "/user/", "", map[string]interface{}{
+		"email":    "new@justinstone.net",
+		"username": "newuser",
+		"password": "newuser",
+	}, &errResponse)
+	equals(t, http.StatusBadRequest, status)
+	equals(t, []string{"min_length", "identity"}, violatedRules(errResponse.Violations))
+
+	status = ts.do(t, http.MethodPost, "/password/forgot", "", map[string]string{"email": "user@justinstone.net"},
+		nil)
+	equals(t, http.StatusAccepted, status)
+	token := linkToken(t, ts.mailer.last(t), "/password/reset")
+
+	status = ts.do(t, http.MethodPost, "/password/reset", "",
+		map[string]string{"token": token, "password": "User@JustinStone.net"}, &errResponse)
+	equals(t, http.StatusBadRequest, status)
+	equals(t, []string{"identity"}, violatedRules(errResponse.Violations))
+
+	status = ts.do(t, http.MethodPost, "/password/reset", "",
+		map[string]string{"token": token, "password": "new password"}, nil)
+	equals(t, http.StatusOK, status)
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// passwordResetTtl is how long a password reset link remains valid.
+	passwordResetTtl = time.Hour
+)
+
+type forgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type passwordResetResponse struct {
+	status int
+}
+
+func (prr passwordResetResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(prr.status)
+
+	return nil
+}
+
+// issueActionToken stores a new action token for the user, returning the token to send them.
+func issueActionToken(userRepo UserRepository, userId string, purpose string, data string,
+	ttl time.Duration) (string, error) {
+	token, tokenHash, err := newOpaqueToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	err = userRepo.AddActionToken(ActionToken{
+		TokenHash: tokenHash,
+		UserId:    userId,
+		Purpose:   purpose,
+		Data:      data,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// actionLink builds the front end link a user follows to use an action token.
+func actionLink(config Configuration, path string, token string) string {
+	return fmt.Sprintf("%s%s?token=%s", config.GetAppUrl(), path, url.QueryEscape(token))
+}
+
+// ForgotPasswordMiddleware middleware to email a password reset link to the owner of an email address. The response
+// is the same whether or not the address belongs to an account, so it can't be used to discover users.
+func ForgotPasswordMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req forgotPasswordRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		if req.Email == "" {
+			RenderResponse(w, r, NewBadRequestErr("email is required"))
+			return
+		}
+
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		mailer, ok := r.Context().Value("mailer").(Mailer)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		user, err := userRepo.GetUserByEmail(req.Email)
+
+		if errors.Is(err, errUserNotFound) {
+			next.ServeHTTP(w, r)
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		token, err := issueActionToken(userRepo, user.Id, passwordResetPurpose, "", passwordResetTtl)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = mailer.Send(Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Someone asked to reset the password for %s. If it was you, follow the link below "+
+				"within the next hour to choose a new one.\n\n%s\n\nIf it wasn't, you can ignore this email.",
+				user.Username, actionLink(config, "/password/reset", token)),
+		})
+
+		// Failing here would reveal that the account exists.
+		if err != nil {
+			log.Printf("Unable to send password reset email: %s", err.Error())
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ForgotPassword renders the response to a password reset request.
+func ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	RenderResponse(w, r, passwordResetResponse{http.StatusAccepted})
+}
+
+// ResetPasswordMiddleware middleware to replace a user's password using an emailed reset token, revoking all of their
+// sessions.
+func ResetPasswordMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req resetPasswordRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		if req.Token == "" {
+			RenderResponse(w, r, NewBadRequestErr("token is required"))
+			return
+		}
+
+		if req.Password == "" {
+			RenderResponse(w, r, NewBadRequestErr("password is required"))
+			return
+		}
+
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		sessionRepo, ok := r.Context().Value("sessionRepo").(SessionRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		// The token is only used up once the new password is known to be acceptable.
+		actionToken, err := userRepo.GetActionToken(hashOpaqueToken(req.Token), passwordResetPurpose)
+
+		if errors.Is(err, errActionTokenInvalid) {
+			RenderResponse(w, r, NewBadRequestErr("invalid or expired token"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		user, err := userRepo.GetUser(actionToken.UserId)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = checkPasswordPolicy(config, req.Password, user.Email, user.Username)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		_, err = userRepo.ConsumeActionToken(actionToken.TokenHash, passwordResetPurpose)
+
+		if errors.Is(err, errActionTokenInvalid) {
+			RenderResponse(w, r, NewBadRequestErr("invalid or expired token"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = userRepo.UpdatePassword(actionToken.UserId, req.Password)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		// Whoever knew the old password may have registered their own passkeys.
+		err = userRepo.RemoveWebAuthnCredentials(actionToken.UserId)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		// Refresh tokens are checked against their session when exchanged, so revoking the sessions is sufficient.
+		err = sessionRepo.RevokeUserSessions(actionToken.UserId)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ResetPassword renders the response to a successful password reset.
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+	RenderResponse(w, r, passwordResetResponse{http.StatusOK})
+}
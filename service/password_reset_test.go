@@ -0,0 +1,104 @@
+package service_test
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newPasswordResetTestServer(t *testing.T) *testServer {
+	ts := newSessionTestServer(t)
+	ts.router.Route("/password", func(r chi.Router) {
+		r.With(service.ForgotPasswordMiddleware).Post("/forgot", service.ForgotPassword)
+		r.With(service.ResetPasswordMiddleware).Post("/reset", service.ResetPassword)
+	})
+
+	return ts
+}
+
+// linkToken extracts the token from the link to path in an email.
+func linkToken(t *testing.T, message service.Message, path string) string {
+	body := message.Body
+	start := strings.Index(body, "http://localhost:8080"+path+"?")
+	assert(t, start >= 0, "expected %s link in %q", path, body)
+
+	link, err := url.Parse(strings.Fields(body[start:])[0])
+	ok(t, err)
+
+	return link.Query().Get("token")
+}
+
+// TestPasswordReset ensures a user can replace a forgotten password with an emailed token, which logs out every
+// session, removes their passkeys and can only be used once.
+func TestPasswordReset(t *testing.T) {
+	ts := newPasswordResetTestServer(t)
+	tokens := login(t, ts)
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+	credential := service.WebAuthnCredential{Id: "passkey", UserId: user.Id, PublicKey: []byte{1}}
+	ok(t, ts.repo.AddWebAuthnCredential(credential))
+
+	status := ts.do(t, http.MethodPost, "/password/forgot", "", map[string]string{"email": "user@justinstone.net"},
+		nil)
+	equals(t, http.StatusAccepted, status)
+	equals(t, "user@justinstone.net", ts.mailer.last(t).To)
+	token := linkToken(t, ts.mailer.last(t), "/password/reset")
+
+	status = ts.do(t, http.MethodPost, "/password/reset", "",
+		map[string]string{"token": token, "password": "new password"}, nil)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodPost, "/password/reset", "",
+		map[string]string{"token": token, "password": "another password"}, nil)
+	equals(t, http.StatusBadRequest, status)
+
+	credentials, err := ts.repo.GetWebAuthnCredentials(user.Id)
+	ok(t, err)
+	equals(t, 0, len(credentials))
+
+	status = ts.do(t, http.MethodDelete, "/session/", tokens.Token, nil, nil)
+	equals(t, http.StatusUnauthorized, status)
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	status = ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "user@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusUnauthorized, status)
+	status = ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "user@justinstone.net", "password": "new password"}, nil)
+	equals(t, http.StatusOK, status)
+}
+
+// TestPasswordReset_LatestTokenOnly ensures requesting another reset invalidates earlier links.
+func TestPasswordReset_LatestTokenOnly(t *testing.T) {
+	ts := newPasswordResetTestServer(t)
+
+	for i := 0; i < 2; i++ {
+		status := ts.do(t, http.MethodPost, "/password/forgot", "",
+			map[string]string{"email": "user@justinstone.net"}, nil)
+		equals(t, http.StatusAccepted, status)
+	}
+
+	status := ts.do(t, http.MethodPost, "/password/reset", "",
+		map[string]string{"token": linkToken(t, ts.mailer.messages[0], "/password/reset"), "password": "new password"},
+		nil)
+	equals(t, http.StatusBadRequest, status)
+
+	status = ts.do(t, http.MethodPost, "/password/reset", "",
+		map[string]string{"token": linkToken(t, ts.mailer.last(t), "/password/reset"), "password": "new password"}, nil)
+	equals(t, http.StatusOK, status)
+}
+
+// TestForgotPassword_UnknownEmail ensures unknown addresses get the same response without an email being sent.
+func TestForgotPassword_UnknownEmail(t *testing.T) {
+	ts := newPasswordResetTestServer(t)
+
+	status := ts.do(t, http.MethodPost, "/password/forgot", "", map[string]string{"email": "nobody@example.com"},
+		nil)
+	equals(t, http.StatusAccepted, status)
+	equals(t, 0, len(ts.mailer.messages))
+}
@@ -2,22 +2,127 @@ package service
 
 import (
 	"database/sql"
+	"errors"
 	pg "github.com/lib/pq"
 	"github.com/twinj/uuid"
-	"golang.org/x/crypto/bcrypt"
+	"log"
+	"strings"
+	"time"
 )
 
 const (
-	getUser           = "SELECT l.email, l.username, up.gender, up.age, up.topics  FROM login l JOIN user_profile up ON (l.id=up.user_id)  WHERE l.id=$1"
-	updateProfile     = "UPDATE user_profile (gender, age, topics) VALUES ($1, $2, $3) WHERE user_id=$4"
-	insertLogin       = "INSERT INTO login (id, email, username, salted_hash) VALUES ($1, $2, $3, $4)"
+	getUser           = "SELECT l.email, l.username, l.email_verified, l.roles, l.status, l.suspended_until, l.purge_at, up.gender, up.age, up.topics  FROM login l JOIN user_profile up ON (l.id=up.user_id)  WHERE l.id=$1"
+	updateProfile     = "UPDATE user_profile SET gender=$1, age=$2, topics=$3 WHERE user_id=$4"
+	insertLogin       = "INSERT INTO login (id, username, email, salted_hash) SELECT $1, $2, $3, $4 WHERE " + usernameFree
 	insertUserProfile = "INSERT INTO user_profile (user_id, gender, age, topics) VALUES ($1, $2, $3, $4)"
-	authenticate      = "SELECT l.salted_hash, l.id, l.username, up.gender, up.age, up.topics  FROM login l JOIN user_profile up ON (l.id=up.user_id)  WHERE l.email=$1"
-	insertStoredLogin = "INSERT INTO login (id, email, username, salted_hash, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6)"
+	authenticate      = "SELECT l.salted_hash, l.id, l.username, l.email_verified, l.roles, l.status, l.suspended_until, l.purge_at, up.gender, up.age, up.topics  FROM login l JOIN user_profile up ON (l.id=up.user_id)  WHERE l.email=$1"
+	getUserByEmail    = "SELECT l.id, l.username, l.email_verified, l.roles, l.status, l.suspended_until, l.purge_at, up.gender, up.age, up.topics FROM login l JOIN user_profile up ON (l.id=up.user_id) WHERE l.email=$1"
+	getSaltedHash     = "SELECT salted_hash FROM login WHERE id=$1"
+	updatePassword    = "UPDATE login SET salted_hash=$2, updated_at=now() WHERE id=$1"
+	rehashPassword    = "UPDATE login SET salted_hash=$2 WHERE id=$1 AND salted_hash=$3"
+	insertStoredLogin = "INSERT INTO login (id, email, username, salted_hash, email_verified, roles, status, suspended_until, purge_at, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, COALESCE($6, '{}'::text[]), COALESCE(NULLIF($7, ''), 'active'), $8, $9, $10, $11)"
+	verifyEmail       = "UPDATE login SET email_verified=true, updated_at=now() WHERE id=$1"
+	setRoles          = "UPDATE login SET roles=$2, updated_at=now() WHERE id=$1"
+	changeEmail       = "UPDATE login SET email=$2, email_verified=true, updated_at=now() WHERE id=$1 AND NOT EXISTS (SELECT 1 FROM login WHERE email=$2)"
+
+	insertRefreshToken       = "INSERT INTO refresh_token (token_hash, family_id, user_id, expires_at) VALUES ($1, $2, $3, $4)"
+	selectRefreshToken       = "SELECT family_id, user_id, expires_at, used_at IS NOT NULL, revoked_at IS NOT NULL FROM refresh_token WHERE token_hash=$1 FOR UPDATE"
+	useRefreshToken          = "UPDATE refresh_token SET used_at=now() WHERE token_hash=$1"
+	revokeRefreshTokenFamily = "UPDATE refresh_token SET revoked_at=now() WHERE family_id=$1 AND revoked_at IS NULL"
+
+	upsertTotp     = "INSERT INTO totp (user_id, secret) VALUES ($1, $2) ON CONFLICT (user_id) DO UPDATE SET secret=$2, confirmed_at=NULL, last_counter=0"
+	getTotp        = "SELECT secret, confirmed_at IS NOT NULL, last_counter FROM totp WHERE user_id=$1"
+	confirmTotp    = "UPDATE totp SET confirmed_at=now(), last_counter=$2 WHERE user_id=$1"
+	useTotpCounter = "UPDATE totp SET last_counter=$2 WHERE user_id=$1 AND last_counter < $2"
+	deleteTotp     = "DELETE FROM totp WHERE user_id=$1"
+
+	deleteRecoveryCodes = "DELETE FROM recovery_code WHERE user_id=$1"
+	insertRecoveryCode  = "INSERT INTO recovery_code (id, user_id, code_hash) VALUES ($1, $2, $3)"
+	getRecoveryCodes    = "SELECT id, code_hash, used_at FROM recovery_code WHERE user_id=$1"
+	useRecoveryCode     = "UPDATE recovery_code SET used_at=now() WHERE id=$1 AND user_id=$2 AND used_at IS NULL"
+
+	invalidateActionTokens = "UPDATE action_token SET used_at=now() WHERE user_id=$1 AND purpose=$2 AND used_at IS NULL"
+	insertActionToken      = "INSERT INTO action_token (token_hash, user_id, purpose, data, expires_at) VALUES ($1, $2, $3, $4, $5)"
+	getActionToken         = "SELECT user_id, data, expires_at FROM action_token WHERE token_hash=$1 AND purpose=$2 AND used_at IS NULL AND expires_at > now()"
+	useActionToken         = "UPDATE action_token SET used_at=now() WHERE token_hash=$1 AND purpose=$2 AND used_at IS NULL AND expires_at > now() RETURNING user_id, data, expires_at"
+
+	usernameFree          = "NOT EXISTS (SELECT 1 FROM login WHERE lower(username)=lower($2) AND id<>$1) AND NOT EXISTS (SELECT 1 FROM username_history WHERE lower(username)=lower($2) AND reserved_until > now() AND user_id<>$1)"
+	selectUsername        = "SELECT username FROM login WHERE id=$1 FOR UPDATE"
+	updateUsername        = "UPDATE login SET username=$2, updated_at=now() WHERE id=$1 AND " + usernameFree
+	insertUsernameHistory = "INSERT INTO username_history (user_id, username, changed_at, reserved_until) VALUES ($1, $2, now(), $3)"
+	getUsernameHistory    = "SELECT username, changed_at, reserved_until FROM username_history WHERE user_id=$1 ORDER BY changed_at"
+	getUserByUsername     = "SELECT l.id, l.email, l.username, l.email_verified, l.roles, l.status, l.suspended_until, l.purge_at, up.gender, up.age, up.topics FROM login l JOIN user_profile up ON (l.id=up.user_id) WHERE lower(l.username)=lower($1)"
+	getPreviousOwner      = "SELECT user_id FROM username_history WHERE lower(username)=lower($1) ORDER BY changed_at DESC LIMIT 1"
+
+	insertCredential  = "INSERT INTO webauthn_credential (id, user_id, name, public_key, sign_count) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (id) DO NOTHING"
+	getCredential     = "SELECT id, user_id, name, public_key, sign_count, created_at, last_used_at FROM webauthn_credential WHERE id=$1"
+	getCredentials    = "SELECT id, user_id, name, public_key, sign_count, created_at, last_used_at FROM webauthn_credential WHERE user_id=$1 ORDER BY created_at"
+	useCredential     = "UPDATE webauthn_credential SET sign_count=$2, last_used_at=now() WHERE id=$1"
+	removeCredential  = "DELETE FROM webauthn_credential WHERE id=$1 AND user_id=$2"
+	removeCredentials = "DELETE FROM webauthn_credential WHERE user_id=$1"
+
+	getLoginFailures    = "SELECT count, last_failed_at FROM login_failure WHERE key=$1"
+	recordLoginFailure  = "INSERT INTO login_failure (key, count, last_failed_at) VALUES ($1, 1, now()) ON CONFLICT (key) DO UPDATE SET count=CASE WHEN login_failure.last_failed_at < now() - $2 * interval '1 second' THEN 1 ELSE login_failure.count + 1 END, last_failed_at=now() RETURNING count, last_failed_at"
+	deleteLoginFailures = "DELETE FROM login_failure WHERE key=$1"
+
+	discardUsedChallenges = "DELETE FROM used_challenge WHERE expires_at <= now()"
+	insertUsedChallenge   = "INSERT INTO used_challenge (id, expires_at) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING"
+
+	listUsers                 = "SELECT l.id, l.email, l.username, l.email_verified, l.roles, l.status, l.suspended_until, l.purge_at, up.gender, up.age, up.topics, l.created_at, l.updated_at FROM login l JOIN user_profile up ON (l.id=up.user_id) WHERE ($1::text = '' OR lower(l.email) LIKE lower($1) ESCAPE '\\') AND ($2::text = '' OR lower(l.username)=lower($2)) AND ($3::timestamptz IS NULL OR l.created_at >= $3) AND ($4::timestamptz IS NULL OR l.created_at < $4) AND ($5::text = '' OR $5 = ANY(up.topics)) ORDER BY l.created_at, l.id LIMIT $6 OFFSET $7"
+	getUserRecord             = "SELECT l.email, l.username, l.email_verified, l.roles, l.status, l.suspended_until, l.purge_at, up.gender, up.age, up.topics, l.created_at, l.updated_at FROM login l JOIN user_profile up ON (l.id=up.user_id) WHERE l.id=$1"
+	setAccountStatus          = "UPDATE login SET status=$2, suspended_until=$3, purge_at=$4, updated_at=now() WHERE id=$1"
+	insertAccountStatusChange = "INSERT INTO account_status_change (user_id, status, suspended_until, purge_at, reason, changed_by, changed_at) VALUES ($1, $2, $3, $4, $5, $6, now())"
+	getAccountStatusHistory   = "SELECT status, suspended_until, purge_at, reason, changed_by, changed_at FROM account_status_change WHERE user_id=$1 ORDER BY changed_at"
+	deleteLogin               = "DELETE FROM login WHERE id=$1 RETURNING email"
+	getUsersToPurge           = "SELECT id FROM login WHERE status='deleted' AND purge_at <= $1 ORDER BY purge_at"
+	lockUserToPurge           = "SELECT true FROM login WHERE id=$1 AND status='deleted' AND purge_at <= $2 FOR UPDATE"
+)
+
+const (
+	// uniqueViolation is the PostgreSQL error code for a row violating a unique index.
+	uniqueViolation = "23505"
+	// loginEmailIndex is the unique index on login holding email addresses to a single user.
+	loginEmailIndex = "login_email_key"
+	// loginUsernameIndex is the unique index on login holding usernames, ignoring case, to a single user.
+	loginUsernameIndex = "login_lower_username_key"
 )
 
+// takenErr maps err to errEmailTaken or errUsernameTaken if it is the violation of the unique index on the email or
+// username of login, returning it unchanged otherwise. The indexes settle concurrent writes the queries' own checks
+// can't see.
+func takenErr(err error) error {
+	var pgErr *pg.Error
+
+	if !errors.As(err, &pgErr) || pgErr.Code != uniqueViolation {
+		return err
+	}
+
+	switch pgErr.Constraint {
+	case loginEmailIndex:
+		return errEmailTaken
+	case loginUsernameIndex:
+		return errUsernameTaken
+	default:
+		return err
+	}
+}
+
+// deleteUserData removes everything stored against a user other than their login, in an order that satisfies foreign
+// keys.
+var deleteUserData = []string{
+	"DELETE FROM refresh_token WHERE user_id=$1",
+	"DELETE FROM totp WHERE user_id=$1",
+	"DELETE FROM recovery_code WHERE user_id=$1",
+	"DELETE FROM webauthn_credential WHERE user_id=$1",
+	"DELETE FROM action_token WHERE user_id=$1",
+	"DELETE FROM username_history WHERE user_id=$1",
+	"DELETE FROM account_status_change WHERE user_id=$1",
+	"DELETE FROM user_profile WHERE user_id=$1",
+}
+
 type postgresqlUserRepository struct {
-	db *sql.DB
+	db     *sql.DB
+	hasher PasswordHasher
 }
 
 // NewUser adds a user to the repo.
@@ -45,7 +150,7 @@ func (impr *postgresqlUserRepository) NewUser(
 
 	id := uuid.NewV4().String()
 
-	saltedHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	saltedHash, err := impr.hasher.Hash(password)
 
 	if err != nil {
 		return "", newErrRepository("unable to generate password")
@@ -58,11 +163,21 @@ func (impr *postgresqlUserRepository) NewUser(
 		return "", err
 	}
 
-	_, err = tx.Exec(insertLogin, id, email, handle, saltedHash)
+	result, err := tx.Exec(insertLogin, id, handle, email, saltedHash)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return "", takenErr(err)
+	}
+
+	affected, err := result.RowsAffected()
 
 	if err != nil {
 		_ = tx.Rollback()
 		return "", err
+	} else if affected == 0 {
+		_ = tx.Rollback()
+		return "", errUsernameTaken
 	}
 
 	_, err = tx.Exec(insertUserProfile, id, gender, age, pg.Array(topics))
@@ -76,7 +191,8 @@ func (impr *postgresqlUserRepository) NewUser(
 	return id, err
 }
 
-// Authenticate compares a given email and password combination against the salted hash in the repo.
+// Authenticate compares a given email and password combination against the salted hash in the repo, replacing the
+// hash if it was made by an outdated algorithm or parameters.
 func (impr *postgresqlUserRepository) Authenticate(email string, password string) (User, error) {
 	if email == "" {
 		return User{}, newErrRepository("email is required")
@@ -90,63 +206,1284 @@ func (impr *postgresqlUserRepository) Authenticate(email string, password string
 	var saltedHash string
 	var id string
 	var username string
+	var emailVerified bool
+	var roles []string
+	var status AccountStatus
 	var gender Gender
 	var age int
 	var topics []string
 
-	err := row.Scan(&saltedHash, &id, &username, &gender, &age, &topics)
+	err := row.Scan(&saltedHash, &id, &username, &emailVerified, pg.Array(&roles), &status.State, &status.SuspendedUntil,
+		&status.PurgeAt, &gender, &age, pg.Array(&topics))
 
+	// Unknown emails are reported like a wrong password, so logins count them as failures without revealing which
+	// emails have accounts.
 	if err == sql.ErrNoRows {
 		return User{}, nil
 	} else if err != nil {
 		return User{}, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(saltedHash), []byte(password))
+	match, err := impr.hasher.Verify(saltedHash, password)
 
 	if err != nil {
+		return User{}, err
+	} else if !match {
 		return User{}, nil
 	}
 
-	return User{id, email, username, UserProfile{Gender: gender, Age: age, Topics: topics}}, nil
+	if impr.hasher.NeedsRehash(saltedHash) {
+		impr.rehash(id, saltedHash, password)
+	}
+
+	user := User{id, email, username, emailVerified, roles, status,
+		UserProfile{Gender: gender, Age: age, Topics: topics}}
+
+	if status.Effective(time.Now()) != AccountActive {
+		return user, errAccountInactive
+	}
+
+	return user, nil
+}
+
+// rehash replaces a user's outdated salted hash, unless their password changed since it was read. Failing only means
+// the hash is replaced on a later login, so errors are just logged.
+func (impr *postgresqlUserRepository) rehash(userId string, saltedHash string, password string) {
+	newHash, err := impr.hasher.Hash(password)
+
+	if err == nil {
+		_, err = impr.db.Exec(rehashPassword, userId, newHash, saltedHash)
+	}
+
+	if err != nil {
+		log.Printf("Unable to rehash password: %s", err.Error())
+	}
 }
 
 func (imr *postgresqlUserRepository) GetUser(id string) (User, error) {
 	if id == "" {
 		return User{}, newErrRepository("id is required")
 	}
-	row := imr.db.QueryRow(id)
+	row := imr.db.QueryRow(getUser, id)
 	var email string
 	var username string
+	var emailVerified bool
+	var roles []string
+	var status AccountStatus
 	var gender Gender
 	var age int
 	var topics []string
 
-	err := row.Scan(&email, &username, &gender, &age, &topics)
+	err := row.Scan(&email, &username, &emailVerified, pg.Array(&roles), &status.State, &status.SuspendedUntil,
+		&status.PurgeAt, &gender, &age, pg.Array(&topics))
 
 	if err == sql.ErrNoRows {
-		return User{}, nil
+		return User{}, errUserNotFound
 	} else if err != nil {
 		return User{}, err
 	}
 
-	return User{id, email, username, UserProfile{Gender: gender, Age: age, Topics: topics}}, nil
+	return User{id, email, username, emailVerified, roles, status,
+		UserProfile{Gender: gender, Age: age, Topics: topics}}, nil
 }
 
-func (impr *postgresqlUserRepository) UpdateProfile(userId string, profile UserProfile) error {
+// GetUserByEmail retrieves the user with the given email address.
+func (impr *postgresqlUserRepository) GetUserByEmail(email string) (User, error) {
+	if email == "" {
+		return User{}, newErrRepository("email is required")
+	}
+
+	user := User{Email: email}
+
+	err := impr.db.QueryRow(getUserByEmail, email).Scan(
+		&user.Id,
+		&user.Username,
+		&user.EmailVerified,
+		pg.Array(&user.Roles),
+		&user.Status.State,
+		&user.Status.SuspendedUntil,
+		&user.Status.PurgeAt,
+		&user.Gender,
+		&user.Age,
+		pg.Array(&user.Topics),
+	)
+
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	} else if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// UpdatePassword replaces a user's password.
+func (impr *postgresqlUserRepository) UpdatePassword(userId string, password string) error {
 	if userId == "" {
 		return newErrRepository("userId is required")
-	} else if profile.Gender == "" {
-		return newErrRepository("gender is required")
-	} else if profile.Age == 0 {
-		return newErrRepository("age is required")
-	} else if profile.Topics == nil {
-		return newErrRepository("topics is required")
+	} else if password == "" {
+		return newErrRepository("password is required")
 	}
 
-	_, err := impr.db.Exec(updateProfile, profile.Gender, profile.Age, profile.Topics, userId)
+	saltedHash, err := impr.hasher.Hash(password)
 
-	return err
+	if err != nil {
+		return newErrRepository("unable to generate password")
+	}
+
+	result, err := impr.db.Exec(updatePassword, userId, saltedHash)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errUserNotFound
+	}
+
+	return nil
+}
+
+// SetRoles replaces the roles granted to a user.
+func (impr *postgresqlUserRepository) SetRoles(userId string, roles []string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	if roles == nil {
+		roles = []string{}
+	}
+
+	result, err := impr.db.Exec(setRoles, userId, pg.Array(roles))
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errUserNotFound
+	}
+
+	return nil
+}
+
+// VerifyEmail records that a user has confirmed they own their email address.
+func (impr *postgresqlUserRepository) VerifyEmail(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	result, err := impr.db.Exec(verifyEmail, userId)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errUserNotFound
+	}
+
+	return nil
+}
+
+// ChangeEmail replaces a user's email address with one they have confirmed they own.
+func (impr *postgresqlUserRepository) ChangeEmail(userId string, email string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if email == "" {
+		return newErrRepository("email is required")
+	}
+
+	result, err := impr.db.Exec(changeEmail, userId, email)
+
+	if err != nil {
+		return takenErr(err)
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		// The user is known to exist when changing their email, so the address must be taken.
+		return errEmailTaken
+	}
+
+	return nil
+}
+
+// likePrefix returns a LIKE pattern matching strings starting with prefix, escaping its wildcards.
+func likePrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix) + "%"
+}
+
+// nullTime returns nil for the zero time, so it is stored as NULL.
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+
+	return t
+}
+
+// GetUserRecord retrieves a user along with when their account was created and last updated.
+func (impr *postgresqlUserRepository) GetUserRecord(userId string) (UserRecord, error) {
+	if userId == "" {
+		return UserRecord{}, newErrRepository("userId is required")
+	}
+
+	record := UserRecord{User: User{Id: userId}}
+
+	err := impr.db.QueryRow(getUserRecord, userId).Scan(
+		&record.Email,
+		&record.Username,
+		&record.EmailVerified,
+		pg.Array(&record.Roles),
+		&record.Status.State,
+		&record.Status.SuspendedUntil,
+		&record.Status.PurgeAt,
+		&record.Gender,
+		&record.Age,
+		pg.Array(&record.Topics),
+		&record.CreatedAt,
+		&record.UpdatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return UserRecord{}, errUserNotFound
+	} else if err != nil {
+		return UserRecord{}, err
+	}
+
+	return record, nil
+}
+
+// ListUsers retrieves up to limit users matching filter, oldest first, skipping the first offset.
+func (impr *postgresqlUserRepository) ListUsers(filter UserFilter, offset int, limit int) ([]UserRecord, error) {
+	if offset < 0 {
+		return nil, newErrRepository("offset must not be negative")
+	} else if limit <= 0 {
+		return nil, newErrRepository("limit must be positive")
+	}
+
+	rows, err := impr.db.Query(listUsers, likePrefix(filter.EmailPrefix), filter.Username,
+		nullTime(filter.CreatedAfter), nullTime(filter.CreatedBefore), filter.Topic, limit, offset)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	records := make([]UserRecord, 0)
+
+	for rows.Next() {
+		var record UserRecord
+
+		err = rows.Scan(
+			&record.Id,
+			&record.Email,
+			&record.Username,
+			&record.EmailVerified,
+			pg.Array(&record.Roles),
+			&record.Status.State,
+			&record.Status.SuspendedUntil,
+			&record.Status.PurgeAt,
+			&record.Gender,
+			&record.Age,
+			pg.Array(&record.Topics),
+			&record.CreatedAt,
+			&record.UpdatedAt,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// SetAccountStatus changes the status of a user's account, recording who changed it, when and why.
+func (impr *postgresqlUserRepository) SetAccountStatus(userId string, status AccountStatus, reason string,
+	changedBy string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if status.State == "" {
+		return newErrRepository("state is required")
+	} else if changedBy == "" {
+		return newErrRepository("changedBy is required")
+	}
+
+	tx, err := impr.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(setAccountStatus, userId, status.State, status.SuspendedUntil, status.PurgeAt)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	} else if affected == 0 {
+		_ = tx.Rollback()
+		return errUserNotFound
+	}
+
+	_, err = tx.Exec(insertAccountStatusChange, userId, status.State, status.SuspendedUntil, status.PurgeAt, reason,
+		changedBy)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAccountStatusHistory retrieves the changes made to the status of a user's account, oldest first.
+func (impr *postgresqlUserRepository) GetAccountStatusHistory(userId string) ([]AccountStatusChange, error) {
+	if userId == "" {
+		return nil, newErrRepository("userId is required")
+	}
+
+	rows, err := impr.db.Query(getAccountStatusHistory, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	history := make([]AccountStatusChange, 0)
+
+	for rows.Next() {
+		var change AccountStatusChange
+
+		err = rows.Scan(&change.Status.State, &change.Status.SuspendedUntil, &change.Status.PurgeAt, &change.Reason,
+			&change.ChangedBy, &change.ChangedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		history = append(history, change)
+	}
+
+	return history, rows.Err()
+}
+
+// DeleteUser permanently removes a user along with everything the repo stores for them.
+func (impr *postgresqlUserRepository) DeleteUser(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	tx, err := impr.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	err = deleteUser(tx, userId)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetUsersToPurge retrieves the ids of the deleted users whose purge time is no later than now, soonest due first.
+func (impr *postgresqlUserRepository) GetUsersToPurge(now time.Time) ([]string, error) {
+	rows, err := impr.db.Query(getUsersToPurge, now)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	userIds := make([]string, 0)
+
+	for rows.Next() {
+		var userId string
+		err = rows.Scan(&userId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		userIds = append(userIds, userId)
+	}
+
+	return userIds, rows.Err()
+}
+
+// PurgeUser permanently removes a deleted user if their purge time is still no later than now. The user is locked
+// while checking, so restoring the account can't race with its purge.
+func (impr *postgresqlUserRepository) PurgeUser(userId string, now time.Time) (bool, error) {
+	if userId == "" {
+		return false, newErrRepository("userId is required")
+	}
+
+	tx, err := impr.db.Begin()
+
+	if err != nil {
+		return false, err
+	}
+
+	var due bool
+	err = tx.QueryRow(lockUserToPurge, userId, now).Scan(&due)
+
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return false, nil
+	} else if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+
+	err = deleteUser(tx, userId)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return false, err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// deleteUser removes a user along with everything stored for them within tx, which the caller rolls back on error.
+func deleteUser(tx *sql.Tx, userId string) error {
+	for _, query := range deleteUserData {
+		_, err := tx.Exec(query, userId)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	var email string
+	err := tx.QueryRow(deleteLogin, userId).Scan(&email)
+
+	if err == sql.ErrNoRows {
+		return errUserNotFound
+	} else if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(deleteLoginFailures, accountThrottleKey(email))
+
+	return err
+}
+
+// ChangeUsername replaces a user's username, reserving the old one for them until reservedUntil.
+func (impr *postgresqlUserRepository) ChangeUsername(userId string, username string, reservedUntil time.Time) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if username == "" {
+		return newErrRepository("username is required")
+	}
+
+	tx, err := impr.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	var previous string
+	err = tx.QueryRow(selectUsername, userId).Scan(&previous)
+
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return errUserNotFound
+	} else if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	result, err := tx.Exec(updateUsername, userId, username)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return takenErr(err)
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	} else if affected == 0 {
+		_ = tx.Rollback()
+		return errUsernameTaken
+	}
+
+	_, err = tx.Exec(insertUsernameHistory, userId, previous, reservedUntil)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetUsernameHistory retrieves the usernames a user has given up, oldest first.
+func (impr *postgresqlUserRepository) GetUsernameHistory(userId string) ([]UsernameChange, error) {
+	if userId == "" {
+		return nil, newErrRepository("userId is required")
+	}
+
+	rows, err := impr.db.Query(getUsernameHistory, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	history := make([]UsernameChange, 0)
+
+	for rows.Next() {
+		var change UsernameChange
+		err = rows.Scan(&change.Username, &change.ChangedAt, &change.ReservedUntil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		history = append(history, change)
+	}
+
+	return history, rows.Err()
+}
+
+// GetUserByUsername retrieves the user currently holding username, ignoring case.
+func (impr *postgresqlUserRepository) GetUserByUsername(username string) (User, error) {
+	if username == "" {
+		return User{}, newErrRepository("username is required")
+	}
+
+	var user User
+
+	err := impr.db.QueryRow(getUserByUsername, username).Scan(
+		&user.Id,
+		&user.Email,
+		&user.Username,
+		&user.EmailVerified,
+		pg.Array(&user.Roles),
+		&user.Status.State,
+		&user.Status.SuspendedUntil,
+		&user.Status.PurgeAt,
+		&user.Gender,
+		&user.Age,
+		pg.Array(&user.Topics),
+	)
+
+	if err == sql.ErrNoRows {
+		return User{}, errUserNotFound
+	} else if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// GetPreviousUsernameOwner retrieves the id of the user who most recently gave up username, ignoring case.
+func (impr *postgresqlUserRepository) GetPreviousUsernameOwner(username string) (string, error) {
+	if username == "" {
+		return "", newErrRepository("username is required")
+	}
+
+	var userId string
+	err := impr.db.QueryRow(getPreviousOwner, username).Scan(&userId)
+
+	if err == sql.ErrNoRows {
+		return "", errUserNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	return userId, nil
+}
+
+// ChangePassword replaces a user's password after verifying their current one.
+func (impr *postgresqlUserRepository) ChangePassword(userId string, currentPassword string, password string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if currentPassword == "" {
+		return newErrRepository("currentPassword is required")
+	} else if password == "" {
+		return newErrRepository("password is required")
+	}
+
+	var saltedHash string
+	err := impr.db.QueryRow(getSaltedHash, userId).Scan(&saltedHash)
+
+	if err == sql.ErrNoRows {
+		return errUserNotFound
+	} else if err != nil {
+		return err
+	}
+
+	match, err := impr.hasher.Verify(saltedHash, currentPassword)
+
+	if err != nil {
+		return err
+	} else if !match {
+		return errPasswordMismatch
+	}
+
+	return impr.UpdatePassword(userId, password)
+}
+
+func (impr *postgresqlUserRepository) UpdateProfile(userId string, profile UserProfile) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if profile.Gender == "" {
+		return newErrRepository("gender is required")
+	} else if profile.Age == 0 {
+		return newErrRepository("age is required")
+	} else if profile.Topics == nil {
+		return newErrRepository("topics is required")
+	}
+
+	result, err := impr.db.Exec(updateProfile, profile.Gender, profile.Age, pg.Array(profile.Topics), userId)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errUserNotFound
+	}
+
+	return nil
+}
+
+// AddRefreshToken stores the hash of a refresh token issued to a user as a member of the given token family.
+func (impr *postgresqlUserRepository) AddRefreshToken(
+	userId string,
+	familyId string,
+	tokenHash string,
+	expiresAt time.Time,
+) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if familyId == "" {
+		return newErrRepository("familyId is required")
+	} else if tokenHash == "" {
+		return newErrRepository("tokenHash is required")
+	}
+
+	_, err := impr.db.Exec(insertRefreshToken, tokenHash, familyId, userId, expiresAt)
+
+	return err
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same family, revoking the family on reuse.
+func (impr *postgresqlUserRepository) RotateRefreshToken(
+	tokenHash string,
+	newTokenHash string,
+	expiresAt time.Time,
+) (string, string, error) {
+	if tokenHash == "" {
+		return "", "", newErrRepository("tokenHash is required")
+	} else if newTokenHash == "" {
+		return "", "", newErrRepository("newTokenHash is required")
+	}
+
+	tx, err := impr.db.Begin()
+
+	if err != nil {
+		return "", "", err
+	}
+
+	var familyId string
+	var userId string
+	var tokenExpiresAt time.Time
+	var used bool
+	var revoked bool
+
+	err = tx.QueryRow(selectRefreshToken, tokenHash).Scan(&familyId, &userId, &tokenExpiresAt, &used, &revoked)
+
+	if err == sql.ErrNoRows {
+		_ = tx.Rollback()
+		return "", "", errRefreshTokenInvalid
+	} else if err != nil {
+		_ = tx.Rollback()
+		return "", "", err
+	}
+
+	if revoked || time.Now().After(tokenExpiresAt) {
+		_ = tx.Rollback()
+		return "", "", errRefreshTokenInvalid
+	}
+
+	if used {
+		_, err = tx.Exec(revokeRefreshTokenFamily, familyId)
+
+		if err != nil {
+			_ = tx.Rollback()
+			return "", "", err
+		}
+
+		err = tx.Commit()
+
+		if err != nil {
+			return "", "", err
+		}
+
+		return userId, familyId, errRefreshTokenReused
+	}
+
+	_, err = tx.Exec(useRefreshToken, tokenHash)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return "", "", err
+	}
+
+	_, err = tx.Exec(insertRefreshToken, newTokenHash, familyId, userId, expiresAt)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return "", "", err
+	}
+
+	err = tx.Commit()
+
+	return userId, familyId, err
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token belonging to the given family.
+func (impr *postgresqlUserRepository) RevokeRefreshTokenFamily(familyId string) error {
+	if familyId == "" {
+		return newErrRepository("familyId is required")
+	}
+
+	_, err := impr.db.Exec(revokeRefreshTokenFamily, familyId)
+
+	return err
+}
+
+// SetTotpSecret stores an unconfirmed TOTP secret for a user, replacing any previous enrollment.
+func (impr *postgresqlUserRepository) SetTotpSecret(userId string, secret string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if secret == "" {
+		return newErrRepository("secret is required")
+	}
+
+	_, err := impr.db.Exec(upsertTotp, userId, secret)
+
+	return err
+}
+
+// GetTotp retrieves a user's TOTP enrollment.
+func (impr *postgresqlUserRepository) GetTotp(userId string) (TotpEnrollment, error) {
+	if userId == "" {
+		return TotpEnrollment{}, newErrRepository("userId is required")
+	}
+
+	var enrollment TotpEnrollment
+
+	err := impr.db.QueryRow(getTotp, userId).Scan(&enrollment.Secret, &enrollment.Confirmed, &enrollment.LastCounter)
+
+	if err == sql.ErrNoRows {
+		return TotpEnrollment{}, errTotpNotFound
+	} else if err != nil {
+		return TotpEnrollment{}, err
+	}
+
+	return enrollment, nil
+}
+
+// ConfirmTotp marks a user's TOTP secret as confirmed.
+func (impr *postgresqlUserRepository) ConfirmTotp(userId string, counter int64) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	result, err := impr.db.Exec(confirmTotp, userId, counter)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errTotpNotFound
+	}
+
+	return nil
+}
+
+// UseTotpCounter records that a code for the given time step was accepted. The update only applies to later time
+// steps, so concurrent logins with the same code can't both succeed.
+func (impr *postgresqlUserRepository) UseTotpCounter(userId string, counter int64) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	result, err := impr.db.Exec(useTotpCounter, userId, counter)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errTotpCodeReused
+	}
+
+	return nil
+}
+
+// RemoveTotp removes a user's TOTP enrollment.
+func (impr *postgresqlUserRepository) RemoveTotp(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	_, err := impr.db.Exec(deleteTotp, userId)
+
+	return err
+}
+
+// SetRecoveryCodes replaces a user's recovery codes with the given hashes.
+func (impr *postgresqlUserRepository) SetRecoveryCodes(userId string, codeHashes []string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	tx, err := impr.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(deleteRecoveryCodes, userId)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	for _, codeHash := range codeHashes {
+		_, err = tx.Exec(insertRecoveryCode, uuid.NewV4().String(), userId, codeHash)
+
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetRecoveryCodes retrieves a user's recovery codes, including used ones.
+func (impr *postgresqlUserRepository) GetRecoveryCodes(userId string) ([]RecoveryCode, error) {
+	if userId == "" {
+		return nil, newErrRepository("userId is required")
+	}
+
+	rows, err := impr.db.Query(getRecoveryCodes, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	codes := make([]RecoveryCode, 0)
+
+	for rows.Next() {
+		var code RecoveryCode
+		err = rows.Scan(&code.Id, &code.CodeHash, &code.UsedAt)
+
+		if err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+
+	return codes, rows.Err()
+}
+
+// UseRecoveryCode records that a user's recovery code was used. The update only applies to unused codes, so concurrent
+// logins with the same code can't both succeed.
+func (impr *postgresqlUserRepository) UseRecoveryCode(userId string, codeId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if codeId == "" {
+		return newErrRepository("codeId is required")
+	}
+
+	result, err := impr.db.Exec(useRecoveryCode, codeId, userId)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errRecoveryCodeUsed
+	}
+
+	return nil
+}
+
+// AddWebAuthnCredential stores a WebAuthn credential for its user.
+func (impr *postgresqlUserRepository) AddWebAuthnCredential(credential WebAuthnCredential) error {
+	if credential.Id == "" {
+		return newErrRepository("id is required")
+	} else if credential.UserId == "" {
+		return newErrRepository("userId is required")
+	} else if len(credential.PublicKey) == 0 {
+		return newErrRepository("publicKey is required")
+	}
+
+	result, err := impr.db.Exec(
+		insertCredential,
+		credential.Id,
+		credential.UserId,
+		credential.Name,
+		credential.PublicKey,
+		int64(credential.SignCount),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errCredentialExists
+	}
+
+	return nil
+}
+
+func scanWebAuthnCredential(row rowScanner) (WebAuthnCredential, error) {
+	var credential WebAuthnCredential
+	var signCount int64
+
+	err := row.Scan(
+		&credential.Id,
+		&credential.UserId,
+		&credential.Name,
+		&credential.PublicKey,
+		&signCount,
+		&credential.CreatedAt,
+		&credential.LastUsedAt,
+	)
+
+	credential.SignCount = uint32(signCount)
+
+	return credential, err
+}
+
+// GetWebAuthnCredential retrieves the WebAuthn credential with the given id.
+func (impr *postgresqlUserRepository) GetWebAuthnCredential(credentialId string) (WebAuthnCredential, error) {
+	if credentialId == "" {
+		return WebAuthnCredential{}, newErrRepository("credentialId is required")
+	}
+
+	credential, err := scanWebAuthnCredential(impr.db.QueryRow(getCredential, credentialId))
+
+	if err == sql.ErrNoRows {
+		return WebAuthnCredential{}, errCredentialNotFound
+	} else if err != nil {
+		return WebAuthnCredential{}, err
+	}
+
+	return credential, nil
+}
+
+// GetWebAuthnCredentials retrieves every WebAuthn credential registered by a user.
+func (impr *postgresqlUserRepository) GetWebAuthnCredentials(userId string) ([]WebAuthnCredential, error) {
+	if userId == "" {
+		return nil, newErrRepository("userId is required")
+	}
+
+	rows, err := impr.db.Query(getCredentials, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	credentials := make([]WebAuthnCredential, 0)
+
+	for rows.Next() {
+		credential, err := scanWebAuthnCredential(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		credentials = append(credentials, credential)
+	}
+
+	return credentials, rows.Err()
+}
+
+// UseWebAuthnCredential records a login with a WebAuthn credential.
+func (impr *postgresqlUserRepository) UseWebAuthnCredential(credentialId string, signCount uint32) error {
+	if credentialId == "" {
+		return newErrRepository("credentialId is required")
+	}
+
+	result, err := impr.db.Exec(useCredential, credentialId, int64(signCount))
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errCredentialNotFound
+	}
+
+	return nil
+}
+
+// RemoveWebAuthnCredential removes one of a user's WebAuthn credentials.
+func (impr *postgresqlUserRepository) RemoveWebAuthnCredential(userId string, credentialId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	} else if credentialId == "" {
+		return newErrRepository("credentialId is required")
+	}
+
+	result, err := impr.db.Exec(removeCredential, credentialId, userId)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errCredentialNotFound
+	}
+
+	return nil
+}
+
+// RemoveWebAuthnCredentials removes every WebAuthn credential registered by a user.
+func (impr *postgresqlUserRepository) RemoveWebAuthnCredentials(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	_, err := impr.db.Exec(removeCredentials, userId)
+
+	return err
+}
+
+// AddActionToken stores an action token, invalidating any outstanding tokens the user has for the same purpose.
+func (impr *postgresqlUserRepository) AddActionToken(token ActionToken) error {
+	if token.TokenHash == "" {
+		return newErrRepository("tokenHash is required")
+	} else if token.UserId == "" {
+		return newErrRepository("userId is required")
+	} else if token.Purpose == "" {
+		return newErrRepository("purpose is required")
+	}
+
+	tx, err := impr.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(invalidateActionTokens, token.UserId, token.Purpose)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(insertActionToken, token.TokenHash, token.UserId, token.Purpose, token.Data, token.ExpiresAt)
+
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetActionToken retrieves the unexpired, unused action token matching tokenHash and purpose without using it.
+func (impr *postgresqlUserRepository) GetActionToken(tokenHash string, purpose string) (ActionToken, error) {
+	if tokenHash == "" {
+		return ActionToken{}, newErrRepository("tokenHash is required")
+	}
+
+	token := ActionToken{TokenHash: tokenHash, Purpose: purpose}
+
+	err := impr.db.QueryRow(getActionToken, tokenHash, purpose).Scan(&token.UserId, &token.Data, &token.ExpiresAt)
+
+	if err == sql.ErrNoRows {
+		return ActionToken{}, errActionTokenInvalid
+	} else if err != nil {
+		return ActionToken{}, err
+	}
+
+	return token, nil
+}
+
+// ConsumeActionToken retrieves the unexpired action token matching tokenHash and purpose, marking it used.
+func (impr *postgresqlUserRepository) ConsumeActionToken(tokenHash string, purpose string) (ActionToken, error) {
+	if tokenHash == "" {
+		return ActionToken{}, newErrRepository("tokenHash is required")
+	}
+
+	token := ActionToken{TokenHash: tokenHash, Purpose: purpose}
+
+	err := impr.db.QueryRow(useActionToken, tokenHash, purpose).Scan(&token.UserId, &token.Data, &token.ExpiresAt)
+
+	if err == sql.ErrNoRows {
+		return ActionToken{}, errActionTokenInvalid
+	} else if err != nil {
+		return ActionToken{}, err
+	}
+
+	return token, nil
+}
+
+// GetLoginFailures retrieves the failed logins counted against key.
+func (impr *postgresqlUserRepository) GetLoginFailures(key string) (LoginFailures, error) {
+	if key == "" {
+		return LoginFailures{}, newErrRepository("key is required")
+	}
+
+	var failures LoginFailures
+	err := impr.db.QueryRow(getLoginFailures, key).Scan(&failures.Count, &failures.LastFailedAt)
+
+	if err == sql.ErrNoRows {
+		return LoginFailures{}, nil
+	} else if err != nil {
+		return LoginFailures{}, err
+	}
+
+	return failures, nil
+}
+
+// RecordLoginFailure counts a failed login against key, starting again if the previous failure is older than window.
+func (impr *postgresqlUserRepository) RecordLoginFailure(key string, window time.Duration) (LoginFailures, error) {
+	if key == "" {
+		return LoginFailures{}, newErrRepository("key is required")
+	}
+
+	var failures LoginFailures
+	err := impr.db.QueryRow(recordLoginFailure, key, window.Seconds()).Scan(&failures.Count, &failures.LastFailedAt)
+
+	if err != nil {
+		return LoginFailures{}, err
+	}
+
+	return failures, nil
+}
+
+// ClearLoginFailures forgets the failed logins counted against key.
+func (impr *postgresqlUserRepository) ClearLoginFailures(key string) error {
+	if key == "" {
+		return newErrRepository("key is required")
+	}
+
+	_, err := impr.db.Exec(deleteLoginFailures, key)
+
+	return err
+}
+
+// UseChallenge records that the challenge token with the given id has been used.
+func (impr *postgresqlUserRepository) UseChallenge(challengeId string, expiresAt time.Time) error {
+	if challengeId == "" {
+		return newErrRepository("challengeId is required")
+	}
+
+	_, err := impr.db.Exec(discardUsedChallenges)
+
+	if err != nil {
+		return err
+	}
+
+	result, err := impr.db.Exec(insertUsedChallenge, challengeId, expiresAt)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	} else if affected == 0 {
+		return errChallengeUsed
+	}
+
+	return nil
 }
 
 func loadInitPostgresqlData(db *sql.DB, dataset string) error {
@@ -163,7 +1500,9 @@ func loadInitPostgresqlData(db *sql.DB, dataset string) error {
 	}
 
 	for id, user := range users {
-		_, err = txn.Exec(insertStoredLogin, id, user.Email, user.Username, user.SaltedHash, user.CreatedAt, user.UpdatedAt)
+		_, err = txn.Exec(insertStoredLogin, id, user.Email, user.Username, user.SaltedHash, user.EmailVerified,
+			pg.Array(user.Roles), user.Status.State, user.Status.SuspendedUntil, user.Status.PurgeAt, user.CreatedAt,
+			user.UpdatedAt)
 
 		if err != nil {
 			return err
@@ -184,5 +1523,5 @@ func MakePostgresqlUserRespository(config Configuration, db *sql.DB) (UserReposi
 		return nil, err
 	}
 
-	return &postgresqlUserRepository{db}, nil
+	return &postgresqlUserRepository{db, config.GetPasswordHasher()}, nil
 }
@@ -3,7 +3,9 @@ package service_test
 import (
 	"database/sql"
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/stone1549/yapyapyap/auth/service"
+	"golang.org/x/crypto/bcrypt"
 	"testing"
 	"time"
 )
@@ -119,3 +121,346 @@ func addExpectedUserId5Row(rows *sqlmock.Rows) *sqlmock.Rows {
 		updatedAt,
 	)
 }
+
+func makeEmptyPgRepo(t *testing.T) (*sql.DB, sqlmock.Sqlmock, service.UserRepository) {
+	db, mock, err := sqlmock.New()
+	ok(t, err)
+
+	repo, err := service.MakePostgresqlUserRespository(pgEmpty, db)
+	ok(t, err)
+
+	return db, mock, repo
+}
+
+// TestPostgresqlUserRepository_RotateRefreshToken ensures an unused refresh token is marked used and replaced.
+func TestPostgresqlUserRepository_RotateRefreshToken(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_token").WithArgs("hash1").WillReturnRows(
+		sqlmock.NewRows([]string{"family_id", "user_id", "expires_at", "used", "revoked"}).
+			AddRow("family", "1", time.Now().Add(time.Hour), false, false))
+	mock.ExpectExec("UPDATE refresh_token SET used_at").WithArgs("hash1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_token").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	userId, familyId, err := repo.RotateRefreshToken("hash1", "hash2", time.Now().Add(time.Hour))
+	ok(t, err)
+	equals(t, "1", userId)
+	equals(t, "family", familyId)
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_RotateRefreshTokenReuse ensures replaying a used refresh token revokes its family.
+func TestPostgresqlUserRepository_RotateRefreshTokenReuse(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_token").WithArgs("hash1").WillReturnRows(
+		sqlmock.NewRows([]string{"family_id", "user_id", "expires_at", "used", "revoked"}).
+			AddRow("family", "1", time.Now().Add(time.Hour), true, false))
+	mock.ExpectExec("UPDATE refresh_token SET revoked_at").WithArgs("family").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	_, _, err := repo.RotateRefreshToken("hash1", "hash2", time.Now().Add(time.Hour))
+	notOk(t, err)
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_UseTotpCounterReuse ensures a code for an already used time step is rejected.
+func TestPostgresqlUserRepository_UseTotpCounterReuse(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE totp SET last_counter").WithArgs("1", int64(10)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE totp SET last_counter").WithArgs("1", int64(10)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ok(t, repo.UseTotpCounter("1", 10))
+	notOk(t, repo.UseTotpCounter("1", 10))
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_ChangeUsernameTaken ensures a username held or reserved by another user is rejected
+// without recording history.
+func TestPostgresqlUserRepository_ChangeUsernameTaken(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT username FROM login").WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("user"))
+	mock.ExpectExec("UPDATE login SET username").WithArgs("1", "taken").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	notOk(t, repo.ChangeUsername("1", "taken", time.Now()))
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_UniqueViolation ensures a username or email address taken by a concurrent write, which
+// only the unique indexes catch, is reported as taken.
+func TestPostgresqlUserRepository_UniqueViolation(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT username FROM login").WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("user"))
+	mock.ExpectExec("UPDATE login SET username").WithArgs("1", "Foo").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "login_lower_username_key"})
+	mock.ExpectRollback()
+	mock.ExpectExec("UPDATE login SET email").WithArgs("1", "taken@justinstone.net").
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "login_email_key"})
+	mock.ExpectExec("UPDATE login SET email").WithArgs("1", "other@justinstone.net").
+		WillReturnError(&pq.Error{Code: "23503", Constraint: "login_email_key"})
+
+	err := repo.ChangeUsername("1", "Foo", time.Now())
+	notOk(t, err)
+	equals(t, "username taken", err.Error())
+
+	err = repo.ChangeEmail("1", "taken@justinstone.net")
+	notOk(t, err)
+	equals(t, "email already in use", err.Error())
+
+	err = repo.ChangeEmail("1", "other@justinstone.net")
+	notOk(t, err)
+	assert(t, err.Error() != "email already in use", "expected other errors to be passed on")
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_AuthenticateRehash ensures a hash made by an outdated algorithm is replaced on login,
+// guarded against a concurrent password change.
+func TestPostgresqlUserRepository_AuthenticateRehash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	ok(t, err)
+	defer db.Close()
+
+	repo, err := service.MakePostgresqlUserRespository(hasherConfiguration{pgEmpty,
+		service.MakeUpgradingHasher(service.MakeArgon2idHasher(testArgon2idParams))}, db)
+	ok(t, err)
+
+	saltedHash, err := service.MakeBcryptHasher(bcrypt.MinCost).Hash("password")
+	ok(t, err)
+
+	mock.ExpectQuery("SELECT (.+) FROM login").WithArgs("user@justinstone.net").WillReturnRows(
+		sqlmock.NewRows([]string{"salted_hash", "id", "username", "email_verified", "roles", "status", "suspended_until",
+			"purge_at", "gender", "age", "topics"}).
+			AddRow(saltedHash, "1", "user", true, "{}", "active", nil, nil, "male", 30, "{}"))
+	mock.ExpectExec("UPDATE login SET salted_hash").WithArgs("1", sqlmock.AnyArg(), saltedHash).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	user, err := repo.Authenticate("user@justinstone.net", "password")
+	ok(t, err)
+	equals(t, "1", user.Id)
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_RecordLoginFailure ensures a failed login is counted with a single upsert.
+func TestPostgresqlUserRepository_RecordLoginFailure(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	failedAt := time.Now()
+	mock.ExpectQuery("INSERT INTO login_failure").WithArgs("ip:192.0.2.1", float64(900)).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "last_failed_at"}).AddRow(3, failedAt))
+
+	failures, err := repo.RecordLoginFailure("ip:192.0.2.1", 15*time.Minute)
+	ok(t, err)
+	equals(t, service.LoginFailures{Count: 3, LastFailedAt: failedAt}, failures)
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_SetRoles ensures roles are stored as an array, and that unknown users are reported.
+func TestPostgresqlUserRepository_SetRoles(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE login SET roles").WithArgs("1", "{\"admin\"}").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE login SET roles").WithArgs("2", "{}").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ok(t, repo.SetRoles("1", []string{service.AdminRole}))
+	notOk(t, repo.SetRoles("2", nil))
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_GetUserNotFound ensures unknown users are reported as an error rather than as an empty
+// user.
+func TestPostgresqlUserRepository_GetUserNotFound(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT (.+) FROM login").WithArgs("1").WillReturnRows(sqlmock.NewRows([]string{"email"}))
+
+	user, err := repo.GetUser("1")
+	notOk(t, err)
+	equals(t, "", user.Id)
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_UpdateProfile ensures a profile is replaced in place, and that unknown users are
+// reported.
+func TestPostgresqlUserRepository_UpdateProfile(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	mock.ExpectExec("UPDATE user_profile SET").WithArgs(service.MALE, 30, "{\"go\"}", "1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE user_profile SET").WithArgs(service.MALE, 30, "{\"go\"}", "2").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	profile := service.UserProfile{Gender: service.MALE, Age: 30, Topics: []string{"go"}}
+	ok(t, repo.UpdateProfile("1", profile))
+	notOk(t, repo.UpdateProfile("2", profile))
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_ListUsers ensures filters are passed as query parameters, with email prefix wildcards
+// escaped and unset dates as NULL.
+func TestPostgresqlUserRepository_ListUsers(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	createdAt := time.Now()
+	mock.ExpectQuery("SELECT (.+) FROM login l").
+		WithArgs(`us\_er%`, "", createdAt, nil, "go", 10, 20).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "username", "email_verified", "roles", "status",
+			"suspended_until", "purge_at", "gender", "age", "topics", "created_at", "updated_at"}).
+			AddRow("1", "us_er@justinstone.net", "user", true, "{admin}", "active", nil, nil, "male", 30, "{go}",
+				createdAt, createdAt))
+
+	users, err := repo.ListUsers(service.UserFilter{EmailPrefix: "us_er", CreatedAfter: createdAt, Topic: "go"}, 20, 10)
+	ok(t, err)
+	equals(t, 1, len(users))
+	equals(t, []string{service.AdminRole}, users[0].Roles)
+	equals(t, []string{"go"}, users[0].Topics)
+	equals(t, createdAt, users[0].CreatedAt)
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_DeleteUser ensures a user's data is removed in one transaction, which is rolled back if
+// the user doesn't exist.
+func TestPostgresqlUserRepository_DeleteUser(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mockExpectExecTimes(mock, "DELETE FROM", 8)
+	mock.ExpectQuery("DELETE FROM login").WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("User@justinstone.net"))
+	mock.ExpectExec("DELETE FROM login_failure").WithArgs("account:user@justinstone.net").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	ok(t, repo.DeleteUser("1"))
+
+	mock.ExpectBegin()
+	mockExpectExecTimes(mock, "DELETE FROM", 8)
+	mock.ExpectQuery("DELETE FROM login").WithArgs("2").WillReturnRows(sqlmock.NewRows([]string{"email"}))
+	mock.ExpectRollback()
+
+	notOk(t, repo.DeleteUser("2"))
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_PurgeUser ensures deleted users past their purge time are found, and removed in a
+// transaction that skips any restored since they were found.
+func TestPostgresqlUserRepository_PurgeUser(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectQuery("SELECT id FROM login").WithArgs(now).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("1").AddRow("2"))
+
+	userIds, err := repo.GetUsersToPurge(now)
+	ok(t, err)
+	equals(t, []string{"1", "2"}, userIds)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT true FROM login").WithArgs("1", now).
+		WillReturnRows(sqlmock.NewRows([]string{"bool"}).AddRow(true))
+	mockExpectExecTimes(mock, "DELETE FROM", 8)
+	mock.ExpectQuery("DELETE FROM login").WithArgs("1").
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@justinstone.net"))
+	mock.ExpectExec("DELETE FROM login_failure").WithArgs("account:user@justinstone.net").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	removed, err := repo.PurgeUser("1", now)
+	ok(t, err)
+	assert(t, removed, "expected due user to be removed")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT true FROM login").WithArgs("2", now).WillReturnRows(sqlmock.NewRows([]string{"bool"}))
+	mock.ExpectRollback()
+
+	removed, err = repo.PurgeUser("2", now)
+	ok(t, err)
+	assert(t, !removed, "expected restored user to be kept")
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_SetAccountStatus ensures a status change and its record are written in one
+// transaction, which is rolled back for unknown users.
+func TestPostgresqlUserRepository_SetAccountStatus(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	until := time.Now().Add(time.Hour)
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE login SET status").WithArgs("1", service.AccountSuspended, &until, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO account_status_change").
+		WithArgs("1", service.AccountSuspended, &until, nil, "spam", "admin").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	ok(t, repo.SetAccountStatus("1", service.AccountStatus{State: service.AccountSuspended, SuspendedUntil: &until},
+		"spam", "admin"))
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE login SET status").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	notOk(t, repo.SetAccountStatus("2", service.AccountStatus{State: service.AccountDisabled}, "", "admin"))
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_UseChallenge ensures a challenge can only be recorded as used once.
+func TestPostgresqlUserRepository_UseChallenge(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	expiresAt := time.Now().Add(5 * time.Minute)
+	mock.ExpectExec("DELETE FROM used_challenge").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO used_challenge").WithArgs("1", expiresAt).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM used_challenge").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO used_challenge").WithArgs("1", expiresAt).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ok(t, repo.UseChallenge("1", expiresAt))
+	notOk(t, repo.UseChallenge("1", expiresAt))
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestPostgresqlUserRepository_RemoveWebAuthnCredential ensures only the user's own credentials are removed.
+func TestPostgresqlUserRepository_RemoveWebAuthnCredential(t *testing.T) {
+	db, mock, repo := makeEmptyPgRepo(t)
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM webauthn_credential WHERE id").WithArgs("passkey", "1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM webauthn_credential WHERE id").WithArgs("passkey", "2").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM webauthn_credential WHERE user_id").WithArgs("1").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	ok(t, repo.RemoveWebAuthnCredential("1", "passkey"))
+	notOk(t, repo.RemoveWebAuthnCredential("2", "passkey"))
+	ok(t, repo.RemoveWebAuthnCredentials("1"))
+	ok(t, mock.ExpectationsWereMet())
+}
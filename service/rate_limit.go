@@ -0,0 +1,111 @@
+package service
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+// RateLimit is the rate requests are allowed at, as a token bucket holding Requests tokens that refills evenly over
+// Period. Callers can burst up to Requests at once, then make one more each time a token is refilled.
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// refillRate returns how many tokens are refilled per second.
+func (rl RateLimit) refillRate() float64 {
+	return float64(rl.Requests) / rl.Period.Seconds()
+}
+
+// untilToken returns how long a bucket holding the given tokens takes to refill a whole token.
+func (rl RateLimit) untilToken(tokens float64) time.Duration {
+	return time.Duration((1 - tokens) / rl.refillRate() * float64(time.Second))
+}
+
+// RateLimitStore represents a data source holding the token buckets of rate limits.
+type RateLimitStore interface {
+	// Take removes a token from the bucket identified by key, creating a full one for limit if there is none. Returns
+	// how long until a token is available if the bucket is empty, or zero if a token was taken.
+	Take(key string, limit RateLimit) (time.Duration, error)
+	// ForgetUser removes every bucket counting the given user's requests through RateLimitByUser, for when the user is
+	// deleted.
+	ForgetUser(userId string) error
+}
+
+// RateLimitKey identifies the caller a request counts against.
+type RateLimitKey func(r *http.Request) string
+
+// RateLimitByIp counts requests against the IP address they come from.
+func RateLimitByIp(r *http.Request) string {
+	return "ip:" + clientIp(r)
+}
+
+// RateLimitByUser counts requests against the user authenticated by JwtAuthMiddleware, or the IP address they come
+// from if there is none.
+func RateLimitByUser(r *http.Request) string {
+	if user, ok := r.Context().Value("user").(User); ok && user.Id != "" {
+		return rateLimitUserKey(user.Id)
+	}
+
+	return RateLimitByIp(r)
+}
+
+// rateLimitUserKey returns the key RateLimitByUser counts a user's requests against. Buckets append it to the name of
+// their route, so every bucket of the user ends with ":" and the key.
+func rateLimitUserKey(userId string) string {
+	return "user:" + userId
+}
+
+// RateLimitByRoute counts every request to a route together, whoever makes it.
+func RateLimitByRoute(_ *http.Request) string {
+	return "route"
+}
+
+// RateLimitMiddleware returns middleware to refuse requests exceeding limit with a 429. name keeps the buckets of a
+// route apart from those of other routes, so routes sharing a name share a limit.
+func RateLimitMiddleware(name string, limit RateLimit, key RateLimitKey) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			store, ok := r.Context().Value("rateLimitStore").(RateLimitStore)
+
+			if !ok {
+				RenderResponse(w, r, NewInternalServerErr("internal error"))
+				return
+			}
+
+			wait, err := store.Take(name+":"+key(r), limit)
+
+			// An unavailable store shouldn't take the service down with it, so requests are let through.
+			if err != nil {
+				log.Printf("Unable to apply rate limit %s: %s", name, err.Error())
+			} else if wait > 0 {
+				RenderResponse(w, r, NewTooManyRequestsErr("rate limit exceeded", wait))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NewRateLimitStore constructs a RateLimitStore from the given configuration. Instances sharing a PostgreSQL database
+// share their rate limits.
+func NewRateLimitStore(config Configuration, db *sql.DB) (RateLimitStore, error) {
+	var err error
+	var store RateLimitStore
+	switch config.GetRepoType() {
+	case InMemoryRepo:
+		store = MakeInMemoryRateLimitStore()
+	case PostgreSqlRepo:
+		if db == nil {
+			return nil, newErrRepository("db is required")
+		}
+		store = MakePostgresqlRateLimitStore(db)
+	default:
+		err = newErrRepository("repository type unimplemented")
+	}
+
+	return store, err
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSweepInterval is how often buckets that have refilled are forgotten.
+const rateLimitSweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	// fullAt is when the bucket will have refilled, after which it is no different to having no bucket
+	fullAt time.Time
+}
+
+type inMemoryRateLimitStore struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	sweptAt time.Time
+}
+
+// Take removes a token from the bucket identified by key.
+func (imrls *inMemoryRateLimitStore) Take(key string, limit RateLimit) (time.Duration, error) {
+	if key == "" {
+		return 0, newErrRepository("key is required")
+	} else if limit.Requests <= 0 || limit.Period <= 0 {
+		return 0, newErrRepository("limit is invalid")
+	}
+
+	imrls.mutex.Lock()
+	defer imrls.mutex.Unlock()
+
+	now := time.Now()
+	capacity := float64(limit.Requests)
+
+	if now.Sub(imrls.sweptAt) > rateLimitSweepInterval {
+		for bucketKey, bucket := range imrls.buckets {
+			if now.After(bucket.fullAt) {
+				delete(imrls.buckets, bucketKey)
+			}
+		}
+
+		imrls.sweptAt = now
+	}
+
+	bucket, ok := imrls.buckets[key]
+
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, updatedAt: now}
+		imrls.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*limit.refillRate())
+	bucket.updatedAt = now
+
+	var wait time.Duration
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+	} else {
+		wait = limit.untilToken(bucket.tokens)
+	}
+
+	bucket.fullAt = now.Add(time.Duration((capacity - bucket.tokens) / limit.refillRate() * float64(time.Second)))
+
+	return wait, nil
+}
+
+// ForgetUser removes every bucket counting the given user's requests.
+func (imrls *inMemoryRateLimitStore) ForgetUser(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imrls.mutex.Lock()
+	defer imrls.mutex.Unlock()
+
+	suffix := ":" + rateLimitUserKey(userId)
+
+	for key := range imrls.buckets {
+		if strings.HasSuffix(key, suffix) {
+			delete(imrls.buckets, key)
+		}
+	}
+
+	return nil
+}
+
+// MakeInMemoryRateLimitStore constructs an in memory backed RateLimitStore.
+func MakeInMemoryRateLimitStore() RateLimitStore {
+	return &inMemoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// refilledTokens is the tokens in an existing bucket once refilled, with $2 the capacity and $3 the refill rate per
+	// second.
+	refilledTokens = "LEAST($2, rate_limit.tokens + EXTRACT(EPOCH FROM now() - rate_limit.updated_at) * $3)"
+
+	takeRateLimitToken = "INSERT INTO rate_limit (key, tokens, allowed, updated_at) VALUES ($1, $2 - 1, true, now()) ON CONFLICT (key) DO UPDATE SET tokens=CASE WHEN " + refilledTokens + " >= 1 THEN " + refilledTokens + " - 1 ELSE " + refilledTokens + " END, allowed=" + refilledTokens + " >= 1, updated_at=now() RETURNING tokens, allowed"
+	sweepRateLimits    = "DELETE FROM rate_limit WHERE updated_at < now() - $1 * interval '1 second'"
+	forgetUser         = "DELETE FROM rate_limit WHERE right(key, char_length($1)) = $1"
+)
+
+type postgresqlRateLimitStore struct {
+	db      *sql.DB
+	mutex   sync.Mutex
+	sweptAt time.Time
+	// longestPeriod is the longest period of the limits seen, after which any bucket will have refilled
+	longestPeriod time.Duration
+}
+
+// Take removes a token from the bucket identified by key.
+func (prls *postgresqlRateLimitStore) Take(key string, limit RateLimit) (time.Duration, error) {
+	if key == "" {
+		return 0, newErrRepository("key is required")
+	} else if limit.Requests <= 0 || limit.Period <= 0 {
+		return 0, newErrRepository("limit is invalid")
+	}
+
+	prls.sweep(limit.Period)
+
+	var tokens float64
+	var allowed bool
+
+	err := prls.db.QueryRow(takeRateLimitToken, key, float64(limit.Requests), limit.refillRate()).Scan(&tokens,
+		&allowed)
+
+	if err != nil {
+		return 0, err
+	} else if allowed {
+		return 0, nil
+	}
+
+	return limit.untilToken(tokens), nil
+}
+
+// sweep deletes buckets that have refilled, at most once every rateLimitSweepInterval. Failing only leaves them for
+// the next sweep, so errors are just logged.
+func (prls *postgresqlRateLimitStore) sweep(period time.Duration) {
+	prls.mutex.Lock()
+	defer prls.mutex.Unlock()
+
+	if period > prls.longestPeriod {
+		prls.longestPeriod = period
+	}
+
+	if time.Since(prls.sweptAt) <= rateLimitSweepInterval {
+		return
+	}
+
+	prls.sweptAt = time.Now()
+
+	_, err := prls.db.Exec(sweepRateLimits, prls.longestPeriod.Seconds())
+
+	if err != nil {
+		log.Printf("Unable to sweep rate limits: %s", err.Error())
+	}
+}
+
+// ForgetUser removes every bucket counting the given user's requests.
+func (prls *postgresqlRateLimitStore) ForgetUser(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	_, err := prls.db.Exec(forgetUser, ":"+rateLimitUserKey(userId))
+
+	return err
+}
+
+// MakePostgresqlRateLimitStore constructs a PostgreSQL backed RateLimitStore from the given db.
+func MakePostgresqlRateLimitStore(db *sql.DB) RateLimitStore {
+	return &postgresqlRateLimitStore{db: db, sweptAt: time.Now()}
+}
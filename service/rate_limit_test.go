@@ -0,0 +1,151 @@
+package service_test
+
+import (
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestInMemoryRateLimitStore_Take ensures a bucket allows a burst of its capacity, then refuses with the time until
+// its next token, keeping keys apart.
+func TestInMemoryRateLimitStore_Take(t *testing.T) {
+	store := service.MakeInMemoryRateLimitStore()
+	limit := service.RateLimit{Requests: 3, Period: time.Hour}
+
+	for i := 0; i < 3; i++ {
+		wait, err := store.Take("signup:ip:192.0.2.1", limit)
+		ok(t, err)
+		equals(t, time.Duration(0), wait)
+	}
+
+	wait, err := store.Take("signup:ip:192.0.2.1", limit)
+	ok(t, err)
+	assert(t, wait > 19*time.Minute && wait <= 20*time.Minute, "expected to wait about 20 minutes, got %s", wait)
+
+	wait, err = store.Take("signup:ip:192.0.2.2", limit)
+	ok(t, err)
+	equals(t, time.Duration(0), wait)
+
+	_, err = store.Take("signup:ip:192.0.2.1", service.RateLimit{})
+	notOk(t, err)
+}
+
+// TestInMemoryRateLimitStore_Refill ensures tokens are refilled over the period.
+func TestInMemoryRateLimitStore_Refill(t *testing.T) {
+	store := service.MakeInMemoryRateLimitStore()
+	limit := service.RateLimit{Requests: 1, Period: 50 * time.Millisecond}
+
+	wait, err := store.Take("key", limit)
+	ok(t, err)
+	equals(t, time.Duration(0), wait)
+
+	wait, err = store.Take("key", limit)
+	ok(t, err)
+	assert(t, wait > 0, "expected bucket to be empty")
+
+	time.Sleep(wait)
+
+	wait, err = store.Take("key", limit)
+	ok(t, err)
+	equals(t, time.Duration(0), wait)
+}
+
+// TestPostgresqlRateLimitStore_Take ensures an empty bucket reports the time until its next token.
+func TestPostgresqlRateLimitStore_Take(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	ok(t, err)
+	defer db.Close()
+
+	store := service.MakePostgresqlRateLimitStore(db)
+
+	mock.ExpectQuery("INSERT INTO rate_limit").WithArgs("key", float64(60), float64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "allowed"}).AddRow(5.0, true))
+	mock.ExpectQuery("INSERT INTO rate_limit").WithArgs("key", float64(60), float64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"tokens", "allowed"}).AddRow(0.5, false))
+
+	wait, err := store.Take("key", service.RateLimit{Requests: 60, Period: time.Minute})
+	ok(t, err)
+	equals(t, time.Duration(0), wait)
+
+	wait, err = store.Take("key", service.RateLimit{Requests: 60, Period: time.Minute})
+	ok(t, err)
+	equals(t, 500*time.Millisecond, wait)
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestRateLimitStore_ForgetUser ensures forgetting a user removes the buckets of every route limited by user, and only
+// theirs.
+func TestRateLimitStore_ForgetUser(t *testing.T) {
+	store := service.MakeInMemoryRateLimitStore()
+	limit := service.RateLimit{Requests: 1, Period: time.Hour}
+
+	for _, key := range []string{"export:user:1", "lookup:user:1", "lookup:user:11", "lookup:ip:192.0.2.1"} {
+		_, err := store.Take(key, limit)
+		ok(t, err)
+	}
+
+	ok(t, store.ForgetUser("1"))
+	notOk(t, store.ForgetUser(""))
+
+	for key, forgotten := range map[string]bool{"export:user:1": true, "lookup:user:1": true,
+		"lookup:user:11": false, "lookup:ip:192.0.2.1": false} {
+		wait, err := store.Take(key, limit)
+		ok(t, err)
+		equals(t, forgotten, wait == 0)
+	}
+
+	db, mock, err := sqlmock.New()
+	ok(t, err)
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM rate_limit").WithArgs(":user:1").WillReturnResult(sqlmock.NewResult(0, 2))
+
+	ok(t, service.MakePostgresqlRateLimitStore(db).ForgetUser("1"))
+	ok(t, mock.ExpectationsWereMet())
+}
+
+// TestRateLimitMiddleware ensures requests over a route's limit are refused with a Retry-After, counted against the
+// key the route is limited by.
+func TestRateLimitMiddleware(t *testing.T) {
+	ts := newSessionTestServer(t)
+	limit := service.RateLimit{Requests: 2, Period: time.Minute}
+	ts.router.With(service.RateLimitMiddleware("ip", limit, service.RateLimitByIp)).Get("/ip",
+		func(w http.ResponseWriter, r *http.Request) {})
+	ts.router.With(service.RateLimitMiddleware("route", limit, service.RateLimitByRoute)).Get("/route",
+		func(w http.ResponseWriter, r *http.Request) {})
+	ts.router.With(service.JwtAuthMiddleware).With(service.RateLimitMiddleware("user", limit,
+		service.RateLimitByUser)).Get("/user", func(w http.ResponseWriter, r *http.Request) {})
+
+	get := func(path string, ip string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = ip + ":1234"
+
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res := httptest.NewRecorder()
+		ts.router.ServeHTTP(res, req)
+
+		return res
+	}
+
+	equals(t, http.StatusOK, get("/ip", "192.0.2.1", "").Code)
+	equals(t, http.StatusOK, get("/ip", "192.0.2.1", "").Code)
+	res := get("/ip", "192.0.2.1", "")
+	equals(t, http.StatusTooManyRequests, res.Code)
+	equals(t, "30", res.Header().Get("Retry-After"))
+	equals(t, http.StatusOK, get("/ip", "192.0.2.2", "").Code)
+
+	equals(t, http.StatusOK, get("/route", "192.0.2.1", "").Code)
+	equals(t, http.StatusOK, get("/route", "192.0.2.2", "").Code)
+	equals(t, http.StatusTooManyRequests, get("/route", "192.0.2.3", "").Code)
+
+	tokens := login(t, ts)
+	equals(t, http.StatusOK, get("/user", "192.0.2.1", tokens.Token).Code)
+	equals(t, http.StatusOK, get("/user", "192.0.2.2", tokens.Token).Code)
+	equals(t, http.StatusTooManyRequests, get("/user", "192.0.2.3", tokens.Token).Code)
+}
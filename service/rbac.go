@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+const (
+	// AdminRole grants every permission.
+	AdminRole = "admin"
+	// ModeratorRole grants reading other users' accounts and changing their status.
+	ModeratorRole = "moderator"
+)
+
+const (
+	// ReadUsersPermission allows reading other users' accounts.
+	ReadUsersPermission = "users:read"
+	// WriteUsersPermission allows changing the status of other users' accounts.
+	WriteUsersPermission = "users:write"
+	// WriteProfilesPermission allows editing other users' profiles.
+	WriteProfilesPermission = "profiles:write"
+	// DeleteUsersPermission allows deleting other users' accounts.
+	DeleteUsersPermission = "users:delete"
+	// ExportUsersPermission allows exporting everything stored about other users.
+	ExportUsersPermission = "users:export"
+	// ManageRolesPermission allows granting and revoking roles.
+	ManageRolesPermission = "roles:manage"
+)
+
+// rolePermissions maps each known role to the permissions it grants.
+var rolePermissions = map[string][]string{
+	AdminRole: {ReadUsersPermission, WriteUsersPermission, WriteProfilesPermission, DeleteUsersPermission,
+		ExportUsersPermission, ManageRolesPermission},
+	ModeratorRole: {ReadUsersPermission, WriteUsersPermission},
+}
+
+// HasRole reports whether the user has been granted role.
+func (u User) HasRole(role string) bool {
+	for _, granted := range u.Roles {
+		if granted == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasPermission reports whether any of the user's roles grants permission.
+func (u User) HasPermission(permission string) bool {
+	for _, role := range u.Roles {
+		for _, granted := range rolePermissions[role] {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// RequirePermission returns middleware restricting an endpoint to users granted every one of the given permissions.
+// It must follow JwtAuthMiddleware, whose user carries the roles from the token, so role changes only apply once the
+// user's tokens are refreshed.
+func RequirePermission(permissions ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value("user").(User)
+
+			if !ok {
+				RenderResponse(w, r, NewInternalServerErr("internal error"))
+				return
+			}
+
+			for _, permission := range permissions {
+				if !user.HasPermission(permission) {
+					RenderResponse(w, r, NewForbiddenErr("forbidden"))
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireSelfOrPermission returns middleware restricting an endpoint about the user in the path to that user and to
+// users granted permission. Like RequirePermission, it must follow JwtAuthMiddleware.
+func RequireSelfOrPermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := r.Context().Value("user").(User)
+
+			if !ok {
+				RenderResponse(w, r, NewInternalServerErr("internal error"))
+				return
+			}
+
+			if user.Id != chi.URLParam(r, "id") && !user.HasPermission(permission) {
+				RenderResponse(w, r, NewForbiddenErr("forbidden"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type setRolesRequest struct {
+	Roles []string `json:"roles"`
+}
+
+type setRolesResponse struct {
+	Roles []string `json:"roles"`
+}
+
+func (srr setRolesResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// SetRolesMiddleware middleware to replace the roles granted to a user. Only known roles may be granted.
+func SetRolesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req setRolesRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil || req.Roles == nil {
+			RenderResponse(w, r, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		roles := make([]string, 0, len(req.Roles))
+		seen := make(map[string]bool)
+
+		for _, role := range req.Roles {
+			if _, ok := rolePermissions[role]; !ok {
+				RenderResponse(w, r, NewBadRequestErr(fmt.Sprintf("unknown role %q", role)))
+				return
+			}
+
+			if !seen[role] {
+				seen[role] = true
+				roles = append(roles, role)
+			}
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		err = userRepo.SetRoles(chi.URLParam(r, "id"), roles)
+
+		if errors.Is(err, errUserNotFound) {
+			RenderResponse(w, r, NewNotFoundErr("user not found"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "roles", setRolesResponse{roles})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// SetRoles renders the roles now granted to the user.
+func SetRoles(w http.ResponseWriter, r *http.Request) {
+	res, ok := r.Context().Value("roles").(setRolesResponse)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, res)
+}
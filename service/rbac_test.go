@@ -0,0 +1,107 @@
+package service_test
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"testing"
+)
+
+// newRbacTestServer constructs a session test server with the role management routes and an endpoint restricted to
+// users allowed to read other users.
+func newRbacTestServer(t *testing.T) *testServer {
+	ts := newSessionTestServer(t)
+	ts.router.Route("/user", func(r chi.Router) {
+		r.With(service.JwtAuthMiddleware).With(service.RequirePermission(service.ManageRolesPermission)).
+			With(service.SetRolesMiddleware).Put("/{id}/roles", service.SetRoles)
+	})
+	ts.router.Route("/admin", func(r chi.Router) {
+		r.With(service.SetRolesMiddleware).Put("/users/{id}/roles", service.SetRoles)
+		r.With(service.JwtAuthMiddleware).With(service.RequirePermission(service.ReadUsersPermission)).
+			Get("/restricted", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})
+	})
+
+	return ts
+}
+
+// TestUser_HasPermission ensures permissions are granted by any of a user's roles.
+func TestUser_HasPermission(t *testing.T) {
+	equals(t, false, service.User{}.HasPermission(service.ReadUsersPermission))
+	equals(t, false, service.User{Roles: []string{"unknown"}}.HasPermission(service.ReadUsersPermission))
+
+	moderator := service.User{Roles: []string{service.ModeratorRole}}
+	equals(t, true, moderator.HasPermission(service.WriteUsersPermission))
+	equals(t, false, moderator.HasPermission(service.ManageRolesPermission))
+	equals(t, false, moderator.HasPermission(service.ExportUsersPermission))
+	equals(t, false, moderator.HasPermission(service.WriteProfilesPermission))
+
+	admin := service.User{Roles: []string{service.ModeratorRole, service.AdminRole}}
+	equals(t, true, admin.HasPermission(service.DeleteUsersPermission))
+	equals(t, true, admin.HasPermission(service.ExportUsersPermission))
+	equals(t, true, admin.HasPermission(service.WriteProfilesPermission))
+	equals(t, true, admin.HasPermission(service.ManageRolesPermission))
+}
+
+// TestRequirePermission ensures restricted endpoints refuse users without the permission, and that roles granted to a
+// user apply once their token is refreshed.
+func TestRequirePermission(t *testing.T) {
+	ts := newRbacTestServer(t)
+	tokens := login(t, ts)
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodGet, "/admin/restricted", "", nil, nil))
+	equals(t, http.StatusForbidden, ts.do(t, http.MethodGet, "/admin/restricted", tokens.Token, nil, nil))
+
+	var res struct {
+		Roles []string `json:"roles"`
+	}
+	status := ts.do(t, http.MethodPut, "/admin/users/"+user.Id+"/roles", "",
+		map[string][]string{"roles": {service.ModeratorRole, service.ModeratorRole}}, &res)
+	equals(t, http.StatusOK, status)
+	equals(t, []string{service.ModeratorRole}, res.Roles)
+
+	// The roles in the existing token are unchanged
+	equals(t, http.StatusForbidden, ts.do(t, http.MethodGet, "/admin/restricted", tokens.Token, nil, nil))
+
+	var refreshed sessionTokens
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, &refreshed)
+	equals(t, http.StatusOK, status)
+	equals(t, http.StatusNoContent, ts.do(t, http.MethodGet, "/admin/restricted", refreshed.Token, nil, nil))
+
+	// Moderators can't manage roles
+	status = ts.do(t, http.MethodPut, "/user/"+user.Id+"/roles", refreshed.Token,
+		map[string][]string{"roles": {service.AdminRole}}, nil)
+	equals(t, http.StatusForbidden, status)
+}
+
+// TestSetRoles ensures admins can manage roles, and that only known roles can be granted to existing users.
+func TestSetRoles(t *testing.T) {
+	ts := newRbacTestServer(t)
+	user, err := ts.repo.GetUserByEmail("user@justinstone.net")
+	ok(t, err)
+	ok(t, ts.repo.SetRoles(user.Id, []string{service.AdminRole}))
+	tokens := login(t, ts)
+
+	status := ts.do(t, http.MethodPut, "/user/"+user.Id+"/roles", tokens.Token,
+		map[string][]string{"roles": {"superuser"}}, nil)
+	equals(t, http.StatusBadRequest, status)
+
+	status = ts.do(t, http.MethodPut, "/user/"+user.Id+"/roles", tokens.Token, map[string]string{}, nil)
+	equals(t, http.StatusBadRequest, status)
+
+	status = ts.do(t, http.MethodPut, "/user/missing/roles", tokens.Token,
+		map[string][]string{"roles": {service.ModeratorRole}}, nil)
+	equals(t, http.StatusNotFound, status)
+
+	status = ts.do(t, http.MethodPut, "/user/"+user.Id+"/roles", tokens.Token,
+		map[string][]string{"roles": {}}, nil)
+	equals(t, http.StatusOK, status)
+
+	user, err = ts.repo.GetUser(user.Id)
+	ok(t, err)
+	equals(t, 0, len(user.Roles))
+}
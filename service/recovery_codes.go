@@ -0,0 +1,205 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// recoveryCodeCount is how many recovery codes are issued at a time.
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 5
+)
+
+type secondFactorRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+func (rcr recoveryCodesResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// normalizeRecoveryCode strips the formatting from a recovery code, so it can be typed however it was written down.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// newRecoveryCodes generates a set of recovery codes to show the user along with the hashes to store in their place.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, recoveryCodeBytes)
+
+		_, err := rand.Read(buf)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(buf))
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, string(hash))
+	}
+
+	return codes, hashes, nil
+}
+
+// issueRecoveryCodes replaces a user's recovery codes with a newly generated set, returning the codes.
+func issueRecoveryCodes(userRepo UserRepository, userId string) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = userRepo.SetRecoveryCodes(userId, hashes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// checkRecoveryCode validates a recovery code against a user's unused codes, recording its use. Errors are
+// ErrorResponse values suitable for rendering.
+func checkRecoveryCode(userRepo UserRepository, userId string, code string) error {
+	codes, err := userRepo.GetRecoveryCodes(userId)
+
+	if err != nil {
+		return NewInternalServerErr("repo error")
+	}
+
+	normalized := []byte(normalizeRecoveryCode(code))
+
+	for _, stored := range codes {
+		if stored.UsedAt != nil || bcrypt.CompareHashAndPassword([]byte(stored.CodeHash), normalized) != nil {
+			continue
+		}
+
+		err = userRepo.UseRecoveryCode(userId, stored.Id)
+
+		if errors.Is(err, errRecoveryCodeUsed) {
+			return NewUnauthorizedErr("code invalid")
+		} else if err != nil {
+			return NewInternalServerErr("repo error")
+		}
+
+		return nil
+	}
+
+	return NewUnauthorizedErr("code invalid")
+}
+
+// checkSecondFactor validates either a TOTP code or, if one is given, a recovery code for a user. Errors are
+// ErrorResponse values suitable for rendering.
+func checkSecondFactor(userRepo UserRepository, userId string, enrollment TotpEnrollment, code string,
+	recoveryCode string) error {
+	if recoveryCode != "" {
+		return checkRecoveryCode(userRepo, userId, recoveryCode)
+	}
+
+	return checkTotpCode(userRepo, userId, enrollment, code)
+}
+
+// decodeSecondFactorRequest reads a TOTP or recovery code from the request body.
+func decodeSecondFactorRequest(r *http.Request) (secondFactorRequest, error) {
+	var req secondFactorRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+
+	if err != nil {
+		return secondFactorRequest{}, NewBadRequestErr("request body invalid")
+	} else if req.Code == "" && req.RecoveryCode == "" {
+		return secondFactorRequest{}, NewBadRequestErr("code or recoveryCode is required")
+	}
+
+	return req, nil
+}
+
+// RegenerateRecoveryCodesMiddleware middleware to replace the authenticated user's recovery codes, requiring a valid
+// second factor to do so
+func RegenerateRecoveryCodesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeSecondFactorRequest(r)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		user, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewUnauthorizedErr("unauthorized"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("repo not found"))
+			return
+		}
+
+		enrollment, err := userRepo.GetTotp(user.Id)
+
+		if errors.Is(err, errTotpNotFound) || (err == nil && !enrollment.Confirmed) {
+			RenderResponse(w, r, NewBadRequestErr("totp not enabled"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = checkSecondFactor(userRepo, user.Id, enrollment, req.Code, req.RecoveryCode)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		codes, err := issueRecoveryCodes(userRepo, user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "recoveryCodes", codes)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RecoveryCodes renders newly issued recovery codes, the only time they are revealed.
+func RecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	codes, ok := r.Context().Value("recoveryCodes").([]string)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, recoveryCodesResponse{codes})
+}
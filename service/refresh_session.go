@@ -2,11 +2,18 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"net/http"
+	"time"
 )
 
+type refreshSessionRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
 type refreshSessionResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
 }
 
 func (rsr refreshSessionResponse) Render(res http.ResponseWriter, _ *http.Request) error {
@@ -14,36 +21,55 @@ func (rsr refreshSessionResponse) Render(res http.ResponseWriter, _ *http.Reques
 	return nil
 }
 
-// RefreshSessionMiddleware middleware to authenticate a user from the request parameters
+// issueRefreshToken generates a new refresh token for the given user as a member of the given session's token family
+// and stores its hash in the repo.
+func issueRefreshToken(userRepo UserRepository, config Configuration, userId string, sessionId string) (string, error) {
+	refreshToken, tokenHash, err := newOpaqueToken()
+
+	if err != nil {
+		return "", err
+	}
+
+	err = userRepo.AddRefreshToken(userId, sessionId, tokenHash, time.Now().Add(config.GetRefreshTokenTtl()))
+
+	if err != nil {
+		return "", err
+	}
+
+	return refreshToken, nil
+}
+
+// RefreshSessionMiddleware middleware to exchange a refresh token for a new access and refresh token pair
 func RefreshSessionMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		user, ok := r.Context().Value("user").(User)
+		decoder := json.NewDecoder(r.Body)
 
-		if !ok {
-			RenderResponse(w, r, NewInternalServerErr("internal error"))
+		var reqSession refreshSessionRequest
+		err := decoder.Decode(&reqSession)
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("request body invalid"))
 			return
 		}
 
-		tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
-
-		if !ok {
-			RenderResponse(w, r, NewInternalServerErr("internal error"))
+		if reqSession.RefreshToken == "" {
+			RenderResponse(w, r, NewBadRequestErr("refreshToken is required"))
 			return
 		}
 
-		token, err := tokenFactory.NewToken(NewClaims(user.Id, user.Email, user.Username))
+		_, token, refreshToken, err := rotateSession(r.Context(), reqSession.RefreshToken)
 
 		if err != nil {
-			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			RenderError(w, r, err)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), "token", token)
+		ctx = context.WithValue(ctx, "refreshToken", refreshToken)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-// RefreshSession responds to authenticated requests with a new token
+// RefreshSession responds to a successful refresh token exchange with a new token pair
 func RefreshSession(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	token, ok := ctx.Value("token").(string)
@@ -53,5 +79,12 @@ func RefreshSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	RenderResponse(w, r, refreshSessionResponse{token})
+	refreshToken, ok := ctx.Value("refreshToken").(string)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, refreshSessionResponse{token, refreshToken})
 }
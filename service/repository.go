@@ -3,6 +3,7 @@ package service
 import (
 	"database/sql"
 	"errors"
+	"time"
 )
 
 type errRepository struct {
@@ -17,30 +18,264 @@ func newErrRepository(msg string) error {
 	return errRepository{errors.New(msg)}
 }
 
+var (
+	// errUserNotFound is returned when no user matches a lookup.
+	errUserNotFound = newErrRepository("user not found")
+	// errRefreshTokenInvalid is returned when a refresh token is unknown, expired or revoked.
+	errRefreshTokenInvalid = newErrRepository("refresh token invalid")
+	// errRefreshTokenReused is returned when a refresh token that has already been rotated is presented again.
+	errRefreshTokenReused = newErrRepository("refresh token reused")
+	// errTotpNotFound is returned when a user has no TOTP secret.
+	errTotpNotFound = newErrRepository("totp not found")
+	// errTotpCodeReused is returned when a TOTP code is presented for a time step that has already been used.
+	errTotpCodeReused = newErrRepository("totp code reused")
+	// errRecoveryCodeUsed is returned when a recovery code that has already been used is presented again.
+	errRecoveryCodeUsed = newErrRepository("recovery code used")
+	// errCredentialNotFound is returned when no WebAuthn credential is registered with a given id.
+	errCredentialNotFound = newErrRepository("credential not found")
+	// errCredentialExists is returned when registering a WebAuthn credential id that is already registered.
+	errCredentialExists = newErrRepository("credential already exists")
+	// errEmailTaken is returned when adding a user, or changing a user's email address, with an email address that
+	// belongs to another user.
+	errEmailTaken = newErrRepository("email already in use")
+	// errUsernameTaken is returned when a username, ignoring case, belongs to or is reserved for another user.
+	errUsernameTaken = newErrRepository("username taken")
+	// errPasswordMismatch is returned when a user's current password is required and doesn't match.
+	errPasswordMismatch = newErrRepository("password does not match")
+	// errActionTokenInvalid is returned when an action token is unknown, expired, already used or for another purpose.
+	errActionTokenInvalid = newErrRepository("action token invalid")
+	// errAccountInactive is returned alongside the user when the right password is given for an account that isn't
+	// active.
+	errAccountInactive = newErrRepository("account inactive")
+	// errChallengeUsed is returned when a challenge token that has already been used is presented again.
+	errChallengeUsed = newErrRepository("challenge used")
+)
+
+const (
+	// passwordResetPurpose identifies action tokens that allow a forgotten password to be replaced.
+	passwordResetPurpose = "password_reset"
+	// emailVerificationPurpose identifies action tokens that confirm a user owns the email address held in their data.
+	emailVerificationPurpose = "email_verification"
+	// emailChangePurpose identifies action tokens that confirm a user owns the new email address held in their data.
+	emailChangePurpose = "email_change"
+	// accountRestorePurpose identifies action tokens that let a user restore their deleted account.
+	accountRestorePurpose = "account_restore"
+)
+
+// ActionToken is a single use token emailed to a user to let them perform an action, stored hashed.
+type ActionToken struct {
+	TokenHash string
+	UserId    string
+	Purpose   string
+	// Data holds any detail of the action the user is confirming.
+	Data      string
+	ExpiresAt time.Time
+}
+
+// UsernameChange records a username a user gave up and until when nobody else may take it.
+type UsernameChange struct {
+	Username      string    `json:"username"`
+	ChangedAt     time.Time `json:"changedAt"`
+	ReservedUntil time.Time `json:"reservedUntil"`
+}
+
+// AccountStatusChange records a change to the status of a user's account.
+type AccountStatusChange struct {
+	Status AccountStatus `json:"status"`
+	Reason string        `json:"reason"`
+	// ChangedBy is the id of the user who made the change
+	ChangedBy string    `json:"changedBy"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// UserFilter narrows the users returned by ListUsers, zero fields match every user.
+type UserFilter struct {
+	// EmailPrefix matches users whose email address starts with it, ignoring case
+	EmailPrefix string
+	// Username matches the user with the username, ignoring case
+	Username string
+	// CreatedAfter matches users created at or after it
+	CreatedAfter time.Time
+	// CreatedBefore matches users created before it
+	CreatedBefore time.Time
+	// Topic matches users with the topic in their profile
+	Topic string
+}
+
+// UserRecord holds a user along with the account details shown to admins.
+type UserRecord struct {
+	User
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// LoginFailures counts the consecutive failed logins against an account or from an IP address.
+type LoginFailures struct {
+	Count        int       `json:"count"`
+	LastFailedAt time.Time `json:"lastFailedAt"`
+}
+
+// TotpEnrollment holds a user's TOTP secret and its state.
+type TotpEnrollment struct {
+	Secret string
+	// Confirmed is set once the user has proven their authenticator produces valid codes, only then is it required
+	// at login.
+	Confirmed bool
+	// LastCounter is the time step of the most recently accepted code.
+	LastCounter int64
+}
+
+// WebAuthnCredential is a passkey or security key registered by a user to log in with.
+type WebAuthnCredential struct {
+	// Id is the base64url encoded credential id chosen by the authenticator.
+	Id     string `json:"id"`
+	UserId string `json:"-"`
+	Name   string `json:"name"`
+	// PublicKey is the COSE encoded credential public key.
+	PublicKey  []byte     `json:"-"`
+	SignCount  uint32     `json:"-"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+// RecoveryCode is a single use code that can stand in for a user's second factor, stored hashed.
+type RecoveryCode struct {
+	Id       string
+	CodeHash string
+	UsedAt   *time.Time
+}
+
 // UserRepository represents a data source through which users can be managed.
 type UserRepository interface {
 	GetUser(id string) (User, error)
 	UpdateProfile(userId string, profile UserProfile) error
-	// NewUser adds a user to the repo.
+	// NewUser adds a user to the repo, returning errEmailTaken if the email address belongs to another user and
+	// errUsernameTaken if the handle is in use or reserved.
 	NewUser(email string, handle string, password string, gender Gender, age int, topics []string) (string, error)
 	// Authenticate validates email and password combo with what is stored in the repo. Returns users unique id on
-	// success and empty string on failure
+	// success and empty string on failure. If the password is right but the account isn't active the user is returned
+	// with errAccountInactive.
 	Authenticate(email string, password string) (User, error)
+	// GetUserByEmail retrieves the user with the given email address, returning errUserNotFound if there is none.
+	GetUserByEmail(email string) (User, error)
+	// UpdatePassword replaces a user's password.
+	UpdatePassword(userId string, password string) error
+	// VerifyEmail records that a user has confirmed they own their email address.
+	VerifyEmail(userId string) error
+	// ChangeEmail replaces a user's email address with one they have confirmed they own, returning errEmailTaken if
+	// it belongs to another user.
+	ChangeEmail(userId string, email string) error
+	// ChangeUsername replaces a user's username, reserving the old one for them until reservedUntil. Returns
+	// errUsernameTaken if the new username is in use or reserved by another user.
+	ChangeUsername(userId string, username string, reservedUntil time.Time) error
+	// GetUsernameHistory retrieves the usernames a user has given up, oldest first.
+	GetUsernameHistory(userId string) ([]UsernameChange, error)
+	// GetUserByUsername retrieves the user currently holding username, ignoring case.
+	GetUserByUsername(username string) (User, error)
+	// GetPreviousUsernameOwner retrieves the id of the user who most recently gave up username, ignoring case.
+	GetPreviousUsernameOwner(username string) (string, error)
+	// ChangePassword replaces a user's password after verifying their current one, returning errPasswordMismatch if it
+	// doesn't match.
+	ChangePassword(userId string, currentPassword string, password string) error
+	// AddRefreshToken stores the hash of a refresh token issued to a user as a member of the given token family.
+	AddRefreshToken(userId string, familyId string, tokenHash string, expiresAt time.Time) error
+	// RotateRefreshToken marks the refresh token matching tokenHash as used and stores newTokenHash in its place within
+	// the same family. Returns the id of the user and the family the token belongs to. Presenting a token that has
+	// already been used revokes its entire family and returns errRefreshTokenReused along with the user and family ids.
+	RotateRefreshToken(tokenHash string, newTokenHash string, expiresAt time.Time) (string, string, error)
+	// RevokeRefreshTokenFamily revokes every refresh token belonging to the given family.
+	RevokeRefreshTokenFamily(familyId string) error
+	// SetTotpSecret stores an unconfirmed TOTP secret for a user, replacing any previous enrollment.
+	SetTotpSecret(userId string, secret string) error
+	// GetTotp retrieves a user's TOTP enrollment, returning errTotpNotFound if they have none.
+	GetTotp(userId string) (TotpEnrollment, error)
+	// ConfirmTotp marks a user's TOTP secret as confirmed, recording the time step of the code that confirmed it.
+	ConfirmTotp(userId string, counter int64) error
+	// UseTotpCounter records that a code for the given time step was accepted, returning errTotpCodeReused if a code
+	// for it or a later time step already was.
+	UseTotpCounter(userId string, counter int64) error
+	// RemoveTotp removes a user's TOTP enrollment.
+	RemoveTotp(userId string) error
+	// SetRecoveryCodes replaces a user's recovery codes with the given hashes, an empty set removes them.
+	SetRecoveryCodes(userId string, codeHashes []string) error
+	// GetRecoveryCodes retrieves a user's recovery codes, including used ones.
+	GetRecoveryCodes(userId string) ([]RecoveryCode, error)
+	// UseRecoveryCode records that a user's recovery code was used, returning errRecoveryCodeUsed if it already was.
+	UseRecoveryCode(userId string, codeId string) error
+	// AddWebAuthnCredential stores a WebAuthn credential for its user, returning errCredentialExists if its id is
+	// already registered.
+	AddWebAuthnCredential(credential WebAuthnCredential) error
+	// GetWebAuthnCredential retrieves the WebAuthn credential with the given id.
+	GetWebAuthnCredential(credentialId string) (WebAuthnCredential, error)
+	// GetWebAuthnCredentials retrieves every WebAuthn credential registered by a user.
+	GetWebAuthnCredentials(userId string) ([]WebAuthnCredential, error)
+	// UseWebAuthnCredential records a login with a WebAuthn credential along with the signature counter it reported.
+	UseWebAuthnCredential(credentialId string, signCount uint32) error
+	// RemoveWebAuthnCredential removes one of a user's WebAuthn credentials, returning errCredentialNotFound if they
+	// have none with the given id.
+	RemoveWebAuthnCredential(userId string, credentialId string) error
+	// RemoveWebAuthnCredentials removes every WebAuthn credential registered by a user.
+	RemoveWebAuthnCredentials(userId string) error
+	// AddActionToken stores an action token, invalidating any outstanding tokens the user has for the same purpose.
+	AddActionToken(token ActionToken) error
+	// GetActionToken retrieves the unexpired, unused action token matching tokenHash and purpose without using it.
+	// Returns errActionTokenInvalid if there is none.
+	GetActionToken(tokenHash string, purpose string) (ActionToken, error)
+	// ConsumeActionToken retrieves the unexpired action token matching tokenHash and purpose, ensuring it can't be used
+	// again. Returns errActionTokenInvalid if there is none.
+	ConsumeActionToken(tokenHash string, purpose string) (ActionToken, error)
+	// GetLoginFailures retrieves the failed logins counted against key, a zero count if there are none.
+	GetLoginFailures(key string) (LoginFailures, error)
+	// RecordLoginFailure counts a failed login against key, starting the count again if the previous failure was more
+	// than window ago. Returns the updated count.
+	RecordLoginFailure(key string, window time.Duration) (LoginFailures, error)
+	// ClearLoginFailures forgets the failed logins counted against key.
+	ClearLoginFailures(key string) error
+	// UseChallenge records that the challenge token with the given id has been used, returning errChallengeUsed if it
+	// already was. Records are only kept until expiresAt, after which the token itself is refused.
+	UseChallenge(challengeId string, expiresAt time.Time) error
+	// SetRoles replaces the roles granted to a user.
+	SetRoles(userId string, roles []string) error
+	// GetUserRecord retrieves a user along with when their account was created and last updated, returning
+	// errUserNotFound if there is none.
+	GetUserRecord(userId string) (UserRecord, error)
+	// ListUsers retrieves up to limit users matching filter, oldest first, skipping the first offset.
+	ListUsers(filter UserFilter, offset int, limit int) ([]UserRecord, error)
+	// SetAccountStatus changes the status of a user's account, recording who changed it, when and why.
+	SetAccountStatus(userId string, status AccountStatus, reason string, changedBy string) error
+	// GetAccountStatusHistory retrieves the changes made to the status of a user's account, oldest first.
+	GetAccountStatusHistory(userId string) ([]AccountStatusChange, error)
+	// DeleteUser permanently removes a user along with everything the repo stores for them. What other repositories
+	// store for the user must be removed first.
+	DeleteUser(userId string) error
+	// GetUsersToPurge retrieves the ids of the deleted users whose purge time is no later than now.
+	GetUsersToPurge(now time.Time) ([]string, error)
+	// PurgeUser permanently removes a deleted user along with everything the repo stores for them, provided their purge
+	// time is still no later than now, and reports whether they were removed. Like DeleteUser, what other repositories
+	// store for the user must be removed first.
+	PurgeUser(userId string, now time.Time) (bool, error)
+}
+
+// NewDb opens the PostgreSQL database named in the given configuration, returning nil when the configuration doesn't use
+// one. The db is shared by every repository so the service keeps a single connection pool.
+func NewDb(config Configuration) (*sql.DB, error) {
+	if config.GetRepoType() != PostgreSqlRepo {
+		return nil, nil
+	}
+
+	return sql.Open("postgres", config.GetPgUrl())
 }
 
-// NewUserRepository constructs a UserRepository from the given configuration.
-func NewUserRepository(config Configuration) (UserRepository, error) {
+// NewUserRepository constructs a UserRepository from the given configuration, backed by db when it uses PostgreSQL.
+func NewUserRepository(config Configuration, db *sql.DB) (UserRepository, error) {
 	var err error
 	var repo UserRepository
-	var db *sql.DB
 	switch config.GetRepoType() {
 	case InMemoryRepo:
 		repo, err = MakeInMemoryRepository(config)
 	case PostgreSqlRepo:
-		db, err = sql.Open("postgres", config.GetPgUrl())
-
-		if err != nil {
-			return nil, err
+		if db == nil {
+			return nil, newErrRepository("db is required")
 		}
 		repo, err = MakePostgresqlUserRespository(config, db)
 	default:
@@ -1,10 +1,11 @@
 package service_test
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"fmt"
 	"github.com/golang-jwt/jwt"
 	"github.com/stone1549/yapyapyap/auth/service"
+	"golang.org/x/crypto/bcrypt"
 	"io/ioutil"
 	"path/filepath"
 	"runtime"
@@ -111,16 +112,8 @@ func (c configuration) GetTokenSecretKey() string {
 	}
 }
 
-func (c configuration) GetTokenPrivateKey() *rsa.PrivateKey {
+func (c configuration) GetTokenSigningKeys() []crypto.Signer {
 	switch c {
-	case inMemorySmall:
-		fallthrough
-	case inMemoryEmpty:
-		fallthrough
-	case pgEmpty:
-		fallthrough
-	case pgSmall:
-		return nil
 	case inMemoryRsa:
 		signBytes, err := ioutil.ReadFile("../data/sample.key")
 		if err != nil {
@@ -132,53 +125,123 @@ func (c configuration) GetTokenPrivateKey() *rsa.PrivateKey {
 			return nil
 		}
 
-		return privateKey
+		return []crypto.Signer{privateKey}
 	default:
 		return nil
 	}
 }
 
-func (c configuration) GetTokenPublicKey() *rsa.PublicKey {
-	switch c {
-	case inMemorySmall:
-		fallthrough
-	case inMemoryEmpty:
-		fallthrough
-	case pgEmpty:
-		fallthrough
-	case pgSmall:
-		return nil
-	case inMemoryRsa:
-		signBytes, err := ioutil.ReadFile("../data/sample.pub")
-		if err != nil {
-			return nil
-		}
+func (c configuration) GetTokenKeyDir() string {
+	return ""
+}
 
-		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(signBytes)
-		if err != nil {
-			return nil
-		}
+func (c configuration) GetTokenKeyRotationInterval() time.Duration {
+	return 0
+}
 
-		return publicKey
-	default:
-		return nil
-	}
+func (c configuration) GetTokenKeyRetention() int {
+	return 2
+}
+
+func (c configuration) GetTokenKeyAlgorithm() string {
+	return ""
+}
+
+func (c configuration) GetAdminKey() string {
+	return "ADMIN!"
 }
 
 // TestNewUserRepository_ImSuccessEmpty ensures an empty in memory repo can be constructed
 func TestNewUserRepository_ImSuccessEmpty(t *testing.T) {
-	_, err := service.NewUserRepository(inMemoryEmpty)
+	_, err := service.NewUserRepository(inMemoryEmpty, nil)
 	ok(t, err)
 }
 
 // TestNewUserRepository_ImSuccessSmall ensures a prepopulated memory repo can be constructed
 func TestNewUserRepository_ImSuccessSmall(t *testing.T) {
-	_, err := service.NewUserRepository(inMemorySmall)
+	_, err := service.NewUserRepository(inMemorySmall, nil)
 	ok(t, err)
 }
 
 // TestNewUserRepository_PgSuccessEmpty ensures an empty PG repo can be constructed
 func TestNewUserRepository_PgSuccessEmpty(t *testing.T) {
-	_, err := service.NewUserRepository(pgEmpty)
+	db, err := service.NewDb(pgEmpty)
+	ok(t, err)
+	defer db.Close()
+
+	_, err = service.NewUserRepository(pgEmpty, db)
 	ok(t, err)
 }
+
+// TestNewUserRepository_PgNoDb ensures a PG repo can't be constructed without a db
+func TestNewUserRepository_PgNoDb(t *testing.T) {
+	_, err := service.NewUserRepository(pgEmpty, nil)
+	notOk(t, err)
+}
+
+func (c configuration) GetRefreshTokenTtl() time.Duration {
+	return 24 * time.Hour
+}
+
+func (c configuration) GetIssuer() string {
+	return "http://localhost:3333"
+}
+
+func (c configuration) GetWebAuthnRpId() string {
+	return "localhost"
+}
+
+func (c configuration) GetWebAuthnOrigins() []string {
+	return []string{"http://localhost:3333"}
+}
+
+func (c configuration) GetMailerType() service.MailerType {
+	return service.LogMailerType
+}
+
+func (c configuration) GetMailerDir() string {
+	return ""
+}
+
+func (c configuration) GetAppUrl() string {
+	return "http://localhost:8080"
+}
+
+func (c configuration) GetRequireVerifiedEmail() bool {
+	return false
+}
+
+func (c configuration) GetUsernameChangeCooldown() time.Duration {
+	return 30 * 24 * time.Hour
+}
+
+func (c configuration) GetUsernameReservation() time.Duration {
+	return 90 * 24 * time.Hour
+}
+
+func (c configuration) GetAccountDeletionGrace() time.Duration {
+	return 30 * 24 * time.Hour
+}
+
+func (c configuration) GetAccountPurgeInterval() time.Duration {
+	return 0
+}
+
+func (c configuration) GetPasswordPolicy() service.PasswordPolicy {
+	return service.PasswordPolicy{MinLength: 8, MaxLength: 72, DisallowIdentity: true}
+}
+
+func (c configuration) GetPasswordHasher() service.PasswordHasher {
+	return service.MakeUpgradingHasher(service.MakeBcryptHasher(bcrypt.DefaultCost))
+}
+
+func (c configuration) GetLoginThrottle() service.LoginThrottle {
+	return service.LoginThrottle{
+		FreeAttempts:    5,
+		Backoff:         time.Second,
+		LockoutAttempts: 10,
+		Lockout:         15 * time.Minute,
+		IpAttempts:      100,
+		Window:          15 * time.Minute,
+	}
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+type rotateKeysResponse struct {
+	Kid string `json:"kid"`
+}
+
+func (rkr rotateKeysResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// RotateKeysMiddleware middleware to replace the token signing key with a newly generated one
+func RotateKeysMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		kid, err := tokenFactory.RotateKeys()
+
+		if err != nil {
+			log.Println(err)
+			RenderResponse(w, r, NewBadRequestErr("unable to rotate keys"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "kid", kid)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RotateKeys renders the response to a key rotation request.
+func RotateKeys(w http.ResponseWriter, r *http.Request) {
+	kid, ok := r.Context().Value("kid").(string)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, rotateKeysResponse{kid})
+}
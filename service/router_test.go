@@ -0,0 +1,107 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testServer bundles a router with the dependencies injected into its request contexts.
+type testServer struct {
+	router       chi.Router
+	config       service.Configuration
+	repo         service.UserRepository
+	sessionRepo  service.SessionRepository
+	oauthRepo    service.OAuthRepository
+	exportRepo   service.ExportRepository
+	mailer       *recordingMailer
+	tokenFactory service.TokenFactory
+	rateLimits   service.RateLimitStore
+}
+
+// recordingMailer is a Mailer that keeps the messages it is asked to send.
+type recordingMailer struct {
+	messages []service.Message
+}
+
+func (rm *recordingMailer) Send(message service.Message) error {
+	rm.messages = append(rm.messages, message)
+	return nil
+}
+
+// last returns the most recently sent message.
+func (rm *recordingMailer) last(t *testing.T) service.Message {
+	assert(t, len(rm.messages) > 0, "expected a message to have been sent")
+	return rm.messages[len(rm.messages)-1]
+}
+
+// newTestServer constructs an in memory backed testServer whose routes are registered by the given function.
+func newTestServer(t *testing.T, routes func(r chi.Router)) *testServer {
+	repo, err := service.MakeInMemoryRepository(inMemoryEmpty)
+	ok(t, err)
+
+	tokenFactory, err := service.NewTokenFactory(inMemoryEmpty)
+	ok(t, err)
+
+	ts := &testServer{
+		router:       chi.NewRouter(),
+		config:       inMemoryEmpty,
+		repo:         repo,
+		sessionRepo:  service.MakeInMemorySessionRepository(),
+		oauthRepo:    service.MakeInMemoryOAuthRepository(),
+		exportRepo:   service.MakeInMemoryExportRepository(),
+		mailer:       &recordingMailer{},
+		tokenFactory: tokenFactory,
+		rateLimits:   service.MakeInMemoryRateLimitStore(),
+	}
+
+	ts.router.Use(render.SetContentType(render.ContentTypeJSON))
+	ts.router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "config", ts.config)
+			ctx = context.WithValue(ctx, "repo", ts.repo)
+			ctx = context.WithValue(ctx, "sessionRepo", ts.sessionRepo)
+			ctx = context.WithValue(ctx, "oauthRepo", ts.oauthRepo)
+			ctx = context.WithValue(ctx, "exportRepo", ts.exportRepo)
+			ctx = context.WithValue(ctx, "mailer", service.Mailer(ts.mailer))
+			ctx = context.WithValue(ctx, "tokenFactory", ts.tokenFactory)
+			ctx = context.WithValue(ctx, "rateLimitStore", ts.rateLimits)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	})
+
+	routes(ts.router)
+
+	return ts
+}
+
+// do performs a request against the test server, encoding body as JSON when it is not nil and decoding the response
+// body into out when it is not nil.
+func (ts *testServer) do(t *testing.T, method, path, token string, body interface{}, out interface{}) int {
+	var reqBody bytes.Buffer
+
+	if body != nil {
+		ok(t, json.NewEncoder(&reqBody).Encode(body))
+	}
+
+	req := httptest.NewRequest(method, path, &reqBody)
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res := httptest.NewRecorder()
+	ts.router.ServeHTTP(res, req)
+
+	if out != nil {
+		ok(t, json.NewDecoder(res.Body).Decode(out))
+	}
+
+	return res.Code
+}
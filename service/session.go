@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// startSession starts a new session for the given user, returning an access token and a refresh token for it. clientId
+// and scope are empty unless the session is started through an OAuth client. Errors are ErrorResponse values suitable
+// for rendering.
+func startSession(ctx context.Context, user User, clientId string, scope string) (string, string, error) {
+	userRepo, ok := ctx.Value("repo").(UserRepository)
+
+	if !ok {
+		return "", "", NewInternalServerErr("repo not found")
+	}
+
+	sessionRepo, ok := ctx.Value("sessionRepo").(SessionRepository)
+
+	if !ok {
+		return "", "", NewInternalServerErr("internal error")
+	}
+
+	config, ok := ctx.Value("config").(Configuration)
+
+	if !ok {
+		return "", "", NewInternalServerErr("internal error")
+	}
+
+	tokenFactory, ok := ctx.Value("tokenFactory").(TokenFactory)
+
+	if !ok {
+		return "", "", NewInternalServerErr("internal error")
+	}
+
+	err := checkAccountStatus(user)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	sessionId, err := sessionRepo.NewSession(user.Id, clientId, scope)
+
+	if err != nil {
+		return "", "", NewInternalServerErr("repo error")
+	}
+
+	claims := NewClaims(user.Id, user.Email, user.Username, sessionId, user.Roles)
+	claims.EmailVerified = user.EmailVerified
+	claims.ClientId = clientId
+	claims.Scope = scope
+
+	token, err := tokenFactory.NewToken(claims)
+
+	if err != nil {
+		return "", "", NewInternalServerErr("internal error")
+	}
+
+	refreshToken, err := issueRefreshToken(userRepo, config, user.Id, sessionId)
+
+	if err != nil {
+		return "", "", NewInternalServerErr("internal error")
+	}
+
+	return token, refreshToken, nil
+}
+
+// rotateSession exchanges a refresh token for a new access and refresh token pair for the same session, returning the
+// session along with the new tokens. Errors are ErrorResponse values suitable for rendering.
+func rotateSession(ctx context.Context, refreshToken string) (Session, string, string, error) {
+	userRepo, ok := ctx.Value("repo").(UserRepository)
+
+	if !ok {
+		return Session{}, "", "", NewInternalServerErr("repo not found")
+	}
+
+	sessionRepo, ok := ctx.Value("sessionRepo").(SessionRepository)
+
+	if !ok {
+		return Session{}, "", "", NewInternalServerErr("internal error")
+	}
+
+	config, ok := ctx.Value("config").(Configuration)
+
+	if !ok {
+		return Session{}, "", "", NewInternalServerErr("internal error")
+	}
+
+	tokenFactory, ok := ctx.Value("tokenFactory").(TokenFactory)
+
+	if !ok {
+		return Session{}, "", "", NewInternalServerErr("internal error")
+	}
+
+	newRefreshToken, newTokenHash, err := newOpaqueToken()
+
+	if err != nil {
+		return Session{}, "", "", NewInternalServerErr("internal error")
+	}
+
+	userId, sessionId, err := userRepo.RotateRefreshToken(
+		hashOpaqueToken(refreshToken),
+		newTokenHash,
+		time.Now().Add(config.GetRefreshTokenTtl()),
+	)
+
+	if errors.Is(err, errRefreshTokenReused) {
+		// The token family may have been stolen, end the session so outstanding access tokens stop working too.
+		_ = sessionRepo.RevokeSession(sessionId)
+		return Session{}, "", "", NewUnauthorizedErr("refresh token invalid")
+	} else if errors.Is(err, errRefreshTokenInvalid) {
+		return Session{}, "", "", NewUnauthorizedErr("refresh token invalid")
+	} else if err != nil {
+		return Session{}, "", "", NewInternalServerErr("repo error")
+	}
+
+	session, err := sessionRepo.GetSession(sessionId)
+
+	if errors.Is(err, errSessionNotFound) || (err == nil && session.RevokedAt != nil) {
+		_ = userRepo.RevokeRefreshTokenFamily(sessionId)
+		return Session{}, "", "", NewUnauthorizedErr("refresh token invalid")
+	} else if err != nil {
+		return Session{}, "", "", NewInternalServerErr("repo error")
+	}
+
+	user, err := userRepo.GetUser(userId)
+
+	// The user may have been purged since the session started
+	if errors.Is(err, errUserNotFound) {
+		_ = userRepo.RevokeRefreshTokenFamily(sessionId)
+		return Session{}, "", "", NewUnauthorizedErr("refresh token invalid")
+	} else if err != nil {
+		return Session{}, "", "", NewInternalServerErr("repo error")
+	}
+
+	err = checkAccountStatus(user)
+
+	if err != nil {
+		_ = userRepo.RevokeRefreshTokenFamily(sessionId)
+		return Session{}, "", "", err
+	}
+
+	claims := NewClaims(user.Id, user.Email, user.Username, sessionId, user.Roles)
+	claims.EmailVerified = user.EmailVerified
+	claims.ClientId = session.ClientId
+	claims.Scope = session.Scope
+
+	token, err := tokenFactory.NewToken(claims)
+
+	if err != nil {
+		return Session{}, "", "", NewInternalServerErr("internal error")
+	}
+
+	return session, token, newRefreshToken, nil
+}
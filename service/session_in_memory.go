@@ -0,0 +1,147 @@
+package service
+
+import (
+	"github.com/twinj/uuid"
+	"sync"
+	"time"
+)
+
+type inMemorySessionRepository struct {
+	mutex    sync.RWMutex
+	sessions map[string]*Session
+}
+
+// NewSession starts a new session for the given user.
+func (imsr *inMemorySessionRepository) NewSession(userId string, clientId string, scope string) (string, error) {
+	if userId == "" {
+		return "", newErrRepository("userId is required")
+	}
+
+	id := uuid.NewV4().String()
+
+	imsr.mutex.Lock()
+	defer imsr.mutex.Unlock()
+
+	imsr.sessions[id] = &Session{Id: id, UserId: userId, ClientId: clientId, Scope: scope, CreatedAt: time.Now()}
+
+	return id, nil
+}
+
+// GetSession retrieves the session with the given id.
+func (imsr *inMemorySessionRepository) GetSession(sessionId string) (Session, error) {
+	if sessionId == "" {
+		return Session{}, newErrRepository("sessionId is required")
+	}
+
+	imsr.mutex.RLock()
+	defer imsr.mutex.RUnlock()
+
+	session, ok := imsr.sessions[sessionId]
+	if !ok {
+		return Session{}, errSessionNotFound
+	}
+
+	return *session, nil
+}
+
+// GetUserSessions retrieves every session started by the given user.
+func (imsr *inMemorySessionRepository) GetUserSessions(userId string) ([]Session, error) {
+	if userId == "" {
+		return nil, newErrRepository("userId is required")
+	}
+
+	imsr.mutex.RLock()
+	defer imsr.mutex.RUnlock()
+
+	sessions := make([]Session, 0)
+
+	for _, session := range imsr.sessions {
+		if session.UserId == userId {
+			sessions = append(sessions, *session)
+		}
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession revokes the session with the given id.
+func (imsr *inMemorySessionRepository) RevokeSession(sessionId string) error {
+	if sessionId == "" {
+		return newErrRepository("sessionId is required")
+	}
+
+	imsr.mutex.Lock()
+	defer imsr.mutex.Unlock()
+
+	session, ok := imsr.sessions[sessionId]
+	if !ok {
+		return errSessionNotFound
+	}
+
+	revoke(session, time.Now())
+
+	return nil
+}
+
+// RevokeUserSessions revokes every session belonging to the given user.
+func (imsr *inMemorySessionRepository) RevokeUserSessions(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imsr.mutex.Lock()
+	defer imsr.mutex.Unlock()
+
+	now := time.Now()
+
+	for _, session := range imsr.sessions {
+		if session.UserId == userId {
+			revoke(session, now)
+		}
+	}
+
+	return nil
+}
+
+// DeleteUserSessions removes every session belonging to the given user.
+func (imsr *inMemorySessionRepository) DeleteUserSessions(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	imsr.mutex.Lock()
+	defer imsr.mutex.Unlock()
+
+	for id, session := range imsr.sessions {
+		if session.UserId == userId {
+			delete(imsr.sessions, id)
+		}
+	}
+
+	return nil
+}
+
+// IsRevoked reports whether the session with the given id has been revoked.
+func (imsr *inMemorySessionRepository) IsRevoked(sessionId string) (bool, error) {
+	if sessionId == "" {
+		return true, nil
+	}
+
+	imsr.mutex.RLock()
+	defer imsr.mutex.RUnlock()
+
+	session, ok := imsr.sessions[sessionId]
+
+	return !ok || session.RevokedAt != nil, nil
+}
+
+func revoke(session *Session, at time.Time) {
+	if session.RevokedAt == nil {
+		session.RevokedAt = &at
+	}
+}
+
+// MakeInMemorySessionRepository constructs an in memory backed SessionRepository.
+func MakeInMemorySessionRepository() SessionRepository {
+	return &inMemorySessionRepository{sessions: make(map[string]*Session)}
+}
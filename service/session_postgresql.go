@@ -0,0 +1,157 @@
+package service
+
+import (
+	"database/sql"
+	"github.com/twinj/uuid"
+)
+
+const (
+	insertSession      = "INSERT INTO session (id, user_id, client_id, scope) VALUES ($1, $2, $3, $4)"
+	getSession         = "SELECT id, user_id, client_id, scope, created_at, revoked_at FROM session WHERE id=$1"
+	getUserSessions    = "SELECT id, user_id, client_id, scope, created_at, revoked_at FROM session WHERE user_id=$1 ORDER BY created_at"
+	revokeSession      = "UPDATE session SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL"
+	revokeUserSessions = "UPDATE session SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL"
+	deleteUserSessions = "DELETE FROM session WHERE user_id=$1"
+	isSessionRevoked   = "SELECT revoked_at IS NOT NULL FROM session WHERE id=$1"
+)
+
+type postgresqlSessionRepository struct {
+	db *sql.DB
+}
+
+// NewSession starts a new session for the given user.
+func (psr *postgresqlSessionRepository) NewSession(userId string, clientId string, scope string) (string, error) {
+	if userId == "" {
+		return "", newErrRepository("userId is required")
+	}
+
+	id := uuid.NewV4().String()
+
+	_, err := psr.db.Exec(insertSession, id, userId, clientId, scope)
+
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// GetSession retrieves the session with the given id.
+func (psr *postgresqlSessionRepository) GetSession(sessionId string) (Session, error) {
+	if sessionId == "" {
+		return Session{}, newErrRepository("sessionId is required")
+	}
+
+	session, err := scanSession(psr.db.QueryRow(getSession, sessionId))
+
+	if err == sql.ErrNoRows {
+		return Session{}, errSessionNotFound
+	}
+
+	return session, err
+}
+
+// GetUserSessions retrieves every session started by the given user.
+func (psr *postgresqlSessionRepository) GetUserSessions(userId string) ([]Session, error) {
+	if userId == "" {
+		return nil, newErrRepository("userId is required")
+	}
+
+	rows, err := psr.db.Query(getUserSessions, userId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	sessions := make([]Session, 0)
+
+	for rows.Next() {
+		session, err := scanSession(rows)
+
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession revokes the session with the given id.
+func (psr *postgresqlSessionRepository) RevokeSession(sessionId string) error {
+	if sessionId == "" {
+		return newErrRepository("sessionId is required")
+	}
+
+	_, err := psr.db.Exec(revokeSession, sessionId)
+
+	return err
+}
+
+// RevokeUserSessions revokes every session belonging to the given user.
+func (psr *postgresqlSessionRepository) RevokeUserSessions(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	_, err := psr.db.Exec(revokeUserSessions, userId)
+
+	return err
+}
+
+// DeleteUserSessions removes every session belonging to the given user.
+func (psr *postgresqlSessionRepository) DeleteUserSessions(userId string) error {
+	if userId == "" {
+		return newErrRepository("userId is required")
+	}
+
+	_, err := psr.db.Exec(deleteUserSessions, userId)
+
+	return err
+}
+
+// IsRevoked reports whether the session with the given id has been revoked.
+func (psr *postgresqlSessionRepository) IsRevoked(sessionId string) (bool, error) {
+	if sessionId == "" {
+		return true, nil
+	}
+
+	var revoked bool
+
+	err := psr.db.QueryRow(isSessionRevoked, sessionId).Scan(&revoked)
+
+	if err == sql.ErrNoRows {
+		return true, nil
+	} else if err != nil {
+		return true, err
+	}
+
+	return revoked, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSession(row rowScanner) (Session, error) {
+	var session Session
+
+	err := row.Scan(
+		&session.Id,
+		&session.UserId,
+		&session.ClientId,
+		&session.Scope,
+		&session.CreatedAt,
+		&session.RevokedAt,
+	)
+
+	return session, err
+}
+
+// MakePostgresqlSessionRepository constructs a PostgreSQL backed SessionRepository from the given db.
+func MakePostgresqlSessionRepository(db *sql.DB) SessionRepository {
+	return &postgresqlSessionRepository{db}
+}
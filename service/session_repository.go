@@ -0,0 +1,61 @@
+package service
+
+import (
+	"database/sql"
+	"time"
+)
+
+// errSessionNotFound is returned when no session exists with a given id.
+var errSessionNotFound = newErrRepository("session not found")
+
+// Session represents a single login of a user, shared by every token issued from that login.
+type Session struct {
+	Id     string `json:"id"`
+	UserId string `json:"userId"`
+	// ClientId is the OAuth client the session was started through, empty for direct logins
+	ClientId string `json:"clientId,omitempty"`
+	// Scope is the OAuth scope granted to the session, empty for direct logins
+	Scope     string     `json:"scope,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// SessionRepository represents a data source through which sessions can be tracked and revoked.
+type SessionRepository interface {
+	// NewSession starts a new session for the given user, returning its unique id. clientId and scope are empty unless
+	// the session is started through an OAuth client.
+	NewSession(userId string, clientId string, scope string) (string, error)
+	// GetSession retrieves the session with the given id.
+	GetSession(sessionId string) (Session, error)
+	// GetUserSessions retrieves every session started by the given user.
+	GetUserSessions(userId string) ([]Session, error)
+	// RevokeSession revokes the session with the given id.
+	RevokeSession(sessionId string) error
+	// RevokeUserSessions revokes every session belonging to the given user.
+	RevokeUserSessions(userId string) error
+	// DeleteUserSessions removes every session belonging to the given user, for when the user is deleted.
+	DeleteUserSessions(userId string) error
+	// IsRevoked reports whether the session with the given id has been revoked. Unknown sessions are reported as
+	// revoked.
+	IsRevoked(sessionId string) (bool, error)
+}
+
+// NewSessionRepository constructs a SessionRepository from the given configuration, backed by db when it uses
+// PostgreSQL.
+func NewSessionRepository(config Configuration, db *sql.DB) (SessionRepository, error) {
+	var err error
+	var repo SessionRepository
+	switch config.GetRepoType() {
+	case InMemoryRepo:
+		repo = MakeInMemorySessionRepository()
+	case PostgreSqlRepo:
+		if db == nil {
+			return nil, newErrRepository("db is required")
+		}
+		repo = MakePostgresqlSessionRepository(db)
+	default:
+		err = newErrRepository("repository type unimplemented")
+	}
+
+	return repo, err
+}
@@ -0,0 +1,114 @@
+package service_test
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"testing"
+)
+
+type sessionTokens struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+func newSessionTestServer(t *testing.T) *testServer {
+	ts := newTestServer(t, func(r chi.Router) {
+		r.Route("/session", func(r chi.Router) {
+			r.With(service.NewSessionMiddleware).Put("/", service.NewSession)
+			r.With(service.RefreshSessionMiddleware).Post("/refresh", service.RefreshSession)
+			r.With(service.JwtAuthMiddleware).With(service.EndSessionMiddleware).Delete("/", service.EndSession)
+			r.With(service.JwtAuthMiddleware).With(service.EndAllSessionsMiddleware).Delete("/all", service.EndSession)
+		})
+	})
+
+	_, err := ts.repo.NewUser("user@justinstone.net", "user", "password", service.MALE, 30, []string{})
+	ok(t, err)
+
+	return ts
+}
+
+func login(t *testing.T, ts *testServer) sessionTokens {
+	var tokens sessionTokens
+	status := ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "user@justinstone.net", "password": "password"}, &tokens)
+	equals(t, http.StatusOK, status)
+	assert(t, tokens.Token != "", "expected token")
+	assert(t, tokens.RefreshToken != "", "expected refresh token")
+	return tokens
+}
+
+// loginAdmin adds an admin and logs in as them, returning their id and access token.
+func loginAdmin(t *testing.T, ts *testServer) (string, string) {
+	adminId, err := ts.repo.NewUser("admin@justinstone.net", "admin", "password", service.FEMALE, 35, []string{})
+	ok(t, err)
+	ok(t, ts.repo.SetRoles(adminId, []string{service.AdminRole}))
+
+	var tokens sessionTokens
+	status := ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "admin@justinstone.net", "password": "password"}, &tokens)
+	equals(t, http.StatusOK, status)
+	return adminId, tokens.Token
+}
+
+// TestRefreshSession_Rotates ensures a refresh token is exchanged for a new pair and can't be used twice.
+func TestRefreshSession_Rotates(t *testing.T) {
+	ts := newSessionTestServer(t)
+	tokens := login(t, ts)
+
+	var refreshed sessionTokens
+	status := ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, &refreshed)
+	equals(t, http.StatusOK, status)
+	assert(t, refreshed.RefreshToken != tokens.RefreshToken, "expected refresh token to rotate")
+
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	// Reuse revokes the whole family, including the token issued by the legitimate exchange.
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": refreshed.RefreshToken}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	status = ts.do(t, http.MethodDelete, "/session/", refreshed.Token, nil, nil)
+	equals(t, http.StatusUnauthorized, status)
+}
+
+// TestEndSession ensures a logged out session's tokens are rejected.
+func TestEndSession(t *testing.T) {
+	ts := newSessionTestServer(t)
+	tokens := login(t, ts)
+	other := login(t, ts)
+
+	status := ts.do(t, http.MethodDelete, "/session/", tokens.Token, nil, nil)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodDelete, "/session/", tokens.Token, nil, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": tokens.RefreshToken}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": other.RefreshToken}, nil)
+	equals(t, http.StatusOK, status)
+}
+
+// TestEndAllSessions ensures logging out everywhere revokes every session of the user.
+func TestEndAllSessions(t *testing.T) {
+	ts := newSessionTestServer(t)
+	tokens := login(t, ts)
+	other := login(t, ts)
+
+	status := ts.do(t, http.MethodDelete, "/session/all", tokens.Token, nil, nil)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodDelete, "/session/", other.Token, nil, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	status = ts.do(t, http.MethodPost, "/session/refresh", "",
+		map[string]string{"refreshToken": other.RefreshToken}, nil)
+	equals(t, http.StatusUnauthorized, status)
+}
@@ -1,16 +1,37 @@
 package service
 
 import (
-	"crypto/rsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"github.com/golang-jwt/jwt"
+	"github.com/stone1549/yapyapyap/auth/verifier"
+	"github.com/twinj/uuid"
 	"time"
 )
 
+const (
+	opaqueTokenBytes = 32
+	// accessTokenTtl is how long an issued access token remains valid.
+	accessTokenTtl = time.Hour
+)
+
 // TokenFactory provides methods for creating authentication tokens.
 type TokenFactory interface {
 	// NewToken returns a new token string with the given claims
 	NewToken(claims Claims) (string, error)
+	// NewIdToken returns a new OpenID Connect ID token string with the given claims
+	NewIdToken(claims IdClaims) (string, error)
+	// NewChallengeToken returns a new token string attesting a partially completed login
+	NewChallengeToken(claims ChallengeClaims) (string, error)
+	// ParseToken parses the given token string, verifying its signature
+	ParseToken(tokenString string) (*jwt.Token, error)
+	// KeySet returns the public keys that can be used to verify issued tokens
+	KeySet() verifier.JSONWebKeySet
+	// RotateKeys replaces the signing key with a newly generated one, returning its kid
+	RotateKeys() (string, error)
 }
 
 type Claims struct {
@@ -23,6 +44,12 @@ type Claims struct {
 	// Subjects username
 	Username string
 
+	// Whether the subject has verified their email address
+	EmailVerified bool
+
+	// Roles granted to the subject
+	Roles []string
+
 	// Not valid before
 	Nbf int64
 
@@ -31,56 +58,324 @@ type Claims struct {
 
 	// Issued at
 	Iat int64
+
+	// Session the token was issued for
+	Sid string
+
+	// Unique id of the token
+	Jti string
+
+	// OAuth client the token was issued to, empty for direct logins
+	ClientId string
+
+	// OAuth scope granted to the token, empty for direct logins
+	Scope string
 }
 
-func NewClaims(id, email, username string) Claims {
+func NewClaims(id, email, username, sessionId string, roles []string) Claims {
 	now := time.Now().Unix()
-	exp := time.Now().Add(time.Hour).Unix()
-	return Claims{id, email, username, now, exp, now}
+	exp := time.Now().Add(accessTokenTtl).Unix()
+	return Claims{
+		Sub:      id,
+		Email:    email,
+		Username: username,
+		Nbf:      now,
+		Exp:      exp,
+		Iat:      now,
+		Sid:      sessionId,
+		Jti:      uuid.NewV4().String(),
+		Roles:    roles,
+	}
+}
+
+// NewClientClaims returns claims for a token issued to an OAuth client acting on its own behalf.
+func NewClientClaims(clientId, scope string) Claims {
+	now := time.Now().Unix()
+	exp := time.Now().Add(accessTokenTtl).Unix()
+	return Claims{
+		Sub:      clientId,
+		Nbf:      now,
+		Exp:      exp,
+		Iat:      now,
+		Jti:      uuid.NewV4().String(),
+		ClientId: clientId,
+		Scope:    scope,
+	}
+}
+
+// IdClaims are the claims of an OpenID Connect ID token, asserting to a client that a user authenticated.
+type IdClaims struct {
+	// Issuer identifier of the service
+	Iss string
+
+	// Subject (globally unique user id) of token
+	Sub string
+
+	// Audience, the client the token was issued to
+	Aud string
+
+	// Expire at
+	Exp int64
+
+	// Issued at
+	Iat int64
+
+	// Time the user authenticated
+	AuthTime int64
+
+	// Value supplied by the client in the authorization request, echoed to prevent replay
+	Nonce string
+
+	// Standard claims describing the user, as permitted by the granted scope
+	Profile map[string]interface{}
+}
+
+// NewIdClaims returns ID token claims for the given user, disclosing the profile claims allowed by scope.
+func NewIdClaims(issuer string, user User, clientId string, nonce string, authTime time.Time, scope string) IdClaims {
+	now := time.Now().Unix()
+	exp := time.Now().Add(accessTokenTtl).Unix()
+	return IdClaims{
+		Iss:      issuer,
+		Sub:      user.Id,
+		Aud:      clientId,
+		Exp:      exp,
+		Iat:      now,
+		AuthTime: authTime.Unix(),
+		Nonce:    nonce,
+		Profile:  userInfoClaims(user, scope),
+	}
+}
+
+// ChallengeClaims are the claims of a short lived token attesting that a user has passed the first step of a login,
+// to be presented with proof of the next step. They can't be used as access tokens.
+type ChallengeClaims struct {
+	// Subject (globally unique user id) of token, empty if the user is yet to be identified
+	Sub string
+
+	// Step of the login the token is exchanged at
+	Purpose string
+
+	// Expire at
+	Exp int64
+
+	// Issued at
+	Iat int64
+
+	// Unique id of the token
+	Jti string
+}
+
+// NewChallengeClaims returns challenge claims for the given user and purpose, valid for ttl.
+func NewChallengeClaims(id string, purpose string, ttl time.Duration) ChallengeClaims {
+	now := time.Now().Unix()
+	exp := time.Now().Add(ttl).Unix()
+	return ChallengeClaims{
+		Sub:     id,
+		Purpose: purpose,
+		Exp:     exp,
+		Iat:     now,
+		Jti:     uuid.NewV4().String(),
+	}
 }
 
 type jwtFactory struct {
-	SigningMethod   jwt.SigningMethod
 	SecretSharedKey []byte
-	RsaPrivateKey   *rsa.PrivateKey
-	RsaPublicKey    *rsa.PublicKey
+	Keys            *keyRing
 }
 
 // NewToken returns a new token string with the given claims
 func (jwtf *jwtFactory) NewToken(claims Claims) (string, error) {
-	token := jwt.NewWithClaims(jwtf.SigningMethod, jwt.MapClaims{
-		"sub":      claims.Sub,
-		"email":    claims.Email,
-		"username": claims.Username,
-		"nbf":      claims.Nbf,
-		"exp":      claims.Exp,
-		"iat":      claims.Iat,
+	mapClaims := jwt.MapClaims{
+		"sub": claims.Sub,
+		"nbf": claims.Nbf,
+		"exp": claims.Exp,
+		"iat": claims.Iat,
+		"jti": claims.Jti,
+	}
+
+	// Tokens issued to clients acting on their own behalf have no user or session
+	if claims.Sid != "" {
+		mapClaims["email"] = claims.Email
+		mapClaims["username"] = claims.Username
+		mapClaims["email_verified"] = claims.EmailVerified
+		mapClaims["sid"] = claims.Sid
+
+		roles := claims.Roles
+
+		if roles == nil {
+			roles = []string{}
+		}
+
+		mapClaims["roles"] = roles
+	}
+
+	if claims.ClientId != "" {
+		mapClaims["client_id"] = claims.ClientId
+		mapClaims["scope"] = claims.Scope
+	}
+
+	return jwtf.sign(mapClaims)
+}
+
+// NewIdToken returns a new OpenID Connect ID token string with the given claims
+func (jwtf *jwtFactory) NewIdToken(claims IdClaims) (string, error) {
+	mapClaims := jwt.MapClaims{}
+
+	for name, value := range claims.Profile {
+		mapClaims[name] = value
+	}
+
+	mapClaims["iss"] = claims.Iss
+	mapClaims["sub"] = claims.Sub
+	mapClaims["aud"] = claims.Aud
+	mapClaims["exp"] = claims.Exp
+	mapClaims["iat"] = claims.Iat
+	mapClaims["auth_time"] = claims.AuthTime
+
+	if claims.Nonce != "" {
+		mapClaims["nonce"] = claims.Nonce
+	}
+
+	return jwtf.sign(mapClaims)
+}
+
+// NewChallengeToken returns a new token string attesting a partially completed login
+func (jwtf *jwtFactory) NewChallengeToken(claims ChallengeClaims) (string, error) {
+	return jwtf.sign(jwt.MapClaims{
+		"sub":     claims.Sub,
+		"purpose": claims.Purpose,
+		"exp":     claims.Exp,
+		"iat":     claims.Iat,
+		"jti":     claims.Jti,
 	})
+}
 
-	if jwtf.SigningMethod == jwt.SigningMethodRS512 {
-		return token.SignedString(jwtf.RsaPrivateKey)
-	} else if jwtf.SigningMethod == jwt.SigningMethodHS512 {
-		return token.SignedString([]byte(jwtf.SecretSharedKey))
+// sign signs the given claims with the current key.
+func (jwtf *jwtFactory) sign(mapClaims jwt.MapClaims) (string, error) {
+	if jwtf.Keys != nil {
+		key := jwtf.Keys.current()
+		token := jwt.NewWithClaims(key.method, mapClaims)
+		token.Header["kid"] = key.jwk.Kid
+		return token.SignedString(key.signer)
+	} else if jwtf.SecretSharedKey != nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS512, mapClaims).SignedString(jwtf.SecretSharedKey)
 	} else {
 		return "", errors.New("unsupported JWT configuration")
 	}
 }
 
+// ParseToken parses the given token string, verifying it was signed by this factory
+func (jwtf *jwtFactory) ParseToken(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		if jwtf.Keys != nil {
+			kid, _ := token.Header["kid"].(string)
+			key, ok := jwtf.Keys.find(kid)
+
+			if !ok {
+				return nil, errors.New("unknown signing key")
+			} else if token.Method != key.method {
+				return nil, errors.New("unexpected signing method")
+			}
+
+			return key.signer.Public(), nil
+		} else if jwtf.SecretSharedKey != nil && token.Method == jwt.SigningMethodHS512 {
+			return jwtf.SecretSharedKey, nil
+		}
+
+		return nil, errors.New("unexpected signing method")
+	})
+}
+
+// KeySet returns the public keys that can be used to verify issued tokens. Shared secrets are never published, so the
+// set is empty when tokens are signed with one.
+func (jwtf *jwtFactory) KeySet() verifier.JSONWebKeySet {
+	if jwtf.Keys != nil {
+		return jwtf.Keys.keySet()
+	}
+
+	return verifier.JSONWebKeySet{Keys: make([]verifier.JSONWebKey, 0)}
+}
+
+// RotateKeys generates a new signing key, keeping previous keys available for verification.
+func (jwtf *jwtFactory) RotateKeys() (string, error) {
+	if jwtf.Keys == nil {
+		return "", errors.New("shared secret keys can't be rotated")
+	}
+
+	return jwtf.Keys.rotate()
+}
+
 // NewTokenFactory constructs a token factory using the given configuration.
 func NewTokenFactory(config Configuration) (TokenFactory, error) {
 	if config.GetTokenSecretKey() != "" {
-		return &jwtFactory{
-			jwt.SigningMethodHS512,
-			[]byte(config.GetTokenSecretKey()),
-			nil,
-			nil}, nil
-	} else if config.GetTokenPublicKey() != nil && config.GetTokenPrivateKey() != nil {
-		return &jwtFactory{
-			jwt.SigningMethodRS512,
-			nil,
-			config.GetTokenPrivateKey(),
-			config.GetTokenPublicKey()}, nil
+		return &jwtFactory{[]byte(config.GetTokenSecretKey()), nil}, nil
+	} else if len(config.GetTokenSigningKeys()) > 0 || config.GetTokenKeyDir() != "" {
+		keys, err := newKeyRing(
+			config.GetTokenSigningKeys(),
+			config.GetTokenKeyAlgorithm(),
+			config.GetTokenKeyRetention(),
+			config.GetTokenKeyDir(),
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &jwtFactory{nil, keys}, nil
 	} else {
 		return nil, errors.New("invalid token signing configuration")
 	}
 }
+
+// parseChallengeToken verifies a challenge token was issued for the given purpose, returning its claims.
+func parseChallengeToken(tokenFactory TokenFactory, tokenString string, purpose string) (ChallengeClaims, error) {
+	token, err := tokenFactory.ParseToken(tokenString)
+
+	if err != nil {
+		return ChallengeClaims{}, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+
+	if !ok || !token.Valid {
+		return ChallengeClaims{}, errors.New("invalid challenge token")
+	}
+
+	challenge := ChallengeClaims{}
+	challenge.Sub, _ = claims["sub"].(string)
+	challenge.Purpose, _ = claims["purpose"].(string)
+	challenge.Jti, _ = claims["jti"].(string)
+
+	if exp, ok := claims["exp"].(float64); ok {
+		challenge.Exp = int64(exp)
+	}
+
+	if challenge.Purpose != purpose {
+		return ChallengeClaims{}, errors.New("invalid challenge token")
+	}
+
+	return challenge, nil
+}
+
+// newOpaqueToken generates a random, url safe token suitable for handing to clients along with the hash that should be
+// stored in place of the token itself.
+func newOpaqueToken() (string, string, error) {
+	buf := make([]byte, opaqueTokenBytes)
+
+	_, err := rand.Read(buf)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	return token, hashOpaqueToken(token), nil
+}
+
+// hashOpaqueToken hashes an opaque token for storage and lookup. Opaque tokens carry enough entropy that a fast,
+// unsalted hash is sufficient.
+func hashOpaqueToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
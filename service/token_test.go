@@ -0,0 +1,147 @@
+package service_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"github.com/stone1549/yapyapyap/auth/verifier"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newKeyDirTokenFactory(t *testing.T, dir string, alg string) service.TokenFactory {
+	setEnv("PROD", "IN_MEMORY", "60", "3333", "", "",
+		"", "", "")
+	_ = os.Setenv(tokenKeyDirKey, dir)
+	_ = os.Setenv(tokenKeyAlgKey, alg)
+	defer clearKeyRingEnv()
+
+	config, err := service.GetConfiguration()
+	ok(t, err)
+
+	tokenFactory, err := service.NewTokenFactory(config)
+	ok(t, err)
+
+	return tokenFactory
+}
+
+func newTestToken(t *testing.T, tokenFactory service.TokenFactory) string {
+	token, err := tokenFactory.NewToken(service.NewClaims("1", "user@justinstone.net", "user", "session", nil))
+	ok(t, err)
+	return token
+}
+
+// TestTokenFactory_RotateKeys ensures tokens signed with retained previous keys remain valid after rotation.
+func TestTokenFactory_RotateKeys(t *testing.T) {
+	tokenFactory, err := service.NewTokenFactory(inMemoryRsa)
+	ok(t, err)
+
+	token := newTestToken(t, tokenFactory)
+
+	kid, err := tokenFactory.RotateKeys()
+	ok(t, err)
+	equals(t, kid, tokenFactory.KeySet().Keys[0].Kid)
+	equals(t, 2, len(tokenFactory.KeySet().Keys))
+
+	_, err = tokenFactory.ParseToken(token)
+	ok(t, err)
+
+	_, err = tokenFactory.ParseToken(newTestToken(t, tokenFactory))
+	ok(t, err)
+
+	// inMemoryRsa retains two previous keys, the third rotation drops the original key
+	_, err = tokenFactory.RotateKeys()
+	ok(t, err)
+	_, err = tokenFactory.RotateKeys()
+	ok(t, err)
+	equals(t, 3, len(tokenFactory.KeySet().Keys))
+
+	_, err = tokenFactory.ParseToken(token)
+	notOk(t, err)
+}
+
+// TestTokenFactory_RotateKeysSecret ensures shared secrets can't be rotated.
+func TestTokenFactory_RotateKeysSecret(t *testing.T) {
+	tokenFactory, err := service.NewTokenFactory(inMemoryEmpty)
+	ok(t, err)
+
+	_, err = tokenFactory.RotateKeys()
+	notOk(t, err)
+}
+
+// TestTokenFactory_RotateKeysDir ensures keys rotated by one instance are picked up by another sharing its key
+// directory.
+func TestTokenFactory_RotateKeysDir(t *testing.T) {
+	dir := t.TempDir()
+	first := newKeyDirTokenFactory(t, dir, "")
+	second := newKeyDirTokenFactory(t, dir, "")
+
+	_, err := second.ParseToken(newTestToken(t, first))
+	ok(t, err)
+
+	_, err = first.RotateKeys()
+	ok(t, err)
+
+	_, err = second.ParseToken(newTestToken(t, first))
+	ok(t, err)
+}
+
+// TestTokenFactory_Algorithms ensures tokens can be signed with each supported asymmetric algorithm and verified using
+// only the published key set.
+func TestTokenFactory_Algorithms(t *testing.T) {
+	for _, alg := range []string{"RS512", "ES256", "ES384", "ES512", "EdDSA"} {
+		t.Run(alg, func(t *testing.T) {
+			tokenFactory := newKeyDirTokenFactory(t, t.TempDir(), alg)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(tokenFactory.KeySet())
+			}))
+			defer server.Close()
+
+			token := newTestToken(t, tokenFactory)
+
+			parsed, err := tokenFactory.ParseToken(token)
+			ok(t, err)
+			equals(t, alg, parsed.Method.Alg())
+
+			claims, err := verifier.NewVerifier(server.URL, time.Minute).Verify(token)
+			ok(t, err)
+			equals(t, "1", claims.Subject)
+		})
+	}
+}
+
+// TestGetConfiguration_EcKeyList ensures SEC 1 encoded ECDSA keys can be configured.
+func TestGetConfiguration_EcKeyList(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+
+	der, err := x509.MarshalECPrivateKey(key)
+	ok(t, err)
+
+	path := filepath.Join(t.TempDir(), "ec.pem")
+	ok(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+
+	setEnv("PROD", "IN_MEMORY", "60", "3333", "", "",
+		"", "", "")
+	_ = os.Setenv(tokenKeysKey, path)
+	defer clearKeyRingEnv()
+
+	config, err := service.GetConfiguration()
+	ok(t, err)
+
+	tokenFactory, err := service.NewTokenFactory(config)
+	ok(t, err)
+
+	parsed, err := tokenFactory.ParseToken(newTestToken(t, tokenFactory))
+	ok(t, err)
+	equals(t, "ES256", parsed.Method.Alg())
+}
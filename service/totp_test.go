@@ -0,0 +1,210 @@
+package service_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// totpCodeAt independently computes the RFC 6238 code for secret at t.
+func totpCodeAt(t *testing.T, secret string, at time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	ok(t, err)
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(at.Unix()/30))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+func newTotpTestServer(t *testing.T) *testServer {
+	ts := newSessionTestServer(t)
+	ts.router.With(service.VerifyMfaMiddleware).Post("/session/mfa", service.NewSession)
+	ts.router.Route("/user/mfa/totp", func(r chi.Router) {
+		r.Use(service.JwtAuthMiddleware)
+		r.With(service.EnrollTotpMiddleware).Post("/", service.EnrollTotp)
+		r.With(service.ConfirmTotpMiddleware).Post("/confirm", service.TotpStatus)
+		r.With(service.RemoveTotpMiddleware).Delete("/", service.TotpStatus)
+	})
+	ts.router.With(service.JwtAuthMiddleware).With(service.RegenerateRecoveryCodesMiddleware).
+		Post("/user/mfa/recovery-codes", service.RecoveryCodes)
+	return ts
+}
+
+// enableTotp enrolls and confirms TOTP for the test user, returning the secret and recovery codes.
+func enableTotp(t *testing.T, ts *testServer, token string) (string, []string) {
+	var enrollment totpEnrollment
+	status := ts.do(t, http.MethodPost, "/user/mfa/totp/", token, nil, &enrollment)
+	equals(t, http.StatusOK, status)
+
+	uri, err := url.Parse(enrollment.Uri)
+	ok(t, err)
+	equals(t, "otpauth", uri.Scheme)
+	equals(t, enrollment.Secret, uri.Query().Get("secret"))
+
+	status = ts.do(t, http.MethodPost, "/user/mfa/totp/confirm", token,
+		map[string]string{"code": "000000"}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	var confirmed struct {
+		Enabled       bool     `json:"enabled"`
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	status = ts.do(t, http.MethodPost, "/user/mfa/totp/confirm", token,
+		map[string]string{"code": totpCodeAt(t, enrollment.Secret, time.Now())}, &confirmed)
+	equals(t, http.StatusOK, status)
+	assert(t, confirmed.Enabled, "expected totp to be enabled")
+	equals(t, 10, len(confirmed.RecoveryCodes))
+
+	return enrollment.Secret, confirmed.RecoveryCodes
+}
+
+// mfaChallenge logs in as the test user, returning the challenge token issued in place of a session.
+func mfaChallenge(t *testing.T, ts *testServer) string {
+	var challenge struct {
+		Token          string `json:"token"`
+		MfaRequired    bool   `json:"mfaRequired"`
+		ChallengeToken string `json:"challengeToken"`
+	}
+	status := ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "user@justinstone.net", "password": "password"}, &challenge)
+	equals(t, http.StatusOK, status)
+	assert(t, challenge.MfaRequired, "expected mfa to be required")
+	equals(t, "", challenge.Token)
+	return challenge.ChallengeToken
+}
+
+// TestTotpCodeAt ensures the test's code generator matches the RFC 6238 SHA1 test vector.
+func TestTotpCodeAt(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	equals(t, "287082", totpCodeAt(t, secret, time.Unix(59, 0)))
+}
+
+// TestTotp_Login ensures a user with TOTP enabled must exchange a challenge and valid code for a session.
+func TestTotp_Login(t *testing.T) {
+	ts := newTotpTestServer(t)
+	secret, _ := enableTotp(t, ts, login(t, ts).Token)
+	challenge := mfaChallenge(t, ts)
+
+	// Challenge tokens aren't access tokens.
+	status := ts.do(t, http.MethodDelete, "/session/", challenge, nil, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	// The code used to confirm enrollment can't be replayed.
+	status = ts.do(t, http.MethodPost, "/session/mfa", "", map[string]string{
+		"challengeToken": challenge,
+		"code":           totpCodeAt(t, secret, time.Now()),
+	}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	var tokens sessionTokens
+	status = ts.do(t, http.MethodPost, "/session/mfa", "", map[string]string{
+		"challengeToken": challenge,
+		"code":           totpCodeAt(t, secret, time.Now().Add(30*time.Second)),
+	}, &tokens)
+	equals(t, http.StatusOK, status)
+	assert(t, tokens.Token != "", "expected token")
+	assert(t, tokens.RefreshToken != "", "expected refresh token")
+
+	status = ts.do(t, http.MethodPost, "/session/mfa", "", map[string]string{
+		"challengeToken": tokens.Token,
+		"code":           totpCodeAt(t, secret, time.Now().Add(-30*time.Second)),
+	}, nil)
+	equals(t, http.StatusUnauthorized, status)
+}
+
+// TestTotp_Remove ensures TOTP can be disabled with a valid code, restoring single step login.
+func TestTotp_Remove(t *testing.T) {
+	ts := newTotpTestServer(t)
+	token := login(t, ts).Token
+	secret, _ := enableTotp(t, ts, token)
+
+	status := ts.do(t, http.MethodPost, "/user/mfa/totp/", token, nil, nil)
+	equals(t, http.StatusBadRequest, status)
+
+	status = ts.do(t, http.MethodDelete, "/user/mfa/totp/", token,
+		map[string]string{"code": "111111"}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	var res struct {
+		Enabled bool `json:"enabled"`
+	}
+	status = ts.do(t, http.MethodDelete, "/user/mfa/totp/", token,
+		map[string]string{"code": totpCodeAt(t, secret, time.Now().Add(30*time.Second))}, &res)
+	equals(t, http.StatusOK, status)
+	assert(t, !res.Enabled, "expected totp to be disabled")
+
+	login(t, ts)
+}
+
+// TestRecoveryCodes_Login ensures each recovery code can stand in for the second factor exactly once.
+func TestRecoveryCodes_Login(t *testing.T) {
+	ts := newTotpTestServer(t)
+	_, codes := enableTotp(t, ts, login(t, ts).Token)
+
+	var tokens sessionTokens
+	status := ts.do(t, http.MethodPost, "/session/mfa", "", map[string]string{
+		"challengeToken": mfaChallenge(t, ts),
+		"recoveryCode":   strings.ToUpper(codes[3]),
+	}, &tokens)
+	equals(t, http.StatusOK, status)
+	assert(t, tokens.Token != "", "expected token")
+
+	status = ts.do(t, http.MethodPost, "/session/mfa", "", map[string]string{
+		"challengeToken": mfaChallenge(t, ts),
+		"recoveryCode":   codes[3],
+	}, nil)
+	equals(t, http.StatusUnauthorized, status)
+}
+
+// TestRecoveryCodes_Regenerate ensures regenerating recovery codes invalidates the previous set.
+func TestRecoveryCodes_Regenerate(t *testing.T) {
+	ts := newTotpTestServer(t)
+	token := login(t, ts).Token
+	_, codes := enableTotp(t, ts, token)
+
+	status := ts.do(t, http.MethodPost, "/user/mfa/recovery-codes", token,
+		map[string]string{"recoveryCode": "not-a-code"}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	var regenerated struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	status = ts.do(t, http.MethodPost, "/user/mfa/recovery-codes", token,
+		map[string]string{"recoveryCode": codes[0]}, &regenerated)
+	equals(t, http.StatusOK, status)
+	equals(t, 10, len(regenerated.RecoveryCodes))
+
+	status = ts.do(t, http.MethodPost, "/session/mfa", "", map[string]string{
+		"challengeToken": mfaChallenge(t, ts),
+		"recoveryCode":   codes[1],
+	}, nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	status = ts.do(t, http.MethodPost, "/session/mfa", "", map[string]string{
+		"challengeToken": mfaChallenge(t, ts),
+		"recoveryCode":   regenerated.RecoveryCodes[1],
+	}, nil)
+	equals(t, http.StatusOK, status)
+}
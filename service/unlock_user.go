@@ -0,0 +1,53 @@
+package service
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+type unlockUserResponse struct {
+}
+
+func (uur unlockUserResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// UnlockUserMiddleware middleware to forget the failed logins of a user, lifting any lockout or backoff on their
+// account. Failures from IP addresses are left alone.
+func UnlockUserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		user, err := userRepo.GetUser(chi.URLParam(r, "id"))
+
+		if errors.Is(err, errUserNotFound) || (err == nil && user.Id == "") {
+			RenderResponse(w, r, NewNotFoundErr("user not found"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = userRepo.ClearLoginFailures(accountThrottleKey(user.Email))
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UnlockUser renders the response to unlocking a user.
+func UnlockUser(w http.ResponseWriter, r *http.Request) {
+	RenderResponse(w, r, unlockUserResponse{})
+}
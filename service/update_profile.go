@@ -2,6 +2,8 @@ package service
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
 	"net/http"
 )
 
@@ -19,12 +21,21 @@ func (nsr updateProfileResponse) Render(w http.ResponseWriter, _ *http.Request)
 	return nil
 }
 
-// UpdateProfileMiddleware middleware to get a user from the repo from the request parameterss
+// UpdateProfileMiddleware middleware to replace a user's profile. Users may only edit their own profile unless they
+// are allowed to edit other users.
 func UpdateProfileMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
 		decoder := json.NewDecoder(r.Body)
 
 		var reqUser updateProfileRequest
+		reqUser.UserId = chi.URLParam(r, "id")
 		err := decoder.Decode(&reqUser.UserProfile)
 		if err != nil {
 			RenderResponse(w, r, NewBadRequestErr("invalid request body"))
@@ -36,6 +47,16 @@ func UpdateProfileMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		if reqUser.UserId != caller.Id && !caller.HasPermission(WriteProfilesPermission) {
+			RenderResponse(w, r, NewForbiddenErr("forbidden"))
+			return
+		}
+
+		if reqUser.Gender == "" || reqUser.Age == 0 || reqUser.Topics == nil {
+			RenderResponse(w, r, NewBadRequestErr("gender, age and topics are required"))
+			return
+		}
+
 		userRepo, ok := r.Context().Value("repo").(UserRepository)
 
 		if !ok {
@@ -48,7 +69,10 @@ func UpdateProfileMiddleware(next http.Handler) http.Handler {
 			reqUser.UserProfile,
 		)
 
-		if err != nil {
+		if errors.Is(err, errUserNotFound) {
+			RenderResponse(w, r, NewNotFoundErr("user not found"))
+			return
+		} else if err != nil {
 			RenderResponse(w, r, NewInternalServerErr("internal error"))
 			return
 		}
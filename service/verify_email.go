@@ -0,0 +1,177 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// emailVerificationTtl is how long an email verification link remains valid.
+	emailVerificationTtl = 24 * time.Hour
+)
+
+type resendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+type verifyEmailResponse struct {
+	status        int
+	EmailVerified bool `json:"emailVerified,omitempty"`
+}
+
+func (ver verifyEmailResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(ver.status)
+
+	return nil
+}
+
+// sendVerificationEmail emails the user a link confirming they own their current email address.
+func sendVerificationEmail(config Configuration, userRepo UserRepository, mailer Mailer, user User) error {
+	token, err := issueActionToken(userRepo, user.Id, emailVerificationPurpose, user.Email, emailVerificationTtl)
+
+	if err != nil {
+		return err
+	}
+
+	return mailer.Send(Message{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Welcome %s! Follow the link below within the next day to confirm this is your email "+
+			"address.\n\n%s\n\nIf you didn't create an account, you can ignore this email.",
+			user.Username, actionLink(config, "/user/verify", token)),
+	})
+}
+
+// checkEmailVerified ensures the user may log in given the configured email verification requirement. Errors are
+// ErrorResponse values suitable for rendering.
+func checkEmailVerified(config Configuration, user User) error {
+	if config.GetRequireVerifiedEmail() && !user.EmailVerified {
+		return NewForbiddenErr("email not verified")
+	}
+
+	return nil
+}
+
+// VerifyEmailMiddleware middleware to mark a user's email address verified using the token from a verification link
+func VerifyEmailMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+
+		if token == "" {
+			RenderResponse(w, r, NewBadRequestErr("token is required"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		actionToken, err := userRepo.ConsumeActionToken(hashOpaqueToken(token), emailVerificationPurpose)
+
+		if errors.Is(err, errActionTokenInvalid) {
+			RenderResponse(w, r, NewBadRequestErr("invalid or expired token"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		user, err := userRepo.GetUser(actionToken.UserId)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		// The link only proves ownership of the address it was sent to.
+		if user.Email != actionToken.Data {
+			RenderResponse(w, r, NewBadRequestErr("invalid or expired token"))
+			return
+		}
+
+		err = userRepo.VerifyEmail(user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// VerifyEmail renders the response to a successful email verification.
+func VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	RenderResponse(w, r, verifyEmailResponse{status: http.StatusOK, EmailVerified: true})
+}
+
+// ResendVerificationMiddleware middleware to send another verification link to an unverified email address. The
+// response is the same whether or not the address belongs to an account, so it can't be used to discover users.
+func ResendVerificationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req resendVerificationRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("invalid request body"))
+			return
+		}
+
+		if req.Email == "" {
+			RenderResponse(w, r, NewBadRequestErr("email is required"))
+			return
+		}
+
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		mailer, ok := r.Context().Value("mailer").(Mailer)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		user, err := userRepo.GetUserByEmail(req.Email)
+
+		if errors.Is(err, errUserNotFound) || (err == nil && user.EmailVerified) {
+			next.ServeHTTP(w, r)
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = sendVerificationEmail(config, userRepo, mailer, user)
+
+		// Failing here would reveal that the account exists.
+		if err != nil {
+			log.Printf("Unable to send verification email: %s", err.Error())
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ResendVerification renders the response to a request for another verification email.
+func ResendVerification(w http.ResponseWriter, r *http.Request) {
+	RenderResponse(w, r, verifyEmailResponse{status: http.StatusAccepted})
+}
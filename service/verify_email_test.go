@@ -0,0 +1,142 @@
+package service_test
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"github.com/stone1549/yapyapyap/auth/verifier"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// verifiedEmailConfiguration is a configuration that refuses logins from users with unverified email addresses.
+type verifiedEmailConfiguration struct {
+	service.Configuration
+}
+
+func (c verifiedEmailConfiguration) GetRequireVerifiedEmail() bool {
+	return true
+}
+
+type newUserResult struct {
+	Token                string `json:"token"`
+	RefreshToken         string `json:"refreshToken"`
+	VerificationRequired bool   `json:"verificationRequired"`
+}
+
+func newVerifyEmailTestServer(t *testing.T) *testServer {
+	ts := newSessionTestServer(t)
+	ts.router.Route("/user", func(r chi.Router) {
+		r.With(service.NewUserMiddleware).Put("/", service.NewUser)
+		r.With(service.VerifyEmailMiddleware).Get("/verify", service.VerifyEmail)
+		r.With(service.ResendVerificationMiddleware).Post("/verify", service.ResendVerification)
+	})
+
+	return ts
+}
+
+func signUp(t *testing.T, ts *testServer, email string) newUserResult {
+	var result newUserResult
+	status := ts.do(t, http.MethodPut, "/user/", "", map[string]interface{}{
+		"email":    email,
+		"username": "new",
+		"password": "password",
+		"profile":  map[string]interface{}{"gender": "female", "age": 30, "topics": []string{}},
+	}, &result)
+	equals(t, http.StatusOK, status)
+	return result
+}
+
+// emailVerified reports the email_verified claim of an access token.
+func emailVerified(t *testing.T, ts *testServer, tokenString string) bool {
+	token, err := ts.tokenFactory.ParseToken(tokenString)
+	ok(t, err)
+	claims, err := verifier.ParseClaims(token)
+	ok(t, err)
+	return claims.EmailVerified
+}
+
+// TestVerifyEmail ensures new users are sent a link that marks their email address verified.
+func TestVerifyEmail(t *testing.T) {
+	ts := newVerifyEmailTestServer(t)
+	result := signUp(t, ts, "new@justinstone.net")
+	assert(t, result.Token != "", "expected token")
+	equals(t, false, emailVerified(t, ts, result.Token))
+
+	message := ts.mailer.last(t)
+	equals(t, "new@justinstone.net", message.To)
+	token := linkToken(t, message, "/user/verify")
+
+	status := ts.do(t, http.MethodGet, "/user/verify?token="+url.QueryEscape(token), "", nil, nil)
+	equals(t, http.StatusOK, status)
+	status = ts.do(t, http.MethodGet, "/user/verify?token="+url.QueryEscape(token), "", nil, nil)
+	equals(t, http.StatusBadRequest, status)
+
+	var tokens sessionTokens
+	status = ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "new@justinstone.net", "password": "password"}, &tokens)
+	equals(t, http.StatusOK, status)
+	equals(t, true, emailVerified(t, ts, tokens.Token))
+}
+
+// TestVerifyEmail_Required ensures unverified users can't log in when verification is required.
+func TestVerifyEmail_Required(t *testing.T) {
+	ts := newVerifyEmailTestServer(t)
+	ts.config = verifiedEmailConfiguration{ts.config}
+
+	result := signUp(t, ts, "new@justinstone.net")
+	equals(t, true, result.VerificationRequired)
+	equals(t, "", result.Token)
+
+	status := ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "new@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusForbidden, status)
+
+	status = ts.do(t, http.MethodPost, "/user/verify", "", map[string]string{"email": "new@justinstone.net"}, nil)
+	equals(t, http.StatusAccepted, status)
+	equals(t, 2, len(ts.mailer.messages))
+
+	// Only the latest link works.
+	status = ts.do(t, http.MethodGet,
+		"/user/verify?token="+url.QueryEscape(linkToken(t, ts.mailer.messages[0], "/user/verify")), "", nil, nil)
+	equals(t, http.StatusBadRequest, status)
+	status = ts.do(t, http.MethodGet,
+		"/user/verify?token="+url.QueryEscape(linkToken(t, ts.mailer.last(t), "/user/verify")), "", nil, nil)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodPut, "/session/", "",
+		map[string]string{"email": "new@justinstone.net", "password": "password"}, nil)
+	equals(t, http.StatusOK, status)
+
+	// Verified addresses aren't sent more links.
+	status = ts.do(t, http.MethodPost, "/user/verify", "", map[string]string{"email": "new@justinstone.net"}, nil)
+	equals(t, http.StatusAccepted, status)
+	equals(t, 2, len(ts.mailer.messages))
+}
+
+// TestNewUser_InvalidEmail ensures accounts can't be created without a valid email address.
+func TestNewUser_InvalidEmail(t *testing.T) {
+	ts := newVerifyEmailTestServer(t)
+
+	for _, email := range []string{"new", "New User <new@justinstone.net>", "new@"} {
+		status := ts.do(t, http.MethodPut, "/user/", "", map[string]interface{}{
+			"email":    email,
+			"username": "new",
+			"password": "password",
+		}, nil)
+		equals(t, http.StatusBadRequest, status)
+	}
+}
+
+// TestNewUser_Taken ensures signing up with an email address or username belonging to another user is a conflict.
+func TestNewUser_Taken(t *testing.T) {
+	ts := newVerifyEmailTestServer(t)
+
+	for _, user := range []map[string]interface{}{
+		{"email": "user@justinstone.net", "username": "new", "password": "password"},
+		{"email": "new@justinstone.net", "username": "USER", "password": "password"},
+	} {
+		user["profile"] = map[string]interface{}{"gender": "female", "age": 30, "topics": []string{}}
+		equals(t, http.StatusConflict, ts.do(t, http.MethodPut, "/user/", "", user, nil))
+	}
+}
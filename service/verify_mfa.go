@@ -0,0 +1,133 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	// mfaChallengePurpose identifies challenge tokens exchanged for a session with a second factor.
+	mfaChallengePurpose = "mfa"
+	// mfaChallengeTtl is how long a user has to provide their second factor after their password is accepted.
+	mfaChallengeTtl = 5 * time.Minute
+)
+
+type verifyMfaRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recoveryCode"`
+}
+
+// mfaRequired reports whether a user must provide a second factor to log in.
+func mfaRequired(userRepo UserRepository, userId string) (bool, error) {
+	enrollment, err := userRepo.GetTotp(userId)
+
+	if errors.Is(err, errTotpNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return enrollment.Confirmed, nil
+}
+
+// newMfaChallenge issues a challenge token for a user who has provided their password but still needs to provide a
+// second factor.
+func newMfaChallenge(ctx context.Context, userId string) (string, error) {
+	tokenFactory, ok := ctx.Value("tokenFactory").(TokenFactory)
+
+	if !ok {
+		return "", NewInternalServerErr("internal error")
+	}
+
+	challenge, err := tokenFactory.NewChallengeToken(NewChallengeClaims(userId, mfaChallengePurpose, mfaChallengeTtl))
+
+	if err != nil {
+		return "", NewInternalServerErr("internal error")
+	}
+
+	return challenge, nil
+}
+
+// VerifyMfaMiddleware middleware to complete a login by exchanging a challenge token and second factor for a session
+func VerifyMfaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req verifyMfaRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("request body invalid"))
+			return
+		}
+
+		if req.ChallengeToken == "" {
+			RenderResponse(w, r, NewBadRequestErr("challengeToken is required"))
+			return
+		}
+
+		if req.Code == "" && req.RecoveryCode == "" {
+			RenderResponse(w, r, NewBadRequestErr("code or recoveryCode is required"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("repo not found"))
+			return
+		}
+
+		tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		challenge, err := parseChallengeToken(tokenFactory, req.ChallengeToken, mfaChallengePurpose)
+		userId := challenge.Sub
+
+		if err != nil || userId == "" {
+			RenderResponse(w, r, NewUnauthorizedErr("challenge token invalid"))
+			return
+		}
+
+		enrollment, err := userRepo.GetTotp(userId)
+
+		if errors.Is(err, errTotpNotFound) || (err == nil && !enrollment.Confirmed) {
+			RenderResponse(w, r, NewUnauthorizedErr("challenge token invalid"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = checkSecondFactor(userRepo, userId, enrollment, req.Code, req.RecoveryCode)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		user, err := userRepo.GetUser(userId)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		token, refreshToken, err := startSession(r.Context(), user, "", "")
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "token", token)
+		ctx = context.WithValue(ctx, "refreshToken", refreshToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
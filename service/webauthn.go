@@ -0,0 +1,301 @@
+package service
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/fxamacker/cbor/v2"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// webAuthnRegisterPurpose identifies challenge tokens issued for registering a credential.
+	webAuthnRegisterPurpose = "webauthn-register"
+	// webAuthnLoginPurpose identifies challenge tokens issued for logging in with a credential.
+	webAuthnLoginPurpose = "webauthn-login"
+	// webAuthnTimeout is how long a user has to complete a WebAuthn ceremony.
+	webAuthnTimeout = 5 * time.Minute
+)
+
+// Authenticator data flags, see https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+const (
+	authDataUserPresent            byte = 0x01
+	authDataUserVerified           byte = 0x04
+	authDataAttestedCredentialData byte = 0x40
+)
+
+// COSE key parameters and algorithms, see RFC 8152.
+const (
+	coseKty        = 1
+	coseAlg        = 3
+	coseKtyOkp     = 1
+	coseKtyEc2     = 2
+	coseKtyRsa     = 3
+	coseCrvP256    = 1
+	coseCrvEd25519 = 6
+	coseAlgES256   = -7
+	coseAlgEdDSA   = -8
+	coseAlgRS256   = -257
+)
+
+// webAuthnAlgorithms are the COSE algorithms accepted for credentials, in order of preference.
+var webAuthnAlgorithms = []int{coseAlgES256, coseAlgEdDSA, coseAlgRS256}
+
+// collectedClientData is the client data signed over by the authenticator in a ceremony.
+type collectedClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type attestationObject struct {
+	Fmt      string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+type authenticatorData struct {
+	RpIdHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialId []byte
+	PublicKey    []byte
+}
+
+// decodeBase64Url decodes base64url data with or without padding, as produced by browsers.
+func decodeBase64Url(data string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+}
+
+// verifyClientData checks the client data of a ceremony was collected for the expected type at an allowed origin,
+// returning the challenge it was made for.
+func verifyClientData(raw []byte, ceremonyType string, origins []string) (string, error) {
+	var clientData collectedClientData
+	err := json.Unmarshal(raw, &clientData)
+
+	if err != nil {
+		return "", errors.New("client data invalid")
+	} else if clientData.Type != ceremonyType {
+		return "", errors.New("client data type invalid")
+	} else if clientData.CrossOrigin || !containsString(origins, clientData.Origin) {
+		return "", errors.New("origin not allowed")
+	}
+
+	challenge, err := decodeBase64Url(clientData.Challenge)
+
+	if err != nil {
+		return "", errors.New("challenge invalid")
+	}
+
+	return string(challenge), nil
+}
+
+// parseAuthenticatorData parses authenticator data, checking it was produced for rpId with the user present.
+func parseAuthenticatorData(data []byte, rpId string) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, errors.New("authenticator data too short")
+	}
+
+	authData := authenticatorData{
+		RpIdHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	rpIdHash := sha256.Sum256([]byte(rpId))
+
+	if subtle.ConstantTimeCompare(authData.RpIdHash, rpIdHash[:]) != 1 {
+		return authenticatorData{}, errors.New("relying party invalid")
+	} else if authData.Flags&authDataUserPresent == 0 {
+		return authenticatorData{}, errors.New("user not present")
+	}
+
+	if authData.Flags&authDataAttestedCredentialData == 0 {
+		return authData, nil
+	}
+
+	// Attested credential data is a 16 byte AAGUID, a 2 byte length, the credential id and its COSE public key
+	rest := data[37:]
+
+	if len(rest) < 18 {
+		return authenticatorData{}, errors.New("attested credential data too short")
+	}
+
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+
+	if len(rest) < idLength {
+		return authenticatorData{}, errors.New("credential id too short")
+	}
+
+	authData.CredentialId = rest[:idLength]
+
+	var publicKey cbor.RawMessage
+	err := cbor.NewDecoder(bytes.NewReader(rest[idLength:])).Decode(&publicKey)
+
+	if err != nil {
+		return authenticatorData{}, errors.New("credential public key invalid")
+	}
+
+	authData.PublicKey = publicKey
+
+	return authData, nil
+}
+
+// parseCosePublicKey parses a COSE encoded public key, returning it along with the algorithm it is used with.
+func parseCosePublicKey(data []byte) (crypto.PublicKey, int, error) {
+	var params map[int]interface{}
+	err := cbor.Unmarshal(data, &params)
+
+	if err != nil {
+		return nil, 0, errors.New("public key invalid")
+	}
+
+	kty, _ := params[coseKty].(uint64)
+	alg, _ := params[coseAlg].(int64)
+	bytesParam := func(label int) []byte {
+		value, _ := params[label].([]byte)
+		return value
+	}
+
+	switch {
+	case kty == coseKtyEc2 && alg == coseAlgES256:
+		if crv, _ := params[-1].(uint64); crv != coseCrvP256 {
+			return nil, 0, errors.New("curve unsupported")
+		}
+
+		x := new(big.Int).SetBytes(bytesParam(-2))
+		y := new(big.Int).SetBytes(bytesParam(-3))
+
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, 0, errors.New("public key invalid")
+		}
+
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, coseAlgES256, nil
+	case kty == coseKtyOkp && alg == coseAlgEdDSA:
+		if crv, _ := params[-1].(uint64); crv != coseCrvEd25519 {
+			return nil, 0, errors.New("curve unsupported")
+		}
+
+		x := bytesParam(-2)
+
+		if len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("public key invalid")
+		}
+
+		return ed25519.PublicKey(x), coseAlgEdDSA, nil
+	case kty == coseKtyRsa && alg == coseAlgRS256:
+		n := new(big.Int).SetBytes(bytesParam(-1))
+		e := new(big.Int).SetBytes(bytesParam(-2))
+
+		if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 {
+			return nil, 0, errors.New("public key invalid")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, coseAlgRS256, nil
+	default:
+		return nil, 0, errors.New("algorithm unsupported")
+	}
+}
+
+// verifyCoseSignature verifies signature over data was made by the private key of a COSE encoded public key.
+func verifyCoseSignature(publicKey []byte, data []byte, signature []byte) error {
+	key, alg, err := parseCosePublicKey(publicKey)
+
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(data)
+
+	switch alg {
+	case coseAlgES256:
+		if !ecdsa.VerifyASN1(key.(*ecdsa.PublicKey), digest[:], signature) {
+			return errors.New("signature invalid")
+		}
+	case coseAlgEdDSA:
+		if !ed25519.Verify(key.(ed25519.PublicKey), data, signature) {
+			return errors.New("signature invalid")
+		}
+	case coseAlgRS256:
+		err = rsa.VerifyPKCS1v15(key.(*rsa.PublicKey), crypto.SHA256, digest[:], signature)
+
+		if err != nil {
+			return errors.New("signature invalid")
+		}
+	}
+
+	return nil
+}
+
+// verifyAttestation verifies the attestation object of a registration ceremony, returning the authenticator data
+// describing the new credential. Attestation statements aren't verified, the service requests none and accepts any
+// authenticator.
+func verifyAttestation(raw []byte, rpId string) (authenticatorData, error) {
+	var attestation attestationObject
+	err := cbor.Unmarshal(raw, &attestation)
+
+	if err != nil {
+		return authenticatorData{}, errors.New("attestation object invalid")
+	}
+
+	authData, err := parseAuthenticatorData(attestation.AuthData, rpId)
+
+	if err != nil {
+		return authenticatorData{}, err
+	} else if authData.Flags&authDataAttestedCredentialData == 0 {
+		return authenticatorData{}, errors.New("attested credential data missing")
+	} else if authData.Flags&authDataUserVerified == 0 {
+		return authenticatorData{}, errors.New("user not verified")
+	}
+
+	_, _, err = parseCosePublicKey(authData.PublicKey)
+
+	if err != nil {
+		return authenticatorData{}, err
+	}
+
+	return authData, nil
+}
+
+// verifyAssertion verifies the signature of a login ceremony against a credential, returning the authenticator data.
+// The user must have been verified by the authenticator, so the credential alone is enough to log in.
+func verifyAssertion(credential WebAuthnCredential, rawAuthData []byte, rawClientData []byte, signature []byte,
+	rpId string) (authenticatorData, error) {
+	authData, err := parseAuthenticatorData(rawAuthData, rpId)
+
+	if err != nil {
+		return authenticatorData{}, err
+	} else if authData.Flags&authDataUserVerified == 0 {
+		return authenticatorData{}, errors.New("user not verified")
+	}
+
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append(make([]byte, 0, len(rawAuthData)+len(clientDataHash)), rawAuthData...), clientDataHash[:]...)
+
+	err = verifyCoseSignature(credential.PublicKey, signed, signature)
+
+	if err != nil {
+		return authenticatorData{}, err
+	}
+
+	// Authenticators that keep a signature counter must report a higher value each time, otherwise the credential may
+	// have been cloned
+	if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+		return authenticatorData{}, errors.New("signature counter invalid")
+	}
+
+	return authData, nil
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+type credentialsResponse struct {
+	Credentials []WebAuthnCredential `json:"credentials"`
+}
+
+func (cr credentialsResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// ListWebAuthnCredentialsMiddleware middleware to retrieve the passkeys registered by the authenticated user.
+func ListWebAuthnCredentialsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewUnauthorizedErr("unauthorized"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("repo not found"))
+			return
+		}
+
+		credentials, err := userRepo.GetWebAuthnCredentials(user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "webAuthnCredentials", credentialsResponse{credentials})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RemoveWebAuthnCredentialMiddleware middleware to remove one of the authenticated user's passkeys, after which it can
+// no longer log in. The passkeys left are passed on.
+func RemoveWebAuthnCredentialMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewUnauthorizedErr("unauthorized"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("repo not found"))
+			return
+		}
+
+		err := userRepo.RemoveWebAuthnCredential(user.Id, chi.URLParam(r, "credentialId"))
+
+		if errors.Is(err, errCredentialNotFound) {
+			RenderResponse(w, r, NewNotFoundErr("credential not found"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		ListWebAuthnCredentialsMiddleware(next).ServeHTTP(w, r)
+	})
+}
+
+// WebAuthnCredentials renders the authenticated user's passkeys.
+func WebAuthnCredentials(w http.ResponseWriter, r *http.Request) {
+	res, ok := r.Context().Value("webAuthnCredentials").(credentialsResponse)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, res)
+}
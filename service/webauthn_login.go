@@ -0,0 +1,261 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// credentialRequestOptions are the options passed to navigator.credentials.get, in the JSON form accepted by
+// PublicKeyCredential.parseRequestOptionsFromJSON.
+type credentialRequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RpId             string                 `json:"rpId"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+type beginLoginResponse struct {
+	PublicKey credentialRequestOptions `json:"publicKey"`
+}
+
+func (blr beginLoginResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+type assertionResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle"`
+}
+
+type finishLoginRequest struct {
+	Id       string            `json:"id"`
+	Type     string            `json:"type"`
+	Response assertionResponse `json:"response"`
+}
+
+// BeginWebAuthnLoginMiddleware middleware to start a passwordless login. The user is identified by the discoverable
+// credential they choose, so no credentials are listed.
+func BeginWebAuthnLoginMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		if config.GetWebAuthnRpId() == "" {
+			RenderResponse(w, r, NewNotFoundErr("WebAuthn is not enabled"))
+			return
+		}
+
+		tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		challenge, err := tokenFactory.NewChallengeToken(NewChallengeClaims("", webAuthnLoginPurpose, webAuthnTimeout))
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		options := credentialRequestOptions{
+			Challenge:        base64.RawURLEncoding.EncodeToString([]byte(challenge)),
+			Timeout:          webAuthnTimeout.Milliseconds(),
+			RpId:             config.GetWebAuthnRpId(),
+			AllowCredentials: make([]credentialDescriptor, 0),
+			UserVerification: "required",
+		}
+
+		ctx := context.WithValue(r.Context(), "webAuthnOptions", beginLoginResponse{options})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// BeginWebAuthnLogin renders the options for requesting an assertion.
+func BeginWebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+	res, ok := r.Context().Value("webAuthnOptions").(beginLoginResponse)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, res)
+}
+
+// FinishWebAuthnLoginMiddleware middleware to authenticate a user from an assertion made with one of their credentials
+func FinishWebAuthnLoginMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req finishLoginRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil || req.Type != "public-key" || req.Id == "" {
+			RenderResponse(w, r, NewBadRequestErr("request body invalid"))
+			return
+		}
+
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		if config.GetWebAuthnRpId() == "" {
+			RenderResponse(w, r, NewNotFoundErr("WebAuthn is not enabled"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("repo not found"))
+			return
+		}
+
+		tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		clientData, err := decodeBase64Url(req.Response.ClientDataJSON)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("clientDataJSON invalid"))
+			return
+		}
+
+		authData, err := decodeBase64Url(req.Response.AuthenticatorData)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("authenticatorData invalid"))
+			return
+		}
+
+		signature, err := decodeBase64Url(req.Response.Signature)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("signature invalid"))
+			return
+		}
+
+		credentialId, err := decodeBase64Url(req.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("id invalid"))
+			return
+		}
+
+		userHandle, err := decodeBase64Url(req.Response.UserHandle)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("userHandle invalid"))
+			return
+		}
+
+		challenge, err := verifyClientData(clientData, "webauthn.get", config.GetWebAuthnOrigins())
+
+		if err != nil {
+			RenderResponse(w, r, NewUnauthorizedErr(err.Error()))
+			return
+		}
+
+		challengeClaims, err := parseChallengeToken(tokenFactory, challenge, webAuthnLoginPurpose)
+
+		if err != nil {
+			RenderResponse(w, r, NewUnauthorizedErr("challenge invalid"))
+			return
+		}
+
+		credential, err := userRepo.GetWebAuthnCredential(base64.RawURLEncoding.EncodeToString(credentialId))
+
+		if errors.Is(err, errCredentialNotFound) {
+			RenderResponse(w, r, NewUnauthorizedErr("login failed"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		if len(userHandle) > 0 && string(userHandle) != credential.UserId {
+			RenderResponse(w, r, NewUnauthorizedErr("login failed"))
+			return
+		}
+
+		verified, err := verifyAssertion(credential, authData, clientData, signature, config.GetWebAuthnRpId())
+
+		if err != nil {
+			RenderResponse(w, r, NewUnauthorizedErr("login failed"))
+			return
+		}
+
+		// Many authenticators always report a sign count of zero, so the challenge is what stops an assertion being
+		// replayed.
+		err = userRepo.UseChallenge(challengeClaims.Jti, time.Unix(challengeClaims.Exp, 0))
+
+		if errors.Is(err, errChallengeUsed) {
+			RenderResponse(w, r, NewUnauthorizedErr("challenge invalid"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = userRepo.UseWebAuthnCredential(credential.Id, verified.SignCount)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		user, err := userRepo.GetUser(credential.UserId)
+
+		if errors.Is(err, errUserNotFound) {
+			RenderResponse(w, r, NewUnauthorizedErr("login failed"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		err = checkAccountStatus(user)
+
+		if err == nil {
+			err = checkEmailVerified(config, user)
+		}
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		// A user verifying passkey is already two factors, so TOTP isn't asked for
+		token, refreshToken, err := startSession(r.Context(), user, "", "")
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "token", token)
+		ctx = context.WithValue(ctx, "refreshToken", refreshToken)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,331 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+type relyingPartyEntity struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type userEntity struct {
+	Id          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type credentialParameters struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+type authenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// credentialCreationOptions are the options passed to navigator.credentials.create, in the JSON form accepted by
+// PublicKeyCredential.parseCreationOptionsFromJSON.
+type credentialCreationOptions struct {
+	Rp                     relyingPartyEntity     `json:"rp"`
+	User                   userEntity             `json:"user"`
+	Challenge              string                 `json:"challenge"`
+	PubKeyCredParams       []credentialParameters `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection authenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+type beginRegistrationResponse struct {
+	PublicKey credentialCreationOptions `json:"publicKey"`
+}
+
+func (brr beginRegistrationResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+type attestationResponse struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+type finishRegistrationRequest struct {
+	Name       string `json:"name"`
+	Credential struct {
+		Id       string              `json:"id"`
+		Type     string              `json:"type"`
+		Response attestationResponse `json:"response"`
+	} `json:"credential"`
+}
+
+type credentialResponse struct {
+	WebAuthnCredential
+}
+
+func (cr credentialResponse) Render(w http.ResponseWriter, _ *http.Request) error {
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// BeginWebAuthnRegistrationMiddleware middleware to start registering a passkey for the authenticated user. Since the
+// passkey will stand in for both their password and second factor, the user must confirm their password along with a
+// TOTP or recovery code if they have enabled two-factor authentication.
+func BeginWebAuthnRegistrationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req confirmIdentityRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("request body invalid"))
+			return
+		}
+
+		user, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewUnauthorizedErr("unauthorized"))
+			return
+		}
+
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		if config.GetWebAuthnRpId() == "" {
+			RenderResponse(w, r, NewNotFoundErr("WebAuthn is not enabled"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("repo not found"))
+			return
+		}
+
+		tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		err = confirmIdentity(r, user.Id, req)
+
+		if err != nil {
+			RenderError(w, r, err)
+			return
+		}
+
+		credentials, err := userRepo.GetWebAuthnCredentials(user.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		// The challenge is a signed token so nothing needs to be stored between the two steps of the ceremony
+		challenge, err := tokenFactory.NewChallengeToken(
+			NewChallengeClaims(user.Id, webAuthnRegisterPurpose, webAuthnTimeout))
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		options := credentialCreationOptions{
+			Rp: relyingPartyEntity{config.GetWebAuthnRpId(), serviceName},
+			User: userEntity{
+				Id:          base64.RawURLEncoding.EncodeToString([]byte(user.Id)),
+				Name:        user.Email,
+				DisplayName: user.Username,
+			},
+			Challenge:          base64.RawURLEncoding.EncodeToString([]byte(challenge)),
+			PubKeyCredParams:   make([]credentialParameters, 0, len(webAuthnAlgorithms)),
+			Timeout:            webAuthnTimeout.Milliseconds(),
+			ExcludeCredentials: make([]credentialDescriptor, 0, len(credentials)),
+			AuthenticatorSelection: authenticatorSelection{
+				ResidentKey:        "required",
+				RequireResidentKey: true,
+				UserVerification:   "required",
+			},
+			Attestation: "none",
+		}
+
+		for _, alg := range webAuthnAlgorithms {
+			options.PubKeyCredParams = append(options.PubKeyCredParams, credentialParameters{"public-key", alg})
+		}
+
+		for _, credential := range credentials {
+			options.ExcludeCredentials = append(options.ExcludeCredentials,
+				credentialDescriptor{"public-key", credential.Id})
+		}
+
+		ctx := context.WithValue(r.Context(), "webAuthnOptions", beginRegistrationResponse{options})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// BeginWebAuthnRegistration renders the options for creating a credential.
+func BeginWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	res, ok := r.Context().Value("webAuthnOptions").(beginRegistrationResponse)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, res)
+}
+
+// FinishWebAuthnRegistrationMiddleware middleware to verify and store a credential created by the authenticated user
+func FinishWebAuthnRegistrationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req finishRegistrationRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+
+		if err != nil || req.Credential.Type != "public-key" {
+			RenderResponse(w, r, NewBadRequestErr("request body invalid"))
+			return
+		}
+
+		user, ok := r.Context().Value("user").(User)
+
+		if !ok {
+			RenderResponse(w, r, NewUnauthorizedErr("unauthorized"))
+			return
+		}
+
+		config, ok := r.Context().Value("config").(Configuration)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		if config.GetWebAuthnRpId() == "" {
+			RenderResponse(w, r, NewNotFoundErr("WebAuthn is not enabled"))
+			return
+		}
+
+		userRepo, ok := r.Context().Value("repo").(UserRepository)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("repo not found"))
+			return
+		}
+
+		tokenFactory, ok := r.Context().Value("tokenFactory").(TokenFactory)
+
+		if !ok {
+			RenderResponse(w, r, NewInternalServerErr("internal error"))
+			return
+		}
+
+		clientData, err := decodeBase64Url(req.Credential.Response.ClientDataJSON)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("clientDataJSON invalid"))
+			return
+		}
+
+		rawAttestation, err := decodeBase64Url(req.Credential.Response.AttestationObject)
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr("attestationObject invalid"))
+			return
+		}
+
+		challenge, err := verifyClientData(clientData, "webauthn.create", config.GetWebAuthnOrigins())
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr(err.Error()))
+			return
+		}
+
+		claims, err := parseChallengeToken(tokenFactory, challenge, webAuthnRegisterPurpose)
+
+		if err != nil || claims.Sub != user.Id {
+			RenderResponse(w, r, NewBadRequestErr("challenge invalid"))
+			return
+		}
+
+		authData, err := verifyAttestation(rawAttestation, config.GetWebAuthnRpId())
+
+		if err != nil {
+			RenderResponse(w, r, NewBadRequestErr(err.Error()))
+			return
+		}
+
+		// Each confirmation of the user's identity registers a single passkey.
+		err = userRepo.UseChallenge(claims.Jti, time.Unix(claims.Exp, 0))
+
+		if errors.Is(err, errChallengeUsed) {
+			RenderResponse(w, r, NewBadRequestErr("challenge invalid"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		credential := WebAuthnCredential{
+			Id:        base64.RawURLEncoding.EncodeToString(authData.CredentialId),
+			UserId:    user.Id,
+			Name:      req.Name,
+			PublicKey: authData.PublicKey,
+			SignCount: authData.SignCount,
+		}
+
+		err = userRepo.AddWebAuthnCredential(credential)
+
+		if errors.Is(err, errCredentialExists) {
+			RenderResponse(w, r, NewBadRequestErr("credential already registered"))
+			return
+		} else if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		credential, err = userRepo.GetWebAuthnCredential(credential.Id)
+
+		if err != nil {
+			RenderResponse(w, r, NewInternalServerErr("repo error"))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "webAuthnCredential", credentialResponse{credential})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// FinishWebAuthnRegistration renders the registered credential.
+func FinishWebAuthnRegistration(w http.ResponseWriter, r *http.Request) {
+	res, ok := r.Context().Value("webAuthnCredential").(credentialResponse)
+
+	if !ok {
+		RenderResponse(w, r, NewInternalServerErr("internal error"))
+		return
+	}
+
+	RenderResponse(w, r, res)
+}
@@ -0,0 +1,378 @@
+package service_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/stone1549/yapyapyap/auth/service"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// softwareAuthenticator is a minimal WebAuthn authenticator holding a single ES256 credential.
+type softwareAuthenticator struct {
+	rpId         string
+	origin       string
+	credentialId []byte
+	key          *ecdsa.PrivateKey
+	userHandle   []byte
+	signCount    uint32
+	// fixedCount is set for authenticators that always report a sign count of zero, as many synced passkeys do
+	fixedCount bool
+}
+
+func newSoftwareAuthenticator(t *testing.T) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ok(t, err)
+
+	credentialId := make([]byte, 16)
+	_, err = rand.Read(credentialId)
+	ok(t, err)
+
+	return &softwareAuthenticator{
+		rpId:         "localhost",
+		origin:       "http://localhost:3333",
+		credentialId: credentialId,
+		key:          key,
+	}
+}
+
+type webAuthnOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		RpId      string `json:"rpId"`
+		Rp        struct {
+			Id string `json:"id"`
+		} `json:"rp"`
+		User struct {
+			Id string `json:"id"`
+		} `json:"user"`
+		ExcludeCredentials []struct {
+			Id string `json:"id"`
+		} `json:"excludeCredentials"`
+	} `json:"publicKey"`
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (sa *softwareAuthenticator) clientData(t *testing.T, ceremonyType string, challenge string) []byte {
+	clientData, err := json.Marshal(map[string]interface{}{
+		"type":      ceremonyType,
+		"challenge": challenge,
+		"origin":    sa.origin,
+	})
+	ok(t, err)
+	return clientData
+}
+
+func (sa *softwareAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(sa.rpId))
+	data := append([]byte{}, rpIdHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, sa.signCount)
+	return append(data, attested...)
+}
+
+// create performs the authenticator side of a registration ceremony with "none" attestation.
+func (sa *softwareAuthenticator) create(t *testing.T, options webAuthnOptions) map[string]interface{} {
+	userHandle, err := base64.RawURLEncoding.DecodeString(options.PublicKey.User.Id)
+	ok(t, err)
+	sa.userHandle = userHandle
+
+	publicKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,
+		3:  -7,
+		-1: 1,
+		-2: sa.key.X.FillBytes(make([]byte, 32)),
+		-3: sa.key.Y.FillBytes(make([]byte, 32)),
+	})
+	ok(t, err)
+
+	attested := make([]byte, 16)
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(sa.credentialId)))
+	attested = append(attested, sa.credentialId...)
+	attested = append(attested, publicKey...)
+
+	attestation, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": sa.authData(0x45, attested),
+	})
+	ok(t, err)
+
+	return map[string]interface{}{
+		"id":    b64(sa.credentialId),
+		"rawId": b64(sa.credentialId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(sa.clientData(t, "webauthn.create", options.PublicKey.Challenge)),
+			"attestationObject": b64(attestation),
+		},
+	}
+}
+
+// get performs the authenticator side of a login ceremony, signing with the given flags.
+func (sa *softwareAuthenticator) get(t *testing.T, options webAuthnOptions, flags byte) map[string]interface{} {
+	if !sa.fixedCount {
+		sa.signCount++
+	}
+
+	authData := sa.authData(flags, nil)
+	clientData := sa.clientData(t, "webauthn.get", options.PublicKey.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, sa.key, digest[:])
+	ok(t, err)
+
+	return map[string]interface{}{
+		"id":    b64(sa.credentialId),
+		"rawId": b64(sa.credentialId),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+			"userHandle":        b64(sa.userHandle),
+		},
+	}
+}
+
+func newWebAuthnTestServer(t *testing.T) *testServer {
+	ts := newSessionTestServer(t)
+	ts.router.Route("/webauthn", func(r chi.Router) {
+		r.With(service.JwtAuthMiddleware).With(service.BeginWebAuthnRegistrationMiddleware).
+			Post("/register/begin", service.BeginWebAuthnRegistration)
+		r.With(service.JwtAuthMiddleware).With(service.FinishWebAuthnRegistrationMiddleware).
+			Post("/register/finish", service.FinishWebAuthnRegistration)
+		r.With(service.JwtAuthMiddleware).With(service.ListWebAuthnCredentialsMiddleware).
+			Get("/credentials", service.WebAuthnCredentials)
+		r.With(service.JwtAuthMiddleware).With(service.RemoveWebAuthnCredentialMiddleware).
+			Delete("/credentials/{credentialId}", service.WebAuthnCredentials)
+		r.With(service.BeginWebAuthnLoginMiddleware).Post("/login/begin", service.BeginWebAuthnLogin)
+		r.With(service.FinishWebAuthnLoginMiddleware).Post("/login/finish", service.NewSession)
+	})
+	return ts
+}
+
+// registerPasskey registers the authenticator's credential for the test user.
+func registerPasskey(t *testing.T, ts *testServer, authenticator *softwareAuthenticator, token string) {
+	var options webAuthnOptions
+	status := ts.do(t, http.MethodPost, "/webauthn/register/begin", token, map[string]string{"password": "password"},
+		&options)
+	equals(t, http.StatusOK, status)
+	equals(t, "localhost", options.PublicKey.Rp.Id)
+
+	var credential struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	}
+	status = ts.do(t, http.MethodPost, "/webauthn/register/finish", token, map[string]interface{}{
+		"name":       "laptop",
+		"credential": authenticator.create(t, options),
+	}, &credential)
+	equals(t, http.StatusOK, status)
+	equals(t, b64(authenticator.credentialId), credential.Id)
+	equals(t, "laptop", credential.Name)
+}
+
+func beginPasskeyLogin(t *testing.T, ts *testServer) webAuthnOptions {
+	var options webAuthnOptions
+	status := ts.do(t, http.MethodPost, "/webauthn/login/begin", "", nil, &options)
+	equals(t, http.StatusOK, status)
+	equals(t, "localhost", options.PublicKey.RpId)
+	return options
+}
+
+// TestWebAuthn_RegisterAndLogin ensures a registered passkey can log in without a password.
+func TestWebAuthn_RegisterAndLogin(t *testing.T) {
+	ts := newWebAuthnTestServer(t)
+	authenticator := newSoftwareAuthenticator(t)
+	token := login(t, ts).Token
+	registerPasskey(t, ts, authenticator, token)
+
+	var options webAuthnOptions
+	status := ts.do(t, http.MethodPost, "/webauthn/register/begin", token, map[string]string{"password": "password"},
+		&options)
+	equals(t, http.StatusOK, status)
+	equals(t, 1, len(options.PublicKey.ExcludeCredentials))
+
+	// Registering the same credential twice is rejected.
+	status = ts.do(t, http.MethodPost, "/webauthn/register/finish", token, map[string]interface{}{
+		"credential": authenticator.create(t, options),
+	}, nil)
+	equals(t, http.StatusBadRequest, status)
+
+	var tokens sessionTokens
+	status = ts.do(t, http.MethodPost, "/webauthn/login/finish", "",
+		authenticator.get(t, beginPasskeyLogin(t, ts), 0x05), &tokens)
+	equals(t, http.StatusOK, status)
+	assert(t, tokens.Token != "", "expected token")
+	assert(t, tokens.RefreshToken != "", "expected refresh token")
+
+	claims, err := ts.tokenFactory.ParseToken(tokens.Token)
+	ok(t, err)
+	assert(t, claims.Valid, "expected valid token")
+}
+
+// TestWebAuthn_LoginRejected ensures assertions that fail verification don't log in.
+func TestWebAuthn_LoginRejected(t *testing.T) {
+	ts := newWebAuthnTestServer(t)
+	authenticator := newSoftwareAuthenticator(t)
+	registerPasskey(t, ts, authenticator, login(t, ts).Token)
+
+	// The user must be verified by the authenticator.
+	status := ts.do(t, http.MethodPost, "/webauthn/login/finish", "",
+		authenticator.get(t, beginPasskeyLogin(t, ts), 0x01), nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	// Assertions for another relying party are rejected.
+	authenticator.rpId = "evil.example.com"
+	status = ts.do(t, http.MethodPost, "/webauthn/login/finish", "",
+		authenticator.get(t, beginPasskeyLogin(t, ts), 0x05), nil)
+	equals(t, http.StatusUnauthorized, status)
+	authenticator.rpId = "localhost"
+
+	// Challenges must have been issued by the service.
+	forged := beginPasskeyLogin(t, ts)
+	forged.PublicKey.Challenge = b64([]byte("forged"))
+	status = ts.do(t, http.MethodPost, "/webauthn/login/finish", "", authenticator.get(t, forged, 0x05), nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	// A signature counter that goes backwards suggests a cloned credential.
+	status = ts.do(t, http.MethodPost, "/webauthn/login/finish", "",
+		authenticator.get(t, beginPasskeyLogin(t, ts), 0x05), nil)
+	equals(t, http.StatusOK, status)
+	authenticator.signCount -= 2
+	status = ts.do(t, http.MethodPost, "/webauthn/login/finish", "",
+		authenticator.get(t, beginPasskeyLogin(t, ts), 0x05), nil)
+	equals(t, http.StatusUnauthorized, status)
+
+	// Unknown credentials can't log in.
+	other := newSoftwareAuthenticator(t)
+	other.userHandle = authenticator.userHandle
+	status = ts.do(t, http.MethodPost, "/webauthn/login/finish", "", other.get(t, beginPasskeyLogin(t, ts), 0x05), nil)
+	equals(t, http.StatusUnauthorized, status)
+}
+
+// TestWebAuthn_LoginReplayed ensures an assertion can't be used twice, even from an authenticator whose sign count
+// never changes.
+func TestWebAuthn_LoginReplayed(t *testing.T) {
+	ts := newWebAuthnTestServer(t)
+	authenticator := newSoftwareAuthenticator(t)
+	authenticator.fixedCount = true
+	registerPasskey(t, ts, authenticator, login(t, ts).Token)
+
+	assertion := authenticator.get(t, beginPasskeyLogin(t, ts), 0x05)
+	equals(t, http.StatusOK, ts.do(t, http.MethodPost, "/webauthn/login/finish", "", assertion, nil))
+	equals(t, http.StatusUnauthorized, ts.do(t, http.MethodPost, "/webauthn/login/finish", "", assertion, nil))
+
+	status := ts.do(t, http.MethodPost, "/webauthn/login/finish", "",
+		authenticator.get(t, beginPasskeyLogin(t, ts), 0x05), nil)
+	equals(t, http.StatusOK, status)
+}
+
+// TestWebAuthn_LoginUnverifiedEmail ensures passkeys can't log in to accounts whose email address must be verified
+// first, just like passwords.
+func TestWebAuthn_LoginUnverifiedEmail(t *testing.T) {
+	ts := newWebAuthnTestServer(t)
+	authenticator := newSoftwareAuthenticator(t)
+	registerPasskey(t, ts, authenticator, login(t, ts).Token)
+	ts.config = verifiedEmailConfiguration{ts.config}
+
+	status := ts.do(t, http.MethodPost, "/webauthn/login/finish", "",
+		authenticator.get(t, beginPasskeyLogin(t, ts), 0x05), nil)
+	equals(t, http.StatusForbidden, status)
+}
+
+// TestWebAuthn_RegisterConfirmed ensures an access token alone can't register a passkey, the user must confirm their
+// password along with their second factor when enabled.
+func TestWebAuthn_RegisterConfirmed(t *testing.T) {
+	ts := newWebAuthnTestServer(t)
+	ts.router.Route("/user/mfa/totp", func(r chi.Router) {
+		r.Use(service.JwtAuthMiddleware)
+		r.With(service.EnrollTotpMiddleware).Post("/", service.EnrollTotp)
+		r.With(service.ConfirmTotpMiddleware).Post("/confirm", service.TotpStatus)
+	})
+	token := login(t, ts).Token
+
+	status := ts.do(t, http.MethodPost, "/webauthn/register/begin", token, map[string]string{}, nil)
+	equals(t, http.StatusBadRequest, status)
+	status = ts.do(t, http.MethodPost, "/webauthn/register/begin", token, map[string]string{"password": "wrong"}, nil)
+	equals(t, http.StatusForbidden, status)
+
+	secret, recoveryCodes := enableTotp(t, ts, token)
+
+	status = ts.do(t, http.MethodPost, "/webauthn/register/begin", token,
+		map[string]string{"password": "password"}, nil)
+	equals(t, http.StatusBadRequest, status)
+	status = ts.do(t, http.MethodPost, "/webauthn/register/begin", token,
+		map[string]string{"password": "password", "code": "000000"}, nil)
+	equals(t, http.StatusUnauthorized, status)
+	status = ts.do(t, http.MethodPost, "/webauthn/register/begin", token,
+		map[string]string{"password": "password", "code": totpCodeAt(t, secret, time.Now().Add(30*time.Second))}, nil)
+	equals(t, http.StatusOK, status)
+	status = ts.do(t, http.MethodPost, "/webauthn/register/begin", token,
+		map[string]string{"password": "password", "recoveryCode": recoveryCodes[0]}, nil)
+	equals(t, http.StatusOK, status)
+}
+
+// TestWebAuthn_RegisterChallengeUsed ensures confirming the user's identity registers a single passkey.
+func TestWebAuthn_RegisterChallengeUsed(t *testing.T) {
+	ts := newWebAuthnTestServer(t)
+	token := login(t, ts).Token
+
+	var options webAuthnOptions
+	status := ts.do(t, http.MethodPost, "/webauthn/register/begin", token, map[string]string{"password": "password"},
+		&options)
+	equals(t, http.StatusOK, status)
+
+	status = ts.do(t, http.MethodPost, "/webauthn/register/finish", token, map[string]interface{}{
+		"credential": newSoftwareAuthenticator(t).create(t, options),
+	}, nil)
+	equals(t, http.StatusOK, status)
+	status = ts.do(t, http.MethodPost, "/webauthn/register/finish", token, map[string]interface{}{
+		"credential": newSoftwareAuthenticator(t).create(t, options),
+	}, nil)
+	equals(t, http.StatusBadRequest, status)
+}
+
+// TestWebAuthn_Credentials ensures users can list their passkeys and remove them, after which they can't log in.
+func TestWebAuthn_Credentials(t *testing.T) {
+	ts := newWebAuthnTestServer(t)
+	authenticator := newSoftwareAuthenticator(t)
+	token := login(t, ts).Token
+	registerPasskey(t, ts, authenticator, token)
+
+	var credentials struct {
+		Credentials []struct {
+			Id   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"credentials"`
+	}
+	status := ts.do(t, http.MethodGet, "/webauthn/credentials", token, nil, &credentials)
+	equals(t, http.StatusOK, status)
+	equals(t, 1, len(credentials.Credentials))
+	equals(t, b64(authenticator.credentialId), credentials.Credentials[0].Id)
+	equals(t, "laptop", credentials.Credentials[0].Name)
+
+	status = ts.do(t, http.MethodDelete, "/webauthn/credentials/"+credentials.Credentials[0].Id, token, nil,
+		&credentials)
+	equals(t, http.StatusOK, status)
+	equals(t, 0, len(credentials.Credentials))
+	status = ts.do(t, http.MethodDelete, "/webauthn/credentials/"+b64(authenticator.credentialId), token, nil, nil)
+	equals(t, http.StatusNotFound, status)
+
+	status = ts.do(t, http.MethodPost, "/webauthn/login/finish", "",
+		authenticator.get(t, beginPasskeyLogin(t, ts), 0x05), nil)
+	equals(t, http.StatusUnauthorized, status)
+}
@@ -0,0 +1,119 @@
+package verifier
+
+import (
+	"errors"
+	"github.com/golang-jwt/jwt"
+)
+
+var (
+	// ErrInvalidClaims is returned when a token is missing claims required of tokens issued by the auth service.
+	ErrInvalidClaims = errors.New("token claims invalid")
+	// ErrDelegatedToken is returned when a token issued to an OAuth client is presented where only tokens from direct
+	// logins are accepted.
+	ErrDelegatedToken = errors.New("token issued to an oauth client")
+)
+
+// Claims holds the claims of a validated auth service token.
+type Claims struct {
+	// Subject is the globally unique id of the user the token was issued to.
+	Subject string
+	// Email is the subject's email address.
+	Email string
+	// Username is the subject's username.
+	Username string
+	// EmailVerified reports whether the subject has verified their email address.
+	EmailVerified bool
+	// Roles are the names of the roles granted to the subject.
+	Roles []string
+	// SessionId is the id of the session the token was issued for.
+	SessionId string
+	// TokenId is the unique id of the token.
+	TokenId string
+	// ClientId is the OAuth client the token was issued to, empty for tokens from direct logins.
+	ClientId string
+	// Scope is the space separated OAuth scope granted to the token.
+	Scope string
+}
+
+// IsClient reports whether the token was issued to an OAuth client acting on its own behalf rather than to a user, in
+// which case Subject is the client id and there is no Email, Username or SessionId.
+func (c Claims) IsClient() bool {
+	return c.ClientId != "" && c.SessionId == ""
+}
+
+// HasRole reports whether the subject was granted role when the token was issued.
+func (c Claims) HasRole(role string) bool {
+	for _, granted := range c.Roles {
+		if granted == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseClaims extracts the claims from a parsed token, ensuring the token is valid and carries every claim the auth
+// service includes in the tokens it issues. Tokens issued to OAuth clients are refused with ErrDelegatedToken, since
+// they only grant the access in their scope.
+func ParseClaims(token *jwt.Token) (Claims, error) {
+	claims, err := ParseDelegatedClaims(token)
+
+	if err != nil {
+		return Claims{}, err
+	} else if claims.ClientId != "" {
+		return Claims{}, ErrDelegatedToken
+	}
+
+	return claims, nil
+}
+
+// ParseDelegatedClaims extracts the claims from a parsed token like ParseClaims, also accepting tokens issued to OAuth
+// clients. Callers must check the Scope of such tokens themselves.
+func ParseDelegatedClaims(token *jwt.Token) (Claims, error) {
+	mapClaims, ok := token.Claims.(jwt.MapClaims)
+
+	if !ok || !token.Valid {
+		return Claims{}, ErrInvalidClaims
+	}
+
+	var claims Claims
+
+	claims.TokenId, _ = mapClaims["jti"].(string)
+	claims.ClientId, _ = mapClaims["client_id"].(string)
+	claims.Scope, _ = mapClaims["scope"].(string)
+	claims.EmailVerified, _ = mapClaims["email_verified"].(bool)
+
+	if roles, ok := mapClaims["roles"].([]interface{}); ok {
+		for _, role := range roles {
+			name, ok := role.(string)
+
+			if !ok {
+				return Claims{}, ErrInvalidClaims
+			}
+
+			claims.Roles = append(claims.Roles, name)
+		}
+	} else if _, ok := mapClaims["roles"]; ok {
+		return Claims{}, ErrInvalidClaims
+	}
+
+	required := map[string]*string{"sub": &claims.Subject}
+
+	if _, ok := mapClaims["sid"]; ok || claims.ClientId == "" {
+		required["email"] = &claims.Email
+		required["username"] = &claims.Username
+		required["sid"] = &claims.SessionId
+	}
+
+	for name, dest := range required {
+		value, ok := mapClaims[name].(string)
+
+		if !ok || (name == "sid" && value == "") {
+			return Claims{}, ErrInvalidClaims
+		}
+
+		*dest = value
+	}
+
+	return claims, nil
+}
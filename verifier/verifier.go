@@ -0,0 +1,239 @@
+// Package verifier validates tokens issued by the auth service using the public keys it publishes at its JWKS
+// endpoint, so that other services never need access to the signing keys.
+//
+// Verification is stateless: a token belonging to a session that has since been revoked remains valid to a Verifier
+// until the token expires.
+package verifier
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKey is returned when a token is signed with a key that is not published by the auth service.
+var ErrUnknownKey = errors.New("signing key unknown")
+
+// minRefreshInterval limits how often an unknown key id can trigger a refetch of the key set.
+const minRefreshInterval = 10 * time.Second
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+type cachedKey struct {
+	alg       string
+	publicKey crypto.PublicKey
+}
+
+// Verifier validates auth service tokens against a cached copy of the service's JSON Web Key Set.
+type Verifier struct {
+	jwksUrl string
+	ttl     time.Duration
+	client  *http.Client
+	// refreshMutex serializes fetches of the key set, which happen without holding mutex so that tokens signed with
+	// cached keys are still verified while the auth service is slow to respond.
+	refreshMutex sync.Mutex
+	mutex        sync.RWMutex
+	keys         map[string]cachedKey
+	fetchedAt    time.Time
+	attemptedAt  time.Time
+}
+
+// NewVerifier constructs a Verifier that fetches keys from the given JWKS url, caching them for the given duration.
+func NewVerifier(jwksUrl string, ttl time.Duration) *Verifier {
+	return &Verifier{
+		jwksUrl: jwksUrl,
+		ttl:     ttl,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		keys:    make(map[string]cachedKey),
+	}
+}
+
+// Verify validates the given token string, returning its claims. Tokens issued to OAuth clients are refused with
+// ErrDelegatedToken.
+func (v *Verifier) Verify(tokenString string) (Claims, error) {
+	token, err := jwt.Parse(tokenString, v.keyFunc)
+
+	if err != nil {
+		return Claims{}, err
+	}
+
+	return ParseClaims(token)
+}
+
+// VerifyDelegated validates the given token string like Verify, also accepting tokens issued to OAuth clients. Callers
+// must check the Scope of such tokens themselves.
+func (v *Verifier) VerifyDelegated(tokenString string) (Claims, error) {
+	token, err := jwt.Parse(tokenString, v.keyFunc)
+
+	if err != nil {
+		return Claims{}, err
+	}
+
+	return ParseDelegatedClaims(token)
+}
+
+// Middleware rejects requests without a valid bearer token from a direct login, making the claims of valid tokens
+// available to later handlers through ClaimsFromContext. Tokens issued to OAuth clients are refused.
+func (v *Verifier) Middleware(next http.Handler) http.Handler {
+	return v.middleware(next, v.Verify)
+}
+
+// DelegatedMiddleware rejects requests without a valid bearer token like Middleware, also accepting tokens issued to
+// OAuth clients. Handlers behind it must check the Scope of the claims themselves.
+func (v *Verifier) DelegatedMiddleware(next http.Handler) http.Handler {
+	return v.middleware(next, v.VerifyDelegated)
+}
+
+func (v *Verifier) middleware(next http.Handler, verify func(string) (Claims, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := strings.Split(r.Header.Get("Authorization"), "Bearer ")
+		if len(authHeader) != 2 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := verify(authHeader[1])
+
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+	})
+}
+
+// ClaimsFromContext retrieves the claims stored by Middleware.
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(claimsContextKey).(Claims)
+	return claims, ok
+}
+
+func (v *Verifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+
+	key, err := v.key(kid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if key.alg != token.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+
+	return key.publicKey, nil
+}
+
+func (v *Verifier) key(kid string) (cachedKey, error) {
+	v.mutex.RLock()
+	key, ok := v.keys[kid]
+	fresh := time.Since(v.fetchedAt) < v.ttl
+	throttled := time.Since(v.attemptedAt) < minRefreshInterval
+	v.mutex.RUnlock()
+
+	if ok && (fresh || throttled) {
+		return key, nil
+	} else if !ok && throttled {
+		return cachedKey{}, ErrUnknownKey
+	}
+
+	err := v.refresh()
+
+	if err != nil {
+		if ok {
+			// Keep verifying with the stale key set rather than failing every request while the auth service is down.
+			return key, nil
+		}
+		return cachedKey{}, err
+	}
+
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	key, ok = v.keys[kid]
+
+	if !ok {
+		return cachedKey{}, ErrUnknownKey
+	}
+
+	return key, nil
+}
+
+func (v *Verifier) refresh() error {
+	v.refreshMutex.Lock()
+	defer v.refreshMutex.Unlock()
+
+	v.mutex.Lock()
+
+	if time.Since(v.attemptedAt) < minRefreshInterval {
+		// Another request refreshed the key set while this one waited.
+		v.mutex.Unlock()
+		return nil
+	}
+
+	v.attemptedAt = time.Now()
+	v.mutex.Unlock()
+
+	keys, err := v.fetchKeys()
+
+	if err != nil {
+		return err
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.keys = keys
+	v.fetchedAt = time.Now()
+
+	return nil
+}
+
+func (v *Verifier) fetchKeys() (map[string]cachedKey, error) {
+	res, err := v.client.Get(v.jwksUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching key set: %d", res.StatusCode)
+	}
+
+	var keySet JSONWebKeySet
+	err = json.NewDecoder(res.Body).Decode(&keySet)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]cachedKey)
+
+	for _, jwk := range keySet.Keys {
+		publicKey, err := jwk.PublicKey()
+
+		if err != nil {
+			continue
+		}
+
+		keys[jwk.Kid] = cachedKey{jwk.Alg, publicKey}
+	}
+
+	return keys, nil
+}
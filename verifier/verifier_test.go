@@ -0,0 +1,224 @@
+package verifier_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/golang-jwt/jwt"
+	"github.com/stone1549/yapyapyap/auth/verifier"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newKeySetServer(t *testing.T, keys ...verifier.JSONWebKey) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := json.NewEncoder(w).Encode(verifier.JSONWebKeySet{Keys: keys})
+		if err != nil {
+			t.Error(err)
+		}
+	}))
+}
+
+func newSignedToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS512, claims)
+	token.Header["kid"] = kid
+
+	tokenString, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tokenString
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":      "1",
+		"email":    "user@justinstone.net",
+		"username": "user",
+		"sid":      "session",
+		"jti":      "token",
+		"exp":      time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func newKey(t *testing.T) (*rsa.PrivateKey, verifier.JSONWebKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwk, err := verifier.NewJSONWebKey(&key.PublicKey, "RS512")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, jwk
+}
+
+// TestVerifier_Verify ensures a token signed with a published key is accepted.
+func TestVerifier_Verify(t *testing.T) {
+	key, jwk := newKey(t)
+	server := newKeySetServer(t, jwk)
+	defer server.Close()
+
+	claims, err := verifier.NewVerifier(server.URL, time.Minute).Verify(newSignedToken(t, key, jwk.Kid, validClaims()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != "1" || claims.SessionId != "session" || claims.TokenId != "token" {
+		t.Fatalf("unexpected claims %#v", claims)
+	}
+}
+
+// TestVerifier_VerifyUnknownKey ensures a token signed with an unpublished key is rejected.
+func TestVerifier_VerifyUnknownKey(t *testing.T) {
+	_, jwk := newKey(t)
+	otherKey, otherJwk := newKey(t)
+	server := newKeySetServer(t, jwk)
+	defer server.Close()
+
+	_, err := verifier.NewVerifier(server.URL, time.Minute).Verify(newSignedToken(t, otherKey, otherJwk.Kid,
+		validClaims()))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// TestVerifier_VerifyMissingClaims ensures a token without the claims issued by the auth service is rejected.
+func TestVerifier_VerifyMissingClaims(t *testing.T) {
+	key, jwk := newKey(t)
+	server := newKeySetServer(t, jwk)
+	defer server.Close()
+
+	claims := validClaims()
+	delete(claims, "sid")
+
+	_, err := verifier.NewVerifier(server.URL, time.Minute).Verify(newSignedToken(t, key, jwk.Kid, claims))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// TestVerifier_VerifyRoles ensures the roles claim is parsed, and rejected when it isn't a list of strings.
+func TestVerifier_VerifyRoles(t *testing.T) {
+	key, jwk := newKey(t)
+	server := newKeySetServer(t, jwk)
+	defer server.Close()
+
+	v := verifier.NewVerifier(server.URL, time.Minute)
+	claims := validClaims()
+	claims["roles"] = []string{"admin"}
+
+	parsed, err := v.Verify(newSignedToken(t, key, jwk.Kid, claims))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !parsed.HasRole("admin") || parsed.HasRole("moderator") {
+		t.Fatalf("unexpected roles %#v", parsed.Roles)
+	}
+
+	claims["roles"] = "admin"
+
+	_, err = v.Verify(newSignedToken(t, key, jwk.Kid, claims))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// TestJSONWebKey_PublicKey ensures a JSONWebKey round trips to the key it was created from.
+func TestJSONWebKey_PublicKey(t *testing.T) {
+	key, jwk := newKey(t)
+
+	publicKey, err := jwk.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !key.PublicKey.Equal(publicKey) {
+		t.Fatal("expected public keys to match")
+	}
+}
+
+// TestJSONWebKey_PublicKeyCurves ensures elliptic curve and Ed25519 JSONWebKeys round trip to their keys.
+func TestJSONWebKey_PublicKeyCurves(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p521, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	edPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	for alg, publicKey := range map[string]crypto.PublicKey{
+		"ES256": &p256.PublicKey,
+		"ES512": &p521.PublicKey,
+		"EdDSA": edPublic,
+	} {
+		jwk, err := verifier.NewJSONWebKey(publicKey, alg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := jwk.PublicKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !publicKey.(interface{ Equal(crypto.PublicKey) bool }).Equal(decoded) {
+			t.Fatalf("expected %s public keys to match", alg)
+		}
+	}
+}
+
+// TestVerifier_VerifyDelegated ensures tokens issued to OAuth clients are only accepted when asked for.
+func TestVerifier_VerifyDelegated(t *testing.T) {
+	key, jwk := newKey(t)
+	server := newKeySetServer(t, jwk)
+	defer server.Close()
+
+	v := verifier.NewVerifier(server.URL, time.Minute)
+	claims := validClaims()
+	claims["client_id"] = "client"
+	claims["scope"] = "openid profile"
+	token := newSignedToken(t, key, jwk.Kid, claims)
+
+	_, err := v.Verify(token)
+	if err != verifier.ErrDelegatedToken {
+		t.Fatalf("expected %v, got %v", verifier.ErrDelegatedToken, err)
+	}
+
+	parsed, err := v.VerifyDelegated(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.ClientId != "client" || parsed.Scope != "openid profile" || parsed.IsClient() {
+		t.Fatalf("unexpected claims %#v", parsed)
+	}
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	for _, test := range []struct {
+		middleware func(http.Handler) http.Handler
+		status     int
+	}{
+		{v.Middleware, http.StatusUnauthorized},
+		{v.DelegatedMiddleware, http.StatusNoContent},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		res := httptest.NewRecorder()
+		test.middleware(handler).ServeHTTP(res, req)
+
+		if res.Code != test.status {
+			t.Fatalf("expected status %d, got %d", test.status, res.Code)
+		}
+	}
+}